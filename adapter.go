@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/server"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol adapters, such as the HTTP endpoint and SNP, accept notifications
+// in other protocols, and hand them to the GNTP handlers as the REGISTER and
+// NOTIFY requests they stand for, so they go through the same rules as any
+// other.
+
+// adaptedType is a type of notification of an application registered by a
+// protocol adapter.
+type adaptedType struct {
+	Name string
+	// Display, if not empty, is the name shown for the type.
+	Display string
+}
+
+// adaptedRegister builds the REGISTER request registering the application
+// named app, with types, and with the icon icon, if not empty.
+func adaptedRegister(app, icon string, types []adaptedType) *server.Request {
+	appHeader := server.NewHeader()
+	appHeader.Set("Application-Name", app)
+	appHeader.Set("Notifications-Count", strconv.Itoa(len(types)))
+	if icon != "" {
+		appHeader.Set("Application-Icon", icon)
+	}
+	headers := []server.Header{appHeader}
+	for _, t := range types {
+		typeHeader := server.NewHeader()
+		typeHeader.Set("Notification-Name", t.Name)
+		if t.Display != "" {
+			typeHeader.Set("Notification-Display-Name", t.Display)
+		}
+		typeHeader.Set("Notification-Enabled", "True")
+		headers = append(headers, typeHeader)
+	}
+	return &server.Request{Type: "REGISTER", Headers: headers}
+}
+
+// binaryReference reports whether icon refers to a binary, with an
+// x-growl-resource:// URL in any case. Adapted requests send no binaries, so
+// could only refer to those other requests did, and such icons are refused.
+func binaryReference(icon string) bool {
+	const prefix = "x-growl-resource://"
+	return len(icon) >= len(prefix) && strings.EqualFold(icon[:len(prefix)], prefix)
+}
+
+// handleAdapted parses the headers of req, sent from remoteAddr, as they
+// would have been read, and has handler respond to it. If srv is not nil,
+// req is recorded in its access log.
+func handleAdapted(srv *server.Server, handler server.Handler, req *server.Request, remoteAddr string) (err error) {
+	req.Version = server.Version{Major: 1, Minor: 0}
+	req.RemoteAddr = remoteAddr
+	req.Received = time.Now()
+	if srv != nil {
+		defer func() { srv.LogAdapted(req.Received, remoteAddr, req, err) }()
+	}
+	switch req.Type {
+	case "REGISTER":
+		req.Register, err = server.ParseRegister(req.Headers)
+	case "NOTIFY":
+		req.Notify, err = server.ParseNotify(req.Headers[0])
+	}
+	if err != nil {
+		return err
+	}
+	return handler.Respond(discardResponse{}, req)
+}
+
+// limitedListener is a net.Listener for a protocol adapter, counting the
+// connections it accepts towards the MaxConns of srv, and closing those over
+// it.
+type limitedListener struct {
+	net.Listener
+	srv *server.Server
+}
+
+// Accept waits for the next connection within the limit.
+func (l limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.srv.AcquireConn() {
+			c.Close()
+			continue
+		}
+		return &limitedConn{Conn: c, srv: l.srv}, nil
+	}
+}
+
+// limitedConn is a connection accepted by a limitedListener, which stops
+// counting towards the limit once it is closed.
+type limitedConn struct {
+	net.Conn
+	srv  *server.Server
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.srv.ReleaseConn)
+	return err
+}
+
+// discardResponse is a server.ResponseWriter for adapted requests, whose
+// responses go nowhere.
+type discardResponse struct{}
+
+func (discardResponse) Header() server.Header                      { return server.NewHeader() }
+func (discardResponse) WriteHeader(string) error                   { return nil }
+func (discardResponse) WriteBinary(string, int64, io.Reader) error { return nil }
+func (discardResponse) Flush() error                               { return nil }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recentNotificationsKept is how many notifications are kept in memory to be
+// listed by the admin API, when there is no -history.
+const recentNotificationsKept = 100
+
+// defaultHistoryLimit is how many notifications the admin API lists, unless
+// asked for another number.
+const defaultHistoryLimit = 50
+
+// AdminAPI serves JSON over HTTP for other programs to manage the running
+// daemon:
+//
+//	GET    /apps                               the registered applications
+//	DELETE /apps/<app>                         unregister an application
+//	PUT    /apps/<app>/notifications/<name>    {"enabled": false}
+//	GET    /notifications[?limit&app&since]    the recent notifications
+//	GET    /dnd                                {"enabled": true, "held": 3}
+//	PUT    /dnd                                {"enabled": true}
+//	POST   /cache/purge                        {"all", "app", "older_than", "keys"}
+//	POST   /test                               send a test notification
+//	GET    /health                             whether the daemon is ready
+//	GET    /health/live                        whether the daemon is running
+//
+// Names in paths are escaped as in URLs. Errors are given as {"error": "..."}.
+type AdminAPI struct {
+	apps    *registry.Applications
+	cache   *cache.FileCache
+	history NotificationLog
+	dnd     *DoNotDisturb
+
+	// server and backend are checked by the health endpoint.
+	server  *server.Server
+	backend Backend
+
+	// register and notify handle the test notifications sent.
+	register server.Handler
+	notify   server.Handler
+}
+
+// adminApplication describes a registered application to the admin API.
+type adminApplication struct {
+	Name          string              `json:"name"`
+	Icon          string              `json:"icon,omitempty"`
+	Notifications []adminNotification `json:"notifications"`
+}
+
+// adminNotification describes a notification type to the admin API.
+type adminNotification struct {
+	Name          string `json:"name"`
+	Display       string `json:"display,omitempty"`
+	Icon          string `json:"icon,omitempty"`
+	Enabled       bool   `json:"enabled"`
+	EnabledByUser bool   `json:"enabled_by_user"`
+}
+
+// adminEnabled is the body of requests and responses switching something on
+// or off.
+type adminEnabled struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// adminDND is the body of responses about do not disturb.
+type adminDND struct {
+	Enabled bool `json:"enabled"`
+	Held    int  `json:"held"`
+}
+
+// adminHealth is the body of health check responses: whether the daemon is
+// ready, as it is accepting connections, its backend can show notifications,
+// and its cache is writable, with the errors found if not.
+type adminHealth struct {
+	OK            bool     `json:"ok"`
+	Accepting     bool     `json:"accepting"`
+	Backend       bool     `json:"backend"`
+	CacheWritable bool     `json:"cache_writable"`
+	Errors        []string `json:"errors,omitempty"`
+}
+
+// adminPurge is the body of cache purge requests, selecting the files to
+// remove as the cache purge command does.
+type adminPurge struct {
+	All       bool     `json:"all"`
+	App       string   `json:"app"`
+	OlderThan string   `json:"older_than"`
+	Keys      []string `json:"keys"`
+}
+
+// ServeHTTP serves the admin API.
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// A web page may reach the API too: by its own name, rebound to a
+	// loopback address, so only loopback hosts are served; or from another
+	// origin, which it can't send JSON to without the browser asking first,
+	// so writes must be sent as JSON.
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !loopbackHost(host) {
+		writeAdminError(w, http.StatusForbidden, errors.New("host not allowed"))
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeAdminError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+			return
+		}
+	}
+
+	// Split the path before unescaping it, so names may contain slashes.
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(part); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	switch {
+	case path == "apps":
+		api.serveApps(w, r)
+	case len(parts) == 2 && parts[0] == "apps":
+		api.serveApp(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "apps" && parts[2] == "notifications":
+		api.serveNotificationType(w, r, parts[1], parts[3])
+	case path == "notifications":
+		api.serveNotifications(w, r)
+	case path == "dnd":
+		api.serveDND(w, r)
+	case path == "cache/purge":
+		api.servePurge(w, r)
+	case path == "test":
+		api.serveTest(w, r)
+	case path == "health":
+		api.serveHealth(w, r)
+	case path == "health/live":
+		if allowMethod(w, r, "GET") {
+			writeAdminJSON(w, http.StatusOK, map[string]bool{"ok": true})
+		}
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// loopbackAddr reports whether addr, given as host:port, is only reachable
+// from this machine.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return loopbackHost(host)
+}
+
+// loopbackHost reports whether host, a name or an IP address, possibly in
+// brackets, is only reachable from this machine.
+func loopbackHost(host string) bool {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// allowMethod reports whether r uses one of methods, replying with an error if
+// it does not.
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if contains(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+// serveApps lists the registered applications, in order of name.
+func (api *AdminAPI) serveApps(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	list := make([]adminApplication, 0)
+	api.apps.Each(func(app *registry.Application) {
+		a := adminApplication{Name: app.Name, Icon: app.Icon}
+		for _, note := range app.Notifications {
+			a.Notifications = append(a.Notifications, adminNotification{
+				Name:          note.Name,
+				Display:       note.Display,
+				Icon:          note.Icon,
+				Enabled:       note.Enabled,
+				EnabledByUser: note.EnabledByUser,
+			})
+		}
+		sort.Slice(a.Notifications, func(i, j int) bool { return a.Notifications[i].Name < a.Notifications[j].Name })
+		list = append(list, a)
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+// serveApp unregisters the application named name.
+func (api *AdminAPI) serveApp(w http.ResponseWriter, r *http.Request, name string) {
+	if !allowMethod(w, r, "DELETE") {
+		return
+	}
+	if !api.apps.Remove(name) {
+		writeAdminError(w, http.StatusNotFound, errors.New("unknown application "+name))
+		return
+	}
+	slog.Info("admin: unregistered application", "app", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveNotificationType enables or disables the notification type named name
+// of the application named app.
+func (api *AdminAPI) serveNotificationType(w http.ResponseWriter, r *http.Request, app, name string) {
+	if !allowMethod(w, r, "PUT") {
+		return
+	}
+	var body adminEnabled
+	if err := readAdminJSON(r, &body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := api.apps.SetEnabled(app, name, *body.Enabled); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	slog.Info("admin: set notification type enabled", "app", app, "name", name, "enabled", *body.Enabled)
+	writeAdminJSON(w, http.StatusOK, body)
+}
+
+// serveNotifications lists the recent notifications, newest first: the last
+// limit, 50 by default or all if 0, of those from app, if given, received
+// since a time or a duration ago, if given.
+func (api *AdminAPI) serveNotifications(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	params := r.URL.Query()
+	q := HistoryQuery{Limit: defaultHistoryLimit, App: params.Get("app")}
+	if s := params.Get("limit"); s != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			writeAdminError(w, http.StatusBadRequest, errors.New("invalid limit "+s))
+			return
+		}
+	}
+	if s := params.Get("since"); s != "" {
+		var err error
+		if q.Since, err = parseSince(s, time.Now()); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	list, err := api.history.Query(q)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+// parseSince parses a time given as RFC 3339, or as a duration before now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("invalid since " + s + ": give a time as RFC 3339 or a duration")
+	}
+	return t, nil
+}
+
+// serveDND reports, or switches, whether do not disturb is on, and how many
+// notifications it holds.
+func (api *AdminAPI) serveDND(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET", "PUT") {
+		return
+	}
+	if r.Method == "PUT" {
+		var body adminEnabled
+		if err := readAdminJSON(r, &body); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		api.dnd.Set(*body.Enabled)
+		slog.Info("admin: set do not disturb", "enabled", *body.Enabled)
+	}
+	writeAdminJSON(w, http.StatusOK, adminDND{api.dnd.On(), api.dnd.Held()})
+}
+
+// servePurge removes the selected files from the cache, listing those removed
+// and the keys given that were not in the cache.
+func (api *AdminAPI) servePurge(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	var body adminPurge
+	if err := readAdminJSON(r, &body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	sel := purgeSelection{All: body.All, App: body.App, Keys: body.Keys}
+	if body.OlderThan != "" {
+		var err error
+		if sel.OlderThan, err = time.ParseDuration(body.OlderThan); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if sel.empty() {
+		writeAdminError(w, http.StatusBadRequest, errors.New("nothing to purge: give keys, app, older_than or all"))
+		return
+	}
+
+	removed, missing, err := purgeFiles(api.cache, sel)
+	if len(removed) > 0 {
+		slog.Info("admin: purged cache", "files", len(removed))
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if removed == nil {
+		removed = []string{}
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+	writeAdminJSON(w, http.StatusOK, map[string][]string{"removed": removed, "missing": missing})
+}
+
+// serveTest sends a test notification.
+func (api *AdminAPI) serveTest(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	if err := sendTestNotification(api.register, api.notify); err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	slog.Info("admin: sent test notification")
+	writeAdminJSON(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+// serveHealth reports whether the daemon is ready, with a 503 status if not.
+func (api *AdminAPI) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	var health adminHealth
+	if health.Accepting = api.server.Accepting(); !health.Accepting {
+		health.Errors = append(health.Errors, "not accepting connections")
+	}
+	health.Backend = api.backend != nil
+	if checked, ok := api.backend.(CheckedBackend); ok {
+		if err := checked.Check(); err != nil {
+			health.Backend = false
+			health.Errors = append(health.Errors, "backend: "+err.Error())
+		}
+	} else if !health.Backend {
+		health.Errors = append(health.Errors, "backend: not started")
+	}
+	if err := api.cache.CheckWritable(); err != nil {
+		health.Errors = append(health.Errors, "cache: "+err.Error())
+	} else {
+		health.CacheWritable = true
+	}
+
+	health.OK = health.Accepting && health.Backend && health.CacheWritable
+	status := http.StatusOK
+	if !health.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeAdminJSON(w, status, health)
+}
+
+// readAdminJSON decodes the JSON body of r into v. Bodies switching something
+// on or off must say which.
+func readAdminJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if body, ok := v.(*adminEnabled); ok && body.Enabled == nil {
+		return errors.New("missing enabled")
+	}
+	return nil
+}
+
+// writeAdminJSON replies to a request with status and v as JSON.
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeAdminError replies to a request with status and err as JSON.
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
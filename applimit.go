@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"time"
+)
+
+// appLimitWindow is how long each application may show up to its limit of
+// notifications for.
+const appLimitWindow = time.Minute
+
+// AppLimitChannel builds and returns a channel for Notifications that passes
+// them on to out, up to limit from each application every minute. Those from
+// an application over its limit are recorded in history and, at the end of
+// the minute, collapsed into a single Notification saying how many more there
+// were.
+func AppLimitChannel(limit int, out chan<- *registry.Notification, history NotificationLog) chan *registry.Notification {
+	c := make(chan *registry.Notification)
+
+	go func() {
+		shown := make(map[string]int)
+		over := make(map[string][]*registry.Notification)
+		ticker := time.NewTicker(appLimitWindow)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case note := <-c:
+				app := note.App.Name
+				if shown[app] < limit {
+					shown[app]++
+					out <- note
+					continue
+				}
+				slog.Debug("gntp: collapsing notification over application limit", "app", app, "name", note.Name)
+				notificationsSuppressed.Inc("app_rate_limit")
+				note.SendCallback(registry.CallbackClosed)
+				history.Add(note, outcomeAppRateLimited)
+				over[app] = append(over[app], note)
+			case <-ticker.C:
+				for app, notes := range over {
+					slog.Info("gntp: showing notifications over application limit", "app", app, "count", len(notes))
+					out <- buildOverflow(app, notes)
+				}
+				shown = make(map[string]int)
+				over = make(map[string][]*registry.Notification)
+			}
+		}
+	}()
+
+	return c
+}
+
+// buildOverflow builds a single Notification summarizing notes, from the
+// application named app, which were over its limit.
+func buildOverflow(app string, notes []*registry.Notification) *registry.Notification {
+	title := "1 more notification from " + app
+	if len(notes) != 1 {
+		title = fmt.Sprintf("%d more notifications from %s", len(notes), app)
+	}
+	summary := buildSummary("Overflow", "overflow", title, notes)
+	summary.Priority = 0
+	return summary
+}
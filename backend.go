@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Backend displays notifications.
+type Backend interface {
+	// Show displays note. It must report what happens to note through
+	// SendCallback, if note asked for a callback.
+	Show(note *registry.Notification)
+}
+
+// CheckedBackend is implemented by Backends that can tell whether they are
+// still able to show notifications.
+type CheckedBackend interface {
+	Backend
+	// Check returns an error if the backend can't show notifications.
+	Check() error
+}
+
+// DisplayingBackend is implemented by Backends that can list the
+// notifications they have on screen.
+type DisplayingBackend interface {
+	Backend
+	// Displayed gives the notifications on screen.
+	Displayed() []*registry.Notification
+}
+
+// BackendOptions holds the settings shared by all backends.
+type BackendOptions struct {
+	// Cache holds the notification icons.
+	Cache *cache.FileCache
+	// Clipboard, if not nil, extracts the text copied by a "Copy" button on
+	// each notification.
+	Clipboard *ClipboardExtractor
+	// IconSize, if positive, is the size icons are scaled down to fit.
+	IconSize int
+	// IconData is whether icons are sent to the notification server as
+	// pixel data, rather than as the names of files in Cache, which may be
+	// removed while their notifications are on screen.
+	IconData bool
+	// IconDirs are the directories icons given as local files may be in.
+	IconDirs IconDirs
+	// DefaultIcon, if not empty, is the icon shown with notifications
+	// without one of their own, or a fallback icon: a local file, a URL or
+	// the name of an icon in the desktop's theme.
+	DefaultIcon string
+	// Sounds decides which notifications may play sounds.
+	Sounds *SoundPolicy
+}
+
+// backends maps names to the functions that build each available Backend.
+var backends = make(map[string]func(*BackendOptions) (Backend, error))
+
+// registerBackend makes a Backend available under name.
+func registerBackend(name string, newBackend func(*BackendOptions) (Backend, error)) {
+	if _, defined := backends[name]; defined {
+		panic("gntp: multiple backends named " + name)
+	}
+	backends[name] = newBackend
+}
+
+// backendNames lists the available backends.
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend builds the Backend named name.
+func NewBackend(name string, opts *BackendOptions) (Backend, error) {
+	newBackend, ok := backends[name]
+	if !ok {
+		return nil, errors.New("unknown backend " + name + " (available: " + strings.Join(backendNames(), ", ") + ")")
+	}
+	return newBackend(opts)
+}
+
+// defaultBackend gives the name of the Backend to use when none is chosen:
+// libnotify, if it was built in, otherwise D-Bus.
+func defaultBackend() string {
+	if _, ok := backends["libnotify"]; ok {
+		return "libnotify"
+	}
+	return "dbus"
+}
+
+// Output is a Backend notifications are also sent to, besides the one
+// displaying them, such as webhooks, known to routes by Name.
+type Output struct {
+	Name string
+	Backend
+}
+
+// multiBackend shows notifications with a primary Backend, which displays
+// them and reports what happens to them, and also sends them to outputs,
+// which must not report callbacks or wait for them to be delivered. Routes,
+// if not nil, choose which of them each notification goes to.
+type multiBackend struct {
+	primary Backend
+	outputs []Output
+	routes  *RouteTable
+}
+
+// withOutputs gives a Backend showing notifications with primary, and also
+// sending them to each of outputs, or to those chosen by routes, if not nil.
+func withOutputs(primary Backend, outputs []Output, routes *RouteTable) Backend {
+	if len(outputs) == 0 && routes == nil {
+		return primary
+	}
+	return &multiBackend{primary, outputs, routes}
+}
+
+// Show sends note to each of the outputs it is routed to, then shows it with
+// the primary backend, if it is routed there. Otherwise, it reports that note
+// was closed.
+func (backend *multiBackend) Show(note *registry.Notification) {
+	routed := backend.routes.Backends(note)
+	to := func(name string) bool {
+		if routed == nil {
+			return true
+		}
+		for _, r := range routed {
+			if r == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, output := range backend.outputs {
+		if to(output.Name) {
+			output.Show(note)
+		}
+	}
+	if !to(DisplayBackend) {
+		slog.Debug("gntp: notification not routed to the display", "app", note.App.Name, "name", note.Name, "backends", routed)
+		note.SendCallback(registry.CallbackClosed)
+		return
+	}
+	backend.primary.Show(note)
+}
+
+// Check checks the primary backend, if it can tell whether it can show
+// notifications.
+func (backend *multiBackend) Check() error {
+	if checked, ok := backend.primary.(CheckedBackend); ok {
+		return checked.Check()
+	}
+	return nil
+}
+
+// Displayed gives the notifications the primary backend has on screen, if it
+// can tell.
+func (backend *multiBackend) Displayed() []*registry.Notification {
+	if displaying, ok := backend.primary.(DisplayingBackend); ok {
+		return displaying.Displayed()
+	}
+	return nil
+}
+
+// AppTargets implements flag.Value for where the notifications sent by a
+// Backend go, such as chats or URLs: a default target, and targets for
+// applications, given as application=target.
+type AppTargets struct {
+	Default string
+	Apps    map[string]string
+}
+
+// String returns the targets as they would be given on the command line.
+func (targets *AppTargets) String() string {
+	var list []string
+	if targets.Default != "" {
+		list = append(list, targets.Default)
+	}
+	for app, target := range targets.Apps {
+		list = append(list, app+"="+target)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// Set parses and adds a target. Targets that may hold an equals sign, such as
+// URLs, are only taken as for an application if the part before it holds no
+// colon or slash.
+func (targets *AppTargets) Set(value string) error {
+	app, target := "", value
+	if i := strings.Index(value, "="); i >= 0 && !strings.ContainsAny(value[:i], ":/") {
+		app, target = value[:i], value[i+1:]
+		if app == "" {
+			return errors.New("missing application")
+		}
+	}
+	if target == "" {
+		return errors.New("missing target")
+	}
+	if app == "" {
+		targets.Default = target
+		return nil
+	}
+	if targets.Apps == nil {
+		targets.Apps = make(map[string]string)
+	}
+	targets.Apps[app] = target
+	return nil
+}
+
+// empty reports whether there are no targets.
+func (targets *AppTargets) empty() bool {
+	return targets.Default == "" && len(targets.Apps) == 0
+}
+
+// target gives the target of the notifications from the application named
+// app, or the empty string if they have none.
+func (targets *AppTargets) target(app string) string {
+	if target, ok := targets.Apps[app]; ok {
+		return target
+	}
+	return targets.Default
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/server"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchUsage describes the bench command.
+const benchUsage = `usage: gntp_notify bench [-to [password@]host[:port]] [-conns <n>] [-rate <n>] [-duration <duration>] [-register-percent <n>] [-binary-size <bytes>] [-keep-alive] [-timeout <duration>]`
+
+// benchApplication is the application the bench command registers, and sends
+// notifications as.
+const benchApplication = "gntp_notify bench"
+
+// runBenchCommand runs the bench command, given args: it sends requests to a
+// GNTP server over several connections at once, at a target rate, and writes
+// the latency of the responses and the share of errors to w.
+func runBenchCommand(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	to := flags.String("to", "localhost", "Send to this GNTP server, given as [password@]host[:port]")
+	conns := flags.Int("conns", 10, "Send requests over this many connections at once")
+	rate := flags.Float64("rate", 100, "Send this many requests a second, in all, or 0 for as many as the server takes")
+	duration := flags.Duration("duration", 10*time.Second, "Send requests for this long")
+	registerPercent := flags.Int("register-percent", 0, "Send this percentage of requests as REGISTER, and the rest as NOTIFY")
+	binarySize := flags.Int("binary-size", 0, "Send an icon of this many bytes with each notification")
+	keepAlive := flags.Bool("keep-alive", false, "Send further requests on each connection while the server keeps it open")
+	timeout := flags.Duration("timeout", forwardTimeout, "Give up on each request after this long")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\n" + benchUsage)
+	}
+	if flags.NArg() > 0 {
+		return errors.New(benchUsage)
+	}
+	if *conns < 1 || *rate < 0 || *duration <= 0 || *binarySize < 0 || *timeout <= 0 {
+		return errors.New("connections, duration and timeout must be positive, and rate and binary size not negative")
+	}
+	if *registerPercent < 0 || *registerPercent > 100 {
+		return errors.New("the register percentage is from 0 to 100")
+	}
+	var targets ForwardTargets
+	if err := targets.Set(*to); err != nil {
+		return err
+	}
+
+	bench := &benchmark{
+		target:          targets[0],
+		registerPercent: *registerPercent,
+		binarySize:      *binarySize,
+		keepAlive:       *keepAlive,
+		timeout:         *timeout,
+		errors:          make(map[string]int),
+	}
+	// Notifications are refused until their application is registered.
+	if err := bench.send(nil, bench.register()); err != nil {
+		return fmt.Errorf("REGISTER: %w", err)
+	}
+
+	// Each connection sends a request whenever it takes a token. They are
+	// handed out at the rate asked for, to connections ready for one, or
+	// as fast as they are taken if there is no rate.
+	tokens := make(chan struct{})
+	missed := 0
+	go func() {
+		defer close(tokens)
+		stop := time.After(*duration)
+		interval := time.Duration(0)
+		if *rate > 0 {
+			interval = time.Duration(float64(time.Second) / *rate)
+		}
+		if interval <= 0 {
+			for {
+				select {
+				case tokens <- struct{}{}:
+				case <-stop:
+					return
+				}
+			}
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case tokens <- struct{}{}:
+				default:
+					// Every connection is busy, so the request is
+					// missed rather than sent late.
+					missed++
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			bench.run(id, tokens)
+		}(i)
+	}
+	wg.Wait()
+	bench.report(w, time.Since(start), missed)
+	return nil
+}
+
+// benchmark holds the settings of the bench command, and what it measured.
+type benchmark struct {
+	target          ForwardTarget
+	registerPercent int
+	binarySize      int
+	keepAlive       bool
+	timeout         time.Duration
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	// errors counts the requests that failed, by their GNTP error, or
+	// the error that kept them from being answered.
+	errors map[string]int
+}
+
+// benchConn is a connection kept open between requests, with -keep-alive.
+type benchConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// run sends a request for each token taken from tokens, over its own
+// connection, until tokens is closed. id tells the connections apart, so
+// each sends its own binary.
+func (bench *benchmark) run(id int, tokens <-chan struct{}) {
+	var binary *server.Binary
+	if bench.binarySize > 0 {
+		data := make([]byte, bench.binarySize)
+		rand.Read(data)
+		binary = &server.Binary{Ident: fmt.Sprintf("%x", md5.Sum(data)), Length: int64(len(data)), Data: data}
+	}
+	var conn *benchConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for n := 0; ; n++ {
+		if _, ok := <-tokens; !ok {
+			return
+		}
+		var req *server.Request
+		if mathrand.Intn(100) < bench.registerPercent {
+			req = bench.register()
+		} else {
+			req = bench.notify(id, n, binary)
+		}
+		start := time.Now()
+		err := bench.send(&conn, req)
+		bench.record(time.Since(start), err)
+	}
+}
+
+// send sends req, authenticated with the target's password, and reads its
+// response. With -keep-alive, the request is sent over *conn if it is open,
+// and the connection is left in *conn for the next; a server may close it
+// while it is idle, so the request is sent again over a new connection if
+// it fails on one already used. Without, conn is nil and a connection is
+// opened for each request.
+func (bench *benchmark) send(conn **benchConn, req *server.Request) error {
+	if bench.target.Password != "" {
+		kh, err := server.NewKeyHash("SHA512", bench.target.Password)
+		if err != nil {
+			return err
+		}
+		req.KeyHash = kh
+	}
+	if conn == nil || !bench.keepAlive {
+		c, err := bench.dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return bench.exchange(c, req)
+	}
+
+	reused := *conn != nil
+	if !reused {
+		c, err := bench.dial()
+		if err != nil {
+			return err
+		}
+		*conn = c
+	}
+	err := bench.exchange(*conn, req)
+	var gerr server.GntpError
+	if err != nil && !errors.As(err, &gerr) {
+		(*conn).Close()
+		*conn = nil
+		if reused {
+			return bench.send(conn, req)
+		}
+	}
+	return err
+}
+
+// dial opens a connection to the target.
+func (bench *benchmark) dial() (*benchConn, error) {
+	c, err := net.DialTimeout("tcp", bench.target.Addr, bench.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &benchConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// exchange writes req to c and reads its response, returning a GntpError if
+// the server responds with -ERROR.
+func (bench *benchmark) exchange(c *benchConn, req *server.Request) error {
+	c.SetDeadline(time.Now().Add(bench.timeout))
+	if err := req.Write(c); err != nil {
+		return err
+	}
+	resp, err := server.ReadResponse(c.r)
+	if err != nil {
+		return err
+	}
+	switch resp.Type {
+	case "OK":
+		return nil
+	case "ERROR":
+		return resp.Err()
+	}
+	return errors.New("unexpected -" + resp.Type + " response")
+}
+
+// register builds the REGISTER request for benchApplication.
+func (bench *benchmark) register() *server.Request {
+	appHeader := server.NewHeader()
+	appHeader.Set("Application-Name", benchApplication)
+	appHeader.Set("Notifications-Count", "1")
+	typeHeader := server.NewHeader()
+	typeHeader.Set("Notification-Name", "Benchmark")
+	typeHeader.Set("Notification-Enabled", "True")
+	return &server.Request{Type: "REGISTER", Headers: []server.Header{appHeader, typeHeader}}
+}
+
+// notify builds the nth NOTIFY request sent over connection id, with binary
+// as its icon if not nil.
+func (bench *benchmark) notify(id, n int, binary *server.Binary) *server.Request {
+	header := server.NewHeader()
+	header.Set("Application-Name", benchApplication)
+	header.Set("Notification-Name", "Benchmark")
+	header.Set("Notification-Title", "Benchmark "+strconv.Itoa(id)+"."+strconv.Itoa(n))
+	header.Set("Notification-Text", "Sent by gntp_notify bench")
+	req := &server.Request{Type: "NOTIFY", Headers: []server.Header{header}, Binaries: make(map[string]*server.Binary)}
+	if binary != nil {
+		header.Set("Notification-Icon", "x-growl-resource://"+binary.Ident)
+		req.Binaries[binary.Ident] = binary
+	}
+	return req
+}
+
+// record records the outcome of a request, answered after latency, or err.
+func (bench *benchmark) record(latency time.Duration, err error) {
+	bench.mu.Lock()
+	defer bench.mu.Unlock()
+	if err == nil {
+		bench.latencies = append(bench.latencies, latency)
+		return
+	}
+	var gerr server.GntpError
+	if errors.As(err, &gerr) {
+		bench.errors[fmt.Sprintf("%d %s", gerr.Code, gerr.Description)]++
+		return
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		bench.errors["timed out"]++
+		return
+	}
+	bench.errors[err.Error()]++
+}
+
+// report writes the number of requests sent over elapsed, and missed as every
+// connection was busy, the share that failed, by error, and the percentiles
+// of the latency of those answered to w.
+func (bench *benchmark) report(w io.Writer, elapsed time.Duration, missed int) {
+	bench.mu.Lock()
+	defer bench.mu.Unlock()
+	failed := 0
+	for _, count := range bench.errors {
+		failed += count
+	}
+	total := len(bench.latencies) + failed
+	fmt.Fprintf(w, "%d requests in %s, %.1f/s\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	if missed > 0 {
+		fmt.Fprintf(w, "%d requests missed, as every connection was busy\n", missed)
+	}
+	if total == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d errors, %.2f%%\n", failed, 100*float64(failed)/float64(total))
+	kinds := make([]string, 0, len(bench.errors))
+	for kind := range bench.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %d\t%s\n", bench.errors[kind], kind)
+	}
+
+	latencies := bench.latencies
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Fprintf(w, "latency min %s", latencies[0])
+	for _, p := range []int{50, 90, 99} {
+		fmt.Fprintf(w, ", p%d %s", p, percentile(latencies, p))
+	}
+	fmt.Fprintf(w, ", max %s\n", latencies[len(latencies)-1])
+}
+
+// percentile gives the pth percentile of sorted, by the nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/godbus/dbus"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// bridgeNotificationName is the notification type the applications whose
+// desktop notifications are bridged are registered with.
+const bridgeNotificationName = "Notification"
+
+// bridgeApplication is the application desktop notifications without an
+// application name are sent as.
+const bridgeApplication = "Desktop"
+
+// Bridge forwards the notifications other programs send to the notification
+// server on the session bus to GNTP servers, so they show up on other
+// machines too. The notifications we show ourselves are not forwarded.
+type Bridge struct {
+	fwd   *Forwarder
+	cache *cache.FileCache
+	// self is the shared session bus connection, used to find out which
+	// program sent each notification; the monitoring connection can't send
+	// messages.
+	self *dbus.Conn
+
+	// registered are the applications registered with the targets, and
+	// senders tells whether the connections that sent notifications are
+	// ours. They are only used by the goroutine reading messages.
+	registered map[string]bool
+	senders    map[string]bool
+}
+
+// NewBridge builds a Bridge forwarding notifications with fwd, keeping their
+// icons in cache to be sent along.
+func NewBridge(fwd *Forwarder, cache *cache.FileCache) *Bridge {
+	return &Bridge{
+		fwd:        fwd,
+		cache:      cache,
+		registered: make(map[string]bool),
+		senders:    make(map[string]bool),
+	}
+}
+
+// Start connects to the session bus and starts watching for notifications,
+// becoming a monitor of the bus if it allows, otherwise eavesdropping.
+func (bridge *Bridge) Start() error {
+	var err error
+	if bridge.self, err = dbus.SessionBus(); err != nil {
+		return err
+	}
+	conn, err := dbus.SessionBusPrivate()
+	if err != nil {
+		return err
+	}
+	if err = conn.Auth(nil); err == nil {
+		err = conn.Hello()
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Messages must be taken before asking to become a monitor: once it
+	// is, the connection must not answer the calls it sees.
+	messages := make(chan *dbus.Message, 64)
+	conn.Eavesdrop(messages)
+	rule := "type='method_call',interface='" + notificationsIface + "',member='Notify'"
+	conn.BusObject().Go("org.freedesktop.DBus.Monitoring.BecomeMonitor", 0, nil, []string{rule}, uint32(0))
+	if err := becomeMonitor(messages); err != nil {
+		slog.Debug("gntp: could not monitor the session bus, eavesdropping instead", "err", err)
+		conn.Eavesdrop(nil)
+		if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, "eavesdrop='true',"+rule); call.Err != nil {
+			conn.Close()
+			return call.Err
+		}
+		conn.Eavesdrop(messages)
+	}
+
+	go bridge.run(messages)
+	return nil
+}
+
+// becomeMonitor waits for the reply to the BecomeMonitor call, the first
+// reply or error among messages.
+func becomeMonitor(messages <-chan *dbus.Message) error {
+	for msg := range messages {
+		switch msg.Type {
+		case dbus.TypeMethodReply:
+			return nil
+		case dbus.TypeError:
+			name, _ := msg.Headers[dbus.FieldErrorName].Value().(string)
+			return errors.New(name)
+		}
+	}
+	return errors.New("connection closed")
+}
+
+// run forwards each Notify call among messages.
+func (bridge *Bridge) run(messages <-chan *dbus.Message) {
+	for msg := range messages {
+		if msg.Type != dbus.TypeMethodCall {
+			continue
+		}
+		if member, _ := msg.Headers[dbus.FieldMember].Value().(string); member != "Notify" {
+			continue
+		}
+		sender, _ := msg.Headers[dbus.FieldSender].Value().(string)
+		if bridge.ours(sender) {
+			continue
+		}
+		var appName, appIcon, summary, body string
+		var replacesId uint32
+		var actions []string
+		var hints map[string]dbus.Variant
+		var expireTimeout int32
+		if err := dbus.Store(msg.Body, &appName, &replacesId, &appIcon, &summary, &body, &actions, &hints, &expireTimeout); err != nil {
+			slog.Debug("gntp: could not read desktop notification", "sender", sender, "err", err)
+			continue
+		}
+		bridge.forward(appName, appIcon, summary, body, hints, expireTimeout)
+	}
+	slog.Warn("gntp: lost the session bus, no longer bridging desktop notifications")
+}
+
+// ours reports whether the connection named sender is one of ours, such as
+// that of libnotify, whose notifications came from GNTP in the first place.
+func (bridge *Bridge) ours(sender string) bool {
+	ours, ok := bridge.senders[sender]
+	if !ok {
+		var pid uint32
+		err := bridge.self.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, sender).Store(&pid)
+		ours = err == nil && int(pid) == os.Getpid()
+		bridge.senders[sender] = ours
+	}
+	return ours
+}
+
+// forward forwards a desktop notification, registering its application
+// first, the first time it sends one.
+func (bridge *Bridge) forward(appName, appIcon, summary, body string, hints map[string]dbus.Variant, expireTimeout int32) {
+	if appName == "" {
+		appName = bridgeApplication
+	}
+	icon := bridge.icon(appIcon)
+
+	if !bridge.registered[appName] {
+		appHeader := server.NewHeader()
+		appHeader.Set("Application-Name", appName)
+		appHeader.Set("Notifications-Count", "1")
+		if icon != "" {
+			appHeader.Set("Application-Icon", icon)
+		}
+		typeHeader := server.NewHeader()
+		typeHeader.Set("Notification-Name", bridgeNotificationName)
+		typeHeader.Set("Notification-Enabled", "True")
+		bridge.fwd.Forward(&server.Request{Type: "REGISTER", Headers: []server.Header{appHeader, typeHeader}})
+		bridge.registered[appName] = true
+	}
+
+	header := server.NewHeader()
+	header.Set("Application-Name", appName)
+	header.Set("Notification-Name", bridgeNotificationName)
+	header.Set("Notification-Title", summary)
+	header.Set("Notification-Text", bodyText(body, serverCapabilities{}))
+	header.Set("Notification-Priority", strconv.Itoa(bridgePriority(hints)))
+	if expireTimeout == 0 {
+		header.Set("Notification-Sticky", "True")
+	}
+	if icon != "" {
+		header.Set("Notification-Icon", icon)
+	}
+	slog.Debug("gntp: bridging desktop notification", "app", appName, "title", summary)
+	bridge.fwd.Forward(&server.Request{Type: "NOTIFY", Headers: []server.Header{header}})
+}
+
+// bridgeIconMaxSize is the size of the largest desktop notification icon
+// sent, in bytes.
+const bridgeIconMaxSize = 1 << 20
+
+// icon gives the value of the icon headers for the icon of a desktop
+// notification: if it is a local image file, it is put in the cache, to be
+// sent as a binary resource. Icons named from the theme can't be sent.
+func (bridge *Bridge) icon(appIcon string) string {
+	path, local := registry.LocalIconPath(appIcon)
+	if !local {
+		return ""
+	}
+	// Check the file is regular before opening it, as opening a FIFO blocks,
+	// and again after, in case it was replaced.
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		slog.Debug("gntp: desktop notification icon not a regular file", "icon", appIcon, "err", err)
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Debug("gntp: could not read desktop notification icon", "icon", appIcon, "err", err)
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		slog.Debug("gntp: desktop notification icon not a regular file", "icon", appIcon, "err", err)
+		return ""
+	}
+	if info.Size() > bridgeIconMaxSize {
+		slog.Debug("gntp: desktop notification icon too large", "icon", appIcon, "size", info.Size())
+		return ""
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		slog.Debug("gntp: could not read desktop notification icon", "icon", appIcon, "err", err)
+		return ""
+	}
+	head = head[:n]
+	if !cache.IsImage(head) {
+		slog.Debug("gntp: desktop notification icon not an image", "icon", appIcon)
+		return ""
+	}
+
+	// The icon is identified by its file and when it last changed, so it is
+	// only cached again once it does.
+	ident := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano()))))
+	if !bridge.cache.Exists(ident) {
+		if err := bridge.cache.Store(ident, io.MultiReader(bytes.NewReader(head), f), bridgeIconMaxSize); err != nil {
+			slog.Warn("gntp: could not cache desktop notification icon", "icon", appIcon, "err", err)
+			return ""
+		}
+	}
+	return "x-growl-resource://" + ident
+}
+
+// bridgePriority gives the GNTP priority of a desktop notification with
+// hints, from its urgency.
+func bridgePriority(hints map[string]dbus.Variant) int {
+	urgency, ok := hints["urgency"].Value().(byte)
+	if !ok {
+		return 0
+	}
+	switch urgency {
+	case 0:
+		return -1
+	case 2:
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/cache"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestBridgeIcon(t *testing.T) {
+	dir := t.TempDir()
+	files := cache.NewFileCache(filepath.Join(dir, "cache"))
+	os.MkdirAll(files.Dir(), 0755)
+	bridge := NewBridge(nil, files)
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	icon := write("icon.png", png)
+	text := write("notes.txt", []byte("not an image"))
+	large := write("large.png", append(png, make([]byte, bridgeIconMaxSize)...))
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		icon string
+		ok   bool
+	}{
+		{icon, true},
+		{"file://" + icon, true},
+		{"dialog-information", false},
+		{text, false},
+		{large, false},
+		{dir, false},
+		{fifo, false},
+		{"/dev/zero", false},
+		{filepath.Join(dir, "missing.png"), false},
+	}
+	for _, tt := range tests {
+		value := bridge.icon(tt.icon)
+		if !tt.ok {
+			if value != "" {
+				t.Errorf("icon %q: got %q, want none", tt.icon, value)
+			}
+			continue
+		}
+		ident := strings.TrimPrefix(value, "x-growl-resource://")
+		if ident == value || !files.Exists(ident) {
+			t.Errorf("icon %q: got %q, not a cached resource", tt.icon, value)
+		}
+	}
+	if bridge.icon(icon) != bridge.icon(icon) {
+		t.Errorf("icon %q: identified differently each time", icon)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/cache"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cacheUsage describes the cache command.
+const cacheUsage = `usage: gntp_notify [-cachedir <dir>] cache ls
+       gntp_notify [-cachedir <dir>] cache purge [-all] [-app <name>] [-older-than <duration>] [key...]`
+
+// runCacheCommand runs the cache command, given args, on the cache in dir,
+// writing its output to w.
+//
+// cache ls lists the files in the cache: their keys, sizes, ages since they
+// were last used, and the applications that referenced them. cache purge
+// removes the files with the given keys, or those selected by its flags.
+func runCacheCommand(dir string, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(cacheUsage)
+	}
+	cache := cache.LoadFileCache(dir)
+	switch args[0] {
+	case "ls":
+		if len(args) > 1 {
+			return errors.New(cacheUsage)
+		}
+		listCache(cache, w)
+		return nil
+	case "purge":
+		return purgeCache(cache, args[1:], w)
+	}
+	return errors.New("unknown cache command " + args[0] + "\n" + cacheUsage)
+}
+
+// listCache writes a table of the files in cache to w.
+func listCache(cache *cache.FileCache, w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tFILE\tSIZE\tAGE\tAPPLICATIONS")
+	var total int64
+	now := time.Now()
+	files := cache.Files()
+	for _, file := range files {
+		apps := "-"
+		if len(file.Apps) > 0 {
+			apps = strings.Join(file.Apps, ",")
+		}
+		age := now.Sub(file.Used).Round(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", file.Key, file.Name, file.Size, age, apps)
+		total += file.Size
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d files, %d bytes in %s\n", len(files), total, cache.Dir())
+}
+
+// purgeCache removes the files from cache selected by args, reporting each to
+// w.
+func purgeCache(cache *cache.FileCache, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("cache purge", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	all := flags.Bool("all", false, "Remove every file")
+	app := flags.String("app", "", "Remove the files referenced by this application")
+	olderThan := flags.Duration("older-than", 0, "Remove the files unused for this long")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\n" + cacheUsage)
+	}
+	sel := purgeSelection{All: *all, App: *app, OlderThan: *olderThan, Keys: flags.Args()}
+	if sel.empty() {
+		return errors.New("nothing to purge: give keys, -app, -older-than or -all\n" + cacheUsage)
+	}
+
+	removed, missing, err := purgeFiles(cache, sel)
+	for _, key := range removed {
+		fmt.Fprintln(w, "removed", key)
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range missing {
+		fmt.Fprintln(w, "not found", key)
+	}
+	fmt.Fprintf(w, "%d files removed\n", len(removed))
+	return nil
+}
+
+// purgeSelection selects files to remove from a cache: every file if All,
+// those referenced by App, those unused for OlderThan, and those with Keys.
+type purgeSelection struct {
+	All       bool
+	App       string
+	OlderThan time.Duration
+	Keys      []string
+}
+
+// empty reports whether sel selects no files at all.
+func (sel purgeSelection) empty() bool {
+	return !sel.All && sel.App == "" && sel.OlderThan <= 0 && len(sel.Keys) == 0
+}
+
+// purgeFiles removes the files from cache selected by sel. It returns the keys
+// of the files removed, and those of sel.Keys that were not in the cache.
+func purgeFiles(cache *cache.FileCache, sel purgeSelection) (removed, missing []string, err error) {
+	keys := make(map[string]bool)
+	for _, key := range sel.Keys {
+		keys[key] = true
+	}
+	expired := time.Now().Add(-sel.OlderThan)
+	for _, file := range cache.Files() {
+		selected := sel.All || keys[file.Key] ||
+			(sel.App != "" && contains(file.Apps, sel.App)) ||
+			(sel.OlderThan > 0 && file.Used.Before(expired))
+		if !selected {
+			continue
+		}
+		if err := cache.Remove(file.Key); err != nil {
+			return removed, nil, err
+		}
+		delete(keys, file.Key)
+		removed = append(removed, file.Key)
+	}
+	if sel.All {
+		if err := cache.ClearReferences(); err != nil {
+			return removed, nil, err
+		}
+	}
+	for _, key := range sel.Keys {
+		if keys[key] {
+			missing = append(missing, key)
+		}
+	}
+	return removed, missing, nil
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// iconRevalidateInterval is how long a downloaded icon is used before checking
+// whether it has changed.
+const iconRevalidateInterval = time.Hour
+
+// downloadValidators holds what is needed to check whether a downloaded file
+// has changed. It is saved in the cache next to the file.
+type downloadValidators struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checked      time.Time `json:"checked"`
+}
+
+// URLKey gives the key the file downloaded from rawurl is saved at in the
+// cache.
+func URLKey(rawurl string) string {
+	hash := md5.New()
+	io.WriteString(hash, rawurl)
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// Downloader downloads the icons notifications refer to by URL and adds them
+// to a FileCache. All downloads share one http.Client, so they are bounded by
+// its timeout; each URL is only downloaded once at a time, and at most PerHost
+// downloads from the same host run at once.
+type Downloader struct {
+	cache  *FileCache
+	client *http.Client
+
+	// MaxBytes is the maximum size of a download, or 0 for no limit.
+	MaxBytes int64
+	// Retries is how many times a download that failed for a reason that may
+	// pass, such as a network error or a 5xx status, is retried.
+	Retries int
+	// PerHost is how many downloads from the same host may run at once, or
+	// 0 for no limit.
+	PerHost int
+
+	mu sync.Mutex
+	// active holds the URLs being downloaded.
+	active map[string]bool
+	// hosts holds a semaphore for each host being downloaded from.
+	hosts map[string]chan struct{}
+}
+
+// NewDownloader allocates and initializes a Downloader adding to cache, whose
+// downloads each time out after timeout, if it is more than 0. Downloads go
+// through proxy, if it is not nil, or else through the proxy given by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, if any.
+func NewDownloader(cache *FileCache, timeout time.Duration, proxy *url.URL) *Downloader {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	return &Downloader{
+		cache:  cache,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+		active: make(map[string]bool),
+		hosts:  make(map[string]chan struct{}),
+	}
+}
+
+// Fetch starts downloading rawurl in a new goroutine, unless it is already
+// being downloaded. If it was downloaded before, it is only downloaded again
+// if it has changed, using a conditional GET.
+func (dl *Downloader) Fetch(rawurl string) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.active[rawurl] {
+		return
+	}
+	dl.active[rawurl] = true
+	go func() {
+		dl.download(rawurl)
+		dl.mu.Lock()
+		delete(dl.active, rawurl)
+		dl.mu.Unlock()
+	}()
+}
+
+// acquire waits until a download from host may start. It returns a function
+// that marks the download finished.
+func (dl *Downloader) acquire(host string) func() {
+	if dl.PerHost <= 0 {
+		return func() {}
+	}
+	dl.mu.Lock()
+	sem, ok := dl.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, dl.PerHost)
+		dl.hosts[host] = sem
+	}
+	dl.mu.Unlock()
+
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+// retryableError marks a download error that may pass if it is retried.
+type retryableError struct {
+	err error
+}
+
+func (err retryableError) Error() string { return err.err.Error() }
+func (err retryableError) Unwrap() error { return err.err }
+
+// download downloads rawurl and adds it to the cache, retrying with
+// exponential backoff if it fails for a reason that may pass.
+func (dl *Downloader) download(rawurl string) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		slog.Warn("gntp: could not download", "url", rawurl, "err", err)
+		return
+	}
+
+	sum := URLKey(rawurl)
+	validatorsKey := sum + ".validators"
+
+	var validators downloadValidators
+	cached := dl.cache.Exists(sum)
+	if cached {
+		if data, err := dl.cache.Get(validatorsKey); err == nil {
+			json.Unmarshal(data, &validators)
+		}
+		if time.Since(validators.Checked) < iconRevalidateInterval {
+			return
+		}
+	}
+
+	release := dl.acquire(u.Host)
+	defer release()
+
+	delay := time.Second
+	for attempt := 0; attempt <= dl.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = dl.get(u, sum, cached, &validators)
+		if !errors.As(err, new(retryableError)) {
+			break
+		}
+	}
+	if err != nil {
+		slog.Warn("gntp: could not download", "url", rawurl, "err", err)
+		return
+	}
+
+	validators.Checked = time.Now()
+	if data, err := json.Marshal(validators); err == nil {
+		dl.cache.Put(validatorsKey, data)
+	}
+}
+
+// get makes one attempt at downloading u into the cache at key. If cached,
+// the download is conditional on validators, which are updated from the
+// response.
+func (dl *Downloader) get(u *url.URL, key string, cached bool, validators *downloadValidators) error {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if cached && validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if cached && validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	resp, err := dl.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+	case resp.StatusCode == http.StatusOK:
+		if dl.MaxBytes > 0 && resp.ContentLength > dl.MaxBytes {
+			return errTooLarge
+		}
+		if err := dl.cache.Store(key, resp.Body, dl.MaxBytes); err != nil {
+			if err == errTooLarge {
+				return err
+			}
+			return retryableError{err}
+		}
+		if cached {
+			dl.cache.RemoveDerived(key)
+		}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return retryableError{errors.New(resp.Status)}
+	default:
+		return errors.New(resp.Status)
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		validators.ETag = etag
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		validators.LastModified = lastModified
+	}
+	return nil
+}
@@ -0,0 +1,726 @@
+// Package cache keeps files for a GNTP server on disk: the binaries sent
+// with requests, and the icons notifications refer to by URL, downloaded by
+// a Downloader.
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/jgrocho/gntp_notify/server"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileCache implements server.Binaries by saving files to disk. It is safe for
+// concurrent use: files are written to a temporary file and renamed into
+// place, and reads of a key wait for any write to it to finish.
+//
+// Files are saved with an extension for the type of their content, such as
+// .png, sniffed as they are written, as some notification servers won't show
+// icons without one. They are still looked up by their key alone.
+//
+// If MaxBytes or MaxEntries are set, the least recently used files are
+// removed whenever the cache grows beyond them, though never the file just
+// saved. If MaxAge is set, Collect
+// removes the files that have not been used for that long.
+type FileCache struct {
+	dir string
+
+	// MaxBytes is the maximum total size of the files, or 0 for no limit.
+	MaxBytes int64
+	// MaxEntries is the maximum number of files, or 0 for no limit.
+	MaxEntries int
+	// MaxAge is how long files are kept after they were last used, or 0 to
+	// keep them until evicted.
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+	// writing holds a channel for each key being written, closed when the
+	// write finishes.
+	writing map[string]chan struct{}
+
+	// hits, misses and evictions count lookups and removals, for Stats.
+	hits, misses, evictions int64
+
+	// OnLookup, if not nil, is called for each lookup of a file, which
+	// found it if hit, such as to update metrics.
+	OnLookup func(hit bool)
+
+	// refs holds the names of the applications that referenced each key,
+	// saved to referencesFile whenever it changes.
+	refsMu sync.Mutex
+	refs   map[string]map[string]bool
+}
+
+// cacheEntry records the name, size and last use of a file in a FileCache.
+type cacheEntry struct {
+	file string
+	size int64
+	used time.Time
+}
+
+// NewFileCache allocates and initializes a FileCache by saving files to dir.
+// The files already in dir are taken as last used when they were modified,
+// and looked up without any extension they were given. Temporary files left
+// behind by interrupted writes are removed.
+func NewFileCache(dir string) *FileCache {
+	cache := LoadFileCache(dir)
+	temps, _ := filepath.Glob(filepath.Join(dir, TempFilePrefix+"*"))
+	for _, temp := range temps {
+		os.Remove(temp)
+	}
+	return cache
+}
+
+// Dir gets the directory the cache saves files to.
+func (cache *FileCache) Dir() string {
+	return cache.dir
+}
+
+// CheckWritable returns an error if files can't be written to the cache's
+// directory, by writing and removing a temporary file.
+func (cache *FileCache) CheckWritable() error {
+	file, err := ioutil.TempFile(cache.dir, TempFilePrefix+"check-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// LoadFileCache allocates and initializes a FileCache for the files already
+// in dir, without changing any of them, as for inspecting the cache of a
+// running daemon.
+func LoadFileCache(dir string) *FileCache {
+	cache := &FileCache{
+		dir:     dir,
+		entries: make(map[string]*cacheEntry),
+		writing: make(map[string]chan struct{}),
+		refs:    make(map[string]map[string]bool),
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return cache
+	}
+	for _, info := range infos {
+		// Files starting with a dot are the cache's own records, and those
+		// of programs keeping their state in its directory.
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if info.Mode().IsRegular() {
+			key := info.Name()
+			if ext := filepath.Ext(key); sniffedExtensions[ext] {
+				key = strings.TrimSuffix(key, ext)
+			}
+			cache.entries[key] = &cacheEntry{info.Name(), info.Size(), info.ModTime()}
+			cache.size += info.Size()
+		}
+	}
+	cache.loadReferences()
+	return cache
+}
+
+// referencesFile is the file in the cache's directory recording which
+// applications referenced each key, as JSON.
+const referencesFile = ".references.json"
+
+// loadReferences reads the references saved in referencesFile, keeping those
+// to keys still in the cache.
+func (cache *FileCache) loadReferences() {
+	data, err := ioutil.ReadFile(filepath.Join(cache.dir, referencesFile))
+	if err != nil {
+		return
+	}
+	var refs map[string][]string
+	if err := json.Unmarshal(data, &refs); err != nil {
+		slog.Warn("gntp: could not read cache references", "err", err)
+		return
+	}
+	for key, apps := range refs {
+		if _, ok := cache.entries[key]; !ok {
+			continue
+		}
+		cache.refs[key] = make(map[string]bool, len(apps))
+		for _, app := range apps {
+			cache.refs[key][app] = true
+		}
+	}
+}
+
+// Reference records that the application named app uses the file at key, as
+// reported by Files.
+func (cache *FileCache) Reference(key, app string) {
+	if key == "" || app == "" {
+		return
+	}
+	cache.refsMu.Lock()
+	defer cache.refsMu.Unlock()
+	if cache.refs[key][app] {
+		return
+	}
+	if cache.refs[key] == nil {
+		cache.refs[key] = make(map[string]bool)
+	}
+	cache.refs[key][app] = true
+
+	refs := make(map[string][]string, len(cache.refs))
+	for key := range cache.refs {
+		refs[key] = cache.references(key)
+	}
+	data, err := json.Marshal(refs)
+	if err == nil {
+		var tempName string
+		if tempName, _, _, err = cache.writeTemp(bytes.NewReader(data)); err == nil {
+			if err = os.Rename(tempName, filepath.Join(cache.dir, referencesFile)); err != nil {
+				os.Remove(tempName)
+			}
+		}
+	}
+	if err != nil {
+		slog.Warn("gntp: could not save cache references", "err", err)
+	}
+}
+
+// ClearReferences forgets which applications referenced each key, removing
+// referencesFile.
+func (cache *FileCache) ClearReferences() error {
+	cache.refsMu.Lock()
+	defer cache.refsMu.Unlock()
+	cache.refs = make(map[string]map[string]bool)
+	if err := os.Remove(filepath.Join(cache.dir, referencesFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// references gives the names of the applications that referenced key, in
+// order. cache.refsMu must be held.
+func (cache *FileCache) references(key string) []string {
+	apps := make([]string, 0, len(cache.refs[key]))
+	for app := range cache.refs[key] {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	return apps
+}
+
+// CachedFile describes a file in a FileCache.
+type CachedFile struct {
+	Key  string    // the key the file is looked up by
+	Name string    // the name of the file in the cache's directory
+	Size int64     // the size of the file in bytes
+	Used time.Time // when the file was last used
+	Apps []string  // the applications that referenced the file, if known
+}
+
+// Files describes the files in the cache, in order of key.
+func (cache *FileCache) Files() []CachedFile {
+	cache.mu.Lock()
+	files := make([]CachedFile, 0, len(cache.entries))
+	for key, entry := range cache.entries {
+		files = append(files, CachedFile{key, entry.file, entry.size, entry.used, nil})
+	}
+	cache.mu.Unlock()
+
+	cache.refsMu.Lock()
+	for i := range files {
+		files[i].Apps = cache.references(files[i].Key)
+	}
+	cache.refsMu.Unlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files
+}
+
+// TempFilePrefix starts the names of the temporary files written to before
+// being renamed into place. NewFileCache removes any left behind, including
+// those of other programs writing to the cache's directory.
+const TempFilePrefix = ".tmp-"
+
+// lock waits for any write to key to finish, then marks key as being written.
+// It returns a function that marks the write finished.
+func (cache *FileCache) lock(key string) func() {
+	cache.mu.Lock()
+	for {
+		done, ok := cache.writing[key]
+		if !ok {
+			break
+		}
+		cache.mu.Unlock()
+		<-done
+		cache.mu.Lock()
+	}
+	done := make(chan struct{})
+	cache.writing[key] = done
+	cache.mu.Unlock()
+
+	return func() {
+		cache.mu.Lock()
+		delete(cache.writing, key)
+		cache.mu.Unlock()
+		close(done)
+	}
+}
+
+// wait waits for any write to key to finish.
+func (cache *FileCache) wait(key string) {
+	cache.mu.Lock()
+	done, ok := cache.writing[key]
+	cache.mu.Unlock()
+	if ok {
+		<-done
+	}
+}
+
+// entry gets the key the file at key is recorded under, and its cacheEntry,
+// or nil if it is not recorded. A key ending with the extension given to its
+// file, as for resized icons, is recorded without it when the file is found
+// in the directory. cache.mu must be held.
+func (cache *FileCache) entry(key string) (string, *cacheEntry) {
+	if entry, ok := cache.entries[key]; ok {
+		return key, entry
+	}
+	if ext := filepath.Ext(key); sniffedExtensions[ext] {
+		trimmed := strings.TrimSuffix(key, ext)
+		if entry, ok := cache.entries[trimmed]; ok && entry.file == key {
+			return trimmed, entry
+		}
+	}
+	return key, nil
+}
+
+// errInvalidKey is returned for keys that can't name a file in the cache.
+var errInvalidKey = errors.New("invalid cache key")
+
+// validKey reports whether key can name a file in the cache's directory: a
+// single path element, not . or .., so it can't name one anywhere else.
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, "/\\\x00")
+}
+
+// path gives the path of the file at key. Keys not in the cache's entries
+// are taken as file names. It returns the empty string if key is not valid.
+func (cache *FileCache) path(key string) string {
+	if !validKey(key) {
+		return ""
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, entry := cache.entry(key); entry != nil {
+		return filepath.Join(cache.dir, entry.file)
+	}
+	return filepath.Join(cache.dir, key)
+}
+
+// record adds the file at key, named file and of size bytes, to the cache's
+// entries and evicts the least recently used files if the cache is now too
+// large. A file previously at key under another name is removed.
+func (cache *FileCache) record(key, file string, size int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if recorded, entry := cache.entry(key); entry != nil {
+		cache.size -= entry.size
+		if entry.file != file {
+			os.Remove(filepath.Join(cache.dir, entry.file))
+		}
+		delete(cache.entries, recorded)
+	}
+	cache.entries[key] = &cacheEntry{file, size, time.Now()}
+	cache.size += size
+	cache.evict(key)
+}
+
+// touch marks the file at key as used now. The modification time of the file
+// is updated too, so the order of use survives a restart.
+func (cache *FileCache) touch(key string) {
+	now := time.Now()
+	cache.mu.Lock()
+	if _, entry := cache.entry(key); entry != nil {
+		entry.used = now
+	}
+	cache.mu.Unlock()
+	path := cache.path(key)
+	os.Chtimes(path, now, now)
+}
+
+// Collect removes the files that have not been used for longer than MaxAge.
+func (cache *FileCache) Collect() {
+	if cache.MaxAge <= 0 {
+		return
+	}
+	expired := time.Now().Add(-cache.MaxAge)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	removed := 0
+	for key, entry := range cache.entries {
+		if !entry.used.Before(expired) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cache.dir, entry.file)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("gntp: could not remove expired file from cache", "key", key, "err", err)
+			continue
+		}
+		cache.size -= entry.size
+		delete(cache.entries, key)
+		atomic.AddInt64(&cache.evictions, 1)
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("gntp: removed expired files from cache", "count", removed)
+	}
+}
+
+// CollectEvery starts a goroutine that calls Collect every interval, and
+// once straight away.
+func (cache *FileCache) CollectEvery(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			cache.Collect()
+			<-ticker.C
+		}
+	}()
+}
+
+// evict removes the least recently used files until the cache is within its
+// limits, other than the file at keep, which was just saved and is kept even
+// if it alone is over them. cache.mu must be held.
+func (cache *FileCache) evict(keep string) {
+	over := func() bool {
+		return (cache.MaxBytes > 0 && cache.size > cache.MaxBytes) ||
+			(cache.MaxEntries > 0 && len(cache.entries) > cache.MaxEntries)
+	}
+	if !over() {
+		return
+	}
+
+	keys := make([]string, 0, len(cache.entries))
+	for key := range cache.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cache.entries[keys[i]].used.Before(cache.entries[keys[j]].used)
+	})
+
+	for _, key := range keys {
+		if !over() {
+			break
+		}
+		if key == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cache.dir, cache.entries[key].file)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("gntp: could not evict file from cache", "key", key, "err", err)
+			continue
+		}
+		cache.size -= cache.entries[key].size
+		delete(cache.entries, key)
+		atomic.AddInt64(&cache.evictions, 1)
+	}
+}
+
+// lookup counts a lookup of a file, which found it if hit.
+func (cache *FileCache) lookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&cache.hits, 1)
+	} else {
+		atomic.AddInt64(&cache.misses, 1)
+	}
+	if cache.OnLookup != nil {
+		cache.OnLookup(hit)
+	}
+}
+
+// Stats gets statistics about the cache: lookups that found a file or didn't,
+// files evicted or expired, and the number and total size of the files.
+func (cache *FileCache) Stats() server.BinaryStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return server.BinaryStats{
+		Hits:      atomic.LoadInt64(&cache.hits),
+		Misses:    atomic.LoadInt64(&cache.misses),
+		Evictions: atomic.LoadInt64(&cache.evictions),
+		Entries:   len(cache.entries),
+		Bytes:     cache.size,
+	}
+}
+
+// Add reads length bytes from r and saves them to disk at key, under
+// FileCache.dir. If there is already a file at key, it is kept.
+//
+// The data is streamed to a temporary file as it is read, so it is never held
+// in memory, and key is only locked once it has all been read.
+func (cache *FileCache) Add(key string, length int64, r io.Reader) error {
+	if !validKey(key) {
+		return errInvalidKey
+	}
+	tempName, n, ext, err := cache.writeTemp(io.LimitReader(r, length))
+	if err != nil {
+		return err
+	}
+	if n != length {
+		os.Remove(tempName)
+		return io.ErrUnexpectedEOF
+	}
+
+	unlock := cache.lock(key)
+	defer unlock()
+	if _, err := os.Stat(cache.path(key)); err == nil {
+		os.Remove(tempName)
+		cache.touch(key)
+		return nil
+	}
+	return cache.rename(tempName, key, ext, length)
+}
+
+// Put saves data to disk at key, under FileCache.dir, replacing any file
+// already there.
+func (cache *FileCache) Put(key string, data []byte) error {
+	return cache.Store(key, bytes.NewReader(data), 0)
+}
+
+// errTooLarge is returned by Store for data larger than its limit.
+var errTooLarge = errors.New("too large")
+
+// Store reads r until EOF and saves the data to disk at key, under
+// FileCache.dir, replacing any file already there. If max is more than 0 and
+// r holds more than max bytes, nothing is saved and errTooLarge is returned.
+//
+// Like Add, the data is streamed to a temporary file as it is read.
+func (cache *FileCache) Store(key string, r io.Reader, max int64) error {
+	if !validKey(key) {
+		return errInvalidKey
+	}
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	tempName, n, ext, err := cache.writeTemp(r)
+	if err != nil {
+		return err
+	}
+	if max > 0 && n > max {
+		os.Remove(tempName)
+		return errTooLarge
+	}
+
+	unlock := cache.lock(key)
+	defer unlock()
+	return cache.rename(tempName, key, ext, n)
+}
+
+// writeTemp copies r to a new temporary file in the cache's directory, and
+// returns its name, the number of bytes copied and the extension for the type
+// of its content. Temporary files are renamed into place once complete, so a
+// partly written file is never seen at a key.
+func (cache *FileCache) writeTemp(r io.Reader) (string, int64, string, error) {
+	file, err := ioutil.TempFile(cache.dir, TempFilePrefix)
+	if err != nil {
+		return "", 0, "", err
+	}
+	var head sniffBuffer
+	n, err := io.Copy(file, io.TeeReader(r, &head))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", 0, "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", 0, "", err
+	}
+	// Temporary files are created readable only by us.
+	os.Chmod(file.Name(), 0644)
+	return file.Name(), n, sniffExtension(head), nil
+}
+
+// rename moves the temporary file tempName, of size bytes, to key, adding ext
+// to its name unless key already ends with it. The caller must hold the lock
+// on key.
+func (cache *FileCache) rename(tempName, key, ext string, size int64) error {
+	file := key
+	if !strings.HasSuffix(strings.ToLower(key), ext) {
+		file += ext
+	}
+	if err := os.Rename(tempName, filepath.Join(cache.dir, file)); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	cache.record(key, file, size)
+	return nil
+}
+
+// Remove removes the file at key, if there is one.
+func (cache *FileCache) Remove(key string) error {
+	if !validKey(key) {
+		return errInvalidKey
+	}
+	unlock := cache.lock(key)
+	defer unlock()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	recorded, entry := cache.entry(key)
+	path := filepath.Join(cache.dir, key)
+	if entry != nil {
+		path = filepath.Join(cache.dir, entry.file)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if entry != nil {
+		cache.size -= entry.size
+		delete(cache.entries, recorded)
+	}
+	return nil
+}
+
+// RemoveDerived removes the files made from the one at key, such as resized
+// icons, which are saved at keys starting with key and a dot, so they are
+// made again from its new contents.
+func (cache *FileCache) RemoveDerived(key string) {
+	cache.mu.Lock()
+	var derived []string
+	for k := range cache.entries {
+		if strings.HasPrefix(k, key+".") {
+			derived = append(derived, k)
+		}
+	}
+	cache.mu.Unlock()
+	for _, k := range derived {
+		cache.Remove(k)
+	}
+}
+
+// Get gets the bytes from the file at key, under FileCache.dir.
+func (cache *FileCache) Get(key string) ([]byte, error) {
+	if !validKey(key) {
+		return nil, errInvalidKey
+	}
+	cache.wait(key)
+	data, err := ioutil.ReadFile(cache.path(key))
+	cache.lookup(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	cache.touch(key)
+
+	return data, nil
+}
+
+// GetFileName gets the absolute filename for the data under key, if it exists,
+// with the extension for the type of its content.
+//
+// If the file does not exist on disk, or key is not valid, it returns the
+// empty string.
+func (cache *FileCache) GetFileName(key string) string {
+	if !validKey(key) {
+		return ""
+	}
+	cache.wait(key)
+	path := cache.path(key)
+	_, err := os.Stat(path)
+	cache.lookup(err == nil)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		cache.touch(key)
+		return abs
+	}
+	return ""
+}
+
+// Exists checks if the key file exists on disk.
+func (cache *FileCache) Exists(key string) bool {
+	if !validKey(key) {
+		return false
+	}
+	cache.wait(key)
+	_, err := os.Stat(cache.path(key))
+	return err == nil
+}
+
+// sniffLen is how much of the start of a file its type is sniffed from.
+const sniffLen = 512
+
+// sniffBuffer keeps the first sniffLen bytes written to it.
+type sniffBuffer []byte
+
+func (head *sniffBuffer) Write(p []byte) (int, error) {
+	if n := sniffLen - len(*head); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		*head = append(*head, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// extensionsByType maps the content types sniffed by http.DetectContentType
+// to the extensions files of that type are saved with.
+var extensionsByType = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"image/x-icon":    ".ico",
+	"audio/wave":      ".wav",
+	"audio/mpeg":      ".mp3",
+	"application/ogg": ".ogg",
+	"audio/aiff":      ".aiff",
+}
+
+// sniffedExtensions holds the extensions sniffExtension gives.
+var sniffedExtensions = map[string]bool{".svg": true}
+
+func init() {
+	for _, ext := range extensionsByType {
+		if ext != "" {
+			sniffedExtensions[ext] = true
+		}
+	}
+}
+
+// IsImage reports whether the file starting with head is an image of a type
+// sniffExtension recognizes.
+func IsImage(head []byte) bool {
+	switch sniffExtension(head) {
+	case ".png", ".jpg", ".gif", ".webp", ".bmp", ".ico", ".svg":
+		return true
+	}
+	return false
+}
+
+// sniffExtension gives the extension for the type of the file starting with
+// head, or the empty string for types without one. SVG images, which
+// http.DetectContentType takes as XML or text, are recognized by their <svg
+// element.
+func sniffExtension(head []byte) string {
+	contentType := http.DetectContentType(head)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	if contentType == "text/xml" || contentType == "text/plain" {
+		if bytes.Contains(head, []byte("<svg")) {
+			return ".svg"
+		}
+		return ""
+	}
+	return extensionsByType[contentType]
+}
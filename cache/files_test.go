@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInvalidKeys(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewFileCache(filepath.Join(dir, "cache"))
+	os.MkdirAll(cache.Dir(), 0755)
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", ".", "..", "../secret", "a/../../secret", "/etc/hostname", `..\secret`} {
+		if name := cache.GetFileName(key); name != "" {
+			t.Errorf("GetFileName(%q) = %q", key, name)
+		}
+		if data, err := cache.Get(key); err == nil {
+			t.Errorf("Get(%q) = %q", key, data)
+		}
+		if cache.Exists(key) {
+			t.Errorf("Exists(%q)", key)
+		}
+		if err := cache.Put(key, []byte("x")); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+	if data, _ := os.ReadFile(secret); string(data) != "secret" {
+		t.Errorf("file outside the cache overwritten: %q", data)
+	}
+
+	if err := cache.Put("abc", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.Get("abc"); err != nil || string(data) != "data" {
+		t.Errorf("Get(abc) = %q, %v", data, err)
+	}
+}
+
+// newTestCache builds a FileCache in a new temporary directory.
+func newTestCache(t *testing.T) *FileCache {
+	cache := NewFileCache(filepath.Join(t.TempDir(), "cache"))
+	os.MkdirAll(cache.Dir(), 0755)
+	return cache
+}
+
+// cached reports which of keys are in cache.
+func cached(cache *FileCache, keys ...string) []bool {
+	var in []bool
+	for _, key := range keys {
+		in = append(in, cache.GetFileName(key) != "")
+	}
+	return in
+}
+
+func TestMaxBytes(t *testing.T) {
+	cache := newTestCache(t)
+	cache.MaxBytes = 10
+	cache.Put("a", []byte("aaaa"))
+	cache.Put("b", []byte("bbbb"))
+	if got := cached(cache, "a", "b"); !got[0] || !got[1] {
+		t.Fatalf("cached %v, want both within the limit", got)
+	}
+	cache.GetFileName("a")
+	cache.Put("c", []byte("cccc"))
+	if got := cached(cache, "a", "b", "c"); !got[0] || got[1] || !got[2] {
+		t.Errorf("cached %v, want the least recently used evicted", got)
+	}
+
+	// A file larger than the limit is kept, alone.
+	cache.Put("large", []byte("larger than the limit"))
+	if got := cached(cache, "a", "c", "large"); got[0] || got[1] || !got[2] {
+		t.Errorf("cached %v, want only the large file", got)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Bytes != 21 || stats.Evictions != 3 {
+		t.Errorf("stats %+v, want 1 entry of 21 bytes and 3 evictions", stats)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	cache := newTestCache(t)
+	cache.MaxEntries = 2
+	cache.Put("a", []byte("a"))
+	cache.Put("b", []byte("b"))
+	cache.GetFileName("a")
+	cache.Put("c", []byte("c"))
+	if got := cached(cache, "a", "b", "c"); !got[0] || got[1] || !got[2] {
+		t.Errorf("cached %v, want the least recently used evicted", got)
+	}
+	// Replacing a file doesn't count as another.
+	cache.Put("c", []byte("cc"))
+	if got := cached(cache, "a", "c"); !got[0] || !got[1] {
+		t.Errorf("cached %v, want both kept after replacing one", got)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	cache := newTestCache(t)
+	cache.Put("old", []byte("old"))
+	cache.Put("new", []byte("new"))
+	cache.mu.Lock()
+	cache.entries["old"].used = time.Now().Add(-2 * time.Hour)
+	cache.mu.Unlock()
+
+	cache.Collect()
+	if got := cached(cache, "old", "new"); !got[0] || !got[1] {
+		t.Errorf("cached %v, want both kept without MaxAge", got)
+	}
+	cache.mu.Lock()
+	cache.entries["old"].used = time.Now().Add(-2 * time.Hour)
+	cache.mu.Unlock()
+
+	cache.MaxAge = time.Hour
+	cache.Collect()
+	if got := cached(cache, "old", "new"); got[0] || !got[1] {
+		t.Errorf("cached %v, want the expired file removed", got)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Evictions != 1 {
+		t.Errorf("stats %+v, want 1 entry and 1 eviction", stats)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	cache := newTestCache(t)
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	cache.Put("icon", png)
+	cache.Put("notes", []byte("plain text"))
+
+	name := cache.GetFileName("icon")
+	if filepath.Ext(name) != ".png" {
+		t.Errorf("GetFileName(icon) = %q, want a .png file", name)
+	}
+	if got := cache.GetFileName("icon.png"); got != name {
+		t.Errorf("GetFileName(icon.png) = %q, want %q", got, name)
+	}
+	if name := cache.GetFileName("notes"); filepath.Base(name) != "notes" {
+		t.Errorf("GetFileName(notes) = %q, want no extension", name)
+	}
+	if data, err := cache.Get("icon"); err != nil || !bytes.Equal(data, png) {
+		t.Errorf("Get(icon) = %q, %v", data, err)
+	}
+
+	// Replacing the file with another type renames it.
+	cache.Put("icon", []byte("GIF89a"))
+	if got := cache.GetFileName("icon"); filepath.Ext(got) != ".gif" {
+		t.Errorf("GetFileName(icon) = %q after replacing it, want a .gif file", got)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("replaced file %q not removed", name)
+	}
+
+	// The files are looked up by key alone once the cache is loaded again.
+	loaded := LoadFileCache(cache.Dir())
+	if got := loaded.GetFileName("icon"); filepath.Ext(got) != ".gif" {
+		t.Errorf("GetFileName(icon) = %q after loading, want a .gif file", got)
+	}
+	if !loaded.Exists("icon") || !loaded.Exists("notes") {
+		t.Error("files not found after loading")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// appsUsage describes the apps command.
+const appsUsage = `usage: gntp_notify -admin-addr <host:port> apps [ls]
+       gntp_notify -admin-addr <host:port> apps enable|disable <app> <name>
+       gntp_notify -admin-addr <host:port> apps remove <app>`
+
+// historyUsage describes the history command.
+const historyUsage = `usage: gntp_notify -admin-addr <host:port> history [-n <count>] [-app <name>] [-since <time|duration>]`
+
+// statusUsage describes the status command.
+const statusUsage = `usage: gntp_notify -admin-addr <host:port> status`
+
+// adminClientTimeout bounds each request to the admin API.
+const adminClientTimeout = 10 * time.Second
+
+// adminClient makes requests to the admin API of a running daemon.
+type adminClient struct {
+	addr   string
+	client *http.Client
+}
+
+// newAdminClient allocates and initializes an adminClient for the admin API
+// at addr.
+func newAdminClient(addr string) (*adminClient, error) {
+	if addr == "" {
+		return nil, errors.New("no admin API address: give -admin-addr, as the daemon was")
+	}
+	return &adminClient{addr, &http.Client{Timeout: adminClientTimeout}}, nil
+}
+
+// do makes a request with method to the admin API at path, with body as JSON
+// unless it is nil, and decodes the JSON response into v unless it is nil.
+func (ac *adminClient) do(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+ac.addr+path, r)
+	if err != nil {
+		return err
+	}
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// health gets the health of the daemon, which is given with a 503 status if
+// it is not ready.
+func (ac *adminClient) health() (*adminHealth, error) {
+	resp, err := ac.client.Get("http://" + ac.addr + "/health")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, errors.New(resp.Status)
+	}
+	health := new(adminHealth)
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// runStatusCommand runs the status command, given args, against the admin
+// API at addr, writing its output to w: whether the daemon is ready, the
+// registered applications, whether do not disturb is on, and the last
+// notification received. It returns an error if the daemon is not ready.
+func runStatusCommand(addr string, args []string, w io.Writer) error {
+	if len(args) > 0 {
+		return errors.New(statusUsage)
+	}
+	ac, err := newAdminClient(addr)
+	if err != nil {
+		return err
+	}
+	health, err := ac.health()
+	if err != nil {
+		return err
+	}
+	var apps []adminApplication
+	if err := ac.do("GET", "/apps", nil, &apps); err != nil {
+		return err
+	}
+	var dnd adminDND
+	if err := ac.do("GET", "/dnd", nil, &dnd); err != nil {
+		return err
+	}
+	var recent []HistoryEntry
+	if err := ac.do("GET", "/notifications?limit=1", nil, &recent); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "admin API:\t%s\n", addr)
+	fmt.Fprintf(tw, "ready:\t%s\n", yesNo(health.OK))
+	fmt.Fprintf(tw, "accepting connections:\t%s\n", yesNo(health.Accepting))
+	fmt.Fprintf(tw, "backend working:\t%s\n", yesNo(health.Backend))
+	fmt.Fprintf(tw, "cache writable:\t%s\n", yesNo(health.CacheWritable))
+	fmt.Fprintf(tw, "applications:\t%d\n", len(apps))
+	if dnd.Enabled {
+		fmt.Fprintf(tw, "do not disturb:\ton, %d held\n", dnd.Held)
+	} else {
+		fmt.Fprintf(tw, "do not disturb:\toff\n")
+	}
+	if len(recent) > 0 {
+		last := recent[0]
+		fmt.Fprintf(tw, "last notification:\t%s %s: %s (%s)\n", last.Time.Local().Format(time.RFC3339), last.Application, last.Title, last.Outcome)
+	} else {
+		fmt.Fprintf(tw, "last notification:\t-\n")
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if !health.OK {
+		return errors.New("not ready: " + strings.Join(health.Errors, "; "))
+	}
+	return nil
+}
+
+// yesNo gives "yes" or "no" for b.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// runHistoryCommand runs the history command, given args, against the admin
+// API at addr, writing a table of the notifications selected by its flags to
+// w, oldest first.
+func runHistoryCommand(addr string, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	n := flags.Int("n", defaultHistoryLimit, "List this many notifications, or 0 for all")
+	app := flags.String("app", "", "List the notifications from this application")
+	since := flags.String("since", "", "List the notifications since this time, or this long ago")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\n" + historyUsage)
+	}
+	if flags.NArg() > 0 {
+		return errors.New(historyUsage)
+	}
+	ac, err := newAdminClient(addr)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{"limit": {strconv.Itoa(*n)}}
+	if *app != "" {
+		params.Set("app", *app)
+	}
+	if *since != "" {
+		params.Set("since", *since)
+	}
+	var entries []HistoryEntry
+	if err := ac.do("GET", "/notifications?"+params.Encode(), nil, &entries); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tAPPLICATION\tNOTIFICATION\tPRIORITY\tOUTCOME\tTITLE")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", entry.Time.Local().Format(time.RFC3339), entry.Application, entry.Name, entry.Priority, entry.Outcome, entry.Title)
+	}
+	return tw.Flush()
+}
+
+// runAppsCommand runs the apps command, given args, against the admin API at
+// addr, writing its output to w.
+//
+// apps ls lists the registered applications and their notification types.
+// apps enable and apps disable enable or disable a notification type, and
+// apps remove unregisters an application.
+func runAppsCommand(addr string, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		args = []string{"ls"}
+	}
+	ac, err := newAdminClient(addr)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "ls":
+		if len(args) > 1 {
+			return errors.New(appsUsage)
+		}
+		return listApps(ac, w)
+	case "enable", "disable":
+		if len(args) != 3 {
+			return errors.New(appsUsage)
+		}
+		enabled := args[0] == "enable"
+		path := "/apps/" + url.PathEscape(args[1]) + "/notifications/" + url.PathEscape(args[2])
+		return ac.do("PUT", path, adminEnabled{&enabled}, nil)
+	case "remove":
+		if len(args) != 2 {
+			return errors.New(appsUsage)
+		}
+		return ac.do("DELETE", "/apps/"+url.PathEscape(args[1]), nil, nil)
+	}
+	return errors.New("unknown apps command " + args[0] + "\n" + appsUsage)
+}
+
+// listApps writes a table of the registered applications and their
+// notification types to w.
+func listApps(ac *adminClient, w io.Writer) error {
+	var apps []adminApplication
+	if err := ac.do("GET", "/apps", nil, &apps); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "APPLICATION\tNOTIFICATION\tENABLED")
+	for _, app := range apps {
+		for _, note := range app.Notifications {
+			enabled := yesNo(note.Enabled)
+			if note.EnabledByUser {
+				enabled += " (user)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", app.Name, note.Name, enabled)
+		}
+		if len(app.Notifications) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\n", app.Name)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d applications\n", len(apps))
+	return err
+}
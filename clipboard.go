@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"github.com/jgrocho/gntp_notify/registry"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// clipboardCommands lists the programs, in order of preference, used to set
+// the clipboard contents. Each reads the new contents from stdin.
+var clipboardCommands = [][]string{
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+}
+
+// copyToClipboard sets the clipboard contents to text.
+func copyToClipboard(text string) error {
+	for _, command := range clipboardCommands {
+		// wl-copy only works under Wayland, the others only under X.
+		if command[0] == "wl-copy" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			continue
+		}
+		if _, err := exec.LookPath(command[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return errors.New("no clipboard program found")
+}
+
+// ClipboardExtractor picks the text of a notification to copy to the
+// clipboard.
+type ClipboardExtractor struct {
+	pattern *regexp.Regexp
+}
+
+// NewClipboardExtractor allocates and initializes a ClipboardExtractor. If
+// pattern is empty the whole notification text is copied, otherwise only the
+// first match of pattern (or its first subexpression, if it has one).
+func NewClipboardExtractor(pattern string) (*ClipboardExtractor, error) {
+	extractor := new(ClipboardExtractor)
+	if pattern != "" {
+		var err error
+		if extractor.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return extractor, nil
+}
+
+// Extract returns the text of note to copy to the clipboard, and whether there
+// is any.
+func (extractor *ClipboardExtractor) Extract(note *registry.Notification) (string, bool) {
+	if extractor.pattern == nil {
+		return note.Text, note.Text != ""
+	}
+
+	// Prefer matches in the body, but fall back to the title.
+	for _, s := range []string{note.Text, note.Title} {
+		m := extractor.pattern.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		if len(m) > 1 {
+			return m[1], true
+		}
+		return m[0], true
+	}
+	return "", false
+}
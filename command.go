@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandOutputLogged is how much of the output of a failed command is
+// logged.
+const commandOutputLogged = 1024
+
+// commandBackend is a Backend that runs a program for each notification, in
+// the background, from a pool of workers.
+type commandBackend struct {
+	opts    *BackendOptions
+	program string
+	timeout time.Duration
+	queue   chan *registry.Notification
+}
+
+// NewCommandBackend builds a Backend that runs program for each
+// notification, from workers goroutines at once, killing it if it runs for
+// longer than timeout, if more than 0. Icons are found as set by opts.
+func NewCommandBackend(opts *BackendOptions, program string, workers int, timeout time.Duration) Backend {
+	backend := &commandBackend{
+		opts:    opts,
+		program: program,
+		timeout: timeout,
+		queue:   make(chan *registry.Notification, webhookQueueSize),
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go backend.run()
+	}
+	return backend
+}
+
+// Show queues note for the program to be run for.
+func (backend *commandBackend) Show(note *registry.Notification) {
+	select {
+	case backend.queue <- note:
+	default:
+		slog.Warn("gntp: command queue full, dropping notification", "app", note.App.Name, "name", note.Name)
+		notificationsFailed.Inc("command")
+	}
+}
+
+// run runs the program for each notification from the queue.
+func (backend *commandBackend) run() {
+	for note := range backend.queue {
+		if err := backend.execute(note); err != nil {
+			notificationsFailed.Inc("command")
+			continue
+		}
+		notificationsShown.Inc("command")
+	}
+}
+
+// commandEnv gives the environment variables describing note, and its icon
+// file, to the program: GNTP_APPLICATION, GNTP_NAME, and so on, and
+// GNTP_HEADER_<header> for each of its custom headers.
+func commandEnv(note *registry.Notification, icon string) []string {
+	env := []string{
+		"GNTP_APPLICATION=" + note.App.Name,
+		"GNTP_NAME=" + note.Name,
+		"GNTP_DISPLAY_NAME=" + note.Display,
+		"GNTP_ID=" + note.Id,
+		"GNTP_TITLE=" + note.Title,
+		"GNTP_TEXT=" + note.Text,
+		"GNTP_PRIORITY=" + strconv.Itoa(note.Priority),
+		"GNTP_STICKY=" + strconv.FormatBool(note.Sticky),
+		"GNTP_ICON=" + icon,
+		"GNTP_CALLBACK_TARGET=" + note.CallbackTarget,
+	}
+	for key, values := range note.Custom {
+		name := strings.ToUpper(strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, key))
+		env = append(env, "GNTP_HEADER_"+name+"="+values[0])
+	}
+	return env
+}
+
+// execute runs the program for note, with the path of its icon as its
+// argument, if it has one.
+func (backend *commandBackend) execute(note *registry.Notification) error {
+	ctx := context.Background()
+	if backend.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, backend.timeout)
+		defer cancel()
+	}
+
+	icon := iconFileName(note, backend.opts.Cache, backend.opts.IconDirs)
+	var args []string
+	if icon != "" {
+		args = append(args, icon)
+	}
+	cmd := exec.CommandContext(ctx, backend.program, args...)
+	cmd.Env = append(os.Environ(), commandEnv(note, icon)...)
+	// Children of the program left running, still holding its output, do
+	// not hold up the worker for long once it is killed.
+	cmd.WaitDelay = time.Second
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if len(output) > commandOutputLogged {
+			output = output[:commandOutputLogged]
+		}
+		slog.Warn("gntp: notification command failed", "program", backend.program, "app", note.App.Name, "name", note.Name, "err", err, "output", string(output))
+		return err
+	}
+	slog.Debug("gntp: ran notification command", "program", backend.program, "app", note.App.Name, "name", note.Name, "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBackend("console", newConsoleBackend)
+}
+
+// consoleColors maps GNTP priorities to the ANSI escape sequences notifications
+// are printed in on a terminal.
+var consoleColors = map[int]string{
+	-2: "\x1b[2m",
+	-1: "\x1b[2m",
+	0:  "\x1b[1m",
+	1:  "\x1b[1;33m",
+	2:  "\x1b[1;31m",
+}
+
+// consoleReset is the ANSI escape sequence ending a color.
+const consoleReset = "\x1b[0m"
+
+// consoleBackend shows notifications by printing them, for when there is no
+// notification server, such as on headless servers and in containers.
+type consoleBackend struct {
+	mu  sync.Mutex
+	out io.Writer
+	// color is whether notifications are colored by priority.
+	color bool
+}
+
+// newConsoleBackend prints notifications to standard output, colored if it is
+// a terminal and NO_COLOR is not set.
+func newConsoleBackend(opts *BackendOptions) (Backend, error) {
+	color := false
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		color = os.Getenv("NO_COLOR") == ""
+	}
+	return &consoleBackend{out: os.Stdout, color: color}, nil
+}
+
+// Show prints note, with its text indented below its title. As it can't be
+// clicked, it reports that note timed out.
+func (backend *consoleBackend) Show(note *registry.Notification) {
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s [%s] ", time.Now().Format("15:04:05"), note.App.Name)
+	if backend.color {
+		line.WriteString(consoleColors[note.Priority] + note.Title + consoleReset)
+	} else {
+		line.WriteString(note.Title)
+	}
+	if note.Progress != nil {
+		fmt.Fprintf(&line, " %d%%", *note.Progress)
+	}
+	line.WriteString("\n")
+	if note.Text != "" {
+		line.WriteString("    " + strings.ReplaceAll(strings.TrimRight(note.Text, "\n"), "\n", "\n    ") + "\n")
+	}
+
+	backend.mu.Lock()
+	io.WriteString(backend.out, line.String())
+	backend.mu.Unlock()
+	notificationsShown.Inc("console")
+	note.SendCallback(registry.CallbackTimedOut)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"github.com/godbus/dbus"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"sync"
+)
+
+func init() {
+	registerBackend("dbus", newDBusBackend)
+}
+
+// The well-known name, object path and interface of the freedesktop
+// notification server.
+const (
+	notificationsName  = "org.freedesktop.Notifications"
+	notificationsPath  = "/org/freedesktop/Notifications"
+	notificationsIface = "org.freedesktop.Notifications"
+)
+
+// errNoNotificationServer is returned when there is no notification server
+// on the session bus, nor one that can be started.
+var errNoNotificationServer = errors.New("no notification server on the session bus")
+
+// notificationServerChanged matches the signal the session bus sends when a
+// notification server starts or stops, such as when one replaces another.
+const notificationServerChanged = "type='signal',interface='org.freedesktop.DBus',member='NameOwnerChanged',arg0='" + notificationsName + "'"
+
+// serverCapabilities are the optional features of the notification server
+// that notifications are adapted to.
+type serverCapabilities struct {
+	// markup is whether the body may have markup, and hyperlinks whether
+	// that markup may have links.
+	markup     bool
+	hyperlinks bool
+	// actions is whether notifications may have actions; without them,
+	// notifications can't be clicked.
+	actions bool
+}
+
+// parseCapabilities gives the serverCapabilities among capabilities, as
+// given by the notification server.
+func parseCapabilities(capabilities []string) serverCapabilities {
+	var caps serverCapabilities
+	for _, capability := range capabilities {
+		switch capability {
+		case "body-markup":
+			caps.markup = true
+		case "body-hyperlinks":
+			caps.hyperlinks = true
+		case "actions":
+			caps.actions = true
+		}
+	}
+	return caps
+}
+
+// notificationServerCapabilities asks the notification server on the session
+// bus conn for its capabilities. It only fails if there is no server, and
+// none can be started; otherwise, as a server may be starting, errors are
+// logged.
+func notificationServerCapabilities(conn *dbus.Conn) ([]string, error) {
+	var capabilities []string
+	err := conn.Object(notificationsName, notificationsPath).Call(notificationsIface+".GetCapabilities", 0).Store(&capabilities)
+	if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+		return nil, errNoNotificationServer
+	}
+	if err != nil {
+		slog.Warn("gntp: could not get notification server capabilities", "err", err)
+	}
+	return capabilities, nil
+}
+
+// dbusBackend shows notifications by talking to the notification server over
+// D-Bus directly, without libnotify.
+type dbusBackend struct {
+	opts *BackendOptions
+	conn *dbus.Conn
+	obj  dbus.BusObject
+
+	mu sync.Mutex
+	// caps are the capabilities of the notification server, asked for
+	// again whenever it is replaced.
+	caps  serverCapabilities
+	shown map[uint32]*shownNotification
+	// coalesced maps the CoalescingKey of notifications on screen to their
+	// ids, so they can be replaced.
+	coalesced map[string]uint32
+}
+
+// newDBusBackend connects to the session bus and starts listening for the
+// notification server's signals. It fails if there is no notification server.
+func newDBusBackend(opts *BackendOptions) (Backend, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, match := range []string{"type='signal',interface='" + notificationsIface + "'", notificationServerChanged} {
+		if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, match); call.Err != nil {
+			return nil, call.Err
+		}
+	}
+
+	capabilities, err := notificationServerCapabilities(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &dbusBackend{
+		opts:      opts,
+		conn:      conn,
+		obj:       conn.Object(notificationsName, notificationsPath),
+		caps:      parseCapabilities(capabilities),
+		shown:     make(map[uint32]*shownNotification),
+		coalesced: make(map[string]uint32),
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	go backend.handleSignals(signals)
+
+	return backend, nil
+}
+
+// handleSignals dispatches the ActionInvoked and NotificationClosed signals
+// for the notifications we have shown, and notices when the notification
+// server is replaced.
+func (backend *dbusBackend) handleSignals(signals <-chan *dbus.Signal) {
+	for signal := range signals {
+		switch signal.Name {
+		case "org.freedesktop.DBus.NameOwnerChanged":
+			var name, oldOwner, newOwner string
+			if err := dbus.Store(signal.Body, &name, &oldOwner, &newOwner); err != nil || name != notificationsName || newOwner == "" {
+				continue
+			}
+			// Ask in another goroutine, as replies are only delivered
+			// once this signal is handled.
+			go backend.updateCapabilities()
+		case notificationsIface + ".ActionInvoked":
+			var id uint32
+			var key string
+			if err := dbus.Store(signal.Body, &id, &key); err != nil {
+				continue
+			}
+			backend.mu.Lock()
+			sn, ok := backend.shown[id]
+			backend.mu.Unlock()
+			if ok {
+				sn.actionInvoked(key)
+			}
+		case notificationsIface + ".NotificationClosed":
+			var id, reason uint32
+			if err := dbus.Store(signal.Body, &id, &reason); err != nil {
+				continue
+			}
+			backend.mu.Lock()
+			sn, ok := backend.shown[id]
+			delete(backend.shown, id)
+			if ok {
+				backend.forget(sn.note, id)
+			}
+			backend.mu.Unlock()
+			if ok {
+				sn.note.SendCallback(closedResult(int(reason)))
+			}
+		}
+	}
+}
+
+// updateCapabilities asks the notification server for its capabilities again.
+func (backend *dbusBackend) updateCapabilities() {
+	capabilities, err := notificationServerCapabilities(backend.conn)
+	if err != nil {
+		return
+	}
+	caps := parseCapabilities(capabilities)
+	backend.mu.Lock()
+	backend.caps = caps
+	backend.mu.Unlock()
+	slog.Debug("gntp: notification server replaced", "capabilities", capabilities)
+}
+
+// forget removes the notification with id from the coalesced notifications,
+// if it is there for note. backend.mu must be held.
+func (backend *dbusBackend) forget(note *registry.Notification, id uint32) {
+	if key := note.CoalescingKey(); key != "" && backend.coalesced[key] == id {
+		delete(backend.coalesced, key)
+	}
+}
+
+// Check pings the session bus, to see that the connection to it still works.
+func (backend *dbusBackend) Check() error {
+	return backend.conn.BusObject().Call("org.freedesktop.DBus.Peer.Ping", 0).Err
+}
+
+// Displayed gives the notifications on screen.
+func (backend *dbusBackend) Displayed() []*registry.Notification {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	notes := make([]*registry.Notification, 0, len(backend.shown))
+	for _, sn := range backend.shown {
+		notes = append(notes, sn.note)
+	}
+	return notes
+}
+
+// Show sends note to the notification server.
+func (backend *dbusBackend) Show(note *registry.Notification) {
+	sn := &shownNotification{note: note}
+
+	backend.mu.Lock()
+	caps := backend.caps
+	backend.mu.Unlock()
+
+	// Without actions, the notification can't be clicked, so its
+	// callback only ever reports that it closed.
+	var actions []string
+	if caps.actions {
+		for _, action := range note.Actions {
+			actions = append(actions, action.Key, action.Label)
+		}
+		if backend.opts.Clipboard != nil {
+			if text, ok := backend.opts.Clipboard.Extract(note); ok {
+				sn.clipboard = text
+				actions = append(actions, "copy", "Copy")
+			}
+		}
+	}
+
+	hints := map[string]dbus.Variant{
+		"urgency": dbus.MakeVariant(byte(urgency(note))),
+	}
+	for key, value := range customHints(note) {
+		hints[key] = dbus.MakeVariant(value)
+	}
+	for key, value := range standardHints(note) {
+		hints[key] = dbus.MakeVariant(value)
+	}
+	var icon string
+	if image := notificationImage(note, backend.opts); image != nil {
+		hints["image-data"] = dbus.MakeVariant(*image)
+	} else {
+		icon = notificationIcon(note, backend.opts)
+	}
+	if !backend.opts.Sounds.allowed(note) {
+		hints["suppress-sound"] = dbus.MakeVariant(true)
+	} else if sound, isFile := notificationSound(note, backend.opts); isFile {
+		hints["sound-file"] = dbus.MakeVariant(sound)
+	} else if sound != "" {
+		hints["sound-name"] = dbus.MakeVariant(sound)
+	}
+
+	// Hold the lock until the notification is recorded, so its signals
+	// can't be handled before then.
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	// Replace the notification on screen with the same coalescing id.
+	key := note.CoalescingKey()
+	var replaces uint32
+	if key != "" {
+		replaces = backend.coalesced[key]
+	}
+	// A notification shown again after a restart replaces itself, if it
+	// is still on screen.
+	if replaces == 0 {
+		replaces = note.ShownId
+	}
+
+	var id uint32
+	call := backend.obj.Call(notificationsIface+".Notify", 0,
+		note.App.Name, replaces, icon,
+		note.Title, bodyText(note.Text, caps), actions, hints, int32(timeout(note)))
+	if err := call.Store(&id); err != nil {
+		slog.Warn("gntp: notification not shown", "app", note.App.Name, "id", note.Id, "err", err)
+		notificationsFailed.Inc("dbus")
+		note.SendCallback(registry.CallbackClosed)
+		return
+	}
+	slog.Info("gntp: notification shown", "app", note.App.Name, "id", note.Id)
+	notificationsShown.Inc("dbus")
+	// The notification server doesn't signal that a replaced notification
+	// closed, so do it here.
+	if old, ok := backend.shown[replaces]; replaces != 0 && ok {
+		delete(backend.shown, replaces)
+		old.note.SendCallback(registry.CallbackClosed)
+	}
+	backend.shown[id] = sn
+	note.ShownId = id
+	if key != "" {
+		backend.coalesced[key] = id
+	}
+}
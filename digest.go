@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// digestApp is the Application used for digest and summary notifications.
+var digestApp = &registry.Application{Name: "gntp_notify"}
+
+// isDigestable reports whether note should be batched into a digest rather
+// than shown on its own. Notifications waiting on a callback are always shown
+// on their own.
+func isDigestable(note *registry.Notification) bool {
+	return note.Priority <= -1 && note.Callback == nil
+}
+
+// buildDigest builds a single Notification summarizing notes.
+func buildDigest(notes []*registry.Notification) *registry.Notification {
+	title := "1 low priority notification"
+	if len(notes) != 1 {
+		title = fmt.Sprintf("%d low priority notifications", len(notes))
+	}
+	return buildSummary("Digest", "digest", title, notes)
+}
+
+// buildSummary builds a single low priority Notification from gntp_notify,
+// of the type named name, with id and title, listing the application and
+// title of each of notes.
+func buildSummary(name, id, title string, notes []*registry.Notification) *registry.Notification {
+	lines := make([]string, len(notes))
+	for i, note := range notes {
+		lines[i] = note.App.Name + ": " + note.Title
+	}
+
+	return &registry.Notification{
+		App:      digestApp,
+		Name:     name,
+		Display:  name,
+		Enabled:  true,
+		Id:       id,
+		Title:    title,
+		Text:     strings.Join(lines, "\n"),
+		Priority: -1,
+	}
+}
+
+// DigestChannel builds and returns a channel for Notifications that passes
+// them on to out. Low priority notifications are held back, as recorded in
+// history and kept in pending, and sent to out as a single digest
+// Notification every interval.
+func DigestChannel(interval time.Duration, out chan<- *registry.Notification, history NotificationLog, pending *PendingNotifications) chan *registry.Notification {
+	c := make(chan *registry.Notification)
+
+	go func() {
+		var held []*registry.Notification
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case note := <-c:
+				if !isDigestable(note) {
+					out <- note
+					continue
+				}
+				slog.Info("gntp: holding notification for digest", "app", note.App.Name, "name", note.Name)
+				notificationsSuppressed.Inc("digest")
+				atomic.AddInt64(&digestPending, 1)
+				history.Add(note, outcomeDigest)
+				pending.Add(note)
+				held = append(held, note)
+			case <-ticker.C:
+				if len(held) == 0 {
+					continue
+				}
+				digest := buildDigest(held)
+				slog.Info("gntp: sending digest", "count", len(held))
+				atomic.AddInt64(&digestPending, -int64(len(held)))
+				for _, note := range held {
+					pending.Remove(note)
+				}
+				held = nil
+				out <- digest
+			}
+		}
+	}()
+
+	return c
+}
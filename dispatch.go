@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"net"
+)
+
+// dispatcher decides what happens to the notifications the NotifyHandler
+// receives: they are refused, or kept from the screen by the user's rules, or
+// sent on to be shown.
+type dispatcher struct {
+	notes     chan *registry.Notification
+	downloads *cache.Downloader
+	forward   *Forwarder
+
+	// overrides, if not nil, holds the user's rules for notifications.
+	overrides *Overrides
+	// filters, if not nil, holds the user's rules for which notifications
+	// are shown.
+	filters *Filters
+	// minPriority is the lowest priority of the notifications shown, unless
+	// overrides replace it for an application.
+	minPriority int
+	// history records the notifications not shown.
+	history NotificationLog
+	// dnd, if not nil and on, holds notifications back instead of showing
+	// them.
+	dnd *DoNotDisturb
+
+	// limit, if not nil, limits how often each client may send
+	// notifications, or each of its applications if perApp is true.
+	limit  *server.RateLimiter
+	perApp bool
+}
+
+// dispatch applies the user's overrides to note, refuses it if its type is
+// disabled or its client is over the rate limit, and otherwise sends it to be
+// shown, unless the user's rules say otherwise. The request it came in is
+// forwarded either way.
+func (d *dispatcher) dispatch(req *server.Request, note *registry.Notification) error {
+	muted := d.overrides.Apply(note, d.downloads)
+	if note.EnabledByUser && !note.Enabled {
+		notificationsSuppressed.Inc("disabled")
+		d.history.Add(note, outcomeDisabled)
+		return server.NotificationDisabledError(note.App.Name, note.Name)
+	}
+
+	if !d.allowRate(req.RemoteAddr, note.App.Name) {
+		req.Logger().Warn("gntp: refused notification over rate limit", "app", note.App.Name)
+		notificationsSuppressed.Inc("rate_limit")
+		d.history.Add(note, outcomeRateLimited)
+		return server.NotAuthorizedError("too many notifications")
+	}
+
+	req.Logger().Info("gntp: received notification", "app", note.App.Name, "name", note.Name, "id", note.Id)
+	rule := d.filters.Match(note)
+	switch {
+	case muted:
+		req.Logger().Debug("gntp: not showing notification from muted application", "app", note.App.Name)
+		notificationsSuppressed.Inc("muted")
+		note.SendCallback(registry.CallbackClosed)
+		d.history.Add(note, outcomeMuted)
+	case note.Priority < d.overrides.MinPriority(note.App.Name, d.minPriority):
+		req.Logger().Debug("gntp: not showing notification below minimum priority", "app", note.App.Name, "priority", note.Priority)
+		notificationsSuppressed.Inc("low_priority")
+		note.SendCallback(registry.CallbackClosed)
+		d.history.Add(note, outcomeLowPriority)
+	case rule != nil && rule.Action != FilterShow:
+		d.filter(req, note, rule)
+	case d.dnd.Hold(note):
+		// The notification may be shown long after, so don't keep the
+		// client waiting for its callback.
+		req.Logger().Debug("gntp: holding notification while do not disturb is on", "app", note.App.Name)
+		notificationsSuppressed.Inc("dnd")
+		note.SendCallback(registry.CallbackClosed)
+		d.history.Add(note, outcomeDND)
+	default:
+		d.notes <- note
+	}
+	if d.forward != nil {
+		d.forward.Forward(req)
+	}
+	return nil
+}
+
+// filter does what rule says to do with note, which it matched, instead of
+// showing it.
+func (d *dispatcher) filter(req *server.Request, note *registry.Notification, rule *FilterRule) {
+	outcome := outcomeFiltered
+	switch rule.Action {
+	case FilterSuppress:
+		req.Logger().Debug("gntp: not showing notification suppressed by filter", "app", note.App.Name, "name", note.Name)
+	case FilterLogOnly:
+		req.Logger().Info("gntp: not showing notification logged by filter", "app", note.App.Name, "name", note.Name, "title", note.Title, "text", note.Text)
+		outcome = outcomeLogged
+	case FilterReroute:
+		req.Logger().Debug("gntp: rerouting notification", "app", note.App.Name, "name", note.Name, "target", rule.target.Addr)
+		rule.forward.Forward(req)
+		outcome = outcomeRerouted
+	}
+	notificationsSuppressed.Inc(outcome)
+	note.SendCallback(registry.CallbackClosed)
+	d.history.Add(note, outcome)
+}
+
+// allowRate reports whether a notification from app, sent from remoteAddr, is
+// within the dispatcher's rate limit.
+func (d *dispatcher) allowRate(remoteAddr, app string) bool {
+	if d.limit == nil {
+		return true
+	}
+	key := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		key = host
+	}
+	if d.perApp {
+		key += "\x00" + app
+	}
+	return d.limit.Allow(key)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// dndMaxHeld is how many notifications are held while do not disturb is on;
+// when more arrive, the oldest held is dropped.
+const dndMaxHeld = 1000
+
+// The ways notifications held while do not disturb was on are shown once it
+// is turned off.
+const (
+	// DNDSummary shows a single notification summarizing them.
+	DNDSummary = "summary"
+	// DNDReplay shows each of them that hasn't expired.
+	DNDReplay = "replay"
+)
+
+// heldNotification is a notification held while do not disturb is on.
+type heldNotification struct {
+	note     *registry.Notification
+	received time.Time
+}
+
+// DoNotDisturb is a switch that, while on, holds notifications back instead
+// of showing them. When it is turned off they are sent on to be shown, as
+// chosen by End. It is safe for concurrent use.
+type DoNotDisturb struct {
+	out chan<- *registry.Notification
+
+	// End is how held notifications are shown once do not disturb is
+	// turned off: DNDSummary or DNDReplay.
+	End string
+	// MaxAge, if more than 0, is how long a held notification may be
+	// replayed for; older ones are dropped.
+	MaxAge time.Duration
+
+	mu   sync.Mutex
+	on   bool
+	held []heldNotification
+}
+
+// NewDoNotDisturb allocates and initializes a DoNotDisturb, which is off,
+// sending held notifications on to out.
+func NewDoNotDisturb(out chan<- *registry.Notification) *DoNotDisturb {
+	return &DoNotDisturb{out: out, End: DNDSummary}
+}
+
+// parseDNDEnd checks end is a way of showing held notifications.
+func parseDNDEnd(end string) (string, error) {
+	switch end {
+	case DNDSummary, DNDReplay:
+		return end, nil
+	}
+	return "", errors.New("unknown do not disturb end " + end + " (available: summary, replay)")
+}
+
+// On reports whether do not disturb is on. A nil DoNotDisturb is always off.
+func (dnd *DoNotDisturb) On() bool {
+	if dnd == nil {
+		return false
+	}
+	dnd.mu.Lock()
+	defer dnd.mu.Unlock()
+	return dnd.on
+}
+
+// Held gives the number of notifications held.
+func (dnd *DoNotDisturb) Held() int {
+	dnd.mu.Lock()
+	defer dnd.mu.Unlock()
+	return len(dnd.held)
+}
+
+// Hold holds note back if do not disturb is on, and reports whether it did.
+// A nil DoNotDisturb never holds notifications.
+func (dnd *DoNotDisturb) Hold(note *registry.Notification) bool {
+	if dnd == nil {
+		return false
+	}
+	dnd.mu.Lock()
+	defer dnd.mu.Unlock()
+	if !dnd.on {
+		return false
+	}
+	if len(dnd.held) >= dndMaxHeld {
+		dropped := dnd.held[0].note
+		slog.Warn("gntp: too many notifications held for do not disturb, dropping oldest", "app", dropped.App.Name, "name", dropped.Name, "id", dropped.Id)
+		dnd.held[0] = heldNotification{}
+		dnd.held = dnd.held[1:]
+	}
+	dnd.held = append(dnd.held, heldNotification{note, time.Now()})
+	return true
+}
+
+// state gives whether do not disturb is on, and the notifications held.
+func (dnd *DoNotDisturb) state() (bool, []heldNotification) {
+	dnd.mu.Lock()
+	defer dnd.mu.Unlock()
+	return dnd.on, append([]heldNotification(nil), dnd.held...)
+}
+
+// restore sets do not disturb on or off, as it was before gntp_notify last
+// exited, holding held ahead of any notifications held since. If it is off,
+// they are sent on to be shown, in a new goroutine.
+func (dnd *DoNotDisturb) restore(on bool, held []heldNotification) {
+	dnd.mu.Lock()
+	defer dnd.mu.Unlock()
+	dnd.on = on
+	dnd.held = append(held, dnd.held...)
+	if len(dnd.held) > dndMaxHeld {
+		dnd.held = dnd.held[len(dnd.held)-dndMaxHeld:]
+	}
+	if on || len(dnd.held) == 0 {
+		return
+	}
+	held = dnd.held
+	dnd.held = nil
+	go dnd.release(held)
+}
+
+// Toggle turns do not disturb on if it is off, or off if it is on, and
+// reports whether it is now on.
+func (dnd *DoNotDisturb) Toggle() bool {
+	dnd.mu.Lock()
+	on := !dnd.on
+	dnd.mu.Unlock()
+	dnd.Set(on)
+	return on
+}
+
+// Set turns do not disturb on or off. Turning it off sends the notifications
+// held on to be shown, in a new goroutine.
+func (dnd *DoNotDisturb) Set(on bool) {
+	dnd.mu.Lock()
+	defer dnd.mu.Unlock()
+	if dnd.on == on {
+		return
+	}
+	dnd.on = on
+	if on || len(dnd.held) == 0 {
+		return
+	}
+	held := dnd.held
+	dnd.held = nil
+	go dnd.release(held)
+}
+
+// release sends the notifications held on to be shown, as chosen by End.
+func (dnd *DoNotDisturb) release(held []heldNotification) {
+	if dnd.End != DNDReplay {
+		notes := make([]*registry.Notification, len(held))
+		for i, h := range held {
+			notes[i] = h.note
+		}
+		slog.Info("gntp: showing summary of notifications held for do not disturb", "count", len(notes))
+		dnd.out <- buildDNDSummary(notes)
+		return
+	}
+
+	expired := time.Now().Add(-dnd.MaxAge)
+	replayed := 0
+	for _, h := range held {
+		if dnd.MaxAge > 0 && h.received.Before(expired) {
+			slog.Debug("gntp: not replaying expired notification", "app", h.note.App.Name, "name", h.note.Name, "id", h.note.Id)
+			continue
+		}
+		dnd.out <- h.note
+		replayed++
+	}
+	slog.Info("gntp: replayed notifications held for do not disturb", "count", replayed, "expired", len(held)-replayed)
+}
+
+// buildDNDSummary builds a single Notification summarizing notes, held while
+// do not disturb was on.
+func buildDNDSummary(notes []*registry.Notification) *registry.Notification {
+	title := "1 notification while do not disturb was on"
+	if len(notes) != 1 {
+		title = fmt.Sprintf("%d notifications while do not disturb was on", len(notes))
+	}
+	summary := buildSummary("Do Not Disturb", "dnd", title, notes)
+	summary.Priority = 0
+	return summary
+}
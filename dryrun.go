@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+)
+
+// dryRunBackend logs the notifications it is given, in place of the Backend
+// named name, instead of showing them, for -dry-run.
+type dryRunBackend struct {
+	name string
+	// primary is whether it stands in for the Backend displaying
+	// notifications, which reports what happens to them.
+	primary bool
+}
+
+// Show logs what note would have been shown as. If it stands in for the
+// primary Backend, it reports that note was closed.
+func (backend dryRunBackend) Show(note *registry.Notification) {
+	slog.Info("gntp: dry run, not showing notification", "backend", backend.name,
+		"app", note.App.Name, "name", note.Name, "id", note.Id,
+		"title", note.Title, "text", note.Text, "icon", note.Icon,
+		"priority", note.Priority, "sticky", note.Sticky)
+	if backend.primary {
+		note.SendCallback(registry.CallbackClosed)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Package e2e provides an end-to-end test harness for gntp_notify.
+
+It starts a private D-Bus session bus, with a fake
+org.freedesktop.Notifications service on it, and runs gntp_notify against
+that bus. Requests are sent over real GNTP connections, and what would have
+been displayed can be inspected, all without a desktop session.
+
+	bus, err := e2e.StartBus()
+	defer bus.Close()
+	fake, err := e2e.NewFakeNotifications(bus)
+	daemon, err := e2e.StartDaemon("./gntp_notify", bus)
+	defer daemon.Close()
+	resp, err := e2e.Send(daemon.Addr, request)
+	shown, err := fake.Next(5 * time.Second)
+*/
+package e2e
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Bus represents a private D-Bus session bus.
+type Bus struct {
+	Address string
+	cmd     *exec.Cmd
+}
+
+// StartBus starts a new dbus-daemon and returns once it is accepting
+// connections.
+func StartBus() (*Bus, error) {
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address=1")
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// dbus-daemon prints its address once it is ready.
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.New("e2e: dbus-daemon did not report an address")
+	}
+
+	return &Bus{strings.TrimSpace(address), cmd}, nil
+}
+
+// Env returns the environment for processes that should use the Bus as their
+// session bus.
+func (bus *Bus) Env() []string {
+	env := []string{"DBUS_SESSION_BUS_ADDRESS=" + bus.Address}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "DBUS_SESSION_BUS_ADDRESS=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// Close stops the dbus-daemon.
+func (bus *Bus) Close() error {
+	if err := bus.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	bus.cmd.Wait()
+	return nil
+}
@@ -0,0 +1,105 @@
+package e2e
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Daemon represents a running gntp_notify process.
+type Daemon struct {
+	Addr     string
+	cacheDir string
+	cmd      *exec.Cmd
+}
+
+// freeAddr finds a free TCP port on the loopback interface.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// StartDaemon runs the gntp_notify binary at path, with bus as its session
+// bus, a fresh cache directory and a free port on the loopback interface, and
+// waits for it to accept connections. Any extra args are passed to
+// gntp_notify.
+func StartDaemon(path string, bus *Bus, args ...string) (*Daemon, error) {
+	addr, err := freeAddr()
+	if err != nil {
+		return nil, err
+	}
+	cacheDir, err := ioutil.TempDir("", "gntp_e2e")
+	if err != nil {
+		return nil, err
+	}
+
+	args = append([]string{"-cachedir", cacheDir, "-addr", addr}, args...)
+	cmd := exec.Command(path, args...)
+	cmd.Env = bus.Env()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(cacheDir)
+		return nil, err
+	}
+
+	daemon := &Daemon{addr, cacheDir, cmd}
+	if err := daemon.waitReady(5 * time.Second); err != nil {
+		daemon.Close()
+		return nil, err
+	}
+	return daemon, nil
+}
+
+// waitReady polls the Daemon's address until it accepts a connection.
+func (daemon *Daemon) waitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", daemon.Addr); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("e2e: gntp_notify did not start listening on " + daemon.Addr)
+}
+
+// Close stops the Daemon and removes its cache directory.
+func (daemon *Daemon) Close() error {
+	defer os.RemoveAll(daemon.cacheDir)
+	if err := daemon.cmd.Process.Signal(os.Interrupt); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- daemon.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		daemon.cmd.Process.Kill()
+		return errors.New("e2e: gntp_notify did not exit")
+	}
+}
+
+// Send sends the raw GNTP request to addr and returns the raw response.
+func Send(addr, request string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return "", err
+	}
+	resp, err := ioutil.ReadAll(conn)
+	return string(resp), err
+}
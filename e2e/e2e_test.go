@@ -0,0 +1,294 @@
+package e2e
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timeout is how long to wait for each notification.
+const timeout = 5 * time.Second
+
+// daemonPath is the gntp_notify binary built by TestMain, or the empty
+// string if the scenarios can't be run.
+var daemonPath string
+
+// env is the environment each scenario runs in.
+type env struct {
+	fake   *FakeNotifications
+	daemon *Daemon
+}
+
+// scenario is a single end-to-end check.
+type scenario struct {
+	name string
+	run  func(*env) error
+}
+
+const registerRequest = "GNTP/1.0 REGISTER NONE\r\n" +
+	"Application-Name: E2E\r\n" +
+	"Notifications-Count: 1\r\n" +
+	"\r\n" +
+	"Notification-Name: Test\r\n" +
+	"Notification-Enabled: True\r\n" +
+	"\r\n"
+
+// notifyRequest builds a NOTIFY request for the E2E application.
+func notifyRequest(title, text string) string {
+	return "GNTP/1.0 NOTIFY NONE\r\n" +
+		"Application-Name: E2E\r\n" +
+		"Notification-Name: Test\r\n" +
+		"Notification-Title: " + title + "\r\n" +
+		"Notification-Text: " + text + "\r\n" +
+		"\r\n"
+}
+
+// expectOK sends request and checks for an -OK response.
+func expectOK(e *env, request string) error {
+	resp, err := Send(e.daemon.Addr, request)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "GNTP/1.0 -OK") {
+		return fmt.Errorf("expected -OK response, got %q", resp)
+	}
+	return nil
+}
+
+var scenarios = []scenario{
+	{"register and notify", func(e *env) error {
+		if err := expectOK(e, registerRequest); err != nil {
+			return err
+		}
+		if err := expectOK(e, notifyRequest("Hello", "World")); err != nil {
+			return err
+		}
+		shown, err := e.fake.Next(timeout)
+		if err != nil {
+			return err
+		}
+		if shown.AppName != "E2E" || shown.Summary != "Hello" || shown.Body != "World" {
+			return fmt.Errorf("unexpected notification %+v", shown)
+		}
+		return nil
+	}},
+	{"html text", func(e *env) error {
+		if err := expectOK(e, notifyRequest("Hello", "<p><strong>Bold</strong> &amp; <font>plain</font></p>")); err != nil {
+			return err
+		}
+		shown, err := e.fake.Next(timeout)
+		if err != nil {
+			return err
+		}
+		if shown.Body != "<b>Bold</b> &amp; &lt;font&gt;plain&lt;/font&gt;" {
+			return fmt.Errorf("unexpected body %q", shown.Body)
+		}
+		return nil
+	}},
+	{"custom headers", func(e *env) error {
+		request := strings.Replace(notifyRequest("Hello", "World"), "\r\n\r\n",
+			"\r\nX-Ticket: 42\r\nData-Thread: abc\r\n\r\n", 1)
+		resp, err := Send(e.daemon.Addr, request)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(resp, "Data-Thread: abc\r\n") {
+			return fmt.Errorf("expected Data-Thread in response, got %q", resp)
+		}
+		shown, err := e.fake.Next(timeout)
+		if err != nil {
+			return err
+		}
+		if hint, ok := shown.Hints["x-gntp-x-ticket"]; !ok || hint.Value() != "42" {
+			return fmt.Errorf("expected x-gntp-x-ticket hint, got %v", shown.Hints)
+		}
+		return nil
+	}},
+	{"unknown application", func(e *env) error {
+		resp, err := Send(e.daemon.Addr, strings.Replace(notifyRequest("Hello", "World"), "E2E", "Unknown", 1))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(resp, "GNTP/1.0 -ERROR") {
+			return fmt.Errorf("expected -ERROR response, got %q", resp)
+		}
+		if shown, err := e.fake.Next(timeout / 5); err == nil {
+			return fmt.Errorf("unexpected notification %+v", shown)
+		}
+		return nil
+	}},
+	{"socket callback", func(e *env) error {
+		request := strings.Replace(notifyRequest("Hello", "World"), "\r\n\r\n",
+			"\r\nNotification-Callback-Context: ctx\r\nNotification-Callback-Context-Type: string\r\n\r\n", 1)
+		responses := make(chan string, 1)
+		errs := make(chan error, 1)
+		go func() {
+			resp, err := Send(e.daemon.Addr, request)
+			if err != nil {
+				errs <- err
+			}
+			responses <- resp
+		}()
+
+		shown, err := e.fake.Next(timeout)
+		if err != nil {
+			return err
+		}
+		if err := e.fake.Dismiss(shown.Id, 2); err != nil {
+			return err
+		}
+
+		select {
+		case err := <-errs:
+			return err
+		case resp := <-responses:
+			if !strings.Contains(resp, "-CALLBACK") || !strings.Contains(resp, "Notification-Callback-Result: CLOSED") {
+				return fmt.Errorf("expected CLOSED callback, got %q", resp)
+			}
+		}
+		return nil
+	}},
+	{"callback action", func(e *env) error {
+		request := strings.Replace(notifyRequest("Hello", "World"), "\r\n\r\n",
+			"\r\nNotification-Callback-Context: ctx\r\nNotification-Callback-Context-Type: string\r\n"+
+				"X-Notification-Action: reply=Reply\r\n\r\n", 1)
+		responses := make(chan string, 1)
+		errs := make(chan error, 1)
+		go func() {
+			resp, err := Send(e.daemon.Addr, request)
+			if err != nil {
+				errs <- err
+			}
+			responses <- resp
+		}()
+
+		shown, err := e.fake.Next(timeout)
+		if err != nil {
+			return err
+		}
+		if strings.Join(shown.Actions, ",") != "default,Open,reply,Reply" {
+			return fmt.Errorf("unexpected actions %q", shown.Actions)
+		}
+		if err := e.fake.Invoke(shown.Id, "reply"); err != nil {
+			return err
+		}
+
+		select {
+		case err := <-errs:
+			return err
+		case resp := <-responses:
+			if !strings.Contains(resp, "Notification-Callback-Result: CLICKED") ||
+				!strings.Contains(resp, "X-Notification-Callback-Action: reply") {
+				return fmt.Errorf("expected CLICKED callback for reply, got %q", resp)
+			}
+		}
+		return nil
+	}},
+	{"coalescing", func(e *env) error {
+		request := func(title string) string {
+			return strings.Replace(notifyRequest(title, "World"), "\r\n\r\n",
+				"\r\nNotification-Coalescing-ID: progress\r\n\r\n", 1)
+		}
+		if err := expectOK(e, request("First")); err != nil {
+			return err
+		}
+		first, err := e.fake.Next(timeout)
+		if err != nil {
+			return err
+		}
+		if err := expectOK(e, request("Second")); err != nil {
+			return err
+		}
+		second, err := e.fake.Next(timeout)
+		if err != nil {
+			return err
+		}
+		if second.Summary != "Second" || second.ReplacesId != first.Id {
+			return fmt.Errorf("expected notification %d to be replaced, got %+v", first.Id, second)
+		}
+		return nil
+	}},
+	{"malformed request", func(e *env) error {
+		resp, err := Send(e.daemon.Addr, "GNTP/1.0 NOTIFY\r\n\r\n")
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(resp, "GNTP/1.0 -ERROR") {
+			return errors.New("expected -ERROR response, got " + resp)
+		}
+		return nil
+	}},
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+// runTests builds gntp_notify, with the D-Bus backend, to run the scenarios
+// against, unless there is no dbus-daemon to start a bus with, or only short
+// tests are run, then runs the tests.
+func runTests(m *testing.M) int {
+	flag.Parse()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil || testing.Short() {
+		return m.Run()
+	}
+
+	dir, err := ioutil.TempDir("", "gntp_e2e")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create build directory: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gntp_notify")
+	cmd := exec.Command("go", "build", "-tags", "nolibnotify", "-o", path, "..")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not build gntp_notify: %v\n", err)
+		return 1
+	}
+	daemonPath = path
+
+	return m.Run()
+}
+
+// TestScenarios runs every scenario, in order, against a single gntp_notify
+// with a private bus and a fake notification daemon.
+func TestScenarios(t *testing.T) {
+	if daemonPath == "" {
+		t.Skip("dbus-daemon not found, or running short tests")
+	}
+
+	bus, err := StartBus()
+	if err != nil {
+		t.Fatalf("could not start bus: %v", err)
+	}
+	defer bus.Close()
+
+	fake, err := NewFakeNotifications(bus)
+	if err != nil {
+		t.Fatalf("could not start fake notification daemon: %v", err)
+	}
+	defer fake.Disconnect()
+
+	daemon, err := StartDaemon(daemonPath, bus)
+	if err != nil {
+		t.Fatalf("could not start gntp_notify: %v", err)
+	}
+	defer daemon.Close()
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.run(&env{fake, daemon}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
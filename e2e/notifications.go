@@ -0,0 +1,153 @@
+package e2e
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+const (
+	notificationsName  = "org.freedesktop.Notifications"
+	notificationsPath  = "/org/freedesktop/Notifications"
+	notificationsIface = "org.freedesktop.Notifications"
+)
+
+// Shown represents a notification sent to the fake notification daemon.
+type Shown struct {
+	Id         uint32
+	AppName    string
+	ReplacesId uint32
+	Icon       string
+	Summary    string
+	Body       string
+	Actions    []string
+	Hints      map[string]dbus.Variant
+	Timeout    int32
+}
+
+// FakeNotifications implements the org.freedesktop.Notifications D-Bus
+// service, recording every notification instead of displaying it.
+type FakeNotifications struct {
+	conn         *dbus.Conn
+	capabilities []string
+
+	mu     sync.Mutex
+	lastId uint32
+	shown  chan *Shown
+}
+
+// NewFakeNotifications connects to bus and registers a FakeNotifications as
+// its notification daemon.
+func NewFakeNotifications(bus *Bus) (*FakeNotifications, error) {
+	conn, err := dbus.Dial(bus.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	fake := &FakeNotifications{
+		conn:         conn,
+		capabilities: []string{"actions", "body", "body-markup", "icon-static", "persistence", "sound"},
+		shown:        make(chan *Shown, 64),
+	}
+	if err = conn.Export(service{fake}, notificationsPath, notificationsIface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := conn.RequestName(notificationsName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, errors.New("e2e: " + notificationsName + " already owned")
+	}
+
+	return fake, nil
+}
+
+// SetCapabilities sets the capabilities reported by GetCapabilities.
+func (fake *FakeNotifications) SetCapabilities(capabilities []string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.capabilities = capabilities
+}
+
+// service holds the methods exported on the bus, keeping them apart from
+// those used by the harness.
+type service struct {
+	fake *FakeNotifications
+}
+
+// GetCapabilities implements org.freedesktop.Notifications.GetCapabilities.
+func (s service) GetCapabilities() ([]string, *dbus.Error) {
+	s.fake.mu.Lock()
+	defer s.fake.mu.Unlock()
+	return s.fake.capabilities, nil
+}
+
+// Notify implements org.freedesktop.Notifications.Notify.
+func (s service) Notify(appName string, replacesId uint32, icon, summary, body string, actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	s.fake.mu.Lock()
+	id := replacesId
+	if id == 0 {
+		s.fake.lastId++
+		id = s.fake.lastId
+	}
+	s.fake.mu.Unlock()
+
+	s.fake.shown <- &Shown{id, appName, replacesId, icon, summary, body, actions, hints, timeout}
+	return id, nil
+}
+
+// CloseNotification implements org.freedesktop.Notifications.CloseNotification.
+func (s service) CloseNotification(id uint32) *dbus.Error {
+	if err := s.fake.Dismiss(id, 3); err != nil {
+		return dbus.NewError("org.freedesktop.DBus.Error.Failed", []interface{}{err.Error()})
+	}
+	return nil
+}
+
+// GetServerInformation implements
+// org.freedesktop.Notifications.GetServerInformation.
+func (s service) GetServerInformation() (string, string, string, string, *dbus.Error) {
+	return "e2e", "gntp_notify", "0", "1.2", nil
+}
+
+// Next waits up to timeout for the next notification to be shown.
+func (fake *FakeNotifications) Next(timeout time.Duration) (*Shown, error) {
+	select {
+	case shown := <-fake.shown:
+		return shown, nil
+	case <-time.After(timeout):
+		return nil, errors.New("e2e: timed out waiting for a notification")
+	}
+}
+
+// Invoke emits the ActionInvoked signal, as if the user clicked the action
+// button with key on notification id.
+func (fake *FakeNotifications) Invoke(id uint32, key string) error {
+	return fake.conn.Emit(notificationsPath, notificationsIface+".ActionInvoked", id, key)
+}
+
+// Dismiss emits the NotificationClosed signal, as if notification id was
+// closed for the given reason (1 expired, 2 dismissed, 3 closed by call).
+func (fake *FakeNotifications) Dismiss(id, reason uint32) error {
+	return fake.conn.Emit(notificationsPath, notificationsIface+".NotificationClosed", id, reason)
+}
+
+// Disconnect disconnects the FakeNotifications from the bus.
+func (fake *FakeNotifications) Disconnect() error {
+	return fake.conn.Close()
+}
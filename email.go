@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// emailMessage is a notification waiting to be emailed to the addresses in
+// to.
+type emailMessage struct {
+	note *registry.Notification
+	to   string
+}
+
+// emailBackend is a Backend that emails notifications through an SMTP
+// server, in the background.
+type emailBackend struct {
+	opts *BackendOptions
+	// server is the SMTP server, as host:port, and auth how to log in to
+	// it, if at all.
+	server string
+	auth   smtp.Auth
+	from   *mail.Address
+	// to are the comma separated addresses notifications are sent to.
+	to *AppTargets
+	// batch, if more than 0, is how long notifications are collected for
+	// to be sent together in a single email to each recipient.
+	batch time.Duration
+	queue chan emailMessage
+}
+
+// NewEmailBackend builds a Backend that emails notifications from the
+// address from to the addresses for their application in to, through the
+// SMTP server at addr, logging in as user with password, if user is not
+// empty. Icons are attached, found as set by opts. If batch is more than 0,
+// the notifications for each recipient are collected and emailed together
+// once every batch.
+func NewEmailBackend(opts *BackendOptions, addr, user, password string, from *mail.Address, to *AppTargets, batch time.Duration) Backend {
+	backend := &emailBackend{
+		opts:   opts,
+		server: addr,
+		from:   from,
+		to:     to,
+		batch:  batch,
+		queue:  make(chan emailMessage, webhookQueueSize),
+	}
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		backend.auth = smtp.PlainAuth("", user, password, host)
+	}
+	go backend.run()
+	return backend
+}
+
+// Show queues note to be emailed to the addresses for its application, if
+// any.
+func (backend *emailBackend) Show(note *registry.Notification) {
+	to := backend.to.target(note.App.Name)
+	if to == "" {
+		return
+	}
+	select {
+	case backend.queue <- emailMessage{note, to}:
+	default:
+		slog.Warn("gntp: email queue full, dropping notification", "app", note.App.Name, "name", note.Name)
+		notificationsFailed.Inc("email")
+	}
+}
+
+// run emails each notification from the queue, or collects them to email in
+// batches.
+func (backend *emailBackend) run() {
+	if backend.batch <= 0 {
+		for msg := range backend.queue {
+			backend.deliver(msg.to, []*registry.Notification{msg.note})
+		}
+		return
+	}
+
+	batches := make(map[string][]*registry.Notification)
+	ticker := time.NewTicker(backend.batch)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-backend.queue:
+			batches[msg.to] = append(batches[msg.to], msg.note)
+		case <-ticker.C:
+			for to, notes := range batches {
+				backend.deliver(to, notes)
+			}
+			batches = make(map[string][]*registry.Notification)
+		}
+	}
+}
+
+// deliver emails notes to the comma separated addresses in to, counting
+// whether they were sent.
+func (backend *emailBackend) deliver(to string, notes []*registry.Notification) {
+	if err := backend.send(to, notes); err != nil {
+		slog.Warn("gntp: could not email notifications", "to", to, "count", len(notes), "err", err)
+		notificationsFailed.Add(float64(len(notes)), "email")
+		return
+	}
+	slog.Debug("gntp: emailed notifications", "to", to, "count", len(notes))
+	notificationsShown.Add(float64(len(notes)), "email")
+}
+
+// send emails notes to the comma separated addresses in to: a single note as
+// its title and text, with its icon attached, or several as a list.
+func (backend *emailBackend) send(to string, notes []*registry.Notification) error {
+	recipients, err := mail.ParseAddressList(to)
+	if err != nil {
+		return err
+	}
+
+	var subject string
+	var text strings.Builder
+	var icon string
+	if len(notes) == 1 {
+		note := notes[0]
+		subject = note.Title
+		text.WriteString(note.Text)
+		if text.Len() > 0 {
+			text.WriteString("\n\n")
+		}
+		fmt.Fprintf(&text, "-- \n%s: %s\n", note.App.Name, note.Name)
+		icon = iconFileName(note, backend.opts.Cache, backend.opts.IconDirs)
+	} else {
+		subject = fmt.Sprintf("%d notifications", len(notes))
+		for _, note := range notes {
+			fmt.Fprintf(&text, "%s: %s\n", note.App.Name, note.Title)
+			if note.Text != "" {
+				text.WriteString(note.Text + "\n")
+			}
+			text.WriteString("\n")
+		}
+	}
+
+	msg, err := buildEmail(backend.from, recipients, subject, text.String(), icon)
+	if err != nil {
+		return err
+	}
+	addrs := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		addrs[i] = recipient.Address
+	}
+	return smtp.SendMail(backend.server, backend.auth, backend.from.Address, addrs, msg)
+}
+
+// buildEmail builds an email from from to recipients with subject and text,
+// attaching the file icon, if not empty and it can be read.
+func buildEmail(from *mail.Address, recipients []*mail.Address, subject, text, icon string) ([]byte, error) {
+	var msg bytes.Buffer
+	id := make([]byte, 16)
+	rand.Read(id)
+	domain := "localhost"
+	if i := strings.LastIndex(from.Address, "@"); i >= 0 {
+		domain = from.Address[i+1:]
+	}
+	to := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		to[i] = recipient.String()
+	}
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	var body bytes.Buffer
+	qp := quotedprintable.NewWriter(&body)
+	qp.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	qp.Close()
+	textHeader := textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	}
+
+	var data []byte
+	if icon != "" {
+		var err error
+		if data, err = ioutil.ReadFile(icon); err != nil {
+			slog.Warn("gntp: could not attach icon to email", "icon", icon, "err", err)
+			icon = ""
+		}
+	}
+	if icon == "" {
+		fmt.Fprintf(&msg, "Content-Type: %s\r\n", textHeader.Get("Content-Type"))
+		fmt.Fprintf(&msg, "Content-Transfer-Encoding: %s\r\n\r\n", textHeader.Get("Content-Transfer-Encoding"))
+		msg.Write(body.Bytes())
+		return msg.Bytes(), nil
+	}
+
+	form := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", form.Boundary())
+	w, err := form.CreatePart(textHeader)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(body.Bytes())
+	if w, err = form.CreatePart(attachmentHeader(icon, data)); err != nil {
+		return nil, err
+	}
+	w.Write(base64Lines(data))
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// attachmentHeader gives the header of the attachment of data from the file
+// at path.
+func attachmentHeader(path string, data []byte) textproto.MIMEHeader {
+	name := filepath.Base(path)
+	return textproto.MIMEHeader{
+		"Content-Type":              {http.DetectContentType(data)},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+	}
+}
+
+// base64Lines encodes data as base64, in lines of 76 characters.
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var out bytes.Buffer
+	for len(encoded) > 76 {
+		out.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	out.WriteString(encoded + "\r\n")
+	return out.Bytes()
+}
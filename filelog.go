@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// FileLogFormats are the formats a file log backend can write: "json", a
+// WebhookPayload on each line, or "text", a line of text.
+var FileLogFormats = []string{"json", "text"}
+
+// fileLogBackend is a Backend that appends each notification to a file, in
+// the background, rotating it once it grows too large.
+type fileLogBackend struct {
+	path   string
+	format string
+	file   *rotatingFile
+	queue  chan *registry.Notification
+}
+
+// NewFileLogBackend builds a Backend that appends each notification to the
+// file at path, in format, one of FileLogFormats. Once it grows past maxSize
+// bytes, if more than 0, the file is rotated, keeping keep old files.
+func NewFileLogBackend(path, format string, maxSize int64, keep int) (Backend, error) {
+	valid := false
+	for _, f := range FileLogFormats {
+		valid = valid || f == format
+	}
+	if !valid {
+		return nil, errors.New("unknown notification log format " + format)
+	}
+	file, err := openRotatingFile(path, maxSize, keep)
+	if err != nil {
+		return nil, err
+	}
+	file.onRotate = func(err error) {
+		if err != nil {
+			slog.Warn("gntp: could not rotate notification log", "file", path, "err", err)
+			return
+		}
+		slog.Debug("gntp: rotated notification log", "file", path)
+	}
+	backend := &fileLogBackend{
+		path:   path,
+		format: format,
+		file:   file,
+		queue:  make(chan *registry.Notification, webhookQueueSize),
+	}
+	go backend.run()
+	return backend, nil
+}
+
+// Show queues note to be written to the file.
+func (backend *fileLogBackend) Show(note *registry.Notification) {
+	select {
+	case backend.queue <- note:
+	default:
+		slog.Warn("gntp: notification log queue full, dropping notification", "app", note.App.Name, "name", note.Name)
+		notificationsFailed.Inc("file")
+	}
+}
+
+// run writes each notification from the queue.
+func (backend *fileLogBackend) run() {
+	for note := range backend.queue {
+		if err := backend.write(note); err != nil {
+			slog.Warn("gntp: could not write notification to log", "file", backend.path, "app", note.App.Name, "name", note.Name, "err", err)
+			notificationsFailed.Inc("file")
+			continue
+		}
+		notificationsShown.Inc("file")
+	}
+}
+
+// fileLogLine formats note as a line of the log, in format.
+func fileLogLine(note *registry.Notification, format string) ([]byte, error) {
+	if format == "json" {
+		data, err := json.Marshal(newWebhookPayload(note))
+		return append(data, '\n'), err
+	}
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %s/%s [%d] %s", time.Now().Format(time.RFC3339), note.App.Name, note.Name, note.Priority, note.Title)
+	if note.Text != "" {
+		line.WriteString(": " + note.Text)
+	}
+	return []byte(strings.ReplaceAll(line.String(), "\n", " ") + "\n"), nil
+}
+
+// write appends note to the file.
+func (backend *fileLogBackend) write(note *registry.Notification) error {
+	line, err := fileLogLine(note, backend.format)
+	if err != nil {
+		return err
+	}
+	_, err = backend.file.Write(line)
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"io/ioutil"
+	"net"
+	"regexp"
+)
+
+// The actions of a FilterRule.
+const (
+	// FilterShow shows the notification as usual.
+	FilterShow = "show"
+	// FilterSuppress doesn't show the notification.
+	FilterSuppress = "suppress"
+	// FilterLogOnly doesn't show the notification, but logs it.
+	FilterLogOnly = "log-only"
+	// FilterReroute doesn't show the notification, but forwards it to
+	// another GNTP server.
+	FilterReroute = "reroute"
+)
+
+// Filters holds the user's rules for which notifications are shown. They are
+// read from a JSON file:
+//
+//	{
+//	  "rules": [
+//	    {"application": "Mail", "title": "(?i)newsletter", "action": "suppress"},
+//	    {"application": "Build", "notification": "Failed", "action": "show"},
+//	    {"application": "Build", "action": "reroute", "to": "secret@desktop"},
+//	    {"from": "192.168.0.0/16", "action": "log-only"}
+//	  ]
+//	}
+//
+// The first rule matching a notification decides what happens to it;
+// notifications matching no rule are shown.
+type Filters struct {
+	Rules []*FilterRule `json:"rules"`
+}
+
+// FilterRule is a rule matching notifications, and what to do with them. The
+// notifications matched are those matching every one of Application,
+// Notification, Title, Text and From given.
+type FilterRule struct {
+	// Application, if not empty, is the name of the application matched.
+	Application string `json:"application"`
+	// Notification, if not empty, is the name of the notification type
+	// matched.
+	Notification string `json:"notification"`
+	// Title and Text, if not empty, are regular expressions matching some
+	// of the title and text of the notifications matched.
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	// From, if not empty, is the address, or network in CIDR notation, the
+	// notifications matched came from. Those received on a Unix socket come
+	// from 127.0.0.1.
+	From string `json:"from"`
+	// Action is what to do with the notifications matched: FilterShow,
+	// FilterSuppress, FilterLogOnly or FilterReroute.
+	Action string `json:"action"`
+	// To is the GNTP server notifications are rerouted to, given as
+	// [password@]host[:port].
+	To string `json:"to"`
+
+	// title and text are Title and Text compiled.
+	title, text *regexp.Regexp
+	// from is From parsed.
+	from *net.IPNet
+	// target is To parsed.
+	target ForwardTarget
+	// forward forwards the notifications rerouted, once rerouting has
+	// started.
+	forward *Forwarder
+}
+
+// LoadFilters reads Filters from the JSON file at path.
+func LoadFilters(path string) (*Filters, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	filters := new(Filters)
+	if err := dec.Decode(filters); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range filters.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %d: empty rule", i+1)
+		}
+		if err := rule.init(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return filters, nil
+}
+
+// init checks the action of rule, compiles its regular expressions, and
+// parses its network and target.
+func (rule *FilterRule) init() (err error) {
+	switch rule.Action {
+	case FilterShow, FilterSuppress, FilterLogOnly:
+		if rule.To != "" {
+			return errors.New("only rules that reroute have a target")
+		}
+	case FilterReroute:
+		var targets ForwardTargets
+		if err := targets.Set(rule.To); err != nil {
+			return fmt.Errorf("target %q: %w", rule.To, err)
+		}
+		rule.target = targets[0]
+	default:
+		return errors.New("unknown action " + rule.Action + " (available: show, suppress, log-only, reroute)")
+	}
+	if rule.Title != "" {
+		if rule.title, err = regexp.Compile(rule.Title); err != nil {
+			return err
+		}
+	}
+	if rule.Text != "" {
+		if rule.text, err = regexp.Compile(rule.Text); err != nil {
+			return err
+		}
+	}
+	if rule.From != "" {
+		if rule.from, err = server.ParseNetwork(rule.From); err != nil {
+			return fmt.Errorf("from %q: %w", rule.From, err)
+		}
+	}
+	return nil
+}
+
+// StartRerouting starts forwarding the notifications rerouted by the rules,
+// with a Forwarder for each target, reading binary data from binaries and
+// retrying up to retries times, or only logging them if dryRun is true.
+func (filters *Filters) StartRerouting(binaries server.Binaries, retries int, dryRun bool) {
+	forwarders := make(map[string]*Forwarder)
+	for _, rule := range filters.Rules {
+		if rule.Action != FilterReroute {
+			continue
+		}
+		fwd, ok := forwarders[rule.target.Addr]
+		if !ok {
+			fwd = NewForwarder([]ForwardTarget{rule.target}, binaries, retries)
+			fwd.DryRun = dryRun
+			forwarders[rule.target.Addr] = fwd
+		}
+		rule.forward = fwd
+	}
+}
+
+// Remember remembers the REGISTER request req for each target notifications
+// are rerouted to, so the application can be registered there before its
+// notifications are. A nil Filters has no rules.
+func (filters *Filters) Remember(req *server.Request) {
+	if filters == nil {
+		return
+	}
+	for _, rule := range filters.Rules {
+		if rule.forward != nil {
+			rule.forward.Remember(req)
+		}
+	}
+}
+
+// Match gives the first rule matching note, or nil if none does. A nil
+// Filters has no rules.
+func (filters *Filters) Match(note *registry.Notification) *FilterRule {
+	if filters == nil {
+		return nil
+	}
+	for _, rule := range filters.Rules {
+		if rule.matches(note) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matches reports whether rule matches note.
+func (rule *FilterRule) matches(note *registry.Notification) bool {
+	return (rule.Application == "" || rule.Application == note.App.Name) &&
+		(rule.Notification == "" || rule.Notification == note.Name) &&
+		(rule.title == nil || rule.title.MatchString(note.Title)) &&
+		(rule.text == nil || rule.text.MatchString(note.Text)) &&
+		(rule.from == nil || rule.from.Contains(remoteIP(note.RemoteAddr)))
+}
+
+// remoteIP gives the IP address a notification came from, given its remote
+// address, or the loopback address if it came through a Unix socket.
+func remoteIP(remoteAddr string) net.IP {
+	if ip := net.ParseIP(remoteHost(remoteAddr)); ip != nil {
+		return ip
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"testing"
+)
+
+func TestFilterRuleMatches(t *testing.T) {
+	app := &registry.Application{Name: "Mail"}
+	note := &registry.Notification{
+		App:        app,
+		Name:       "New Mail",
+		Title:      "From: Alice",
+		Text:       "Lunch at noon?",
+		RemoteAddr: "192.168.1.20:50000",
+	}
+	local := &registry.Notification{App: app, Name: "New Mail", RemoteAddr: "@"}
+
+	tests := []struct {
+		rule FilterRule
+		note *registry.Notification
+		want bool
+	}{
+		{FilterRule{}, note, true},
+		{FilterRule{Application: "Mail"}, note, true},
+		{FilterRule{Application: "mail"}, note, false},
+		{FilterRule{Application: "Mail", Notification: "New Mail"}, note, true},
+		{FilterRule{Application: "Mail", Notification: "Sent"}, note, false},
+		{FilterRule{Title: "^From: (Alice|Bob)$"}, note, true},
+		{FilterRule{Title: "Carol"}, note, false},
+		{FilterRule{Text: "(?i)LUNCH"}, note, true},
+		{FilterRule{Title: "Alice", Text: "dinner"}, note, false},
+		{FilterRule{From: "192.168.1.0/24"}, note, true},
+		{FilterRule{From: "192.168.1.20"}, note, true},
+		{FilterRule{From: "10.0.0.0/8"}, note, false},
+		{FilterRule{From: "127.0.0.1"}, local, true},
+		{FilterRule{From: "192.168.1.0/24"}, local, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		rule.Action = FilterSuppress
+		if err := rule.init(); err != nil {
+			t.Errorf("rule %+v: %v", tt.rule, err)
+			continue
+		}
+		if got := rule.matches(tt.note); got != tt.want {
+			t.Errorf("rule %+v matches %s from %q = %v, want %v", tt.rule, tt.note.Title, tt.note.RemoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestFiltersMatch(t *testing.T) {
+	filters := &Filters{Rules: []*FilterRule{
+		{Application: "Mail", Title: "Alice", Action: FilterShow},
+		{Application: "Mail", Action: FilterSuppress},
+	}}
+	for _, rule := range filters.Rules {
+		if err := rule.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		app, title string
+		want       *FilterRule
+	}{
+		{"Mail", "From: Alice", filters.Rules[0]},
+		{"Mail", "From: Bob", filters.Rules[1]},
+		{"Chat", "From: Alice", nil},
+	}
+	for _, tt := range tests {
+		note := &registry.Notification{App: &registry.Application{Name: tt.app}, Title: tt.title}
+		if got := filters.Match(note); got != tt.want {
+			t.Errorf("Match(%s, %q) = %+v, want %+v", tt.app, tt.title, got, tt.want)
+		}
+	}
+	if (*Filters)(nil).Match(&registry.Notification{App: &registry.Application{}}) != nil {
+		t.Error("a nil Filters matched")
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ForwardTarget represents a downstream GNTP server that requests are
+// forwarded to.
+type ForwardTarget struct {
+	Addr     string
+	Password string
+}
+
+// ForwardTargets implements flag.Value for a list of ForwardTargets, each
+// given as [password@]host[:port].
+type ForwardTargets []ForwardTarget
+
+// String returns the targets as they would be given on the command line,
+// without their passwords.
+func (targets *ForwardTargets) String() string {
+	addrs := make([]string, len(*targets))
+	for i, target := range *targets {
+		addrs[i] = target.Addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Set parses and adds a target.
+func (targets *ForwardTargets) Set(value string) error {
+	var target ForwardTarget
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		target.Password = value[:i]
+		value = value[i+1:]
+	}
+	if value == "" {
+		return errors.New("missing host")
+	}
+	// Downstream servers listen on the standard GNTP port unless told
+	// otherwise.
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		value = net.JoinHostPort(value, "23053")
+	}
+	target.Addr = value
+	*targets = append(*targets, target)
+	return nil
+}
+
+// forwardTimeout bounds connecting to, and exchanging a request with, a
+// target.
+const forwardTimeout = 10 * time.Second
+
+// forwardQueueSize is how many requests may wait to be forwarded to each
+// target before more are dropped.
+const forwardQueueSize = 64
+
+// Forwarder re-sends REGISTER and NOTIFY requests to ForwardTargets, and to
+// the clients subscribed to us. Each target has its own queue, so requests
+// reach it in the order they were received, and a slow target does not hold
+// up the others.
+type Forwarder struct {
+	// Subscribers, if not nil, are also forwarded every request, with the
+	// key derived from SubscriptionPassword and their Subscriber-ID, as GNTP
+	// asks. They must be set before requests are forwarded.
+	Subscribers          *registry.Subscribers
+	SubscriptionPassword string
+	// DryRun is whether requests are logged, rather than forwarded.
+	DryRun bool
+
+	addrs    []string // the addresses of the targets
+	binaries server.Binaries
+	retries  int
+	queues   []chan *server.Request
+	// origin, if not nil, describes this machine in the Received headers
+	// added to the requests forwarded.
+	origin *server.Origin
+
+	mu        sync.RWMutex
+	registers map[string]*server.Request
+	// subQueues are the queues of the subscribers, keyed by their id and
+	// address, started once a request is forwarded to them.
+	subQueues map[string]subscriberQueue
+}
+
+// subscriberQueue is the queue of requests to forward to a subscriber. Once
+// the subscription expires, done is closed to stop forwarding them; the
+// queue itself is never closed, as requests may still be sent on it.
+type subscriberQueue struct {
+	queue chan *server.Request
+	done  chan struct{}
+}
+
+// NewForwarder allocates and initializes a Forwarder, starting a goroutine
+// for each of targets. Binary data is read from binaries. Requests that could
+// not be delivered are retried up to retries times.
+func NewForwarder(targets []ForwardTarget, binaries server.Binaries, retries int) *Forwarder {
+	fwd := &Forwarder{
+		binaries:  binaries,
+		retries:   retries,
+		origin:    server.DefaultServer.Origin,
+		registers: make(map[string]*server.Request),
+		subQueues: make(map[string]subscriberQueue),
+	}
+	for _, target := range targets {
+		queue := make(chan *server.Request, forwardQueueSize)
+		fwd.queues = append(fwd.queues, queue)
+		fwd.addrs = append(fwd.addrs, target.Addr)
+		go fwd.run(target, queue, nil)
+	}
+	return fwd
+}
+
+// Forward queues req to be forwarded to every target and subscriber.
+// REGISTER requests are remembered, so they can be re-sent to targets that
+// forget the application, and to subscribers that don't know it yet.
+func (fwd *Forwarder) Forward(req *server.Request) {
+	fwd.Remember(req)
+	if fwd.DryRun {
+		to := append([]string(nil), fwd.addrs...)
+		if fwd.Subscribers != nil {
+			for _, sub := range fwd.Subscribers.All() {
+				to = append(to, net.JoinHostPort(sub.Host, strconv.Itoa(sub.Port)))
+			}
+		}
+		req.Logger().Info("gntp: dry run, not forwarding request", "to", to)
+		return
+	}
+
+	// The targets' queues are shared, so are copied before the subscribers'
+	// are added.
+	queues := append(append([]chan *server.Request(nil), fwd.queues...), fwd.subscriberQueues()...)
+	for _, queue := range queues {
+		select {
+		case queue <- req:
+		default:
+			req.Logger().Warn("gntp: forwarding queue full, dropping request")
+		}
+	}
+}
+
+// subscriberQueues gives the queues of the current subscribers, starting
+// those of new subscribers, and stopping forwarding to expired ones.
+func (fwd *Forwarder) subscriberQueues() []chan *server.Request {
+	if fwd.Subscribers == nil {
+		return nil
+	}
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	current := make(map[string]subscriberQueue)
+	for _, sub := range fwd.Subscribers.All() {
+		target := ForwardTarget{
+			Addr:     net.JoinHostPort(sub.Host, strconv.Itoa(sub.Port)),
+			Password: fwd.SubscriptionPassword + sub.Id,
+		}
+		key := sub.Id + "\x00" + target.Addr
+		sq, ok := fwd.subQueues[key]
+		if !ok {
+			sq = subscriberQueue{make(chan *server.Request, forwardQueueSize), make(chan struct{})}
+			go fwd.run(target, sq.queue, sq.done)
+		}
+		current[key] = sq
+	}
+	for key, sq := range fwd.subQueues {
+		if _, ok := current[key]; !ok {
+			close(sq.done)
+		}
+	}
+	fwd.subQueues = current
+
+	queues := make([]chan *server.Request, 0, len(current))
+	for _, sq := range current {
+		queues = append(queues, sq.queue)
+	}
+	return queues
+}
+
+// Remember remembers req, if it is a REGISTER request, to be sent to targets
+// that don't know the application before its notifications are.
+func (fwd *Forwarder) Remember(req *server.Request) {
+	if req.Type != "REGISTER" {
+		return
+	}
+	if name, ok := req.Headers[0].Get("Application-Name"); ok {
+		fwd.mu.Lock()
+		fwd.registers[name] = req
+		fwd.mu.Unlock()
+	}
+}
+
+// QueueDepth gets the number of requests waiting to be forwarded, across
+// every target and subscriber.
+func (fwd *Forwarder) QueueDepth() int {
+	depth := 0
+	for _, queue := range fwd.queues {
+		depth += len(queue)
+	}
+	fwd.mu.RLock()
+	for _, sq := range fwd.subQueues {
+		depth += len(sq.queue)
+	}
+	fwd.mu.RUnlock()
+	return depth
+}
+
+// register gets the remembered REGISTER request for the application named
+// name.
+func (fwd *Forwarder) register(name string) *server.Request {
+	fwd.mu.RLock()
+	defer fwd.mu.RUnlock()
+	return fwd.registers[name]
+}
+
+// run forwards each request from queue to target, until done is closed, if
+// not nil.
+func (fwd *Forwarder) run(target ForwardTarget, queue <-chan *server.Request, done <-chan struct{}) {
+	for {
+		var req *server.Request
+		select {
+		case req = <-queue:
+		case <-done:
+			return
+		}
+		err := fwd.deliver(target, req)
+		if errors.Is(err, server.GntpError{Code: server.CodeUnknownApplication}) && req.Type == "NOTIFY" {
+			// The target doesn't know the application (anymore); register
+			// it and try again.
+			name, _ := req.Headers[0].Get("Application-Name")
+			if register := fwd.register(name); register != nil {
+				if err = fwd.deliver(target, register); err == nil {
+					err = fwd.deliver(target, req)
+				}
+			}
+		}
+		if errors.Is(err, server.GntpError{Code: server.CodeAlreadyProcessed}) {
+			// The target forwarded req to us in the first place.
+			req.Logger().Debug("gntp: not forwarding request back", "target", target.Addr)
+		} else if err != nil {
+			req.Logger().Warn("gntp: could not forward request", "target", target.Addr, "err", err)
+		}
+	}
+}
+
+// deliver sends req to target, retrying with exponential backoff if the
+// target can't be reached. Errors returned by the target are not retried.
+func (fwd *Forwarder) deliver(target ForwardTarget, req *server.Request) error {
+	delay := time.Second
+	var err error
+	for attempt := 0; attempt <= fwd.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = fwd.send(target, req); err == nil {
+			return nil
+		}
+		if _, ok := server.AsGntpError(err); ok {
+			return err
+		}
+	}
+	return err
+}
+
+// send sends req to target and reads its response, returning a GntpError if
+// the target responds with -ERROR.
+func (fwd *Forwarder) send(target ForwardTarget, req *server.Request) error {
+	out, err := fwd.outgoing(target, req)
+	if err != nil {
+		return err
+	}
+	return sendRequest(target.Addr, out)
+}
+
+// sendRequest sends req, as it is, to the GNTP server at addr and reads its
+// response, returning a GntpError if the server responds with -ERROR.
+func sendRequest(addr string, req *server.Request) error {
+	conn, err := net.DialTimeout("tcp", addr, forwardTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	resp, err := server.ReadResponse(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	switch resp.Type {
+	case "OK":
+		return nil
+	case "ERROR":
+		return resp.Err()
+	}
+	return errors.New("unexpected -" + resp.Type + " response")
+}
+
+// forwardedHeader reports whether a header is forwarded. Socket callbacks can
+// only be answered by us, so they are not passed on.
+func forwardedHeader(key string) bool {
+	return !strings.HasPrefix(key, "Notification-Callback-Context")
+}
+
+// outgoing builds the request sent to target for req: authenticated with
+// target's password, without the headers that aren't forwarded, with the
+// data of any binaries it references, and with a Received header recording
+// that it passed through us.
+func (fwd *Forwarder) outgoing(target ForwardTarget, req *server.Request) (*server.Request, error) {
+	out := &server.Request{
+		Type:     req.Type,
+		Binaries: make(map[string]*server.Binary),
+	}
+	if target.Password != "" {
+		kh, err := server.NewKeyHash("SHA512", target.Password)
+		if err != nil {
+			return nil, err
+		}
+		out.KeyHash = kh
+	}
+
+	for i, header := range req.Headers {
+		forwarded := server.NewHeader()
+		for key, values := range header {
+			if !forwardedHeader(key) {
+				continue
+			}
+			for _, value := range values {
+				if binaryReference(value) {
+					// Only binaries we hold are sent on, and references
+					// to any others left out.
+					ident, ok := server.ResourceIdent(value)
+					if !ok || !fwd.binaries.Exists(ident) {
+						continue
+					}
+					data, err := fwd.binaries.Get(ident)
+					if err != nil {
+						return nil, err
+					}
+					out.Binaries[ident] = &server.Binary{Ident: ident, Length: int64(len(data)), Data: data}
+				}
+				forwarded.Add(key, value)
+			}
+		}
+		if i == 0 && fwd.origin != nil {
+			fwd.origin.AddReceived(forwarded, remoteHost(req.RemoteAddr))
+		}
+		out.Headers = append(out.Headers, forwarded)
+	}
+
+	return out, nil
+}
+
+// remoteHost gives the host a request came from, given its remote address,
+// or localhost if it came through a Unix socket.
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return "localhost"
+}
+
+// preventLoops is a server.Middleware refusing requests that have already
+// been received by the Server origin describes, as shown by their Received
+// headers. Otherwise, daemons forwarding to each other would pass the same
+// requests back and forth forever.
+func preventLoops(origin *server.Origin) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return server.HandlerFuncs{
+			ParseFunc: next.Parse,
+			RespondFunc: func(w server.ResponseWriter, req *server.Request) error {
+				if len(req.Headers) > 0 && origin.Received(req.Headers[0]) {
+					req.Logger().Warn("gntp: refusing request forwarded back to us", "received", req.Headers[0]["Received"])
+					return server.AlreadyProcessedError()
+				}
+				return next.Respond(w, req)
+			},
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/server"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutgoingBinaries(t *testing.T) {
+	files := cache.NewFileCache(filepath.Join(t.TempDir(), "cache"))
+	os.MkdirAll(files.Dir(), 0755)
+	if err := files.Put("abc", []byte("icon")); err != nil {
+		t.Fatal(err)
+	}
+	fwd := &Forwarder{binaries: files}
+
+	tests := []struct {
+		icon  string
+		ident string // the binary forwarded, if any
+	}{
+		{"https://example.com/icon.png", ""},
+		{"x-growl-resource://abc", "abc"},
+		{"X-Growl-Resource://abc", "abc"},
+		{"x-growl-resource://missing", ""},
+		{"x-growl-resource://../../etc/hostname", ""},
+	}
+	for _, tt := range tests {
+		header := server.NewHeader()
+		header.Set("Application-Name", "Test")
+		header.Set("Notification-Icon", tt.icon)
+		out, err := fwd.outgoing(ForwardTarget{}, &server.Request{Type: "NOTIFY", Headers: []server.Header{header}})
+		if err != nil {
+			t.Errorf("icon %q: %v", tt.icon, err)
+			continue
+		}
+		icon, _ := out.Headers[0].Get("Notification-Icon")
+		if tt.ident == "" {
+			if len(out.Binaries) != 0 {
+				t.Errorf("icon %q: forwarded binaries %v", tt.icon, out.Binaries)
+			}
+			if icon != "" && icon != tt.icon {
+				t.Errorf("icon %q: forwarded as %q", tt.icon, icon)
+			}
+			if icon != "" && binaryReference(icon) {
+				t.Errorf("icon %q: reference forwarded without its binary", tt.icon)
+			}
+			continue
+		}
+		if icon != tt.icon {
+			t.Errorf("icon %q: forwarded as %q", tt.icon, icon)
+		}
+		if b := out.Binaries[tt.ident]; b == nil || string(b.Data) != "icon" {
+			t.Errorf("icon %q: binary %q not forwarded", tt.icon, tt.ident)
+		}
+	}
+}
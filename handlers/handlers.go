@@ -0,0 +1,476 @@
+/*
+Package handlers provides the handlers of a GNTP server for the requests of
+GNTP clients: REGISTER and NOTIFY, and the UNREGISTER and SUBSCRIBE
+extensions.
+
+Applications registered are kept in a registry.Applications, and the binaries
+sent with requests in a cache.FileCache. What happens to each notification
+received is left to the program the handlers are used in, which gives it to
+the NotifyHandler's Dispatch:
+
+	apps := registry.NewApplications()
+	files := cache.NewFileCache(dir)
+	downloads := cache.NewDownloader(files, time.Minute, nil)
+	server.Register("REGISTER", &handlers.RegisterHandler{Apps: apps, Cache: files, Downloads: downloads})
+	server.Register("NOTIFY", &handlers.NotifyHandler{Apps: apps, Cache: files, Downloads: downloads, Dispatch: show})
+*/
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNotParsed is returned by handlers given a request their Parse didn't
+// return, so it lacks what Parse builds.
+var errNotParsed = errors.New("request not parsed by its handler")
+
+// RegisterHandler handles GNTP REGISTER requests, adding the applications
+// they register to Apps.
+type RegisterHandler struct {
+	Apps *registry.Applications
+	// Cache saves the binaries sent with requests, and records the
+	// applications using them.
+	Cache *cache.FileCache
+	// Downloads fetches the icons given by URL.
+	Downloads *cache.Downloader
+
+	// OnRegister, if not nil, is called with each request once its
+	// application is registered, such as to forward it.
+	OnRegister func(req *server.Request, app *registry.Application)
+}
+
+// Parse parses GNTP REGISTER requests. It reads the Application block, each
+// Notification block and any binary data sections.
+func (handler *RegisterHandler) Parse(b *bufio.Reader, req *server.Request) (*server.Request, error) {
+	if err := req.ReadRegister(b); err != nil {
+		return nil, err
+	}
+	if err := req.ReadBinaries(b, handler.Cache); err != nil {
+		return nil, err
+	}
+
+	req.Logger().Debug("gntp: parsed request", "request", req)
+
+	return req, nil
+}
+
+// buildApplication builds an Application (and it's corresponding notification
+// types) from a REGISTER request. Icons given by URL are fetched by downloads.
+func buildApplication(reg *server.RegisterRequest, downloads *cache.Downloader) *registry.Application {
+	app := &registry.Application{
+		Name:  reg.Application,
+		Icon:  reg.Icon,
+		Count: len(reg.Notifications),
+	}
+	if registry.RemoteIcon(app.Icon) {
+		// For any icon that's not a GNTP resource identifier or a local file,
+		// download it in the background.
+		downloads.Fetch(app.Icon)
+	}
+
+	app.Notifications = make(map[string]*registry.Notification, app.Count)
+	for _, nt := range reg.Notifications {
+		note := &registry.Notification{
+			App:     app,
+			Name:    nt.Name,
+			Display: nt.Display,
+			Enabled: nt.Enabled,
+		}
+
+		// Default to the application's icon.
+		note.Icon = app.Icon
+		if nt.Icon != "" {
+			// Use the notification icon, only if it is defined.
+			note.Icon = nt.Icon
+			if registry.RemoteIcon(note.Icon) {
+				// Download the icon if it's not a GNTP resource identifier or a
+				// local file. We should not move this outside the outer if block.
+				// We don't need to re-download the icon if it's the same as
+				// app.Icon.
+				downloads.Fetch(note.Icon)
+			}
+		}
+
+		app.Notifications[note.Name] = note
+	}
+
+	return app
+}
+
+// referenceFiles records in files that the application named app uses the
+// binaries sent with req, and those of icons downloaded by URL.
+func referenceFiles(files *cache.FileCache, app string, req *server.Request, icons ...string) {
+	for ident := range req.Binaries {
+		files.Reference(ident, app)
+	}
+	for _, icon := range icons {
+		if registry.RemoteIcon(icon) {
+			files.Reference(cache.URLKey(icon), app)
+		}
+	}
+}
+
+// Respond builds the Application (and Notification defaults) and writes the
+// response.
+func (handler *RegisterHandler) Respond(w server.ResponseWriter, req *server.Request) error {
+	// Require GNTP/1.0
+	if req.Version.Major != 1 || req.Version.Minor != 0 {
+		return server.UnknownProtocolVersionError(req.Version)
+	}
+
+	app := buildApplication(req.Register, handler.Downloads)
+	if handler.Apps.Add(app) {
+		req.Logger().Debug("gntp: replaced registered application", "app", app.Name)
+	}
+	icons := []string{app.Icon}
+	for _, note := range app.Notifications {
+		icons = append(icons, note.Icon)
+	}
+	referenceFiles(handler.Cache, app.Name, req, icons...)
+	req.Logger().Info("gntp: registered application", "app", app.Name, "notifications", len(app.Notifications))
+	if handler.OnRegister != nil {
+		handler.OnRegister(req, app)
+	}
+
+	// Write a simple Response.
+	w.Header().Set("Response-Action", "REGISTER")
+	return w.WriteHeader("OK")
+}
+
+// UnregisterHandler handles UNREGISTER requests, an extension to GNTP that
+// removes a registered application, given by its Application-Name header. Its
+// notifications are refused until it registers again.
+type UnregisterHandler struct {
+	Apps *registry.Applications
+}
+
+// unregisterKey is the key of the name of the application an UNREGISTER
+// request removes, in the Context of the request once parsed.
+type unregisterKey struct{}
+
+// Parse parses UNREGISTER requests. It reads the single block of Application
+// headers.
+func (handler *UnregisterHandler) Parse(b *bufio.Reader, req *server.Request) (*server.Request, error) {
+	header, err := req.ReadHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	req.Headers = []server.Header{header}
+	name, err := header.Require("Application-Name")
+	if err != nil {
+		return nil, err
+	}
+
+	req.Logger().Debug("gntp: parsed request", "request", req)
+
+	return req.WithContext(context.WithValue(req.Context(), unregisterKey{}, name)), nil
+}
+
+// Respond removes the application and writes the response.
+func (handler *UnregisterHandler) Respond(w server.ResponseWriter, req *server.Request) error {
+	if req.Version.Major != 1 || req.Version.Minor != 0 {
+		return server.UnknownProtocolVersionError(req.Version)
+	}
+
+	name, ok := req.Context().Value(unregisterKey{}).(string)
+	if !ok {
+		return errNotParsed
+	}
+	if !handler.Apps.Remove(name) {
+		return server.UnknownApplicationError(name)
+	}
+	req.Logger().Info("gntp: unregistered application", "app", name)
+
+	w.Header().Set("Response-Action", "UNREGISTER")
+	return w.WriteHeader("OK")
+}
+
+// NotifyHandler handles GNTP NOTIFY requests, for the applications in Apps.
+// Each notification received is given to Dispatch, which decides what
+// happens to it, and the client is told whether it was accepted, followed by
+// the result of its callback if it waits for one.
+type NotifyHandler struct {
+	Apps *registry.Applications
+	// Cache saves the binaries sent with requests, and records the
+	// applications using them.
+	Cache *cache.FileCache
+	// Downloads fetches the icons given by URL.
+	Downloads *cache.Downloader
+
+	// Dispatch decides what happens to each notification received, such as
+	// showing it, and must be set. It returns an error, such as a
+	// server.GntpError, to refuse the notification. Notifications it
+	// accepts without showing should have their callback sent, so the
+	// client isn't kept waiting for one.
+	Dispatch func(req *server.Request, note *registry.Notification) error
+}
+
+// Parse parses GNTP NOTIFY requests. It reads the Notification block and any
+// binary data sections.
+func (handler *NotifyHandler) Parse(b *bufio.Reader, req *server.Request) (*server.Request, error) {
+	if err := req.ReadNotify(b); err != nil {
+		return nil, err
+	}
+	if err := req.ReadBinaries(b, handler.Cache); err != nil {
+		return nil, err
+	}
+
+	req.Logger().Debug("gntp: parsed request", "request", req)
+
+	return req, nil
+}
+
+// buildNotification builds a Notification from a NOTIFY request, and its
+// Header block for the headers that aren't part of GNTP. Icons given by URL
+// are fetched by downloads.
+func buildNotification(apps *registry.Applications, n *server.NotifyRequest, header server.Header, downloads *cache.Downloader) (*registry.Notification, error) {
+	// Get any defaults specified during registration. The notification must
+	// be previously registered.
+	app, defaults, err := apps.NotificationType(n.Application, n.Name)
+	if err != nil {
+		return nil, err
+	}
+	note := &registry.Notification{
+		App:                 app,
+		Name:                n.Name,
+		Title:               n.Title,
+		Text:                n.Text,
+		Id:                  n.Id,
+		Enabled:             defaults.Enabled,
+		EnabledByUser:       defaults.EnabledByUser,
+		Sticky:              n.Sticky,
+		Priority:            n.Priority,
+		Coalescing:          n.CoalescingId,
+		CallbackContext:     n.Callback.Context,
+		CallbackContextType: n.Callback.ContextType,
+		CallbackTarget:      n.Callback.Target,
+		Custom:              n.Custom,
+	}
+
+	note.Icon = defaults.Icon
+	if n.Icon != "" {
+		note.Icon = n.Icon
+		if registry.RemoteIcon(note.Icon) {
+			downloads.Fetch(note.Icon)
+		}
+	}
+
+	var ok bool
+	if note.Sound, ok = header.Get("Notification-Sound"); !ok {
+		note.Sound, _ = header.Get("X-Sound")
+	}
+
+	if note.CallbackContext != "" || note.CallbackTarget != "" {
+		note.Actions = buildActions(header)
+	}
+
+	if note.Hints, err = buildHints(header); err != nil {
+		return nil, err
+	}
+	if v, ok := header.Get("X-Progress"); ok && v != "" {
+		progress, err := header.GetInt("X-Progress", 0)
+		if err != nil {
+			return nil, err
+		}
+		if progress < 0 || progress > 100 {
+			return nil, server.InvalidRequestError("X-Progress must be from 0 to 100")
+		}
+		note.Progress = &progress
+	}
+
+	return note, nil
+}
+
+// buildHints builds the DesktopHints for a notification from its
+// X-Notification-Desktop-Entry, X-Notification-Category,
+// X-Notification-Transient, X-Notification-Resident and
+// X-Notification-Urgency headers.
+func buildHints(header server.Header) (hints registry.DesktopHints, err error) {
+	hints.DesktopEntry, _ = header.Get("X-Notification-Desktop-Entry")
+	hints.Category, _ = header.Get("X-Notification-Category")
+	if hints.Transient, err = header.GetBool("X-Notification-Transient", false); err != nil {
+		return hints, err
+	}
+	if hints.Resident, err = header.GetBool("X-Notification-Resident", false); err != nil {
+		return hints, err
+	}
+	if u, ok := header.Get("X-Notification-Urgency"); ok && u != "" {
+		if hints.Urgency, err = registry.ParseUrgency(u); err != nil {
+			return hints, server.InvalidRequestError(err.Error())
+		}
+	}
+	return hints, nil
+}
+
+// buildActions builds the action buttons for a notification with a callback:
+// the default action, invoked by clicking the notification, and any named
+// actions given as X-Notification-Action: key=Label headers.
+func buildActions(header server.Header) []registry.NotificationAction {
+	actions := []registry.NotificationAction{{Key: registry.DefaultAction, Label: "Open"}}
+	for _, value := range header["X-Notification-Action"] {
+		action := registry.NotificationAction{Key: value, Label: value}
+		if i := strings.Index(value, "="); i >= 0 {
+			action.Key, action.Label = value[:i], value[i+1:]
+		}
+		if action.Key == "" || action.Key == registry.DefaultAction || action.Key == "copy" {
+			continue
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// writeCallback waits for the result of note's callback, then writes it to
+// w as a -CALLBACK response. It gives up without writing anything if req's
+// Context is canceled first, as when the server shuts down.
+func writeCallback(w server.ResponseWriter, req *server.Request, note *registry.Notification) error {
+	var event registry.CallbackEvent
+	select {
+	case event = <-note.Callback:
+	case <-req.Context().Done():
+		return nil
+	}
+
+	header := w.Header()
+	header.Set("Response-Action", "NOTIFY")
+	header.Set("Application-Name", note.App.Name)
+	header.Set("Notification-ID", note.Id)
+	header.Set("Notification-Callback-Result", string(event.Result))
+	header.Set("Notification-Callback-Timestamp", time.Now().Format(time.RFC3339))
+	header.Set("Notification-Callback-Context", note.CallbackContext)
+	header.Set("Notification-Callback-Context-Type", note.CallbackContextType)
+	if event.Action != "" {
+		header.Set("X-Notification-Callback-Action", event.Action)
+	}
+	setDataHeaders(header, note)
+	return w.WriteHeader("CALLBACK")
+}
+
+// Respond builds the Notification, gives it to Dispatch, and writes the
+// response, followed by the result of its callback if the client waits for
+// it.
+func (handler *NotifyHandler) Respond(w server.ResponseWriter, req *server.Request) error {
+	if req.Version.Major != 1 || req.Version.Minor != 0 {
+		return server.UnknownProtocolVersionError(req.Version)
+	}
+
+	note, err := buildNotification(handler.Apps, req.Notify, req.Headers[0], handler.Downloads)
+	if err != nil {
+		return err
+	}
+	note.RemoteAddr, note.Received = req.RemoteAddr, req.Received
+
+	// A callback context without a target asks for a socket callback: the
+	// connection stays open until the notification is clicked or closed.
+	if note.CallbackContext != "" && note.CallbackTarget == "" {
+		note.Callback = make(chan registry.CallbackEvent, 1)
+	}
+	if err := handler.Dispatch(req, note); err != nil {
+		return err
+	}
+	referenceFiles(handler.Cache, note.App.Name, req, note.Icon)
+
+	w.Header().Set("Response-Action", "NOTIFY")
+	setDataHeaders(w.Header(), note)
+	if err := w.WriteHeader("OK"); err != nil || note.Callback == nil {
+		return err
+	}
+	return writeCallback(w, req, note)
+}
+
+// setDataHeaders copies the Data-* headers note was sent with to header, as
+// GNTP asks for them to be returned in responses to the notification.
+func setDataHeaders(header server.Header, note *registry.Notification) {
+	for key, values := range note.Custom {
+		if strings.HasPrefix(key, "Data-") {
+			header[key] = values
+		}
+	}
+}
+
+// SubscribeHandler handles GNTP SUBSCRIBE requests.
+type SubscribeHandler struct {
+	Subs *registry.Subscribers
+}
+
+// subscriberKey is the key of the *Subscriber a SUBSCRIBE request adds, in
+// the Context of the request once parsed.
+type subscriberKey struct{}
+
+// Parse parses GNTP SUBSCRIBE requests. It reads the single block of
+// Subscriber headers, and builds the Subscriber.
+func (handler *SubscribeHandler) Parse(b *bufio.Reader, req *server.Request) (*server.Request, error) {
+	header, err := req.ReadHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	req.Headers = []server.Header{header}
+	sub, err := buildSubscriber(header, req.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Logger().Debug("gntp: parsed request", "request", req)
+
+	return req.WithContext(context.WithValue(req.Context(), subscriberKey{}, sub)), nil
+}
+
+// buildSubscriber builds a Subscriber from the Header block and the address
+// the request came from.
+func buildSubscriber(header server.Header, remoteAddr string) (*registry.Subscriber, error) {
+	sub := new(registry.Subscriber)
+
+	var err error
+	if sub.Id, err = header.Require("Subscriber-ID"); err != nil {
+		return nil, err
+	}
+	if sub.Name, err = header.Require("Subscriber-Name"); err != nil {
+		return nil, err
+	}
+
+	// Subscribers listen on the standard GNTP port unless they say otherwise.
+	if sub.Port, err = header.GetInt("Subscriber-Port", 23053); err != nil || sub.Port <= 0 || sub.Port > 65535 {
+		return nil, server.InvalidRequestError("subscriber port invalid")
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, server.InvalidRequestError("subscriber address unknown")
+	}
+	sub.Host = host
+
+	return sub, nil
+}
+
+// Respond records the Subscriber and writes the response, telling the
+// subscriber how long its subscription lasts.
+func (handler *SubscribeHandler) Respond(w server.ResponseWriter, req *server.Request) error {
+	if req.Version.Major != 1 || req.Version.Minor != 0 {
+		return server.UnknownProtocolVersionError(req.Version)
+	}
+
+	// Subscriptions must always be password protected.
+	if req.KeyHash == nil {
+		return server.NotAuthorizedError("SUBSCRIBE requires a password")
+	}
+
+	sub, ok := req.Context().Value(subscriberKey{}).(*registry.Subscriber)
+	if !ok {
+		return errNotParsed
+	}
+	handler.Subs.Add(sub)
+	req.Logger().Info("gntp: subscribed", "name", sub.Name, "id", sub.Id, "host", sub.Host, "port", sub.Port)
+
+	w.Header().Set("Response-Action", "SUBSCRIBE")
+	w.Header().Set("Subscription-TTL", strconv.Itoa(int(handler.Subs.TTL/time.Second)))
+	return w.WriteHeader("OK")
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bufio"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"github.com/jgrocho/gntp_notify/server/gntptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves the handlers over gntptest, with the password given,
+// recording the notifications dispatched.
+type testServer struct {
+	*gntptest.Server
+	apps *registry.Applications
+	subs *registry.Subscribers
+
+	mu    sync.Mutex
+	notes []*registry.Notification
+}
+
+func newTestServer(t *testing.T, password string) *testServer {
+	ts := &testServer{
+		apps: registry.NewApplications(),
+		subs: registry.NewSubscribers(time.Hour),
+	}
+	files := cache.NewFileCache(t.TempDir())
+	downloads := cache.NewDownloader(files, time.Minute, nil)
+	mux := server.NewServeMux()
+	mux.Register("REGISTER", &RegisterHandler{Apps: ts.apps, Cache: files, Downloads: downloads})
+	mux.Register("NOTIFY", &NotifyHandler{Apps: ts.apps, Cache: files, Downloads: downloads, Dispatch: func(req *server.Request, note *registry.Notification) error {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.notes = append(ts.notes, note)
+		return nil
+	}})
+	mux.Register("UNREGISTER", &UnregisterHandler{Apps: ts.apps})
+	mux.Register("SUBSCRIBE", &SubscribeHandler{Subs: ts.subs})
+	ts.Server = gntptest.NewServer(mux)
+	ts.Password = password
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do sends req, with the server's password, and gives the code of the error
+// it is answered with, or 0 for an -OK response.
+func (ts *testServer) do(t *testing.T, req *gntptest.Request) int {
+	t.Helper()
+	if req.Password == "" {
+		req.Password = ts.Password
+	}
+	resp, err := ts.Do(req.Bytes())
+	if err != nil {
+		t.Fatalf("%s: %v", req.Type, err)
+	}
+	gerr, _ := server.AsGntpError(resp.Err())
+	return gerr.Code
+}
+
+func registerRequest() *gntptest.Request {
+	return gntptest.NewRequest("REGISTER",
+		gntptest.NewHeader("Application-Name", "Test", "Notifications-Count", "1"),
+		gntptest.NewHeader("Notification-Name", "Done", "Notification-Enabled", "True"),
+	)
+}
+
+func notifyRequest(app string) *gntptest.Request {
+	return gntptest.NewRequest("NOTIFY", gntptest.NewHeader(
+		"Application-Name", app,
+		"Notification-Name", "Done",
+		"Notification-Title", "Hello",
+	))
+}
+
+func TestRegisterNotify(t *testing.T) {
+	ts := newTestServer(t, "")
+	if code := ts.do(t, notifyRequest("Test")); code != server.CodeUnknownApplication {
+		t.Errorf("NOTIFY before REGISTER: error %d, want %d", code, server.CodeUnknownApplication)
+	}
+	if code := ts.do(t, registerRequest()); code != 0 {
+		t.Fatalf("REGISTER: error %d", code)
+	}
+	if code := ts.do(t, notifyRequest("Test")); code != 0 {
+		t.Fatalf("NOTIFY: error %d", code)
+	}
+	if code := ts.do(t, notifyRequest("Other")); code != server.CodeUnknownApplication {
+		t.Errorf("NOTIFY for an unknown application: error %d, want %d", code, server.CodeUnknownApplication)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.notes) != 1 || ts.notes[0].Title != "Hello" || ts.notes[0].App.Name != "Test" {
+		t.Errorf("dispatched %v, want the one notification", ts.notes)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	ts := newTestServer(t, "")
+	unregister := gntptest.NewRequest("UNREGISTER", gntptest.NewHeader("Application-Name", "Test"))
+	if code := ts.do(t, unregister); code != server.CodeUnknownApplication {
+		t.Errorf("UNREGISTER before REGISTER: error %d, want %d", code, server.CodeUnknownApplication)
+	}
+	ts.do(t, registerRequest())
+	if code := ts.do(t, unregister); code != 0 {
+		t.Errorf("UNREGISTER: error %d", code)
+	}
+	if code := ts.do(t, notifyRequest("Test")); code != server.CodeUnknownApplication {
+		t.Errorf("NOTIFY after UNREGISTER: error %d, want %d", code, server.CodeUnknownApplication)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	ts := newTestServer(t, "secret")
+	tests := []struct {
+		password string
+		code     int
+	}{
+		{"secret", 0},
+		{"wrong", server.CodeNotAuthorized},
+	}
+	for _, tt := range tests {
+		req := registerRequest()
+		req.Password = tt.password
+		if code := ts.do(t, req); code != tt.code {
+			t.Errorf("REGISTER with password %q: error %d, want %d", tt.password, code, tt.code)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	subscribe := func(port string) *gntptest.Request {
+		header := gntptest.NewHeader("Subscriber-ID", "abc", "Subscriber-Name", "Laptop")
+		if port != "" {
+			header.Set("Subscriber-Port", port)
+		}
+		return gntptest.NewRequest("SUBSCRIBE", header)
+	}
+
+	// Subscriptions need a password, even if the server has none.
+	if code := newTestServer(t, "").do(t, subscribe("")); code != server.CodeNotAuthorized {
+		t.Errorf("SUBSCRIBE without a password: error %d, want %d", code, server.CodeNotAuthorized)
+	}
+
+	ts := newTestServer(t, "secret")
+	if code := ts.do(t, subscribe("0")); code != server.CodeInvalidRequest {
+		t.Errorf("SUBSCRIBE with port 0: error %d, want %d", code, server.CodeInvalidRequest)
+	}
+	if code := ts.do(t, subscribe("")); code != 0 {
+		t.Fatalf("SUBSCRIBE: error %d", code)
+	}
+	sub := ts.subs.Get("abc")
+	if sub == nil || sub.Name != "Laptop" || sub.Host != "127.0.0.1" || sub.Port != 23053 {
+		t.Errorf("subscriber %+v, want Laptop at 127.0.0.1:23053", sub)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ts := newTestServer(t, "")
+	ts.IdleTimeout = time.Minute
+
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b := bufio.NewReader(conn)
+	for _, req := range []*gntptest.Request{registerRequest(), notifyRequest("Test"), notifyRequest("Test")} {
+		go conn.Write(req.Bytes())
+		resp, err := server.ReadResponse(b)
+		if err != nil {
+			t.Fatalf("%s: %v", req.Type, err)
+		}
+		if err := resp.Err(); err != nil {
+			t.Errorf("%s: %v", req.Type, err)
+		}
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.notes) != 2 {
+		t.Errorf("dispatched %d notifications over one connection, want 2", len(ts.notes))
+	}
+}
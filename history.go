@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/jgrocho/gntp_notify/registry"
+	bolt "go.etcd.io/bbolt"
+	"log/slog"
+	"time"
+)
+
+// historyBucket is the bucket of the History database holding its entries,
+// as JSON keyed by their sequence number.
+var historyBucket = []byte("notifications")
+
+// historyPruneInterval is how often entries older than the History's MaxAge
+// are removed.
+const historyPruneInterval = time.Hour
+
+// History is a NotificationLog keeping every notification received in a Bolt
+// database, so it lasts across restarts. The database can only be open in
+// one process at once.
+type History struct {
+	db *bolt.DB
+
+	// MaxAge, if more than 0, is how long entries are kept.
+	MaxAge time.Duration
+}
+
+// OpenHistory opens, or creates, the History database at path.
+func OpenHistory(path string) (*History, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &History{db: db}, nil
+}
+
+// Close closes the database.
+func (history *History) Close() error {
+	return history.db.Close()
+}
+
+// Add records that note had outcome. Entries are written in batches, so
+// many notifications at once don't each wait for the disk.
+func (history *History) Add(note *registry.Notification, outcome string) {
+	data, err := json.Marshal(newHistoryEntry(note, outcome))
+	if err == nil {
+		err = history.db.Batch(func(tx *bolt.Tx) error {
+			b := tx.Bucket(historyBucket)
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+			return b.Put(key, data)
+		})
+	}
+	if err != nil {
+		slog.Warn("gntp: could not record notification in history", "app", note.App.Name, "name", note.Name, "err", err)
+	}
+}
+
+// Query gives the entries selected by q, newest first.
+func (history *History) Query(q HistoryQuery) ([]HistoryEntry, error) {
+	list := make([]HistoryEntry, 0)
+	err := history.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Last(); k != nil && (q.Limit <= 0 || len(list) < q.Limit); k, v = c.Prev() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				continue
+			}
+			// Entries are in the order they were received, so none
+			// before this one can be selected either.
+			if entry.Time.Before(q.Since) {
+				break
+			}
+			if q.matches(&entry) {
+				list = append(list, entry)
+			}
+		}
+		return nil
+	})
+	return list, err
+}
+
+// Prune removes the entries older than MaxAge.
+func (history *History) Prune() {
+	if history.MaxAge <= 0 {
+		return
+	}
+	expired := time.Now().Add(-history.MaxAge)
+	var removed int
+	err := history.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		// Find the expired keys first, as deleting while iterating with a
+		// cursor skips entries.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(v, &entry); err == nil && !entry.Time.Before(expired) {
+				break
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	if err != nil {
+		slog.Warn("gntp: could not prune history", "err", err)
+	} else if removed > 0 {
+		slog.Debug("gntp: pruned history", "entries", removed)
+	}
+}
+
+// PruneEvery prunes the history now, then every interval, in a new goroutine.
+func (history *History) PruneEvery(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			history.Prune()
+			<-ticker.C
+		}
+	}()
+}
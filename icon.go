@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// Register the formats icons are decoded from.
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+// maxIconPixels is the most pixels an icon may have to be decoded. Image
+// headers can declare sizes far larger than the file, taking that much
+// memory to decode, so larger icons are left undecoded.
+const maxIconPixels = 4096 * 4096
+
+// notificationIcon gets the file name of the icon to show with note, resized
+// to fit opts.IconSize, or the name of an icon in the theme, or the empty
+// string if it has none.
+func notificationIcon(note *registry.Notification, opts *BackendOptions) string {
+	fileName := resolveIcon(note, opts)
+	if fileName == "" || opts.IconSize <= 0 || themeIcon(fileName) {
+		return fileName
+	}
+	return resizeIcon(opts.Cache, fileName, opts.IconSize)
+}
+
+// resolveIcon gets the file name of the icon for note, as iconFileName does.
+// If it has none, or it couldn't be downloaded, it falls back on the
+// fallback icon its Overrides give, then on opts.DefaultIcon, which may be
+// the name of an icon in the theme.
+func resolveIcon(note *registry.Notification, opts *BackendOptions) string {
+	if fileName := iconFileName(note, opts.Cache, opts.IconDirs); fileName != "" {
+		return fileName
+	}
+	for _, icon := range []string{note.FallbackIcon, opts.DefaultIcon} {
+		if fileName := fallbackIconFileName(icon, opts.Cache); fileName != "" {
+			return fileName
+		}
+	}
+	return ""
+}
+
+// fallbackIconFileName gets the file name of the fallback icon, a local file
+// or a URL downloaded to files, or its name if it is the name of an icon in
+// the theme, or the empty string if it has none.
+func fallbackIconFileName(icon string, files *cache.FileCache) string {
+	if icon == "" || themeIcon(icon) {
+		return icon
+	}
+	fileName, local := registry.LocalIconPath(icon)
+	if !local {
+		fileName = files.GetFileName(cache.URLKey(icon))
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return ""
+	}
+	return fileName
+}
+
+// themeIcon reports whether icon is the name of an icon in the desktop's
+// theme, such as "dialog-information", rather than a file or a URL.
+func themeIcon(icon string) bool {
+	_, local := registry.LocalIconPath(icon)
+	return !local && !strings.Contains(icon, "://") && !strings.ContainsRune(icon, os.PathSeparator)
+}
+
+// imageData is an icon as the pixel data of the image-data hint: rows of
+// RGBA pixels, with 8 bits per sample, not premultiplied by alpha.
+type imageData struct {
+	Width, Height, Rowstride int32
+	HasAlpha                 bool
+	BitsPerSample, Channels  int32
+	Data                     []byte
+}
+
+// notificationImage gets the pixel data of the icon to show with note, scaled
+// down to fit opts.IconSize, if opts.IconData is set. It returns nil if it
+// isn't, or the icon is not a file that can be decoded, and so must be shown
+// by its file name.
+func notificationImage(note *registry.Notification, opts *BackendOptions) *imageData {
+	if !opts.IconData {
+		return nil
+	}
+	fileName := resolveIcon(note, opts)
+	if fileName == "" || themeIcon(fileName) {
+		return nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	src, err := decodeIcon(file)
+	if err != nil {
+		return nil
+	}
+
+	bounds := src.Bounds()
+	if opts.IconSize > 0 && (bounds.Dx() > opts.IconSize || bounds.Dy() > opts.IconSize) {
+		src = scaleDown(src, opts.IconSize)
+		bounds = src.Bounds()
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+	return &imageData{
+		Width:         int32(bounds.Dx()),
+		Height:        int32(bounds.Dy()),
+		Rowstride:     int32(dst.Stride),
+		HasAlpha:      true,
+		BitsPerSample: 8,
+		Channels:      4,
+		Data:          dst.Pix,
+	}
+}
+
+// resizeIcon scales the icon in fileName down to fit within size pixels
+// square, and saves it to cache as a PNG. It returns the file name of the
+// resized icon, or fileName if it can't be decoded or is small enough already.
+func resizeIcon(cache *cache.FileCache, fileName string, size int) string {
+	key := resizedIconKey(cache, fileName, size)
+	if key == "" {
+		return fileName
+	}
+	if cache.Exists(key) {
+		return cache.GetFileName(key)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fileName
+	}
+	defer file.Close()
+	src, err := decodeIcon(file)
+	if err != nil {
+		// Not an image we can decode, such as SVG, or too large to;
+		// leave it to the notification server.
+		return fileName
+	}
+
+	bounds := src.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return fileName
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleDown(src, size)); err != nil {
+		slog.Warn("gntp: could not encode resized icon", "err", err)
+		return fileName
+	}
+	if err := cache.Add(key, int64(buf.Len()), &buf); err != nil {
+		slog.Warn("gntp: could not save resized icon", "err", err)
+		return fileName
+	}
+
+	return cache.GetFileName(key)
+}
+
+// decodeIcon decodes the icon in file, once its header shows it has no more
+// than maxIconPixels pixels.
+func decodeIcon(file io.ReadSeeker) (image.Image, error) {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxIconPixels/config.Height {
+		return nil, fmt.Errorf("icon is %dx%d pixels, too large to decode", config.Width, config.Height)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(file)
+	return src, err
+}
+
+// resizedIconKey gives the key the icon in fileName, resized to size, is saved
+// at in cache, or the empty string if fileName can't be read. Icons from the
+// cache are keyed by their own key; local files, which may change, by a hash
+// of their name and modification time.
+func resizedIconKey(cache *cache.FileCache, fileName string, size int) string {
+	if dir, err := filepath.Abs(cache.Dir()); err == nil && filepath.Dir(fileName) == dir {
+		return fmt.Sprintf("%s.%d.png", filepath.Base(fileName), size)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return ""
+	}
+	sum := md5.Sum([]byte(fmt.Sprintf("%s\x00%d", fileName, info.ModTime().UnixNano())))
+	return fmt.Sprintf("%x.%d.png", sum, size)
+}
+
+// scaleDown scales src down, keeping its aspect ratio, to fit within size
+// pixels square. Each pixel is the average of the pixels of src it covers.
+func scaleDown(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := size, size
+	if w > h {
+		dh = h * size / w
+	} else {
+		dw = w * size / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+(x+1)*w/dw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sr, sg, sb, sa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(sr), g+uint64(sg), b+uint64(sb), a+uint64(sa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// IconDirs implements flag.Value for the directories icons given as local
+// files may be in, given by repeating the flag. The directories are kept
+// absolute, with any symbolic links resolved.
+type IconDirs []string
+
+// String returns the directories, separated by commas.
+func (dirs *IconDirs) String() string {
+	return strings.Join(*dirs, ",")
+}
+
+// Set adds a directory.
+func (dirs *IconDirs) Set(value string) error {
+	if value == "" {
+		return errors.New("missing directory")
+	}
+	dir, err := filepath.Abs(value)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	*dirs = append(*dirs, dir)
+	return nil
+}
+
+// allows reports whether the file at path is inside one of dirs, once any
+// symbolic links are resolved. No file is allowed if there are no dirs.
+func (dirs IconDirs) allows(path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IngestRequest is the JSON body of a request to the HTTP endpoint, asking
+// for a notification to be shown.
+type IngestRequest struct {
+	Application string `json:"application"`
+	// Name is the type of the notification; it defaults to "Message".
+	Name         string `json:"name"`
+	Id           string `json:"id"`
+	CoalescingId string `json:"coalescing_id"`
+	Title        string `json:"title"`
+	Text         string `json:"text"`
+	Priority     int    `json:"priority"`
+	Sticky       bool   `json:"sticky"`
+	// Icon is the URL of the icon.
+	Icon string `json:"icon"`
+}
+
+// IngestAPI serves an HTTP endpoint for programs that can't speak GNTP to
+// send notifications:
+//
+//	POST /notify    {"application": "Backup", "title": "Done", "text": "..."}
+//
+// Each request is handled as a NOTIFY request, so notifications go through
+// the same rules as any other. Applications are registered the first time
+// they send a notification, with its type as their only one. If a password
+// is set, requests must give it as a bearer token.
+type IngestAPI struct {
+	// server holds the limits requests are held to, as GNTP requests are,
+	// and the access log they are recorded in.
+	server   *server.Server
+	apps     *registry.Applications
+	register server.Handler
+	notify   server.Handler
+	password string
+}
+
+// ServeHTTP serves the endpoint.
+func (api *IngestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(r.URL.Path, "/") != "notify" {
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	if err := api.server.Admit(server.AddrFromString(r.RemoteAddr)); err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	if api.password != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(api.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, errors.New("wrong or missing password"))
+			return
+		}
+	}
+
+	var body IngestRequest
+	if err := readAdminJSON(r, &body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Application == "" || body.Title == "" {
+		writeAdminError(w, http.StatusBadRequest, errors.New("missing application or title"))
+		return
+	}
+	if !validPriority(body.Priority) {
+		writeAdminError(w, http.StatusBadRequest, errors.New("priorities are from -2 to 2"))
+		return
+	}
+	if binaryReference(body.Icon) {
+		writeAdminError(w, http.StatusBadRequest, errors.New("icon must be a URL or a file, not a binary resource"))
+		return
+	}
+	if body.Name == "" {
+		body.Name = "Message"
+	}
+
+	if api.apps.Get(body.Application) == nil {
+		register := adaptedRegister(body.Application, "", []adaptedType{{Name: body.Name}})
+		if err := handleAdapted(api.server, api.register, register, r.RemoteAddr); err != nil {
+			writeIngestError(w, err)
+			return
+		}
+	}
+	if err := handleAdapted(api.server, api.notify, ingestNotify(&body), r.RemoteAddr); err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+// ListenAndServe listens on the TCP address addr and serves the endpoint,
+// with the timeouts and connection limit of the GNTP server.
+func (api *IngestAPI) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           api,
+		ReadHeaderTimeout: api.server.ReadPhaseTimeout,
+		ReadTimeout:       api.server.ReadTimeout,
+		WriteTimeout:      api.server.WriteTimeout,
+		IdleTimeout:       api.server.IdleTimeout,
+	}
+	return srv.Serve(limitedListener{l, api.server})
+}
+
+// ingestNotify builds the NOTIFY request for body.
+func ingestNotify(body *IngestRequest) *server.Request {
+	header := server.NewHeader()
+	header.Set("Application-Name", body.Application)
+	header.Set("Notification-Name", body.Name)
+	header.Set("Notification-Title", body.Title)
+	header.Set("Notification-Priority", strconv.Itoa(body.Priority))
+	set := func(key, value string) {
+		if value != "" {
+			header.Set(key, value)
+		}
+	}
+	set("Notification-Text", body.Text)
+	set("Notification-ID", body.Id)
+	set("Notification-Coalescing-ID", body.CoalescingId)
+	set("Notification-Icon", body.Icon)
+	if body.Sticky {
+		header.Set("Notification-Sticky", "True")
+	}
+	return &server.Request{Type: "NOTIFY", Headers: []server.Header{header}}
+}
+
+// writeIngestError replies to a request with err, with the HTTP status
+// closest to its GNTP error code.
+func writeIngestError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if gntpErr, ok := server.AsGntpError(err); ok {
+		switch gntpErr.Code {
+		case server.CodeInvalidRequest, server.CodeRequiredHeaderMissing:
+			status = http.StatusBadRequest
+		case server.CodeNotAuthorized:
+			status = http.StatusForbidden
+		case server.CodeUnknownApplication, server.CodeUnknownNotification:
+			status = http.StatusNotFound
+		case server.CodeAlreadyProcessed, server.CodeNotificationDisabled:
+			status = http.StatusConflict
+		}
+	}
+	writeAdminError(w, status, err)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIngestIcons(t *testing.T) {
+	tests := []struct {
+		icon   string
+		status int
+	}{
+		{"", http.StatusAccepted},
+		{"https://example.com/icon.png", http.StatusAccepted},
+		{"x-growl-resource://../../etc/hostname", http.StatusBadRequest},
+		{"X-Growl-Resource://../../etc/hostname", http.StatusBadRequest},
+		{"x-growl-resource://abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var notified *server.Request
+		api := &IngestAPI{
+			server:   &server.Server{},
+			apps:     registry.NewApplications(),
+			register: server.HandlerFunc(func(server.ResponseWriter, *server.Request) error { return nil }),
+			notify: server.HandlerFunc(func(_ server.ResponseWriter, req *server.Request) error {
+				notified = req
+				return nil
+			}),
+		}
+		body := `{"application": "Test", "title": "Hello", "icon": "` + tt.icon + `"}`
+		r := httptest.NewRequest("POST", "/notify", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("icon %q: status %d, want %d: %s", tt.icon, w.Code, tt.status, w.Body)
+		}
+		if tt.status != http.StatusAccepted && notified != nil {
+			t.Errorf("icon %q: notification handled", tt.icon)
+		}
+	}
+}
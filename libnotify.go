@@ -0,0 +1,454 @@
+//go:build !nolibnotify
+// +build !nolibnotify
+
+package main
+
+// #cgo pkg-config: libnotify
+// #include <stdlib.h>
+// #include <libnotify/notify.h>
+//
+// extern void goActionInvoked(NotifyNotification *notification, char *action, guint id);
+// extern void goNotificationClosed(NotifyNotification *notification, guint id, gint reason);
+// extern void goDispatchNotifications(void);
+//
+// static void action_invoked(NotifyNotification *notification, char *action, gpointer user_data) {
+// 	goActionInvoked(notification, action, GPOINTER_TO_UINT(user_data));
+// }
+//
+// static void add_action(NotifyNotification *notification, char *action, char *label, guint id) {
+// 	notify_notification_add_action(notification, action, label,
+// 		NOTIFY_ACTION_CALLBACK(action_invoked), GUINT_TO_POINTER(id), NULL);
+// }
+//
+// static void closed(NotifyNotification *notification, gpointer user_data) {
+// 	goNotificationClosed(notification, GPOINTER_TO_UINT(user_data),
+// 		notify_notification_get_closed_reason(notification));
+// }
+//
+// static void connect_closed(NotifyNotification *notification, guint id) {
+// 	g_signal_connect(notification, "closed", G_CALLBACK(closed), GUINT_TO_POINTER(id));
+// }
+//
+// static void set_hint_boolean(NotifyNotification *notification, char *key, gboolean value) {
+// 	notify_notification_set_hint(notification, key, g_variant_new_boolean(value));
+// }
+//
+// static void set_hint_int32(NotifyNotification *notification, char *key, gint value) {
+// 	notify_notification_set_hint(notification, key, g_variant_new_int32(value));
+// }
+//
+// static void set_image_data(NotifyNotification *notification, gint width, gint height, gint rowstride, gboolean has_alpha, gint bits_per_sample, gint channels, void *data, gsize len) {
+// 	GVariant *pixels = g_variant_new_fixed_array(G_VARIANT_TYPE_BYTE, data, len, 1);
+// 	notify_notification_set_hint(notification, "image-data",
+// 		g_variant_new("(iiibii@ay)", width, height, rowstride, has_alpha, bits_per_sample, channels, pixels));
+// }
+//
+// static void free_server_caps(GList *caps) {
+// 	g_list_free_full(caps, g_free);
+// }
+//
+// static gboolean dispatch_notifications(gpointer user_data) {
+// 	goDispatchNotifications();
+// 	return G_SOURCE_REMOVE;
+// }
+//
+// static void schedule_dispatch(void) {
+// 	g_idle_add(dispatch_notifications, NULL);
+// }
+import "C"
+import (
+	"errors"
+	"github.com/godbus/dbus"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+func init() {
+	registerBackend("libnotify", newLibnotifyBackend)
+}
+
+// shown maps the ids passed to libnotify signal handlers to the notifications
+// still on screen.
+var shown = struct {
+	sync.Mutex
+	next uint
+	m    map[uint]*shownNotification
+}{m: make(map[uint]*shownNotification)}
+
+// track adds sn to shown and returns its id.
+func track(sn *shownNotification) uint {
+	shown.Lock()
+	defer shown.Unlock()
+	shown.next++
+	shown.m[shown.next] = sn
+	return shown.next
+}
+
+// displayed gives the notifications in shown.
+func displayed() []*registry.Notification {
+	shown.Lock()
+	defer shown.Unlock()
+	notes := make([]*registry.Notification, 0, len(shown.m))
+	for _, sn := range shown.m {
+		notes = append(notes, sn.note)
+	}
+	return notes
+}
+
+// untrack removes and returns the notification with id from shown.
+func untrack(id uint) *shownNotification {
+	shown.Lock()
+	defer shown.Unlock()
+	sn := shown.m[id]
+	delete(shown.m, id)
+	return sn
+}
+
+// retrack replaces the notification with id in shown by sn, returning the one
+// replaced.
+func retrack(id uint, sn *shownNotification) *shownNotification {
+	shown.Lock()
+	defer shown.Unlock()
+	old := shown.m[id]
+	shown.m[id] = sn
+	return old
+}
+
+// coalescedNotification is a notification on screen that may be replaced by
+// one with the same coalescing id.
+type coalescedNotification struct {
+	notification *C.NotifyNotification
+	id           uint
+}
+
+// coalesced maps the CoalescingKey of notifications on screen to them. It is
+// only used from the main loop.
+var coalesced = make(map[string]coalescedNotification)
+
+// addAction adds a button with key and label to notification.
+func addAction(notification *C.NotifyNotification, id uint, key, label string) {
+	action := C.CString(key)
+	defer C.free(unsafe.Pointer(action))
+	notify_label := C.CString(label)
+	defer C.free(unsafe.Pointer(notify_label))
+	C.add_action(notification, action, notify_label, C.guint(id))
+}
+
+// setHintString sets the hint key to value on notification.
+func setHintString(notification *C.NotifyNotification, key, value string) {
+	notify_key := C.CString(key)
+	defer C.free(unsafe.Pointer(notify_key))
+	notify_value := C.CString(value)
+	defer C.free(unsafe.Pointer(notify_value))
+	C.notify_notification_set_hint_string(notification, notify_key, notify_value)
+}
+
+// setHintBoolean sets the hint key to value on notification.
+func setHintBoolean(notification *C.NotifyNotification, key string, value bool) {
+	notify_key := C.CString(key)
+	defer C.free(unsafe.Pointer(notify_key))
+	notify_value := C.gboolean(C.FALSE)
+	if value {
+		notify_value = C.TRUE
+	}
+	C.set_hint_boolean(notification, notify_key, notify_value)
+}
+
+// setHintInt32 sets the hint key to value on notification.
+func setHintInt32(notification *C.NotifyNotification, key string, value int32) {
+	notify_key := C.CString(key)
+	defer C.free(unsafe.Pointer(notify_key))
+	C.set_hint_int32(notification, notify_key, C.gint(value))
+}
+
+// setImageData sets the image-data hint to image on notification.
+func setImageData(notification *C.NotifyNotification, image *imageData) {
+	data := C.CBytes(image.Data)
+	defer C.free(data)
+	hasAlpha := C.gboolean(C.FALSE)
+	if image.HasAlpha {
+		hasAlpha = C.TRUE
+	}
+	C.set_image_data(notification, C.gint(image.Width), C.gint(image.Height), C.gint(image.Rowstride),
+		hasAlpha, C.gint(image.BitsPerSample), C.gint(image.Channels), data, C.gsize(len(image.Data)))
+}
+
+// getServerCapabilities asks the notification server for its capabilities.
+func getServerCapabilities() serverCapabilities {
+	var capabilities []string
+	caps := C.notify_get_server_caps()
+	for c := caps; c != nil; c = c.next {
+		capabilities = append(capabilities, C.GoString((*C.char)(c.data)))
+	}
+	C.free_server_caps(caps)
+	return parseCapabilities(capabilities)
+}
+
+// actionInvoked is called by libnotify when an action button is clicked.
+func actionInvoked(action string, id uint) {
+	shown.Lock()
+	sn, ok := shown.m[id]
+	shown.Unlock()
+
+	if ok {
+		sn.actionInvoked(action)
+	}
+}
+
+// notificationClosed is called by libnotify when a notification is closed.
+func notificationClosed(notification *C.NotifyNotification, id uint, reason int) {
+	defer C.g_object_unref(C.gpointer(notification))
+
+	if sn := untrack(id); sn != nil {
+		if key := sn.note.CoalescingKey(); key != "" && coalesced[key].id == id {
+			delete(coalesced, key)
+		}
+		sn.note.SendCallback(closedResult(reason))
+	}
+}
+
+// capabilities are the capabilities of the notification server. They are
+// asked for when libnotify is initialized, and again before the next
+// notification whenever capabilitiesStale is set, when the server is
+// replaced. They are only used by the main loop.
+var capabilities serverCapabilities
+
+// capabilitiesStale is set, to 1, when the notification server is replaced.
+var capabilitiesStale int32
+
+// processNotification sends the notification to libnotify.
+func processNotification(note *registry.Notification, opts *BackendOptions) {
+	if inited := bool(C.notify_is_initted() != 0); !inited {
+		// We might be able to initialize libnotify here, if doing so is thread
+		// safe and can be called multiple times.
+		slog.Error("gntp: libnotify is not initted")
+		return
+	}
+
+	if atomic.SwapInt32(&capabilitiesStale, 0) != 0 {
+		capabilities = getServerCapabilities()
+	}
+
+	notify_title := C.CString(note.Title)
+	defer C.free(unsafe.Pointer(notify_title))
+
+	notify_text := C.CString(bodyText(note.Text, capabilities))
+	defer C.free(unsafe.Pointer(notify_text))
+
+	// Icons sent as pixel data are not named as well.
+	image := notificationImage(note, opts)
+	var icon string
+	if image == nil {
+		icon = notificationIcon(note, opts)
+	}
+	notify_icon := C.CString(icon)
+	defer C.free(unsafe.Pointer(notify_icon))
+
+	sn := &shownNotification{note: note}
+	key := note.CoalescingKey()
+	c, replacing := coalesced[key]
+	notify_notification, id := c.notification, c.id
+	if replacing {
+		// Update the notification on screen with the same coalescing id.
+		// It isn't closed, so tell the client of the one replaced here.
+		C.notify_notification_update(notify_notification, notify_title, notify_text, notify_icon)
+		C.notify_notification_clear_hints(notify_notification)
+		C.notify_notification_clear_actions(notify_notification)
+		if old := retrack(id, sn); old != nil {
+			old.note.SendCallback(registry.CallbackClosed)
+		}
+	} else {
+		notify_notification = C.notify_notification_new(notify_title, notify_text, notify_icon)
+		// Keep the notification (and our reference to it) until it is closed.
+		id = track(sn)
+		C.connect_closed(notify_notification, C.guint(id))
+		if key != "" {
+			coalesced[key] = coalescedNotification{notify_notification, id}
+		}
+	}
+
+	notify_app_name := C.CString(note.App.Name)
+	C.notify_notification_set_app_name(notify_notification, notify_app_name)
+	defer C.free(unsafe.Pointer(notify_app_name))
+
+	notify_urgency := C.NotifyUrgency(urgency(note))
+	C.notify_notification_set_urgency(notify_notification, notify_urgency)
+
+	notify_timeout := C.gint(timeout(note))
+	C.notify_notification_set_timeout(notify_notification, notify_timeout)
+
+	if !opts.Sounds.allowed(note) {
+		setHintBoolean(notify_notification, "suppress-sound", true)
+	} else if sound, isFile := notificationSound(note, opts); isFile {
+		setHintString(notify_notification, "sound-file", sound)
+	} else if sound != "" {
+		setHintString(notify_notification, "sound-name", sound)
+	}
+
+	for key, value := range customHints(note) {
+		setHintString(notify_notification, key, value)
+	}
+	if image != nil {
+		setImageData(notify_notification, image)
+	}
+	for key, value := range standardHints(note) {
+		switch value := value.(type) {
+		case string:
+			setHintString(notify_notification, key, value)
+		case bool:
+			setHintBoolean(notify_notification, key, value)
+		case int32:
+			setHintInt32(notify_notification, key, value)
+		}
+	}
+
+	// Without actions, the notification can't be clicked, so its
+	// callback only ever reports that it closed.
+	if capabilities.actions {
+		for _, action := range note.Actions {
+			addAction(notify_notification, id, action.Key, action.Label)
+		}
+		if opts.Clipboard != nil {
+			if text, ok := opts.Clipboard.Extract(note); ok {
+				sn.clipboard = text
+				addAction(notify_notification, id, "copy", "Copy")
+			}
+		}
+	}
+
+	// Actually show the notification and report any error.
+	var err *C.GError
+	if shown := bool(C.notify_notification_show(notify_notification, &err) != 0); shown {
+		slog.Info("gntp: notification shown", "app", note.App.Name, "id", note.Id)
+		notificationsShown.Inc("libnotify")
+	} else {
+		var message string
+		if err != nil {
+			message = C.GoString((*C.char)(err.message))
+		}
+		slog.Warn("gntp: notification not shown", "app", note.App.Name, "id", note.Id, "err", message)
+		notificationsFailed.Inc("libnotify")
+		// A notification being replaced may still be on screen, so keep it
+		// until it is closed.
+		if !replacing {
+			untrack(id)
+			delete(coalesced, key)
+			C.g_object_unref(C.gpointer(notify_notification))
+		}
+		note.SendCallback(registry.CallbackClosed)
+	}
+}
+
+// pending holds the notifications waiting to be shown by the main loop, and
+// the options they are shown with.
+var pending = struct {
+	sync.Mutex
+	opts  *BackendOptions
+	notes []*registry.Notification
+}{}
+
+// dispatchNotifications is called from the main loop to show the pending
+// notifications.
+func dispatchNotifications() {
+	pending.Lock()
+	notes, opts := pending.notes, pending.opts
+	pending.notes = nil
+	pending.Unlock()
+
+	for _, note := range notes {
+		processNotification(note, opts)
+	}
+}
+
+// libnotifyBackend shows notifications with libnotify.
+type libnotifyBackend struct{}
+
+// newLibnotifyBackend initializes libnotify and starts the thread running the
+// GLib main loop. All libnotify calls are made from the main loop, which also
+// delivers the signals for clicked and closed notifications. It fails if
+// there is no notification server.
+func newLibnotifyBackend(opts *BackendOptions) (Backend, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := notificationServerCapabilities(conn); err != nil {
+		return nil, err
+	}
+	if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, notificationServerChanged); call.Err != nil {
+		return nil, call.Err
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	go watchNotificationServer(signals)
+
+	pending.Lock()
+	pending.opts = opts
+	pending.Unlock()
+
+	inited := make(chan bool)
+	go func() {
+		// libnotify (and GLib) expect to be used from a single thread.
+		runtime.LockOSThread()
+
+		// libnotify needs a default app name when initialized. This will be
+		// changed later.
+		appName := C.CString("gntp_notify")
+		defer C.free(unsafe.Pointer(appName))
+		if ok := bool(C.notify_init(appName) != 0); !ok {
+			inited <- false
+			return
+		}
+		defer C.notify_uninit()
+		capabilities = getServerCapabilities()
+		inited <- true
+
+		loop := C.g_main_loop_new(nil, C.FALSE)
+		defer C.g_main_loop_unref(loop)
+		C.g_main_loop_run(loop)
+	}()
+
+	if !<-inited {
+		return nil, errors.New("could not initialize libnotify")
+	}
+	return &libnotifyBackend{}, nil
+}
+
+// watchNotificationServer marks the capabilities stale whenever signals tell
+// that the notification server was replaced.
+func watchNotificationServer(signals <-chan *dbus.Signal) {
+	for signal := range signals {
+		var name, oldOwner, newOwner string
+		if signal.Name != "org.freedesktop.DBus.NameOwnerChanged" || dbus.Store(signal.Body, &name, &oldOwner, &newOwner) != nil {
+			continue
+		}
+		if name == notificationsName && newOwner != "" {
+			atomic.StoreInt32(&capabilitiesStale, 1)
+		}
+	}
+}
+
+// Check reports whether libnotify is still initialized.
+func (backend *libnotifyBackend) Check() error {
+	if C.notify_is_initted() == 0 {
+		return errors.New("libnotify not initialized")
+	}
+	return nil
+}
+
+// Displayed gives the notifications on screen.
+func (backend *libnotifyBackend) Displayed() []*registry.Notification {
+	return displayed()
+}
+
+// Show queues note and wakes the main loop to show it.
+func (backend *libnotifyBackend) Show(note *registry.Notification) {
+	pending.Lock()
+	pending.notes = append(pending.notes, note)
+	pending.Unlock()
+	C.schedule_dispatch()
+}
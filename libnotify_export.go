@@ -0,0 +1,27 @@
+//go:build !nolibnotify
+// +build !nolibnotify
+
+package main
+
+// #cgo pkg-config: libnotify
+// #include <libnotify/notify.h>
+import "C"
+
+// This file holds the Go functions called from C. cgo does not allow
+// definitions in the preamble of a file using //export, so they are kept
+// apart from the rest of the libnotify code.
+
+//export goActionInvoked
+func goActionInvoked(notification *C.NotifyNotification, action *C.char, id C.guint) {
+	actionInvoked(C.GoString(action), uint(id))
+}
+
+//export goNotificationClosed
+func goNotificationClosed(notification *C.NotifyNotification, id C.guint, reason C.gint) {
+	notificationClosed(notification, uint(id), int(reason))
+}
+
+//export goDispatchNotifications
+func goDispatchNotifications() {
+	dispatchNotifications()
+}
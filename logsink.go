@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// logIdentifier is the name log messages are sent to the journal and syslog
+// under.
+const logIdentifier = "gntp_notify"
+
+// journalSocket is the socket of the native protocol of systemd-journald.
+// See systemd.journal-fields(7) and sd_journal_send(3).
+const journalSocket = "/run/systemd/journal/socket"
+
+// logPriority gives the syslog priority of log messages at level, as the
+// journal and syslog both use.
+func logPriority(level slog.Level) syslog.Priority {
+	switch {
+	case level >= slog.LevelError:
+		return syslog.LOG_ERR
+	case level >= slog.LevelWarn:
+		return syslog.LOG_WARNING
+	case level >= slog.LevelInfo:
+		return syslog.LOG_INFO
+	}
+	return syslog.LOG_DEBUG
+}
+
+// withoutTime drops the time from log messages, for sinks that record it
+// themselves.
+func withoutTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// journalHandler is a slog.Handler sending log messages to systemd-journald,
+// each with its priority and its attributes as fields of its own.
+type journalHandler struct {
+	conn  net.Conn
+	level slog.Leveler
+	// fields are the fields added by WithAttrs, already encoded, and
+	// prefix is that of the fields of the group opened by WithGroup.
+	fields []byte
+	prefix string
+}
+
+// newJournalHandler connects to systemd-journald, failing if it isn't
+// running, to send it log messages at level or above.
+func newJournalHandler(level slog.Leveler) (*journalHandler, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", r.Message)
+	writeJournalField(&b, "PRIORITY", string('0'+byte(logPriority(r.Level))))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", logIdentifier)
+	b.Write(h.fields)
+	r.Attrs(func(a slog.Attr) bool {
+		appendJournalAttr(&b, h.prefix, a)
+		return true
+	})
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b bytes.Buffer
+	b.Write(h.fields)
+	for _, a := range attrs {
+		appendJournalAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.fields = b.Bytes()
+	return &h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "_"
+	return &h2
+}
+
+// appendJournalAttr encodes a, in the group with prefix, as a journal field,
+// or a field for each attribute of a group.
+func appendJournalAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range v.Group() {
+			appendJournalAttr(b, prefix, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	writeJournalField(b, journalFieldName(prefix+a.Key), v.String())
+}
+
+// journalFieldName gives the journal field name for the attribute key: in
+// upper case, with only letters, digits and underscores, and not starting
+// with an underscore, which marks the fields journald adds itself.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "X" + name
+	}
+	return name
+}
+
+// writeJournalField encodes the field name with value, as the native
+// protocol of journald expects: NAME=value on a line, or the value's length
+// before it if it spans several.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// syslogWriter sends what is written to it to syslog, at the priority of the
+// message being logged.
+type syslogWriter struct {
+	w *syslog.Writer
+	// mu is held while a message is logged at level.
+	mu    sync.Mutex
+	level slog.Level
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	m := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch logPriority(w.level) {
+	case syslog.LOG_ERR:
+		err = w.w.Err(m)
+	case syslog.LOG_WARNING:
+		err = w.w.Warning(m)
+	case syslog.LOG_INFO:
+		err = w.w.Info(m)
+	default:
+		err = w.w.Debug(m)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newSyslogWriter connects to the local syslog daemon.
+func newSyslogWriter() (*syslogWriter, error) {
+	w, err := syslog.New(syslog.LOG_USER|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+// syslogHandler is a slog.Handler sending log messages, formatted by
+// another writing to w, to syslog.
+type syslogHandler struct {
+	slog.Handler
+	w *syslogWriter
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), w: h.w}
+}
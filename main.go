@@ -1,20 +1,324 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/handlers"
+	"github.com/jgrocho/gntp_notify/metrics"
+	"github.com/jgrocho/gntp_notify/registry"
 	"github.com/jgrocho/gntp_notify/server"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 var (
-	help     = flag.Bool("help", false, "Displays this help")
-	cachedir = flag.String("cachedir", "", "Set an alternate cache directory")
+	listenAddrs    ListenAddrs
+	allowNetworks  Networks
+	denyNetworks   Networks
+	forwardTargets ForwardTargets
+	bridgeTargets  ForwardTargets
+	mutedApps      ApplicationNames
+	iconDirs       IconDirs
+	quietHours     QuietHours
+	webhookURLs    WebhookURLs
+	telegramChats  AppTargets
+	slackHooks     AppTargets
+	emailTo        AppTargets
+
+	help        = flag.Bool("help", false, "Displays this help")
+	showVersion = flag.Bool("version", false, "Print the version of gntp_notify, and when and from what it was built")
+	port        = flag.Int("port", 23053, "Listen on this port, for addresses given without one")
+	cachedir    = flag.String("cachedir", "", "Set an alternate cache directory")
+	password    = flag.String("password", "", "Require requests to be authenticated with this password")
+	subTTL      = flag.Duration("subscription-ttl", 10*time.Minute, "Set how long SUBSCRIBE subscriptions last")
+	digest      = flag.Duration("digest", 0, "Batch low priority notifications into a digest shown at this interval")
+
+	readTimeout  = flag.Duration("read-timeout", 30*time.Second, "Set how long to wait for a client to send its request")
+	idleTimeout  = flag.Duration("idle-timeout", 0, "Keep connections open this long after a response for another request")
+	phaseTimeout = flag.Duration("read-phase-timeout", 10*time.Second, "Set how long to wait for each part of a request")
+	writeTimeout = flag.Duration("write-timeout", 30*time.Second, "Set how long to wait for a client to accept a response")
+
+	maxConns     = flag.Int("max-conns", 256, "Set the maximum number of connections served at once")
+	maxConnsWait = flag.Duration("max-conns-wait", 500*time.Millisecond, "Set how long a connection over -max-conns waits before it is refused")
+
+	maxRequestSize  = flag.Int64("max-request-size", 16<<20, "Set the maximum size of a request in bytes, including binaries")
+	maxHeaderSize   = flag.Int64("max-header-size", 64<<10, "Set the maximum size of the headers of a request in bytes")
+	maxBinarySize   = flag.Int64("max-binary-size", 8<<20, "Set the maximum size of each binary in a request in bytes")
+	maxHeaderBlocks = flag.Int("max-header-blocks", 1000, "Set the maximum number of header blocks in a request")
+	maxHeaderLines  = flag.Int("max-header-lines", 1000, "Set the maximum number of lines in each header block")
+	maxLineSize     = flag.Int("max-line-size", 16<<10, "Set the maximum size of the directive line and each header line in bytes")
+
+	clipboard        = flag.Bool("clipboard", false, "Add a button to copy notification text to the clipboard")
+	clipboardPattern = flag.String("clipboard-pattern", "", "Only copy the text matching this regular expression")
+
+	forwardRetries = flag.Int("forward-retries", 3, "Set how many times to retry forwarding to an unreachable server")
+
+	cacheSize    = flag.Int64("cache-size", 64<<20, "Set the maximum size of the cache directory in bytes, or 0 for no limit")
+	cacheEntries = flag.Int("cache-entries", 10000, "Set the maximum number of files in the cache directory, or 0 for no limit")
+	cacheTTL     = flag.Duration("cache-ttl", 30*24*time.Hour, "Remove files from the cache directory unused for this long, or 0 to keep them")
+
+	iconSize    = flag.Int("icon-size", 128, "Scale icons down to fit this many pixels square, or 0 to show them at full size")
+	defaultIcon = flag.String("default-icon", "", "Show notifications without an icon with this icon: a file, a URL or an icon name from the theme")
+	iconData    = flag.Bool("icon-data", false, "Send icons to the notification server as pixel data, rather than as the paths of cached files")
+
+	downloadTimeout = flag.Duration("download-timeout", 10*time.Second, "Set how long to wait for an icon to download, or 0 to wait forever")
+	downloadRetries = flag.Int("download-retries", 2, "Set how many times to retry a failed icon download")
+	downloadMaxSize = flag.Int64("download-max-size", 8<<20, "Set the maximum size of a downloaded icon in bytes, or 0 for no limit")
+	downloadPerHost = flag.Int("download-per-host", 2, "Download at most this many icons from the same host at once, or 0 for no limit")
+	downloadProxy   = flag.String("download-proxy", "", "Download icons through the proxy at this URL, instead of the one from the environment")
+
+	metricsAddr = flag.String("metrics-addr", "", "Serve Prometheus metrics over HTTP at /metrics on this address")
+
+	debugAddr = flag.String("debug-addr", "", "Serve expvar statistics over HTTP at /debug/vars on this localhost address")
+
+	httpAddr  = flag.String("http-addr", "", "Accept notifications as JSON POSTed to /notify over HTTP on this host:port")
+	snpAddr   = flag.String("snp-addr", "", "Accept notifications from Snarl clients over SNP on this host:port (usually :9887)")
+	adminAddr = flag.String("admin-addr", "", "Serve the JSON admin API over HTTP on this localhost address, or find it there for status, apps and history")
+
+	logFormat = flag.String("log-format", "text", "Set the format of log messages: text or json")
+	logOutput = flag.String("log-output", "stderr", "Write log messages to stderr, journald or syslog")
+	logLevel  = flag.String("log-level", "info", "Only log messages at this level or above: debug, info, warn or error")
+
+	logFile        = flag.String("log-file", "", "Write log messages to this file instead of stderr")
+	logFileMaxSize = flag.Int64("log-file-max-size", 10<<20, "Rotate the log file once it grows past this many bytes, or 0 to never rotate it")
+	logFileKeep    = flag.Int("log-file-keep", 3, "Keep this many rotated log files")
+
+	accessLogFile   = flag.String("access-log", "", "Record each request in this file, or - for standard output")
+	accessLogFormat = flag.String("access-log-format", "common", "Set the format of the access log: common or json")
+
+	noSound = flag.Bool("no-sound", false, "Never play the sounds requested by notifications")
+
+	mdns     = flag.Bool("mdns", false, "Advertise the server on the local network over mDNS, through Avahi")
+	mdnsName = flag.String("mdns-name", "", "Advertise the server under this name, instead of the host name")
+
+	dndEnd    = flag.String("dnd-end", DNDSummary, "Once do not disturb is turned off, show the notifications held as a summary or replay them")
+	dndMaxAge = flag.Duration("dnd-replay-max-age", time.Hour, "Only replay notifications held for do not disturb for less than this, or 0 to replay them all")
+
+	quietPriority = flag.Int("quiet-priority", 1, "Keep notifications below this priority quiet during -quiet-hours")
+	quietAction   = flag.String("quiet-action", QuietHold, "Hold notifications during -quiet-hours until they end, or suppress them")
+
+	historyFile   = flag.String("history", "", "Record every notification received in this database file")
+	historyMaxAge = flag.Duration("history-max-age", 30*24*time.Hour, "Remove notifications from the history after this long, or 0 to keep them")
+
+	minPriority   = flag.Int("min-priority", -2, "Only show notifications with at least this priority, from -2 to 2")
+	overridesFile = flag.String("overrides", "", "Apply the rules for notifications in this JSON file")
+	filtersFile   = flag.String("filters", "", "Apply the rules for which notifications are shown in this JSON file")
+	dryRun        = flag.Bool("dry-run", false, "Log the notifications received, and the requests that would be forwarded, instead of showing or forwarding them")
+	backendName   = flag.String("backend", "", "Show notifications with this backend: libnotify, dbus, console or none (default libnotify if built in, otherwise dbus)")
+	routesFile    = flag.String("routes", "", "Apply the rules for which backends notifications are sent to in this JSON file, reloading it when it changes")
+
+	testNotification = flag.Bool("test-notification", false, "Show a test notification on starting, to check notifications are shown")
+
+	webhookTemplate    = flag.String("webhook-template", "", "Build the body of webhook requests with the Go template in this file, instead of as JSON")
+	webhookContentType = flag.String("webhook-content-type", "application/json", "Set the content type of webhook requests")
+	webhookSecret      = flag.String("webhook-secret", "", "Sign the body of webhook requests with this key, as an HMAC-SHA256 in the X-Gntp-Signature header")
+
+	telegramToken  = flag.String("telegram-token", "", "Also send notifications to Telegram chats through the bot with this token")
+	telegramPhotos = flag.Bool("telegram-photos", false, "Send notifications with an icon to Telegram as a photo of it")
+	telegramAPIURL = flag.String("telegram-api", telegramAPI, "Use the Telegram Bot API server at this URL")
+
+	slackUsername = flag.String("slack-username", "", "Post notifications to Slack or Mattermost as this user name, instead of the webhook's")
+
+	smtpServer   = flag.String("smtp-server", "localhost:25", "Send email through the SMTP server at this host:port")
+	smtpUser     = flag.String("smtp-user", "", "Log in to the SMTP server as this user")
+	smtpPassword = flag.String("smtp-password", "", "Log in to the SMTP server with this password")
+	emailFrom    = flag.String("email-from", "", "Send email from this address")
+	emailBatch   = flag.Duration("email-batch", 0, "Collect notifications for this long and email them together, or 0 to email each on its own")
+
+	execCommand = flag.String("exec", "", "Also run this program for each notification shown, described by GNTP_* environment variables")
+	execWorkers = flag.Int("exec-workers", 2, "Run the -exec program for this many notifications at once")
+	execTimeout = flag.Duration("exec-timeout", 30*time.Second, "Kill the -exec program if it runs for longer than this, or 0 for no limit")
+
+	fileLog        = flag.String("notification-log", "", "Also append each notification shown to this file")
+	fileLogFormat  = flag.String("notification-log-format", "json", "Set the format of the notification log: json or text")
+	fileLogMaxSize = flag.Int64("notification-log-max-size", 10<<20, "Rotate the notification log once it grows past this many bytes, or 0 to never rotate it")
+	fileLogKeep    = flag.Int("notification-log-keep", 3, "Keep this many rotated notification logs")
+
+	workers   = flag.Int("workers", 2, "Show this many notifications at once")
+	queueSize = flag.Int("queue-size", 100, "Queue up to this many notifications waiting to be shown, dropping the oldest when full")
+
+	connRate         = flag.Float64("conn-rate", 0, "Limit each host to this many connections per second, or 0 for no limit")
+	connBurst        = flag.Int("conn-burst", 20, "Allow each host bursts of this many connections over -conn-rate")
+	notifyRate       = flag.Float64("notify-rate", 0, "Limit each client to this many notifications per second, or 0 for no limit")
+	notifyBurst      = flag.Int("notify-burst", 10, "Allow each client bursts of this many notifications over -notify-rate")
+	notifyRatePerApp = flag.Bool("notify-rate-per-app", false, "Apply -notify-rate to each application of a client separately")
+	appRateLimit     = flag.Int("app-rate-limit", 0, "Show at most this many notifications from each application a minute, collapsing the rest into one, or 0 for no limit")
 )
 
+// cacheCollectInterval is how often expired files are removed from the cache.
+const cacheCollectInterval = time.Hour
+
+func init() {
+	flag.Var(&listenAddrs, "addr", "Listen on this address, given as host[:port] or unix:path (may be repeated; defaults to all interfaces)")
+	flag.Var(&allowNetworks, "allow", "Only accept requests from this network, given as an address or CIDR (may be repeated)")
+	flag.Var(&denyNetworks, "deny", "Refuse requests from this network, given as an address or CIDR (may be repeated)")
+	flag.Var(&forwardTargets, "forward", "Forward requests to this GNTP server, given as [password@]host[:port] (may be repeated)")
+	flag.Var(&bridgeTargets, "bridge", "Forward the desktop notifications of other programs to this GNTP server, given as [password@]host[:port] (may be repeated)")
+	flag.Var(&iconDirs, "icon-dir", "Allow icons given as local files in this directory (may be repeated)")
+	flag.Var(&webhookURLs, "webhook", "Also POST each notification shown to this http or https URL (may be repeated)")
+	flag.Var(&telegramChats, "telegram-chat", "Send notifications to this Telegram chat id, or those of an application to the chat given as application=id (may be repeated)")
+	flag.Var(&slackHooks, "slack-webhook", "Also post notifications to this Slack or Mattermost incoming webhook URL, or those of an application to the one given as application=url (may be repeated)")
+	flag.Var(&emailTo, "email-to", "Also email notifications to these comma separated addresses, or those of an application to the ones given as application=addresses (may be repeated)")
+	flag.Var(&quietHours, "quiet-hours", "Keep notifications below -quiet-priority quiet during this period, given as [days ]HH:MM-HH:MM (may be repeated)")
+	flag.Var(&mutedApps, "mute", "Never play the sounds requested by this application (may be repeated)")
+}
+
+// ListenAddrs implements flag.Value for the list of addresses to listen on.
+type ListenAddrs []string
+
+// String returns the addresses, separated by commas.
+func (addrs *ListenAddrs) String() string {
+	return strings.Join(*addrs, ",")
+}
+
+// Set adds an address.
+func (addrs *ListenAddrs) Set(value string) error {
+	if value == "" {
+		return errors.New("missing address")
+	}
+	*addrs = append(*addrs, value)
+	return nil
+}
+
+// Networks implements flag.Value for a list of networks, each given as an IP
+// address or in CIDR notation.
+type Networks []*net.IPNet
+
+// String returns the networks, separated by commas.
+func (networks *Networks) String() string {
+	list := make([]string, len(*networks))
+	for i, network := range *networks {
+		list[i] = network.String()
+	}
+	return strings.Join(list, ",")
+}
+
+// Set parses and adds a network.
+func (networks *Networks) Set(value string) error {
+	network, err := server.ParseNetwork(value)
+	if err != nil {
+		return err
+	}
+	*networks = append(*networks, network)
+	return nil
+}
+
+// withPort gives the addresses to listen on, adding port to those without one.
+// With no addresses, it listens on port on all interfaces.
+func (addrs ListenAddrs) withPort(port int) []string {
+	if len(addrs) == 0 {
+		return []string{":" + strconv.Itoa(port)}
+	}
+	withPort := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil && !strings.HasPrefix(addr, "unix:") {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(port))
+		}
+		withPort[i] = addr
+	}
+	return withPort
+}
+
+// fatal logs msg, with the key-value pairs in args, and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newLogHandler builds the slog.Handler for log messages at level or above,
+// in format, written to output: standard error, or file instead if not nil,
+// the journal, or syslog. Messages sent to the journal carry their
+// attributes as fields, whatever the format.
+func newLogHandler(format, output string, file io.Writer, level slog.Level) (slog.Handler, error) {
+	var w io.Writer = os.Stderr
+	opts := &slog.HandlerOptions{Level: level}
+	var sw *syslogWriter
+	if file != nil && output != "stderr" {
+		return nil, errors.New("a log file can't be written with log output " + output)
+	}
+	switch output {
+	case "stderr":
+		if file != nil {
+			w = file
+		}
+	case "journald":
+		return newJournalHandler(level)
+	case "syslog":
+		var err error
+		if sw, err = newSyslogWriter(); err != nil {
+			return nil, err
+		}
+		w = sw
+		opts.ReplaceAttr = withoutTime
+	default:
+		return nil, errors.New("unknown log output " + output)
+	}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, errors.New("unknown log format " + format)
+	}
+	if sw != nil {
+		h = &syslogHandler{Handler: h, w: sw}
+	}
+	return h, nil
+}
+
+// openAccessLog opens the access log at path, appending to it, or standard
+// output if path is "-".
+func openAccessLog(path, format string) (*server.AccessLog, error) {
+	if path == "-" {
+		return server.NewAccessLog(os.Stdout, format)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewAccessLog(file, format)
+}
+
+// parseProxyURL parses the URL of a proxy, given as
+// scheme://[user:password@]host[:port]. A URL without a scheme is taken as an
+// HTTP proxy, as in the proxy environment variables.
+func parseProxyURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("unsupported proxy scheme " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing proxy host")
+	}
+	return u, nil
+}
+
 func getCacheDir() (cacheDir string, err error) {
 	var baseDir string
 	if baseDir = os.Getenv("XDG_CACHE_HOME"); baseDir == "" {
@@ -32,47 +336,518 @@ func getCacheDir() (cacheDir string, err error) {
 	return
 }
 
+// commandUsage describes the commands. serve, the default, runs the daemon;
+// the others are described by their own usage.
+const commandUsage = `usage: gntp_notify [flags] [serve [flags]]
+       gntp_notify [-cachedir <dir>] cache ls|purge ...
+       gntp_notify send [flags] <title> [text]
+       gntp_notify bench [flags]
+       gntp_notify -admin-addr <host:port> status
+       gntp_notify -admin-addr <host:port> apps [ls|enable|disable|remove] ...
+       gntp_notify -admin-addr <host:port> history [flags]`
+
+// usage writes the usage of the commands and the flags to standard error.
+func usage() {
+	fmt.Fprintln(flag.CommandLine.Output(), commandUsage)
+	fmt.Fprintln(flag.CommandLine.Output(), "\nflags:")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
 	if *help {
 		flag.Usage()
 		return
 	}
+	if *showVersion {
+		printVersion(os.Stdout)
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("invalid log level", "err", err)
+	}
+	var logFileWriter io.Writer
+	if *logFile != "" {
+		file, err := openRotatingFile(*logFile, *logFileMaxSize, *logFileKeep)
+		if err != nil {
+			fatal("could not open log file", "file", *logFile, "err", err)
+		}
+		file.onRotate = func(err error) {
+			if err != nil {
+				slog.Warn("gntp: could not rotate log file", "file", *logFile, "err", err)
+			}
+		}
+		logFileWriter = file
+	}
+	logHandler, err := newLogHandler(*logFormat, *logOutput, logFileWriter, level)
+	if err != nil {
+		fatal("could not set up logging", "err", err)
+	}
+	slog.SetDefault(slog.New(logHandler))
+
+	// Run the command given, failing with its usage if it was used wrongly.
+	args := flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	switch command := flag.Arg(0); command {
+	case "", "serve":
+		// The daemon's flags may also follow serve.
+		flag.CommandLine.Parse(args)
+		if flag.NArg() > 0 {
+			err = errors.New(commandUsage)
+			break
+		}
+		serve()
+		return
+	case "cache":
+		var cacheDir string
+		if cacheDir, err = getCacheDir(); err != nil {
+			fatal("could not create cache directory", "dir", cacheDir, "err", err)
+		}
+		err = runCacheCommand(cacheDir, args, os.Stdout)
+	case "send":
+		err = runSendCommand(args)
+	case "bench":
+		err = runBenchCommand(args, os.Stdout)
+	case "status":
+		err = runStatusCommand(*adminAddr, args, os.Stdout)
+	case "apps":
+		err = runAppsCommand(*adminAddr, args, os.Stdout)
+	case "history":
+		err = runHistoryCommand(*adminAddr, args, os.Stdout)
+	default:
+		err = errors.New("unknown command " + command + "\n" + commandUsage)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// advertise advertises the server listening on addrs over mDNS, under
+// -mdns-name or the host name. It returns a function that withdraws the
+// advertisement, or nil if the server could not be advertised.
+func advertise(addrs []string) func() {
+	port := listenPort(addrs)
+	if port == 0 {
+		slog.Warn("not advertising over mDNS: not listening on a TCP port")
+		return nil
+	}
+	name := *mdnsName
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			name = "gntp_notify"
+		}
+	}
+	withdraw, err := advertiseService(name, port)
+	if err != nil {
+		slog.Warn("could not advertise over mDNS", "err", err)
+		return nil
+	}
+	slog.Info("advertising over mDNS", "name", name, "type", mdnsServiceType, "port", port)
+	return withdraw
+}
 
+// serve runs the daemon until it is interrupted.
+func serve() {
 	cacheDir, err := getCacheDir()
 	if err != nil {
-		log.Fatalf("could not create cache directory: %s\n", cacheDir)
+		fatal("could not create cache directory", "dir", cacheDir, "err", err)
 	}
-	if testFile, err := ioutil.TempDir(cacheDir, "test"); err != nil {
-		log.Fatalf("cache directoy '%s' not writable\n", cacheDir)
-	} else {
-		if err = os.Remove(testFile); err != nil {
-			log.Printf("could not remove temporary file: %v\n")
+	binaryCache := cache.NewFileCache(cacheDir)
+	if err := binaryCache.CheckWritable(); err != nil {
+		fatal("cache directory not writable", "dir", cacheDir, "err", err)
+	}
+	binaryCache.MaxBytes = *cacheSize
+	binaryCache.MaxEntries = *cacheEntries
+	binaryCache.MaxAge = *cacheTTL
+	binaryCache.OnLookup = cacheLookup
+	if *cacheTTL > 0 {
+		binaryCache.CollectEvery(cacheCollectInterval)
+	}
+	registerCacheMetrics(binaryCache)
+	publishCacheStats(binaryCache)
+
+	var proxy *url.URL
+	if *downloadProxy != "" {
+		if proxy, err = parseProxyURL(*downloadProxy); err != nil {
+			fatal("invalid download proxy", "err", err)
+		}
+	}
+	downloads := cache.NewDownloader(binaryCache, *downloadTimeout, proxy)
+	downloads.MaxBytes = *downloadMaxSize
+	downloads.Retries = *downloadRetries
+	downloads.PerHost = *downloadPerHost
+	if *defaultIcon != "" && !themeIcon(*defaultIcon) {
+		if path, local := registry.LocalIconPath(*defaultIcon); local {
+			if _, err := os.Stat(path); err != nil {
+				slog.Warn("gntp: default icon not found", "icon", path, "err", err)
+			}
+		} else if registry.RemoteIcon(*defaultIcon) {
+			downloads.Fetch(*defaultIcon)
 		}
 	}
 
-	binaryCache := NewFileCache(cacheDir)
+	apps := registry.NewApplications()
+	var extractor *ClipboardExtractor
+	if *clipboard {
+		if extractor, err = NewClipboardExtractor(*clipboardPattern); err != nil {
+			fatal("invalid clipboard pattern", "err", err)
+		}
+	}
+
+	opts := &BackendOptions{
+		Cache:       binaryCache,
+		Clipboard:   extractor,
+		IconSize:    *iconSize,
+		IconData:    *iconData,
+		IconDirs:    iconDirs,
+		DefaultIcon: *defaultIcon,
+		Sounds:      &SoundPolicy{Disabled: *noSound, Muted: mutedApps},
+	}
+	// A backend chosen by the user must start, but the default may fall
+	// back to printing notifications where there is no desktop. A dry run
+	// starts none.
+	name := *backendName
+	if name == "" {
+		name = defaultBackend()
+	}
+	var backend Backend
+	if *dryRun {
+		backend = dryRunBackend{name: name, primary: true}
+	} else if backend, err = NewBackend(name, opts); err != nil {
+		if *backendName != "" {
+			fatal("could not start notification backend", "backend", name, "err", err)
+		}
+		slog.Warn("gntp: could not start notification backend, printing notifications instead", "backend", name, "err", err)
+		if backend, err = NewBackend("console", opts); err != nil {
+			fatal("could not start notification backend", "err", err)
+		}
+	}
+	var outputs []Output
+	if len(webhookURLs) > 0 {
+		var tmpl *template.Template
+		if *webhookTemplate != "" {
+			if tmpl, err = ParseWebhookTemplate(*webhookTemplate); err != nil {
+				fatal("could not load webhook template", "file", *webhookTemplate, "err", err)
+			}
+		}
+		outputs = append(outputs, Output{"webhook", NewWebhookBackend(webhookURLs, tmpl, *webhookContentType, *webhookSecret)})
+	}
+	if *telegramToken != "" {
+		if telegramChats.empty() {
+			fatal("no telegram chat given to send notifications to")
+		}
+		outputs = append(outputs, Output{"telegram", NewTelegramBackend(opts, *telegramAPIURL, *telegramToken, &telegramChats, *telegramPhotos)})
+	}
+	if !slackHooks.empty() {
+		outputs = append(outputs, Output{"slack", NewSlackBackend(&slackHooks, *slackUsername)})
+	}
+	if !emailTo.empty() {
+		from, err := mail.ParseAddress(*emailFrom)
+		if err != nil {
+			fatal("invalid address to send email from", "from", *emailFrom, "err", err)
+		}
+		outputs = append(outputs, Output{"email", NewEmailBackend(opts, *smtpServer, *smtpUser, *smtpPassword, from, &emailTo, *emailBatch)})
+	}
+	if *execCommand != "" {
+		outputs = append(outputs, Output{"exec", NewCommandBackend(opts, *execCommand, *execWorkers, *execTimeout)})
+	}
+	if *fileLog != "" {
+		fileLogBackend, err := NewFileLogBackend(*fileLog, *fileLogFormat, *fileLogMaxSize, *fileLogKeep)
+		if err != nil {
+			fatal("could not open notification log", "file", *fileLog, "err", err)
+		}
+		outputs = append(outputs, Output{"notification-log", fileLogBackend})
+	}
+	if *dryRun {
+		for i := range outputs {
+			outputs[i].Backend = dryRunBackend{name: outputs[i].Name}
+		}
+	}
+	var routes *RouteTable
+	if *routesFile != "" {
+		names := []string{DisplayBackend}
+		for _, output := range outputs {
+			names = append(names, output.Name)
+		}
+		if routes, err = OpenRoutes(*routesFile, names); err != nil {
+			fatal("could not load routes", "file", *routesFile, "err", err)
+		}
+		go routes.Watch(routesReloadInterval)
+	}
+	backend = withOutputs(backend, outputs, routes)
+
+	var history NotificationLog = NewRecentNotifications(recentNotificationsKept)
+	if *historyFile != "" {
+		h, err := OpenHistory(*historyFile)
+		if err != nil {
+			fatal("could not open history", "file", *historyFile, "err", err)
+		}
+		defer h.Close()
+		h.MaxAge = *historyMaxAge
+		h.PruneEvery(historyPruneInterval)
+		history = h
+	}
+
+	pending := NewPendingNotifications()
+	notes := NotificationChannel(backend, *workers, *queueSize, history, pending)
+	if *appRateLimit > 0 {
+		notes = AppLimitChannel(*appRateLimit, notes, history)
+	}
+	if *digest > 0 {
+		notes = DigestChannel(*digest, notes, history, pending)
+	}
+	if len(quietHours) > 0 {
+		action, err := parseQuietAction(*quietAction)
+		if err != nil {
+			fatal("invalid quiet hours action", "err", err)
+		}
+		notes = QuietHoursChannel(quietHours, *quietPriority, action, notes, history, pending)
+	}
+
+	dnd := NewDoNotDisturb(notes)
+	if dnd.End, err = parseDNDEnd(*dndEnd); err != nil {
+		fatal("invalid do not disturb end", "err", err)
+	}
+	dnd.MaxAge = *dndMaxAge
+
+	// Show the notifications that were still waiting when we last exited.
+	if restored, err := RestorePending(cacheDir, apps, notes, dnd); err != nil {
+		slog.Warn("could not restore pending notifications", "err", err)
+	} else if restored > 0 {
+		slog.Info("restored pending notifications", "count", restored, "dnd", dnd.On())
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default)
+		go func() {
+			slog.Info("serving metrics", "addr", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				slog.Error("could not serve metrics", "err", err)
+			}
+		}()
+	}
 
+	server.DefaultServer.Observer = serverMetrics{}
+	server.DefaultServer.Origin = server.NewOrigin("gntp_notify", fullVersion())
+	server.DefaultServer.Middleware = []server.Middleware{preventLoops(server.DefaultServer.Origin)}
+	if len(allowNetworks) > 0 || len(denyNetworks) > 0 {
+		server.DefaultServer.Access = &server.AccessList{Allow: allowNetworks, Deny: denyNetworks}
+	}
+	if *accessLogFile != "" {
+		accessLog, err := openAccessLog(*accessLogFile, *accessLogFormat)
+		if err != nil {
+			fatal("could not open access log", "err", err)
+		}
+		server.DefaultServer.AccessLog = accessLog
+	}
+	if *connRate > 0 {
+		server.DefaultServer.RateLimiter = server.NewRateLimiter(*connRate, *connBurst)
+	}
+	server.DefaultServer.Password = *password
+	server.DefaultServer.ReadTimeout = *readTimeout
+	server.DefaultServer.ReadPhaseTimeout = *phaseTimeout
+	server.DefaultServer.IdleTimeout = *idleTimeout
+	server.DefaultServer.WriteTimeout = *writeTimeout
+	server.DefaultServer.MaxConns = *maxConns
+	server.DefaultServer.MaxConnsWait = *maxConnsWait
+	server.DefaultServer.MaxRequestBytes = *maxRequestSize
+	server.DefaultServer.MaxHeaderBytes = *maxHeaderSize
+	server.DefaultServer.MaxBinaryBytes = *maxBinarySize
+	server.DefaultServer.MaxHeaderBlocks = *maxHeaderBlocks
+	server.DefaultServer.MaxHeaderLines = *maxHeaderLines
+	server.DefaultServer.MaxLineBytes = *maxLineSize
+	// Subscriptions are only accepted when a password is set.
+	var subscribers *registry.Subscribers
+	if *password != "" {
+		subscribers = registry.NewSubscribers(*subTTL)
+	}
+	var forwarder *Forwarder
+	if len(forwardTargets) > 0 || subscribers != nil {
+		forwarder = NewForwarder(forwardTargets, binaryCache, *forwardRetries)
+		forwarder.Subscribers = subscribers
+		forwarder.SubscriptionPassword = *password
+		forwarder.DryRun = *dryRun
+	}
+	if len(bridgeTargets) > 0 {
+		fwd := NewForwarder(bridgeTargets, binaryCache, *forwardRetries)
+		fwd.DryRun = *dryRun
+		bridge := NewBridge(fwd, binaryCache)
+		if err := bridge.Start(); err != nil {
+			fatal("could not bridge desktop notifications", "err", err)
+		}
+	}
+
+	publishQueueDepth(forwarder, dnd)
+	if *debugAddr != "" {
+		// expvar publishes the command line too, with any -password.
+		if !loopbackAddr(*debugAddr) {
+			fatal("debug address must be a localhost address", "addr", *debugAddr)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			slog.Info("serving debug statistics", "addr", *debugAddr)
+			if err := http.ListenAndServe(*debugAddr, mux); err != nil {
+				slog.Error("could not serve debug statistics", "err", err)
+			}
+		}()
+	}
+
+	var filters *Filters
+	if *filtersFile != "" {
+		if filters, err = LoadFilters(*filtersFile); err != nil {
+			fatal("could not load filters", "file", *filtersFile, "err", err)
+		}
+		filters.StartRerouting(binaryCache, *forwardRetries, *dryRun)
+	}
+
+	register := &handlers.RegisterHandler{Apps: apps, Cache: binaryCache, Downloads: downloads}
+	register.OnRegister = func(req *server.Request, app *registry.Application) {
+		if forwarder != nil {
+			forwarder.Forward(req)
+		}
+		filters.Remember(req)
+	}
+	server.Register("REGISTER", register)
+	dispatch := &dispatcher{notes: notes, downloads: downloads, forward: forwarder, history: history, dnd: dnd, filters: filters}
+	if !validPriority(*minPriority) {
+		fatal("invalid minimum priority: priorities are from -2 to 2", "priority", *minPriority)
+	}
+	dispatch.minPriority = *minPriority
+	if *overridesFile != "" {
+		if dispatch.overrides, err = LoadOverrides(*overridesFile); err != nil {
+			fatal("could not load overrides", "file", *overridesFile, "err", err)
+		}
+	}
+	if *notifyRate > 0 {
+		dispatch.limit = server.NewRateLimiter(*notifyRate, *notifyBurst)
+		dispatch.perApp = *notifyRatePerApp
+	}
+	notify := &handlers.NotifyHandler{Apps: apps, Cache: binaryCache, Downloads: downloads, Dispatch: dispatch.dispatch}
+	server.Register("NOTIFY", notify)
+	server.Register("UNREGISTER", &handlers.UnregisterHandler{Apps: apps})
+	if subscribers != nil {
+		server.Register("SUBSCRIBE", &handlers.SubscribeHandler{Subs: subscribers})
+	}
+	if *httpAddr != "" {
+		ingest := &IngestAPI{server: server.DefaultServer, apps: apps, register: register, notify: notify, password: *password}
+		go func() {
+			slog.Info("serving HTTP notifications", "addr", *httpAddr)
+			if err := ingest.ListenAndServe(*httpAddr); err != nil {
+				slog.Error("could not serve HTTP notifications", "err", err)
+			}
+		}()
+	}
+	if *snpAddr != "" {
+		snp := NewSNPServer(server.DefaultServer, apps, register, notify, *password, *readTimeout)
+		go func() {
+			slog.Info("serving SNP notifications", "addr", *snpAddr)
+			if err := snp.ListenAndServe(*snpAddr); err != nil {
+				slog.Error("could not serve SNP notifications", "err", err)
+			}
+		}()
+	}
+
+	if *adminAddr != "" {
+		if !loopbackAddr(*adminAddr) {
+			fatal("admin address must be a localhost address", "addr", *adminAddr)
+		}
+		admin := &AdminAPI{apps: apps, cache: binaryCache, history: history, dnd: dnd, server: server.DefaultServer, backend: backend, register: register, notify: notify}
+		go func() {
+			slog.Info("serving admin API", "addr", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, admin); err != nil {
+				slog.Error("could not serve admin API", "err", err)
+			}
+		}()
+	}
+
+	if *testNotification {
+		if err := sendTestNotification(register, notify); err != nil {
+			slog.Warn("could not send test notification", "err", err)
+		}
+	}
+
+	// Toggle do not disturb on SIGUSR1.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			slog.Info("set do not disturb", "enabled", dnd.Toggle())
+		}
+	}()
+
+	// Shutdown cleanly on an interrupt, or when terminated, as by systemd,
+	// waiting a while for connections to complete.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
 	go func() {
-		for sig := range c {
-			log.Printf("caputred %v, exiting\n", sig)
-			go func() {
-				time.Sleep(15 * time.Second)
-				log.Printf("clean exit timed out, forcing\n")
-				os.Exit(1)
-			}()
-			server.Exit()
+		sig := <-c
+		slog.Info("captured signal, exiting", "signal", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("clean exit timed out, forcing", "err", err)
 		}
+		close(done)
 	}()
 
-	apps := NewApplications()
-	notes := NotificationChannel(binaryCache)
+	// Use the sockets passed by systemd, if we were socket activated,
+	// otherwise listen ourselves.
+	listeners, err := systemdListeners()
+	if err != nil {
+		fatal("could not use sockets from systemd", "err", err)
+	}
+	addrs := listenAddrs.withPort(*port)
+	if len(listeners) > 0 {
+		addrs = make([]string, len(listeners))
+		for i, l := range listeners {
+			addrs[i] = l.Addr().String()
+			if l.Addr().Network() == "unix" {
+				addrs[i] = "unix:" + addrs[i]
+			}
+		}
+	}
+	if *mdns {
+		if withdraw := advertise(addrs); withdraw != nil {
+			defer withdraw()
+		}
+	}
+	if len(listeners) == 0 {
+		for _, addr := range addrs {
+			slog.Info("listening", "addr", addr)
+		}
+		err = server.StartAll(addrs...)
+	} else {
+		for _, l := range listeners {
+			slog.Info("serving socket from systemd", "addr", l.Addr())
+		}
+		err = server.ServeAll(listeners...)
+	}
+	if err != server.ErrServerClosed {
+		fatal("could not start server", "err", err)
+	}
+	<-done
 
-	server.Register("REGISTER", &RegisterHandler{apps, binaryCache})
-	server.Register("NOTIFY", &NotifyHandler{apps, notes, binaryCache})
-	server.Start()
-	log.Println("Ending")
+	// Save the notifications not shown yet, and those sticky on screen, to
+	// show them once we start again.
+	var displayed []*registry.Notification
+	if d, ok := backend.(DisplayingBackend); ok {
+		displayed = d.Displayed()
+	}
+	if saved, err := SavePending(cacheDir, pending, displayed, dnd); err != nil {
+		slog.Warn("could not save pending notifications", "err", err)
+	} else if saved > 0 {
+		slog.Info("saved pending notifications", "count", saved)
+	}
+	slog.Info("ending")
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// htmlTag matches a start or end tag of one of the HTML tags bodyText knows,
+// capturing whether it is an end tag, its name and its attributes. Attributes
+// must have values, so text such as "a<b and c>d" isn't taken for a tag.
+var htmlTag = regexp.MustCompile(`<(/?)(?i:(b|strong|i|em|u|a|br|p|div))((?:\s+[a-zA-Z_:][-a-zA-Z0-9_:.]*\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>]+))*)\s*/?>`)
+
+// hrefAttribute matches the href attribute of a tag, capturing its value.
+var hrefAttribute = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// markupTags maps the HTML tags kept in markup to the tags they become.
+var markupTags = map[string]string{
+	"b":      "b",
+	"strong": "b",
+	"i":      "i",
+	"em":     "i",
+	"u":      "u",
+	"a":      "a",
+}
+
+// markupEscaper escapes the characters with special meaning in markup.
+var markupEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// openTag is an HTML tag that has been opened, but not yet closed.
+type openTag struct {
+	name   string
+	markup string
+}
+
+// bodyText converts the text of a notification, which Growl clients often send
+// as basic HTML, for the notification server with caps. If it supports markup
+// the text is converted to the markup of the Desktop Notifications spec, with
+// links only if it supports them too, otherwise to plain text. Known tags with
+// no equivalent are dropped, and anything else in angle brackets, such as an
+// email address, is kept as text.
+func bodyText(text string, caps serverCapabilities) string {
+	markup := caps.markup
+	var buf bytes.Buffer
+	var open []openTag
+
+	writeText := func(s string) {
+		s = html.UnescapeString(s)
+		if markup {
+			s = markupEscaper.Replace(s)
+		}
+		buf.WriteString(s)
+	}
+	// closeTo closes the open tags, down to and including the last named
+	// name, so the markup stays well-formed.
+	closeTo := func(name string) {
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i].name != name {
+				continue
+			}
+			for j := len(open) - 1; j >= i; j-- {
+				buf.WriteString("</" + open[j].markup + ">")
+			}
+			open = open[:i]
+			return
+		}
+	}
+
+	last := 0
+	for _, m := range htmlTag.FindAllStringSubmatchIndex(text, -1) {
+		writeText(text[last:m[0]])
+		last = m[1]
+
+		end := m[3] > m[2]
+		name := strings.ToLower(text[m[4]:m[5]])
+		attrs := text[m[6]:m[7]]
+
+		switch name {
+		case "br":
+			buf.WriteString("\n")
+			continue
+		case "p", "div":
+			if end {
+				buf.WriteString("\n")
+			}
+			continue
+		}
+
+		tag, ok := markupTags[name]
+		if !markup || !ok || (tag == "a" && !caps.hyperlinks) {
+			continue
+		}
+		if end {
+			closeTo(name)
+			continue
+		}
+		if tag == "a" {
+			href := hrefAttribute.FindStringSubmatch(attrs)
+			if href == nil {
+				continue
+			}
+			url := html.UnescapeString(href[1] + href[2] + href[3])
+			buf.WriteString(`<a href="` + markupEscaper.Replace(url) + `">`)
+		} else {
+			buf.WriteString("<" + tag + ">")
+		}
+		open = append(open, openTag{name, tag})
+	}
+	writeText(text[last:])
+
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString("</" + open[i].markup + ">")
+	}
+
+	return strings.TrimRight(buf.String(), "\n")
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestBodyText(t *testing.T) {
+	plain := serverCapabilities{}
+	markup := serverCapabilities{markup: true}
+	links := serverCapabilities{markup: true, hyperlinks: true}
+	tests := []struct {
+		text string
+		caps serverCapabilities
+		want string
+	}{
+		{"From: John <john@example.com>", plain, "From: John <john@example.com>"},
+		{"From: John <john@example.com>", markup, "From: John &lt;john@example.com&gt;"},
+		{"expected <identifier> here", plain, "expected <identifier> here"},
+		{"expected <identifier> here", markup, "expected &lt;identifier&gt; here"},
+		{"a<b and c>d", plain, "a<b and c>d"},
+		{"a<b and c>d", markup, "a&lt;b and c&gt;d"},
+		{"<span>x</span>", markup, "&lt;span&gt;x&lt;/span&gt;"},
+		{"<b>bold</b> &amp; <i>it</i>", plain, "bold & it"},
+		{"<b>bold</b> &amp; <i>it</i>", markup, "<b>bold</b> &amp; <i>it</i>"},
+		{"<STRONG>x</STRONG> <em>y", markup, "<b>x</b> <i>y</i>"},
+		{"<b><u>x</b>y", markup, "<b><u>x</u></b>y"},
+		{"one<br>two<br/>three<BR />", plain, "one\ntwo\nthree"},
+		{`<p class="note">one</p><div>two</div>`, plain, "one\ntwo"},
+		{`<a href="https://example.com/?a=1&amp;b=2">link</a>`, links, `<a href="https://example.com/?a=1&amp;b=2">link</a>`},
+		{`<a href="https://example.com/">link</a>`, markup, "link"},
+		{`<a href='https://example.com/'>link</a>`, plain, "link"},
+		{"<a>link</a>", links, "link"},
+	}
+	for _, tt := range tests {
+		if got := bodyText(tt.text, tt.caps); got != tt.want {
+			t.Errorf("bodyText(%q, %+v) = %q, want %q", tt.text, tt.caps, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/godbus/dbus"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// mdnsServiceType is the DNS-SD service type GNTP servers are advertised as.
+const mdnsServiceType = "_gntp._tcp"
+
+// The well-known name and interfaces of the Avahi daemon, which advertises
+// services over mDNS on the system bus.
+const (
+	avahiName       = "org.freedesktop.Avahi"
+	avahiServer     = "org.freedesktop.Avahi.Server"
+	avahiEntryGroup = "org.freedesktop.Avahi.EntryGroup"
+)
+
+// Avahi's values for any network interface and any protocol, IPv4 or IPv6.
+const (
+	avahiIfUnspec    int32 = -1
+	avahiProtoUnspec int32 = -1
+)
+
+// advertiseService advertises the GNTP server listening on port over mDNS as
+// name, through the Avahi daemon, so GNTP clients on the local network can
+// discover it. It returns a function that withdraws the advertisement.
+func advertiseService(name string, port int) (withdraw func(), err error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	var path dbus.ObjectPath
+	if err := conn.Object(avahiName, "/").Call(avahiServer+".EntryGroupNew", 0).Store(&path); err != nil {
+		return nil, err
+	}
+	group := conn.Object(avahiName, path)
+
+	txt := [][]byte{[]byte("txtvers=1"), []byte("version=" + version)}
+	call := group.Call(avahiEntryGroup+".AddService", 0,
+		avahiIfUnspec, avahiProtoUnspec, uint32(0),
+		name, mdnsServiceType, "", "", uint16(port), txt)
+	if call.Err == nil {
+		call = group.Call(avahiEntryGroup+".Commit", 0)
+	}
+	if call.Err != nil {
+		group.Call(avahiEntryGroup+".Free", 0)
+		return nil, call.Err
+	}
+
+	return func() {
+		if call := group.Call(avahiEntryGroup+".Free", 0); call.Err != nil {
+			slog.Warn("could not withdraw mDNS advertisement", "err", call.Err)
+		}
+	}, nil
+}
+
+// listenPort gives the port to advertise for the server listening on addrs,
+// given as host:port or unix:path, the first TCP port among them, or 0 if
+// there is none.
+func listenPort(addrs []string) int {
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "unix:") {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			if n, err := strconv.Atoi(port); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/metrics"
+	"github.com/jgrocho/gntp_notify/server"
+	"time"
+)
+
+// The metrics exposed by the -metrics-addr listener.
+var (
+	requestsTotal = metrics.NewCounter("gntp_requests_total",
+		"Requests served, by request type and response (OK or the error code).", "type", "response")
+	requestDuration = metrics.NewHistogram("gntp_request_duration_seconds",
+		"Time from accepting a connection to writing the response, by request type.", metrics.DefaultBuckets, "type")
+	parseErrorsTotal = metrics.NewCounter("gntp_parse_errors_total",
+		"Requests that could not be parsed.")
+	activeConnections = metrics.NewGauge("gntp_active_connections",
+		"Connections currently open, including those waiting on a callback.")
+
+	notificationsShown = metrics.NewCounter("gntp_notifications_shown_total",
+		"Notifications shown, by backend.", "backend")
+	notificationsFailed = metrics.NewCounter("gntp_notifications_failed_total",
+		"Notifications the backend failed to show, by backend.", "backend")
+	notificationsSuppressed = metrics.NewCounter("gntp_notifications_suppressed_total",
+		"Notifications not shown on their own, by reason.", "reason")
+
+	cacheLookups = metrics.NewCounter("gntp_cache_lookups_total",
+		"Lookups of files in the cache, by result (hit or miss).", "result")
+)
+
+// cacheLookup counts a lookup in the cache, which found a file if hit.
+func cacheLookup(hit bool) {
+	if hit {
+		cacheLookups.Inc("hit")
+	} else {
+		cacheLookups.Inc("miss")
+	}
+}
+
+// registerCacheMetrics registers the metrics got from the Stats of cache: its
+// evictions, and the number and total size of its files.
+func registerCacheMetrics(cache server.StatBinaries) {
+	metrics.NewCounterFunc("gntp_cache_evictions_total",
+		"Files removed from the cache to make room, or because they expired.",
+		func() float64 { return float64(cache.Stats().Evictions) })
+	metrics.NewGaugeFunc("gntp_cache_files",
+		"Files in the cache.",
+		func() float64 { return float64(cache.Stats().Entries) })
+	metrics.NewGaugeFunc("gntp_cache_bytes",
+		"Total size of the files in the cache.",
+		func() float64 { return float64(cache.Stats().Bytes) })
+}
+
+// serverMetrics implements server.Observer, updating the metrics and expvar
+// statistics for the Server's connections and requests.
+type serverMetrics struct{}
+
+func (serverMetrics) ConnOpened() {
+	activeConnections.Inc()
+	statConnections.Add("active", 1)
+	statConnections.Add("total", 1)
+}
+
+func (serverMetrics) ConnClosed() {
+	activeConnections.Dec()
+	statConnections.Add("active", -1)
+}
+
+func (serverMetrics) ParseFailed(err error) {
+	parseErrorsTotal.Inc()
+}
+
+func (serverMetrics) Served(reqType string, resp *server.Response, elapsed time.Duration) {
+	response := resp.Type
+	if code, ok := resp.Headers[0].Get("Error-Code"); ok {
+		response = code
+	}
+	requestsTotal.Inc(reqType, response)
+	statRequests.Add(reqType, 1)
+	requestDuration.Observe(elapsed.Seconds(), reqType)
+}
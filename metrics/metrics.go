@@ -0,0 +1,347 @@
+/*
+Package metrics provides counters, gauges and histograms, and serves them over
+HTTP in the Prometheus text exposition format.
+
+Metrics are created in a Registry, usually the Default one, and labelled with
+the values given each time they are updated:
+
+	requests := metrics.NewCounter("requests_total", "Requests served.", "type")
+	requests.Inc("NOTIFY")
+	http.Handle("/metrics", metrics.Default)
+
+Values already kept elsewhere can be exposed with a Func, which calls a
+function for the value each time the metrics are written.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a family of values, one for each combination of label values.
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds metrics, and writes them out when served over HTTP.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// NewRegistry allocates and initializes an empty Registry.
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+// Default is the Registry used by NewCounter, NewGauge and NewHistogram.
+var Default = NewRegistry()
+
+// register adds m to the Registry.
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric in the Registry to w, in the Prometheus text
+// exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP writes every metric in the Registry as the response.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// family holds what is common to every kind of metric: its name, help text,
+// label names, and a value for each combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// value gets the value for labelValues, creating it with newValue if there
+// isn't one yet. f.mu must be held.
+func (f *family) value(labelValues []string, newValue func() interface{}) interface{} {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, given %d values", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v, ok := f.values[key]
+	if !ok {
+		v = newValue()
+		f.values[key] = v
+	}
+	return v
+}
+
+// each calls fn with the label values and value of each combination of label
+// values, in order, under f.mu.
+func (f *family) each(fn func(labelValues []string, value interface{})) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var labelValues []string
+		if len(f.labels) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		fn(labelValues, f.values[key])
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of f.
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// labelEscaper escapes the characters with special meaning in label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a line with the value of name for the given labels and
+// values, and any extra label.
+func writeSample(w io.Writer, name string, labels, labelValues []string, extra string, value float64) {
+	pairs := make([]string, 0, len(labels)+1)
+	for i, label := range labels {
+		pairs = append(pairs, label+`="`+labelEscaper.Replace(labelValues[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// formatFloat formats v as Prometheus expects.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	family
+}
+
+// NewCounter creates a Counter in the Default Registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter creates a Counter in the Registry, with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]interface{})}}
+	if len(labels) == 0 {
+		// Without labels, there is a single value from the start.
+		c.Add(0)
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the Counter for labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the Counter for labelValues.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.value(labelValues, func() interface{} { return new(float64) }).(*float64) += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	c.each(func(labelValues []string, value interface{}) {
+		writeSample(w, c.name, c.labels, labelValues, "", *value.(*float64))
+	})
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	family
+}
+
+// NewGauge creates a Gauge in the Default Registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewGauge creates a Gauge in the Registry, with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family{name: name, help: help, kind: "gauge", labels: labels, values: make(map[string]interface{})}}
+	if len(labels) == 0 {
+		g.Add(0)
+	}
+	r.register(g)
+	return g
+}
+
+// Set sets the Gauge for labelValues to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.value(labelValues, func() interface{} { return new(float64) }).(*float64) = v
+}
+
+// Add adds v to the Gauge for labelValues.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.value(labelValues, func() interface{} { return new(float64) }).(*float64) += v
+}
+
+// Inc adds one to the Gauge for labelValues.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts one from the Gauge for labelValues.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeHeader(w)
+	g.each(func(labelValues []string, value interface{}) {
+		writeSample(w, g.name, g.labels, labelValues, "", *value.(*float64))
+	})
+}
+
+// Func is a metric without labels whose value is got from a function each
+// time it is written, for values already kept elsewhere.
+type Func struct {
+	family
+	fn func() float64
+}
+
+// NewGaugeFunc creates a gauge Func in the Default Registry.
+func NewGaugeFunc(name, help string, fn func() float64) *Func {
+	return Default.NewGaugeFunc(name, help, fn)
+}
+
+// NewGaugeFunc creates a gauge Func in the Registry, whose value is got from
+// fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *Func {
+	f := &Func{family{name: name, help: help, kind: "gauge"}, fn}
+	r.register(f)
+	return f
+}
+
+// NewCounterFunc creates a counter Func in the Default Registry.
+func NewCounterFunc(name, help string, fn func() float64) *Func {
+	return Default.NewCounterFunc(name, help, fn)
+}
+
+// NewCounterFunc creates a counter Func in the Registry, whose value is got
+// from fn, which must never decrease.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) *Func {
+	f := &Func{family{name: name, help: help, kind: "counter"}, fn}
+	r.register(f)
+	return f
+}
+
+func (f *Func) write(w io.Writer) {
+	f.writeHeader(w)
+	writeSample(w, f.name, nil, nil, "", f.fn())
+}
+
+// DefaultBuckets are the upper bounds of Histogram buckets suited to the
+// duration, in seconds, of handling a request.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a metric that counts observations in buckets.
+type Histogram struct {
+	family
+	buckets []float64
+}
+
+// histogramValue holds the counts of a Histogram for one combination of label
+// values.
+type histogramValue struct {
+	counts []uint64 // the count of observations in each bucket
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a Histogram in the Default Registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram creates a Histogram in the Registry, with buckets as the sorted
+// upper bounds of its buckets and the given label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family{name: name, help: help, kind: "histogram", labels: labels, values: make(map[string]interface{})},
+		buckets,
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records v in the Histogram for labelValues.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.value(labelValues, func() interface{} {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	}).(*histogramValue)
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.each(func(labelValues []string, value interface{}) {
+		hv := value.(*histogramValue)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hv.counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, labelValues, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, labelValues, `le="+Inf"`, float64(hv.count))
+		writeSample(w, h.name+"_sum", h.labels, labelValues, "", hv.sum)
+		writeSample(w, h.name+"_count", h.labels, labelValues, "", float64(hv.count))
+	})
+}
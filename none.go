@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+)
+
+func init() {
+	registerBackend("none", newNoneBackend)
+}
+
+// noneBackend shows no notifications, for when they are only wanted by the
+// other outputs, such as webhooks or the notification log.
+type noneBackend struct{}
+
+// newNoneBackend builds a Backend showing no notifications.
+func newNoneBackend(opts *BackendOptions) (Backend, error) {
+	return noneBackend{}, nil
+}
+
+// Show reports that note was closed, without showing it.
+func (noneBackend) Show(note *registry.Notification) {
+	note.SendCallback(registry.CallbackClosed)
+}
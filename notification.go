@@ -1,32 +1,29 @@
 package main
 
-// #cgo pkg-config: libnotify
-// #include <stdlib.h>
-// #include <libnotify/notify.h>
-import "C"
 import (
-	"crypto/md5"
-	"fmt"
-	"io"
-	"log"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"log/slog"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
-	"unsafe"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Notification represents a notification.
-type Notification struct {
-	App        *Application
-	Name       string
-	Display    string
-	Enabled    bool
-	Icon       string
-	Id         string
-	Title      string
-	Text       string
-	Sticky     bool
-	Priority   int
-	Coalescing string
+// urgencyNames maps the names of the urgency levels, and their numbers, to
+// the levels.
+var urgencyNames = map[string]NotifyUrgency{
+	"low":      NOTIFY_URGENCY_LOW,
+	"normal":   NOTIFY_URGENCY_NORMAL,
+	"critical": NOTIFY_URGENCY_CRITICAL,
+	"0":        NOTIFY_URGENCY_LOW,
+	"1":        NOTIFY_URGENCY_NORMAL,
+	"2":        NOTIFY_URGENCY_CRITICAL,
 }
 
 // NotifyUrgency represents the urgency of a notification for libnotify.
@@ -48,99 +45,295 @@ const (
 	NOTIFY_EXPIRES_NEVER
 )
 
-// processNotification sends the notification to libnotify.
-func processNotification(note *Notification, cache *FileCache) {
-	if inited := bool(C.notify_is_initted() != 0); !inited {
-		// We might be able to initialize libnotify here, if doing so is thread
-		// safe and can be called multiple times.
-		log.Println("gntp: libnotify is not initted")
+// The reasons the notification server gives for a notification closing.
+const (
+	closedExpired   = 1
+	closedDismissed = 2
+	closedByCall    = 3
+)
+
+// closedResult gives the CallbackResult for a notification closed for reason.
+func closedResult(reason int) registry.CallbackResult {
+	if reason == closedExpired {
+		return registry.CallbackTimedOut
+	}
+	return registry.CallbackClosed
+}
+
+// shownNotification holds what is needed to handle the signals (clicks on
+// action buttons, closing) for a notification on screen.
+type shownNotification struct {
+	note      *registry.Notification
+	clipboard string
+}
+
+// actionInvoked handles a click on the action button with key for sn.
+func (sn *shownNotification) actionInvoked(key string) {
+	if key == "copy" {
+		go func() {
+			if err := copyToClipboard(sn.clipboard); err != nil {
+				slog.Warn("gntp: could not copy to clipboard", "err", err)
+			}
+		}()
 		return
 	}
 
-	notify_title := C.CString(note.Title)
-	defer C.free(unsafe.Pointer(notify_title))
+	for _, action := range sn.note.Actions {
+		if action.Key != key {
+			continue
+		}
+		event := registry.CallbackEvent{Result: registry.CallbackClicked}
+		if key != registry.DefaultAction {
+			event.Action = key
+		}
+		sn.note.SendCallbackEvent(event)
+		if sn.note.CallbackTarget != "" {
+			go openCallbackTarget(sn.note.CallbackTarget)
+		}
+		return
+	}
+}
+
+// openCallbackTarget opens the URL a notification's callback targets. Only
+// http and https URLs are opened: the target comes from the client, and
+// xdg-open would as well open local files, or run whatever handles any other
+// scheme.
+func openCallbackTarget(target string) {
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		slog.Warn("gntp: ignored callback target not an http or https URL", "target", target)
+		return
+	}
+	if err := exec.Command("xdg-open", target).Run(); err != nil {
+		slog.Warn("gntp: could not open callback target", "target", target, "err", err)
+	}
+}
 
-	notify_text := C.CString(note.Text)
-	defer C.free(unsafe.Pointer(notify_text))
+// inCache reports whether the file at path is inside the directory of files,
+// once any symbolic links are resolved.
+func inCache(files *cache.FileCache, path string) bool {
+	dir, err := filepath.EvalSymlinks(files.Dir())
+	if err != nil {
+		return false
+	}
+	return IconDirs{dir}.allows(path)
+}
 
-	notify_icon := C.CString("")
+// iconFileName gets the file name of the icon for note from files, or from
+// one of dirs if it is a local file, or the empty string if it has none.
+// Local files chosen by the user need not be in dirs.
+func iconFileName(note *registry.Notification, files *cache.FileCache, dirs IconDirs) string {
 	icon := note.Icon
 	var iconFileName string
-	if strings.HasPrefix(strings.ToLower(icon), "x-growl-resource://") {
-		icon = icon[19:]
-		iconFileName = cache.GetFileName(icon)
+	if binaryReference(icon) {
+		ident, ok := server.ResourceIdent(icon)
+		if !ok {
+			return ""
+		}
+		iconFileName = files.GetFileName(ident)
+		if iconFileName != "" && !inCache(files, iconFileName) {
+			slog.Warn("gntp: icon not in the cache directory", "icon", icon, "app", note.App.Name, "name", note.Name)
+			return ""
+		}
+	} else if path, ok := registry.LocalIconPath(icon); ok {
+		if !note.UserIcon && !dirs.allows(path) {
+			slog.Warn("gntp: icon not in an allowed directory", "icon", path, "app", note.App.Name, "name", note.Name)
+			return ""
+		}
+		iconFileName = path
 	} else if icon != "" {
-		hash := md5.New()
-		io.WriteString(hash, icon)
-		sum := fmt.Sprintf("%x", hash.Sum(nil))
-		iconFileName = cache.GetFileName(sum)
+		iconFileName = files.GetFileName(cache.URLKey(icon))
 	}
-	if _, err := os.Stat(iconFileName); err == nil {
-		notify_icon = C.CString(iconFileName)
+	if _, err := os.Stat(iconFileName); err != nil {
+		return ""
 	}
-	defer C.free(unsafe.Pointer(notify_icon))
-
-	notify_notification := C.notify_notification_new(notify_title, notify_text, notify_icon)
-	// TODO: Find the correct way to free notify_notification.
-	//defer C.free(unsafe.Pointer(&notify_notification))
-
-	notify_app_name := C.CString(note.App.Name)
-	C.notify_notification_set_app_name(notify_notification, notify_app_name)
-	defer C.free(unsafe.Pointer(notify_app_name))
+	return iconFileName
+}
 
-	var urgency NotifyUrgency
+// urgency gives the NotifyUrgency of note: that its hints give, or else the
+// one its GNTP priority maps to.
+func urgency(note *registry.Notification) NotifyUrgency {
+	if u, ok := urgencyNames[note.Hints.Urgency]; ok {
+		return u
+	}
 	switch note.Priority {
 	case -2, -1:
-		urgency = NOTIFY_URGENCY_LOW
+		return NOTIFY_URGENCY_LOW
 	case 0:
-		urgency = NOTIFY_URGENCY_NORMAL
+		return NOTIFY_URGENCY_NORMAL
 	case 1, 2:
-		urgency = NOTIFY_URGENCY_CRITICAL
-	default:
-		log.Printf("gntp: unknown priority %v for notification %v from app %v\n", note.Priority, note.Name, note.App.Name)
-		urgency = NOTIFY_URGENCY_NORMAL
+		return NOTIFY_URGENCY_CRITICAL
 	}
-	notify_urgency := C.NotifyUrgency(urgency)
-	C.notify_notification_set_urgency(notify_notification, notify_urgency)
+	slog.Warn("gntp: unknown priority", "priority", note.Priority, "app", note.App.Name, "name", note.Name)
+	return NOTIFY_URGENCY_NORMAL
+}
 
-	timeout := NOTIFY_EXPIRES_DEFAULT
+// timeout gives the NotifyTimeout for note.
+func timeout(note *registry.Notification) NotifyTimeout {
 	if note.Sticky {
-		timeout = NOTIFY_EXPIRES_NEVER
+		return NOTIFY_EXPIRES_NEVER
 	}
-	notify_timeout := C.gint(timeout)
-	C.notify_notification_set_timeout(notify_notification, notify_timeout)
+	return NOTIFY_EXPIRES_DEFAULT
+}
 
-	// Actually show the notification and report any error.
-	var err *C.GError
-	if shown := bool(C.notify_notification_show(notify_notification, &err) != 0); shown {
-		log.Printf("Notification %s shown\n", note.Id)
-	} else {
-		log.Printf("Notification %s not shown\n", note.Id)
-		if err != nil {
-			message := C.GoString((*C.char)(err.message))
-			log.Printf("  %s\n", message)
-		}
+// customHints gives the hints passing the custom headers of note on to the
+// notification server, as vendor-specific x-gntp-<header> hints holding the
+// first value of each header.
+func customHints(note *registry.Notification) map[string]string {
+	hints := make(map[string]string, len(note.Custom))
+	for key, values := range note.Custom {
+		hints["x-gntp-"+strings.ToLower(key)] = values[0]
 	}
+	return hints
 }
 
-// NotificationChannel builds and returns a channel for Notifications.
-func NotificationChannel(cache *FileCache) chan *Notification {
-	c := make(chan *Notification)
+// standardHints gives the hints passing the DesktopHints of note, other than
+// its urgency, and its Progress on to the notification server: strings,
+// booleans and integers.
+func standardHints(note *registry.Notification) map[string]interface{} {
+	hints := make(map[string]interface{})
+	if note.Hints.DesktopEntry != "" {
+		hints["desktop-entry"] = note.Hints.DesktopEntry
+	}
+	if note.Hints.Category != "" {
+		hints["category"] = note.Hints.Category
+	}
+	if note.Hints.Transient {
+		hints["transient"] = true
+	}
+	if note.Hints.Resident {
+		hints["resident"] = true
+	}
+	if note.Progress != nil {
+		hints["value"] = int32(*note.Progress)
+	}
+	return hints
+}
 
-	go func() {
-		// libnotify needs a default app name when initialized. This will be
-		// changed later.
-		appName := C.CString("gntp_notify")
-		defer C.free(unsafe.Pointer(appName))
-		if inited := bool(C.notify_init(appName) != 0); !inited {
-			log.Fatalf("gntp: Could not initialize libnotify")
-		}
-		defer C.notify_uninit()
+// NotificationChannel builds and returns a channel for Notifications, which
+// are shown by backend from a pool of workers goroutines. Sending on the
+// channel doesn't wait for notifications to be shown: they wait in a queue of
+// up to queueSize, and when it is full the oldest waiting is dropped. Whether
+// each was shown or dropped is recorded in history. Notifications are kept in
+// pending until then, including while the backend can't show them.
+func NotificationChannel(backend Backend, workers, queueSize int, history NotificationLog, pending *PendingNotifications) chan *registry.Notification {
+	c := make(chan *registry.Notification)
+	queue := newNotificationQueue(queueSize)
 
-		for {
-			processNotification(<-c, cache)
+	go func() {
+		for note := range c {
+			pending.Add(note)
+			if dropped := queue.push(note); dropped != nil {
+				pending.Remove(dropped)
+				slog.Warn("gntp: notification queue full, dropping oldest", "app", dropped.App.Name, "name", dropped.Name, "id", dropped.Id)
+				notificationsSuppressed.Inc("queue_full")
+				dropped.SendCallback(registry.CallbackClosed)
+				history.Add(dropped, outcomeDropped)
+			}
 		}
+		queue.close()
 	}()
 
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				note, ok := queue.pop()
+				if !ok {
+					return
+				}
+				waitForBackend(backend)
+				history.Add(note, outcomeShown)
+				backend.Show(note)
+				pending.Remove(note)
+			}
+		}()
+	}
+
 	return c
 }
+
+// backendRetryInterval is how often a backend that can't show notifications
+// is checked again.
+const backendRetryInterval = 5 * time.Second
+
+// waitForBackend waits until backend can show notifications, if it can tell.
+func waitForBackend(backend Backend) {
+	checked, ok := backend.(CheckedBackend)
+	if !ok {
+		return
+	}
+	err := checked.Check()
+	if err == nil {
+		return
+	}
+	slog.Warn("gntp: backend can't show notifications, waiting", "err", err)
+	for err != nil {
+		time.Sleep(backendRetryInterval)
+		err = checked.Check()
+	}
+	slog.Info("gntp: backend can show notifications again")
+}
+
+// notificationQueue is a bounded queue of Notifications waiting to be shown.
+// It is safe for concurrent use.
+type notificationQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	notes  []*registry.Notification
+	size   int
+	closed bool
+}
+
+func newNotificationQueue(size int) *notificationQueue {
+	if size < 1 {
+		size = 1
+	}
+	queue := &notificationQueue{size: size}
+	queue.cond = sync.NewCond(&queue.mu)
+	return queue
+}
+
+// push adds note to the end of the queue. If the queue was full, the note at
+// its front is removed to make room, and returned.
+func (queue *notificationQueue) push(note *registry.Notification) (dropped *registry.Notification) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.notes) >= queue.size {
+		dropped = queue.notes[0]
+		queue.notes[0] = nil
+		queue.notes = queue.notes[1:]
+	} else {
+		atomic.AddInt64(&notificationsPending, 1)
+	}
+	queue.notes = append(queue.notes, note)
+	queue.cond.Signal()
+	return dropped
+}
+
+// pop waits for a note and removes it from the front of the queue. It returns
+// false once the queue is closed and empty.
+func (queue *notificationQueue) pop() (*registry.Notification, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for len(queue.notes) == 0 {
+		if queue.closed {
+			return nil, false
+		}
+		queue.cond.Wait()
+	}
+	note := queue.notes[0]
+	queue.notes[0] = nil
+	queue.notes = queue.notes[1:]
+	atomic.AddInt64(&notificationsPending, -1)
+	return note, true
+}
+
+// close wakes the workers waiting on an empty queue, so they can return.
+func (queue *notificationQueue) close() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.closed = true
+	queue.cond.Broadcast()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIconFileNameResources(t *testing.T) {
+	dir := t.TempDir()
+	files := cache.NewFileCache(filepath.Join(dir, "cache"))
+	os.MkdirAll(files.Dir(), 0755)
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	if err := files.Put("abc", png); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "outside.png")
+	if err := os.WriteFile(outside, png, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(files.Dir(), "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		icon string
+		ok   bool
+	}{
+		{"x-growl-resource://abc", true},
+		{"X-Growl-Resource://abc", true},
+		{"x-growl-resource://missing", false},
+		{"x-growl-resource://../outside.png", false},
+		{"x-growl-resource://link", false},
+	}
+	for _, tt := range tests {
+		note := &registry.Notification{App: &registry.Application{Name: "Test"}, Name: "Test", Icon: tt.icon}
+		name := iconFileName(note, files, nil)
+		if tt.ok && name != files.GetFileName("abc") {
+			t.Errorf("icon %q: file %q, want %q", tt.icon, name, files.GetFileName("abc"))
+		}
+		if !tt.ok && name != "" {
+			t.Errorf("icon %q: file %q, want none", tt.icon, name)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"io/ioutil"
+	"strconv"
+	"text/template"
+)
+
+// Overrides holds the user's rules for what notifications look like, which
+// take precedence over what applications ask for. They are read from a JSON
+// file:
+//
+//	{
+//	  "applications": {
+//	    "Chatty": {"mute": true},
+//	    "Monitor": {"min_priority": 1},
+//	    "Mail": {
+//	      "icon": "/usr/share/icons/hicolor/48x48/apps/mail.png",
+//	      "fallback_icon": "mail-unread",
+//	      "text_template": "{{.Header \"X-From\"}}: {{truncate 80 .Text}}",
+//	      "hints": {"desktop_entry": "thunderbird", "category": "email.arrived"},
+//	      "priorities": {"2": 0},
+//	      "notifications": {
+//	        "New Mail": {"priority": 1},
+//	        "Sync Error": {"enabled": false}
+//	      }
+//	    }
+//	  }
+//	}
+type Overrides struct {
+	Applications map[string]*ApplicationOverride `json:"applications"`
+}
+
+// ApplicationOverride holds the rules for an application. The rules for its
+// notification types apply on top of those for the application as a whole.
+type ApplicationOverride struct {
+	// Mute stops every notification from the application being shown.
+	Mute bool `json:"mute"`
+	// MinPriority, if not nil, replaces -min-priority for the application:
+	// its notifications below it are not shown.
+	MinPriority *int `json:"min_priority"`
+	NotificationOverride
+	Notifications map[string]*NotificationOverride `json:"notifications"`
+}
+
+// NotificationOverride holds the rules for notifications.
+type NotificationOverride struct {
+	// Enabled, if not nil, enables or disables the notifications, whatever
+	// was chosen for them before.
+	Enabled *bool `json:"enabled"`
+	// Priority, if not nil, replaces the priority of the notifications.
+	Priority *int `json:"priority"`
+	// Priorities replaces the priorities of the notifications given by its
+	// keys with its values.
+	Priorities map[string]int `json:"priorities"`
+	// Icon, if not empty, replaces the icon of the notifications: a URL, or
+	// a local file, which need not be in an -icon-dir.
+	Icon string `json:"icon"`
+	// FallbackIcon, if not empty, is the icon of the notifications that
+	// have none, or whose icon couldn't be downloaded: a URL, a local file,
+	// or the name of an icon in the desktop's theme.
+	FallbackIcon string `json:"fallback_icon"`
+	// Hints sets those of the standard hints of the notifications given.
+	Hints *registry.DesktopHints `json:"hints"`
+	// TitleTemplate and TextTemplate, if not empty, are the text/template
+	// templates the title and text of the notifications are replaced with,
+	// executed on their TemplateData.
+	TitleTemplate string `json:"title_template"`
+	TextTemplate  string `json:"text_template"`
+
+	// priorities is Priorities with its keys parsed.
+	priorities map[int]int
+	// titleTemplate and textTemplate are TitleTemplate and TextTemplate
+	// parsed.
+	titleTemplate, textTemplate *template.Template
+}
+
+// LoadOverrides reads Overrides from the JSON file at path.
+func LoadOverrides(path string) (*Overrides, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	overrides := new(Overrides)
+	if err := dec.Decode(overrides); err != nil {
+		return nil, err
+	}
+
+	for app, ao := range overrides.Applications {
+		if ao == nil {
+			return nil, errors.New("no rules for " + app)
+		}
+		if ao.MinPriority != nil && !validPriority(*ao.MinPriority) {
+			return nil, fmt.Errorf("%s: minimum priority %d: priorities are from -2 to 2", app, *ao.MinPriority)
+		}
+		if err := ao.NotificationOverride.init(); err != nil {
+			return nil, fmt.Errorf("%s: %w", app, err)
+		}
+		for name, no := range ao.Notifications {
+			if no == nil {
+				return nil, errors.New("no rules for " + app + ": " + name)
+			}
+			if err := no.init(); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", app, name, err)
+			}
+		}
+	}
+	return overrides, nil
+}
+
+// validPriority reports whether p is a GNTP priority.
+func validPriority(p int) bool {
+	return p >= -2 && p <= 2
+}
+
+// init checks the priorities and urgency of no and parses its Priorities and
+// templates.
+func (no *NotificationOverride) init() (err error) {
+	if no.Hints != nil && no.Hints.Urgency != "" {
+		urgency, err := registry.ParseUrgency(no.Hints.Urgency)
+		if err != nil {
+			return err
+		}
+		no.Hints.Urgency = urgency
+	}
+	if no.Priority != nil && !validPriority(*no.Priority) {
+		return fmt.Errorf("priority %d: priorities are from -2 to 2", *no.Priority)
+	}
+	no.priorities = make(map[int]int, len(no.Priorities))
+	for from, to := range no.Priorities {
+		p, err := strconv.Atoi(from)
+		if err != nil || !validPriority(p) || !validPriority(to) {
+			return fmt.Errorf("priorities %q to %d: priorities are from -2 to 2", from, to)
+		}
+		no.priorities[p] = to
+	}
+	if no.TitleTemplate != "" {
+		if no.titleTemplate, err = parseTemplate("title_template", no.TitleTemplate); err != nil {
+			return err
+		}
+	}
+	if no.TextTemplate != "" {
+		if no.textTemplate, err = parseTemplate("text_template", no.TextTemplate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply applies the rules for note, fetching any icon they give by URL with
+// downloads. It reports whether note's application is muted, and so note
+// should not be shown. A nil Overrides has no rules.
+func (overrides *Overrides) Apply(note *registry.Notification, downloads *cache.Downloader) (muted bool) {
+	if overrides == nil {
+		return false
+	}
+	ao, ok := overrides.Applications[note.App.Name]
+	if !ok {
+		return false
+	}
+	if ao.Mute {
+		return true
+	}
+	ao.NotificationOverride.apply(note, downloads)
+	if no, ok := ao.Notifications[note.Name]; ok {
+		no.apply(note, downloads)
+	}
+	return false
+}
+
+// MinPriority gives the lowest priority of the notifications from the
+// application named app that are shown, which is min unless the rules for
+// app replace it. A nil Overrides has no rules.
+func (overrides *Overrides) MinPriority(app string, min int) int {
+	if overrides == nil {
+		return min
+	}
+	if ao, ok := overrides.Applications[app]; ok && ao.MinPriority != nil {
+		return *ao.MinPriority
+	}
+	return min
+}
+
+// apply applies the rules in no to note.
+func (no *NotificationOverride) apply(note *registry.Notification, downloads *cache.Downloader) {
+	if no.Enabled != nil {
+		note.Enabled = *no.Enabled
+		note.EnabledByUser = true
+	}
+	if to, ok := no.priorities[note.Priority]; ok {
+		note.Priority = to
+	}
+	if no.Priority != nil {
+		note.Priority = *no.Priority
+	}
+	if no.Hints != nil {
+		note.Hints.Merge(no.Hints)
+	}
+	if no.Icon != "" {
+		note.Icon = no.Icon
+		note.UserIcon = true
+		if registry.RemoteIcon(note.Icon) {
+			downloads.Fetch(note.Icon)
+		}
+	}
+	if no.FallbackIcon != "" {
+		note.FallbackIcon = no.FallbackIcon
+		if !themeIcon(note.FallbackIcon) && registry.RemoteIcon(note.FallbackIcon) {
+			downloads.Fetch(note.FallbackIcon)
+		}
+	}
+	// Both templates see the title and text as they were before either.
+	if no.titleTemplate != nil || no.textTemplate != nil {
+		data := newTemplateData(note)
+		if title, ok := executeTemplate(no.titleTemplate, data); ok {
+			note.Title = title
+		}
+		if text, ok := executeTemplate(no.textTemplate, data); ok {
+			note.Text = text
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jgrocho/gntp_notify/cache"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pendingFile is the file in the cache's directory the notifications not yet
+// shown when gntp_notify exits are saved to, as JSON, to be shown once it
+// starts again.
+const pendingFile = ".pending.json"
+
+// PendingNotifications keeps the notifications waiting to be shown, while
+// they are queued, held for a digest or for quiet hours, or waiting for the
+// backend, so they can be saved when gntp_notify exits. It is safe for
+// concurrent use.
+type PendingNotifications struct {
+	mu    sync.Mutex
+	notes map[*registry.Notification]time.Time
+}
+
+// NewPendingNotifications allocates and initializes PendingNotifications.
+func NewPendingNotifications() *PendingNotifications {
+	return &PendingNotifications{notes: make(map[*registry.Notification]time.Time)}
+}
+
+// Add keeps note until it is removed. Adding a note already kept doesn't
+// change when it was received.
+func (pending *PendingNotifications) Add(note *registry.Notification) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if _, ok := pending.notes[note]; !ok {
+		pending.notes[note] = time.Now()
+	}
+}
+
+// Remove stops keeping note, once it is shown or dropped.
+func (pending *PendingNotifications) Remove(note *registry.Notification) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	delete(pending.notes, note)
+}
+
+// list gives the notifications kept, in the order they were received.
+func (pending *PendingNotifications) list() []heldNotification {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	list := make([]heldNotification, 0, len(pending.notes))
+	for note, received := range pending.notes {
+		list = append(list, heldNotification{note, received})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].received.Before(list[j].received)
+	})
+	return list
+}
+
+// savedNotification is a Notification as saved to pendingFile. Clients
+// waiting on a callback have gone by the time it is shown, so only callbacks
+// to a target are kept.
+type savedNotification struct {
+	Received            time.Time                     `json:"received"`
+	Application         string                        `json:"application"`
+	Name                string                        `json:"name"`
+	Display             string                        `json:"display,omitempty"`
+	Icon                string                        `json:"icon,omitempty"`
+	UserIcon            bool                          `json:"user_icon,omitempty"`
+	FallbackIcon        string                        `json:"fallback_icon,omitempty"`
+	Id                  string                        `json:"id,omitempty"`
+	Title               string                        `json:"title"`
+	Text                string                        `json:"text,omitempty"`
+	Sticky              bool                          `json:"sticky,omitempty"`
+	Priority            int                           `json:"priority"`
+	Coalescing          string                        `json:"coalescing,omitempty"`
+	Sound               string                        `json:"sound,omitempty"`
+	Custom              server.Header                 `json:"custom,omitempty"`
+	Hints               registry.DesktopHints         `json:"hints"`
+	Progress            *int                          `json:"progress,omitempty"`
+	CallbackContext     string                        `json:"callback_context,omitempty"`
+	CallbackContextType string                        `json:"callback_context_type,omitempty"`
+	CallbackTarget      string                        `json:"callback_target,omitempty"`
+	Actions             []registry.NotificationAction `json:"actions,omitempty"`
+	ShownId             uint32                        `json:"shown_id,omitempty"`
+}
+
+// savedNotifications is the content of pendingFile.
+type savedNotifications struct {
+	// Pending are the notifications that were waiting to be shown, or
+	// were sticky and still on screen.
+	Pending []savedNotification `json:"pending"`
+	// DND is whether do not disturb was on, and Held the notifications it
+	// was holding.
+	DND  bool                `json:"dnd"`
+	Held []savedNotification `json:"held"`
+}
+
+// saveNotification converts h for saving.
+func saveNotification(h heldNotification) savedNotification {
+	note := h.note
+	return savedNotification{
+		Received:            h.received,
+		Application:         note.App.Name,
+		Name:                note.Name,
+		Display:             note.Display,
+		Icon:                note.Icon,
+		UserIcon:            note.UserIcon,
+		FallbackIcon:        note.FallbackIcon,
+		Id:                  note.Id,
+		Title:               note.Title,
+		Text:                note.Text,
+		Sticky:              note.Sticky,
+		Priority:            note.Priority,
+		Coalescing:          note.Coalescing,
+		Sound:               note.Sound,
+		Custom:              note.Custom,
+		Hints:               note.Hints,
+		Progress:            note.Progress,
+		CallbackContext:     note.CallbackContext,
+		CallbackContextType: note.CallbackContextType,
+		CallbackTarget:      note.CallbackTarget,
+		Actions:             note.Actions,
+		ShownId:             note.ShownId,
+	}
+}
+
+// restore converts saved back into a notification, from the application
+// registered in apps, or one with just its name if it hasn't registered
+// since.
+func (saved *savedNotification) restore(apps *registry.Applications) heldNotification {
+	app := apps.Get(saved.Application)
+	if app == nil {
+		app = &registry.Application{Name: saved.Application}
+	}
+	note := &registry.Notification{
+		App:                 app,
+		Name:                saved.Name,
+		Display:             saved.Display,
+		Enabled:             true,
+		Icon:                saved.Icon,
+		UserIcon:            saved.UserIcon,
+		FallbackIcon:        saved.FallbackIcon,
+		Id:                  saved.Id,
+		Title:               saved.Title,
+		Text:                saved.Text,
+		Sticky:              saved.Sticky,
+		Priority:            saved.Priority,
+		Coalescing:          saved.Coalescing,
+		Sound:               saved.Sound,
+		Custom:              saved.Custom,
+		Hints:               saved.Hints,
+		Progress:            saved.Progress,
+		CallbackContext:     saved.CallbackContext,
+		CallbackContextType: saved.CallbackContextType,
+		CallbackTarget:      saved.CallbackTarget,
+		Actions:             saved.Actions,
+		ShownId:             saved.ShownId,
+	}
+	return heldNotification{note, saved.Received}
+}
+
+// SavePending saves the notifications in pending, the sticky ones among those
+// on screen, and the state of dnd, to pendingFile in dir, or removes the file
+// if there are none.
+func SavePending(dir string, pending *PendingNotifications, displayed []*registry.Notification, dnd *DoNotDisturb) (int, error) {
+	var saved savedNotifications
+	for _, h := range pending.list() {
+		saved.Pending = append(saved.Pending, saveNotification(h))
+	}
+	for _, note := range displayed {
+		if note.Sticky {
+			saved.Pending = append(saved.Pending, saveNotification(heldNotification{note, time.Now()}))
+		}
+	}
+	var held []heldNotification
+	saved.DND, held = dnd.state()
+	for _, h := range held {
+		saved.Held = append(saved.Held, saveNotification(h))
+	}
+
+	path := filepath.Join(dir, pendingFile)
+	count := len(saved.Pending) + len(saved.Held)
+	if count == 0 && !saved.DND {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return 0, err
+	}
+	// Write a temporary file the cache removes, if it is left behind.
+	temp := filepath.Join(dir, cache.TempFilePrefix+"pending")
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return 0, err
+	}
+	return count, nil
+}
+
+// RestorePending reads the notifications saved to pendingFile in dir, and
+// removes it. The notifications that were pending are sent to notes, in a new
+// goroutine, and do not disturb is set as it was, holding what it held. It
+// returns the number of notifications restored.
+func RestorePending(dir string, apps *registry.Applications, notes chan<- *registry.Notification, dnd *DoNotDisturb) (int, error) {
+	path := filepath.Join(dir, pendingFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	os.Remove(path)
+	var saved savedNotifications
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, err
+	}
+
+	held := make([]heldNotification, len(saved.Held))
+	for i := range saved.Held {
+		held[i] = saved.Held[i].restore(apps)
+	}
+	dnd.restore(saved.DND, held)
+
+	pending := make([]*registry.Notification, len(saved.Pending))
+	for i := range saved.Pending {
+		pending[i] = saved.Pending[i].restore(apps).note
+	}
+	go func() {
+		for _, note := range pending {
+			notes <- note
+		}
+	}()
+	return len(pending) + len(held), nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// quietCheckInterval is how often notifications held for quiet hours are
+// checked for whether they may now be shown.
+const quietCheckInterval = time.Minute
+
+// The ways notifications during quiet hours are kept from being shown.
+const (
+	// QuietHold holds them back until the quiet hours end.
+	QuietHold = "hold"
+	// QuietSuppress drops them.
+	QuietSuppress = "suppress"
+)
+
+// QuietPeriod is a period of the day, on some days of the week, when
+// notifications are kept quiet. A period ending before it starts runs past
+// midnight, into the next day.
+type QuietPeriod struct {
+	// Days are the days of the week the period starts on, indexed by
+	// time.Weekday.
+	Days [7]bool
+	// Start and End are the minutes since midnight the period starts and
+	// ends at.
+	Start, End int
+}
+
+// quietDays maps the names of days, and of sets of days, to the days.
+var quietDays = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// ParseQuietPeriod parses a QuietPeriod given as [days ]HH:MM-HH:MM, where
+// days is a comma separated list of days (mon, tue, ...), ranges of days
+// (mon-fri), weekdays or weekends. Without days, the period is every day.
+func ParseQuietPeriod(s string) (QuietPeriod, error) {
+	var period QuietPeriod
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		for day := range period.Days {
+			period.Days[day] = true
+		}
+	case 2:
+		for _, name := range strings.Split(strings.ToLower(fields[0]), ",") {
+			days, err := parseQuietDays(name)
+			if err != nil {
+				return period, err
+			}
+			for _, day := range days {
+				period.Days[day] = true
+			}
+		}
+	default:
+		return period, errors.New("invalid quiet hours " + s + ": give [days ]HH:MM-HH:MM")
+	}
+
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return period, errors.New("invalid quiet hours " + s + ": give [days ]HH:MM-HH:MM")
+	}
+	var err error
+	if period.Start, err = parseMinutes(times[0]); err != nil {
+		return period, err
+	}
+	if period.End, err = parseMinutes(times[1]); err != nil {
+		return period, err
+	}
+	if period.Start == period.End {
+		return period, errors.New("invalid quiet hours " + s + ": the period is empty")
+	}
+	return period, nil
+}
+
+// parseQuietDays parses the name of a day, a set of days, or a range of days
+// such as mon-fri.
+func parseQuietDays(name string) ([]time.Weekday, error) {
+	if days, ok := quietDays[name]; ok {
+		return days, nil
+	}
+	if i := strings.Index(name, "-"); i >= 0 {
+		from, okFrom := quietDays[name[:i]]
+		to, okTo := quietDays[name[i+1:]]
+		if okFrom && okTo && len(from) == 1 && len(to) == 1 {
+			var days []time.Weekday
+			for day := from[0]; ; day = (day + 1) % 7 {
+				days = append(days, day)
+				if day == to[0] {
+					return days, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("unknown days " + name)
+}
+
+// parseMinutes parses a time of day given as HH:MM into the minutes since
+// midnight. 24:00 is midnight at the end of the day.
+func parseMinutes(s string) (int, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil || n != 2 ||
+		hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, errors.New("invalid time " + s + ": give HH:MM")
+	}
+	return hours*60 + minutes, nil
+}
+
+// contains reports whether t is within the period.
+func (period QuietPeriod) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	if period.Start < period.End {
+		return period.Days[today] && minute >= period.Start && minute < period.End
+	}
+	// The period runs past midnight: it is either in its first part,
+	// started today, or in its second part, started yesterday.
+	yesterday := (today + 6) % 7
+	return (period.Days[today] && minute >= period.Start) ||
+		(period.Days[yesterday] && minute < period.End)
+}
+
+// QuietHours implements flag.Value for a list of QuietPeriods.
+type QuietHours []QuietPeriod
+
+// String returns the number of periods, as they are not kept as given.
+func (qh *QuietHours) String() string {
+	return fmt.Sprintf("%d periods", len(*qh))
+}
+
+// Set parses and adds a period.
+func (qh *QuietHours) Set(value string) error {
+	period, err := ParseQuietPeriod(value)
+	if err != nil {
+		return err
+	}
+	*qh = append(*qh, period)
+	return nil
+}
+
+// Quiet reports whether t is within any of the periods.
+func (qh QuietHours) Quiet(t time.Time) bool {
+	for _, period := range qh {
+		if period.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// QuietHoursChannel builds and returns a channel for Notifications that
+// passes them on to out, except those below priority during quiet hours:
+// each is checked as it comes, and those kept quiet are held until the quiet
+// hours end, or dropped, as chosen by action. Either is recorded in history,
+// and those held are kept in pending.
+func QuietHoursChannel(hours QuietHours, priority int, action string, out chan<- *registry.Notification, history NotificationLog, pending *PendingNotifications) chan *registry.Notification {
+	c := make(chan *registry.Notification)
+
+	go func() {
+		var held []*registry.Notification
+		ticker := time.NewTicker(quietCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case note := <-c:
+				if note.Priority >= priority || !hours.Quiet(time.Now()) {
+					out <- note
+					continue
+				}
+				notificationsSuppressed.Inc("quiet_hours")
+				note.SendCallback(registry.CallbackClosed)
+				history.Add(note, outcomeQuiet)
+				if action == QuietSuppress {
+					slog.Debug("gntp: not showing notification during quiet hours", "app", note.App.Name, "name", note.Name)
+					continue
+				}
+				slog.Debug("gntp: holding notification until quiet hours end", "app", note.App.Name, "name", note.Name)
+				if len(held) >= dndMaxHeld {
+					slog.Warn("gntp: too many notifications held for quiet hours, dropping oldest", "app", held[0].App.Name, "name", held[0].Name)
+					pending.Remove(held[0])
+					held = held[1:]
+					atomic.AddInt64(&quietPending, -1)
+				}
+				pending.Add(note)
+				held = append(held, note)
+				atomic.AddInt64(&quietPending, 1)
+			case <-ticker.C:
+				if len(held) == 0 || hours.Quiet(time.Now()) {
+					continue
+				}
+				slog.Info("gntp: quiet hours ended, showing held notifications", "count", len(held))
+				atomic.AddInt64(&quietPending, -int64(len(held)))
+				for _, note := range held {
+					pending.Remove(note)
+					out <- note
+				}
+				held = nil
+			}
+		}
+	}()
+
+	return c
+}
+
+// parseQuietAction checks action is a way of keeping notifications quiet.
+func parseQuietAction(action string) (string, error) {
+	switch action {
+	case QuietHold, QuietSuppress:
+		return action, nil
+	}
+	return "", errors.New("unknown quiet hours action " + action + " (available: hold, suppress)")
+}
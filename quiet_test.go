@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// days builds the Days of a QuietPeriod.
+func days(weekdays ...time.Weekday) (d [7]bool) {
+	for _, day := range weekdays {
+		d[day] = true
+	}
+	return d
+}
+
+func TestParseQuietPeriod(t *testing.T) {
+	every := days(0, 1, 2, 3, 4, 5, 6)
+	tests := []struct {
+		s    string
+		want QuietPeriod
+	}{
+		{"22:00-07:00", QuietPeriod{every, 22 * 60, 7 * 60}},
+		{"mon-fri 09:00-17:30", QuietPeriod{days(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday), 9 * 60, 17*60 + 30}},
+		{"sat-mon 10:00-12:00", QuietPeriod{days(time.Saturday, time.Sunday, time.Monday), 10 * 60, 12 * 60}},
+		{"Weekends,wed 08:00-24:00", QuietPeriod{days(time.Saturday, time.Sunday, time.Wednesday), 8 * 60, 24 * 60}},
+		{"weekdays 0:00-1:05", QuietPeriod{days(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday), 0, 65}},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuietPeriod(tt.s)
+		if err != nil {
+			t.Errorf("ParseQuietPeriod(%q): %v", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseQuietPeriod(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"22:00",
+		"22:00-07:00-08:00",
+		"mon fri 10:00-11:00",
+		"funday 10:00-11:00",
+		"mon-weekends 10:00-11:00",
+		"mon- 10:00-11:00",
+		"10:00-10:00",
+		"24:01-01:00",
+		"10:60-11:00",
+		"ab:cd-11:00",
+		"10-11",
+	} {
+		if _, err := ParseQuietPeriod(s); err == nil {
+			t.Errorf("ParseQuietPeriod(%q) accepted", s)
+		}
+	}
+}
+
+func TestQuietPeriodContains(t *testing.T) {
+	// at gives a time on a day of the week: 1 January 2024 was a Monday.
+	at := func(day time.Weekday, hour, minute int) time.Time {
+		return time.Date(2024, time.January, 7+int(day), hour, minute, 0, 0, time.Local)
+	}
+	parse := func(s string) QuietPeriod {
+		period, err := ParseQuietPeriod(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return period
+	}
+	tests := []struct {
+		period string
+		t      time.Time
+		want   bool
+	}{
+		{"mon-fri 09:00-17:00", at(time.Monday, 9, 0), true},
+		{"mon-fri 09:00-17:00", at(time.Monday, 8, 59), false},
+		{"mon-fri 09:00-17:00", at(time.Friday, 16, 59), true},
+		{"mon-fri 09:00-17:00", at(time.Friday, 17, 0), false},
+		{"mon-fri 09:00-17:00", at(time.Saturday, 12, 0), false},
+		{"sat-mon 10:00-12:00", at(time.Sunday, 11, 0), true},
+		{"sat-mon 10:00-12:00", at(time.Monday, 11, 59), true},
+		{"sat-mon 10:00-12:00", at(time.Tuesday, 11, 0), false},
+		{"22:00-07:00", at(time.Wednesday, 23, 0), true},
+		{"22:00-07:00", at(time.Wednesday, 6, 59), true},
+		{"22:00-07:00", at(time.Wednesday, 7, 0), false},
+		{"22:00-07:00", at(time.Wednesday, 21, 59), false},
+		{"fri 22:00-07:00", at(time.Friday, 23, 30), true},
+		{"fri 22:00-07:00", at(time.Saturday, 6, 0), true},
+		{"fri 22:00-07:00", at(time.Friday, 6, 0), false},
+		{"fri 22:00-07:00", at(time.Saturday, 23, 0), false},
+		{"18:00-24:00", at(time.Thursday, 23, 59), true},
+		{"18:00-24:00", at(time.Thursday, 0, 0), false},
+		{"00:00-24:00", at(time.Sunday, 0, 0), true},
+	}
+	for _, tt := range tests {
+		if got := parse(tt.period).contains(tt.t); got != tt.want {
+			t.Errorf("%q contains %s = %v, want %v", tt.period, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"sync"
+	"time"
+)
+
+// The outcomes of notifications recorded in a NotificationLog.
+const (
+	outcomeShown          = "shown"
+	outcomeMuted          = "muted"
+	outcomeDND            = "dnd"
+	outcomeDisabled       = "disabled"
+	outcomeRateLimited    = "rate_limit"
+	outcomeAppRateLimited = "app_rate_limit"
+	outcomeDropped        = "queue_full"
+	outcomeDigest         = "digest"
+	outcomeQuiet          = "quiet_hours"
+	outcomeLowPriority    = "low_priority"
+	outcomeFiltered       = "filtered"
+	outcomeLogged         = "logged"
+	outcomeRerouted       = "rerouted"
+)
+
+// HistoryEntry describes a notification that was received.
+type HistoryEntry struct {
+	Time        time.Time `json:"time"`
+	Application string    `json:"application"`
+	Name        string    `json:"name"`
+	Id          string    `json:"id,omitempty"`
+	Title       string    `json:"title"`
+	Text        string    `json:"text,omitempty"`
+	Priority    int       `json:"priority"`
+	// Outcome is what happened to the notification: "shown" if it was sent
+	// to be shown, or else why it wasn't: "muted", "dnd", "disabled",
+	// "rate_limit", "app_rate_limit", "queue_full", "quiet_hours",
+	// "low_priority", "filtered", "logged" or "rerouted" by a filter, or
+	// "digest" if it was held for a digest.
+	Outcome string `json:"outcome"`
+}
+
+// newHistoryEntry builds the HistoryEntry for note, which had outcome.
+func newHistoryEntry(note *registry.Notification, outcome string) HistoryEntry {
+	return HistoryEntry{
+		Time:        time.Now(),
+		Application: note.App.Name,
+		Name:        note.Name,
+		Id:          note.Id,
+		Title:       note.Title,
+		Text:        note.Text,
+		Priority:    note.Priority,
+		Outcome:     outcome,
+	}
+}
+
+// HistoryQuery selects entries from a NotificationLog.
+type HistoryQuery struct {
+	// Limit is the most entries to select, or 0 for no limit.
+	Limit int
+	// App, if not empty, selects the entries of the application it names.
+	App string
+	// Since, if not zero, selects the entries since then.
+	Since time.Time
+}
+
+// matches reports whether q selects entry, not counting its Limit.
+func (q HistoryQuery) matches(entry *HistoryEntry) bool {
+	return (q.App == "" || entry.Application == q.App) && !entry.Time.Before(q.Since)
+}
+
+// NotificationLog records what happened to the notifications received.
+type NotificationLog interface {
+	// Add records that note had outcome.
+	Add(note *registry.Notification, outcome string)
+	// Query gives the entries selected by q, newest first.
+	Query(q HistoryQuery) ([]HistoryEntry, error)
+}
+
+// RecentNotifications is a NotificationLog keeping the most recent
+// notifications received, up to a fixed number, in memory. It is safe for
+// concurrent use.
+type RecentNotifications struct {
+	mu    sync.Mutex
+	notes []HistoryEntry
+	// next is the index in notes the next notification is kept at, once
+	// notes is full.
+	next int
+}
+
+// NewRecentNotifications allocates and initializes RecentNotifications
+// keeping up to size notifications.
+func NewRecentNotifications(size int) *RecentNotifications {
+	if size < 1 {
+		size = 1
+	}
+	return &RecentNotifications{notes: make([]HistoryEntry, 0, size)}
+}
+
+// Add keeps note, which had outcome, replacing the oldest notification kept
+// if there are already as many as can be kept.
+func (recent *RecentNotifications) Add(note *registry.Notification, outcome string) {
+	entry := newHistoryEntry(note, outcome)
+
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	if len(recent.notes) < cap(recent.notes) {
+		recent.notes = append(recent.notes, entry)
+		return
+	}
+	recent.notes[recent.next] = entry
+	recent.next = (recent.next + 1) % len(recent.notes)
+}
+
+// Query gives the notifications kept that are selected by q, newest first.
+func (recent *RecentNotifications) Query(q HistoryQuery) ([]HistoryEntry, error) {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	n := len(recent.notes)
+	list := make([]HistoryEntry, 0)
+	for i := 0; i < n && (q.Limit <= 0 || len(list) < q.Limit); i++ {
+		// The newest is just before next, wrapping around.
+		entry := &recent.notes[(recent.next-1-i+2*n)%n]
+		if q.matches(entry) {
+			list = append(list, *entry)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,113 @@
+// Package registry holds what a GNTP server knows of its clients: the
+// applications registered, with their types of notification, the
+// notifications received, and the subscribers to them.
+package registry
+
+import (
+	"github.com/jgrocho/gntp_notify/server"
+	"sync"
+)
+
+// Application represents an application.
+type Application struct {
+	Name          string
+	Icon          string
+	Count         int
+	Notifications map[string]*Notification
+}
+
+// Applications maps names to applications.
+type Applications struct {
+	mu sync.RWMutex
+	m  map[string]*Application
+}
+
+// Add adds an application to the applications. If an application with the
+// same name was registered before, it is replaced, as Growl does: its
+// notification types become those of app, but the types it had already keep
+// whether the user enabled them. Add reports whether an application was
+// replaced.
+func (apps *Applications) Add(app *Application) bool {
+	apps.mu.Lock()
+	defer apps.mu.Unlock()
+	old, replaced := apps.m[app.Name]
+	if replaced {
+		for name, note := range app.Notifications {
+			if prev, ok := old.Notifications[name]; ok && prev.EnabledByUser {
+				note.Enabled = prev.Enabled
+				note.EnabledByUser = true
+			}
+		}
+	}
+	apps.m[app.Name] = app
+	return replaced
+}
+
+// Remove removes the application named name from the applications, and
+// reports whether there was one.
+func (apps *Applications) Remove(name string) bool {
+	apps.mu.Lock()
+	defer apps.mu.Unlock()
+	_, ok := apps.m[name]
+	delete(apps.m, name)
+	return ok
+}
+
+// Get gets the application from the applications.
+func (apps *Applications) Get(name string) *Application {
+	apps.mu.RLock()
+	defer apps.mu.RUnlock()
+	return apps.m[name]
+}
+
+// Each calls f for each of the applications, in no particular order. The
+// applications may not be changed while f is running, so f must not add,
+// remove or change any of them.
+func (apps *Applications) Each(f func(app *Application)) {
+	apps.mu.RLock()
+	defer apps.mu.RUnlock()
+	for _, app := range apps.m {
+		f(app)
+	}
+}
+
+// NotificationType gets the application named app, and a copy of its
+// notification type named name, holding the defaults for its notifications.
+// It returns a GntpError if either is not registered.
+func (apps *Applications) NotificationType(app, name string) (*Application, Notification, error) {
+	apps.mu.RLock()
+	defer apps.mu.RUnlock()
+	a, ok := apps.m[app]
+	if !ok {
+		return nil, Notification{}, server.UnknownApplicationError(app)
+	}
+	note, ok := a.Notifications[name]
+	if !ok {
+		return nil, Notification{}, server.UnknownNotificationError(app, name)
+	}
+	return a, *note, nil
+}
+
+// SetEnabled enables or disables, as chosen by the user, the notification
+// type named name of the application named app. The choice is kept when the
+// application registers again.
+func (apps *Applications) SetEnabled(app, name string, enabled bool) error {
+	apps.mu.Lock()
+	defer apps.mu.Unlock()
+	a, ok := apps.m[app]
+	if !ok {
+		return server.UnknownApplicationError(app)
+	}
+	note, ok := a.Notifications[name]
+	if !ok {
+		return server.UnknownNotificationError(app, name)
+	}
+	note.Enabled = enabled
+	note.EnabledByUser = true
+	return nil
+}
+
+// NewApplications allocates and initializes Applications.
+func NewApplications() *Applications {
+	return &Applications{m: make(map[string]*Application)}
+}
@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"errors"
+	"github.com/jgrocho/gntp_notify/server"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Notification represents a notification.
+type Notification struct {
+	App        *Application
+	Name       string
+	Display    string
+	Enabled    bool
+	Icon       string
+	Id         string
+	Title      string
+	Text       string
+	Sticky     bool
+	Priority   int
+	Coalescing string
+	Sound      string
+	// EnabledByUser is whether Enabled was chosen by the user, rather than
+	// registered by the application. Types registered as disabled are still
+	// shown, as many clients never enable them; those disabled by the user
+	// are not.
+	EnabledByUser bool
+	// Custom holds the X-* and Data-* headers the notification was sent
+	// with, for the application's own use.
+	Custom server.Header
+	// Hints are the standard hints the notification is shown with.
+	Hints DesktopHints
+	// Progress, if not nil, is how far along the task the notification is
+	// about is, from 0 to 100, shown as a progress bar.
+	Progress *int
+	// UserIcon is whether Icon was chosen by the user, rather than sent by
+	// the application.
+	UserIcon bool
+	// FallbackIcon, if not empty, is the icon the user chose for when the
+	// notification has none, or it couldn't be downloaded.
+	FallbackIcon string
+	// ShownId is the id the notification server gave the notification
+	// when it was shown over D-Bus, so it can be replaced once shown again
+	// after a restart.
+	ShownId uint32
+
+	CallbackContext     string
+	CallbackContextType string
+	CallbackTarget      string
+	// Actions are the buttons shown with the notification, which trigger
+	// its callback when clicked.
+	Actions []NotificationAction
+	// Callback, if not nil, receives what happened to the notification.
+	Callback chan CallbackEvent
+	// RemoteAddr is the network address the notification came from, and
+	// Received is when it was received.
+	RemoteAddr string
+	Received   time.Time
+}
+
+// NotificationAction represents an action button on a notification.
+type NotificationAction struct {
+	Key   string
+	Label string
+}
+
+// DefaultAction is the key of the action invoked by clicking on the
+// notification itself, rather than one of its buttons.
+const DefaultAction = "default"
+
+// DesktopHints are the standard hints of the Desktop Notifications spec that
+// desktops use to group notifications, and to find the settings for them.
+// Those empty are not sent.
+type DesktopHints struct {
+	// DesktopEntry is the name of the desktop file of the application
+	// sending the notification, without .desktop, such as "thunderbird".
+	DesktopEntry string `json:"desktop_entry,omitempty"`
+	// Category is the type of the notification, such as "email.arrived".
+	Category string `json:"category,omitempty"`
+	// Transient notifications are not kept once they leave the screen, and
+	// resident notifications are not closed when they are clicked.
+	Transient bool `json:"transient,omitempty"`
+	Resident  bool `json:"resident,omitempty"`
+	// Urgency, if not empty, replaces the urgency the priority of the
+	// notification gives: "low", "normal" or "critical".
+	Urgency string `json:"urgency,omitempty"`
+}
+
+// Merge sets the hints in over that aren't empty on hints.
+func (hints *DesktopHints) Merge(over *DesktopHints) {
+	if over.DesktopEntry != "" {
+		hints.DesktopEntry = over.DesktopEntry
+	}
+	if over.Category != "" {
+		hints.Category = over.Category
+	}
+	hints.Transient = hints.Transient || over.Transient
+	hints.Resident = hints.Resident || over.Resident
+	if over.Urgency != "" {
+		hints.Urgency = over.Urgency
+	}
+}
+
+// urgencyNames maps the names of the urgency levels, and their numbers, to
+// the names.
+var urgencyNames = map[string]string{
+	"low":      "low",
+	"normal":   "normal",
+	"critical": "critical",
+	"0":        "low",
+	"1":        "normal",
+	"2":        "critical",
+}
+
+// ParseUrgency gives the name of the urgency level named, or numbered, s.
+func ParseUrgency(s string) (string, error) {
+	u, ok := urgencyNames[strings.ToLower(strings.TrimSpace(s))]
+	if !ok {
+		return "", errors.New("urgency " + s + " must be low, normal or critical")
+	}
+	return u, nil
+}
+
+// CallbackResult represents what happened to a notification, as reported
+// to clients that asked for a callback.
+type CallbackResult string
+
+// The recognized callback results.
+const (
+	CallbackClicked  CallbackResult = "CLICKED"
+	CallbackClosed   CallbackResult = "CLOSED"
+	CallbackTimedOut CallbackResult = "TIMEDOUT"
+)
+
+// CallbackEvent represents what happened to a notification: its
+// CallbackResult and, if it was clicked, the key of the action clicked.
+type CallbackEvent struct {
+	Result CallbackResult
+	Action string
+}
+
+// SendCallback reports result to the client of note, if it asked for a
+// callback.
+func (note *Notification) SendCallback(result CallbackResult) {
+	note.SendCallbackEvent(CallbackEvent{Result: result})
+}
+
+// SendCallbackEvent reports event to the client of note, if it asked for a
+// callback. Only the first event is reported.
+func (note *Notification) SendCallbackEvent(event CallbackEvent) {
+	if note.Callback == nil {
+		return
+	}
+	select {
+	case note.Callback <- event:
+	default:
+		// A result has already been sent.
+	}
+}
+
+// CoalescingKey gives the key identifying the notification on screen that
+// note replaces, or the empty string if it doesn't replace any.
+func (note *Notification) CoalescingKey() string {
+	if note.Coalescing == "" {
+		return ""
+	}
+	return note.App.Name + "\x00" + note.Coalescing
+}
+
+// RemoteIcon reports whether icon is given by a URL to download, rather than
+// as a GNTP resource identifier or a local file.
+func RemoteIcon(icon string) bool {
+	lower := strings.ToLower(icon)
+	if icon == "" || strings.HasPrefix(lower, "x-growl-resource://") || strings.HasPrefix(lower, "file:") {
+		return false
+	}
+	_, local := LocalIconPath(icon)
+	return !local
+}
+
+// LocalIconPath gives the path of the local file icon refers to, as a
+// file:// URI or an absolute path, and true; or false if it is neither.
+func LocalIconPath(icon string) (string, bool) {
+	if strings.HasPrefix(icon, "/") {
+		return filepath.Clean(icon), true
+	}
+	if !strings.HasPrefix(strings.ToLower(icon), "file://") {
+		return "", false
+	}
+	u, err := url.Parse(icon)
+	if err != nil || (u.Host != "" && u.Host != "localhost") || !strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	return filepath.Clean(u.Path), true
+}
@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+// Subscriber represents a GNTP client subscribed to our notifications.
+type Subscriber struct {
+	Id      string
+	Name    string
+	Host    string
+	Port    int
+	Expires time.Time
+}
+
+// Subscribers maps ids to subscribers, forgetting each subscriber once its
+// subscription expires.
+type Subscribers struct {
+	TTL time.Duration
+
+	mu sync.Mutex
+	m  map[string]*Subscriber
+}
+
+// expire removes expired subscribers. subs.mu must be held.
+func (subs *Subscribers) expire(now time.Time) {
+	for id, sub := range subs.m {
+		if now.After(sub.Expires) {
+			delete(subs.m, id)
+		}
+	}
+}
+
+// Add adds a subscriber to the subscribers, or renews its subscription. The
+// subscription expires after the Subscribers' TTL.
+func (subs *Subscribers) Add(sub *Subscriber) {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	now := time.Now()
+	subs.expire(now)
+	sub.Expires = now.Add(subs.TTL)
+	subs.m[sub.Id] = sub
+}
+
+// Get gets the subscriber from the subscribers, if its subscription has not
+// expired.
+func (subs *Subscribers) Get(id string) *Subscriber {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	subs.expire(time.Now())
+	return subs.m[id]
+}
+
+// All returns every subscriber whose subscription has not expired.
+func (subs *Subscribers) All() []*Subscriber {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	subs.expire(time.Now())
+	all := make([]*Subscriber, 0, len(subs.m))
+	for _, sub := range subs.m {
+		all = append(all, sub)
+	}
+	return all
+}
+
+// NewSubscribers allocates and initializes Subscribers whose subscriptions
+// last for ttl.
+func NewSubscribers(ttl time.Duration) *Subscribers {
+	return &Subscribers{TTL: ttl, m: make(map[string]*Subscriber)}
+}
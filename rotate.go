@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// rotatingFile is an io.Writer appending to a file, which it rotates once it
+// grows too large.
+type rotatingFile struct {
+	path string
+	// maxSize, if more than 0, is the size in bytes past which the file is
+	// rotated, and keep how many rotated files are kept, as path.1 (the
+	// newest), path.2, and so on.
+	maxSize int64
+	keep    int
+	// onRotate, if not nil, is called once the file has been rotated, with
+	// the error renaming it, if any, in which case it is appended to still.
+	onRotate func(err error)
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openRotatingFile opens the file at path, appending to it. Once it grows
+// past maxSize bytes, if more than 0, it is rotated, keeping keep old files.
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file, appending to it.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write appends p to the file, first rotating it if p would take it past
+// its maximum size, or opening it again if that failed before.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	n, rotated, renameErr, err := f.write(p)
+	f.mu.Unlock()
+	// onRotate may well write to the file itself, so is called without the
+	// lock held.
+	if rotated && f.onRotate != nil {
+		f.onRotate(renameErr)
+	}
+	return n, err
+}
+
+// write appends p to the file, reporting whether it was rotated first, and
+// the error renaming it if so.
+func (f *rotatingFile) write(p []byte) (n int, rotated bool, renameErr, err error) {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, false, nil, err
+		}
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		rotated = true
+		renameErr = f.rotate()
+		if err := f.open(); err != nil {
+			return 0, rotated, renameErr, err
+		}
+	}
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return n, rotated, renameErr, err
+}
+
+// rotate closes the file and renames it to path.1, after shifting the files
+// already rotated along and removing the oldest, or removes it if no rotated
+// files are kept.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	if f.keep < 1 {
+		os.Remove(f.path)
+		return nil
+	}
+	os.Remove(f.path + "." + strconv.Itoa(f.keep))
+	for i := f.keep - 1; i >= 1; i-- {
+		os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+	return os.Rename(f.path, f.path+".1")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DisplayBackend is the name routes give the Backend displaying
+// notifications on the desktop.
+const DisplayBackend = "display"
+
+// routesReloadInterval is how often the routes file is checked for changes.
+const routesReloadInterval = 5 * time.Second
+
+// Routes holds the user's rules for which backends notifications are sent to.
+// They are read from a JSON file:
+//
+//	{
+//	  "rules": [
+//	    {"application": "Build", "min_priority": 2, "backends": ["display", "telegram"]},
+//	    {"hours": ["mon-fri 09:00-18:00"], "title": "(?i)deploy", "backends": ["slack"]},
+//	    {"max_priority": -1, "backends": ["notification-log"]}
+//	  ]
+//	}
+//
+// The first rule matching a notification decides where it is sent;
+// notifications matching no rule are sent to every backend.
+type Routes struct {
+	Rules []*RouteRule `json:"rules"`
+}
+
+// RouteRule is a rule matching notifications, and the backends they are sent
+// to. The notifications matched are those matching every one of the
+// conditions given.
+type RouteRule struct {
+	// Application, if not empty, is the name of the application matched.
+	Application string `json:"application"`
+	// Notification, if not empty, is the name of the notification type
+	// matched.
+	Notification string `json:"notification"`
+	// Title and Text, if not empty, are regular expressions matching some
+	// of the title and text of the notifications matched.
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	// MinPriority and MaxPriority, if not nil, bound the priority of the
+	// notifications matched.
+	MinPriority *int `json:"min_priority"`
+	MaxPriority *int `json:"max_priority"`
+	// Hours, if not empty, are the periods of the week in which
+	// notifications are matched, as given to -quiet-hours.
+	Hours []string `json:"hours"`
+	// Backends are the names of the backends the notifications matched are
+	// sent to: DisplayBackend, or the name of an output.
+	Backends []string `json:"backends"`
+
+	// title and text are Title and Text compiled.
+	title, text *regexp.Regexp
+	// hours are Hours parsed.
+	hours []QuietPeriod
+}
+
+// LoadRoutes reads Routes from the JSON file at path. Their rules may only
+// send notifications to the backends named in names.
+func LoadRoutes(path string, names []string) (*Routes, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	routes := new(Routes)
+	if err := dec.Decode(routes); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range routes.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %d: empty rule", i+1)
+		}
+		if err := rule.init(names); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return routes, nil
+}
+
+// init checks the priorities and backends of rule, and compiles its regular
+// expressions and parses its hours.
+func (rule *RouteRule) init(names []string) (err error) {
+	for _, priority := range []*int{rule.MinPriority, rule.MaxPriority} {
+		if priority != nil && !validPriority(*priority) {
+			return fmt.Errorf("invalid priority %d (must be from -2 to 2)", *priority)
+		}
+	}
+	if len(rule.Backends) == 0 {
+		return errors.New("no backends")
+	}
+	for _, backend := range rule.Backends {
+		known := false
+		for _, name := range names {
+			known = known || name == backend
+		}
+		if !known {
+			return errors.New("unknown backend " + backend + " (available: " + strings.Join(names, ", ") + ")")
+		}
+	}
+	for _, hours := range rule.Hours {
+		period, err := ParseQuietPeriod(hours)
+		if err != nil {
+			return fmt.Errorf("hours %q: %w", hours, err)
+		}
+		rule.hours = append(rule.hours, period)
+	}
+	if rule.Title != "" {
+		if rule.title, err = regexp.Compile(rule.Title); err != nil {
+			return err
+		}
+	}
+	if rule.Text != "" {
+		if rule.text, err = regexp.Compile(rule.Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether rule matches note, sent at t.
+func (rule *RouteRule) matches(note *registry.Notification, t time.Time) bool {
+	if (rule.Application != "" && rule.Application != note.App.Name) ||
+		(rule.Notification != "" && rule.Notification != note.Name) ||
+		(rule.MinPriority != nil && note.Priority < *rule.MinPriority) ||
+		(rule.MaxPriority != nil && note.Priority > *rule.MaxPriority) ||
+		(rule.title != nil && !rule.title.MatchString(note.Title)) ||
+		(rule.text != nil && !rule.text.MatchString(note.Text)) {
+		return false
+	}
+	if len(rule.hours) == 0 {
+		return true
+	}
+	for _, period := range rule.hours {
+		if period.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteTable holds the Routes read from a file, reloading them when it
+// changes. It is safe for concurrent use.
+type RouteTable struct {
+	path  string
+	names []string
+
+	mu      sync.RWMutex
+	routes  *Routes
+	modTime time.Time
+}
+
+// OpenRoutes reads the Routes in the file at path, which may only send
+// notifications to the backends named in names.
+func OpenRoutes(path string, names []string) (*RouteTable, error) {
+	table := &RouteTable{path: path, names: names}
+	if err := table.Reload(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Reload reads the Routes from the file again. If they can't be read, the
+// Routes read before are kept.
+func (table *RouteTable) Reload() error {
+	info, err := os.Stat(table.path)
+	if err != nil {
+		return err
+	}
+	routes, err := LoadRoutes(table.path, table.names)
+	if err != nil {
+		return err
+	}
+	table.mu.Lock()
+	table.routes, table.modTime = routes, info.ModTime()
+	table.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the Routes whenever the file is changed, checking it every
+// interval.
+func (table *RouteTable) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(table.path)
+		if err != nil {
+			continue
+		}
+		table.mu.RLock()
+		changed := !info.ModTime().Equal(table.modTime)
+		table.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := table.Reload(); err != nil {
+			slog.Warn("gntp: could not reload routes, keeping the previous ones", "file", table.path, "err", err)
+			// Don't try again until the file changes once more.
+			table.mu.Lock()
+			table.modTime = info.ModTime()
+			table.mu.Unlock()
+			continue
+		}
+		slog.Info("gntp: reloaded routes", "file", table.path)
+	}
+}
+
+// Backends gives the names of the backends note is sent to, or nil if it is
+// sent to all of them. A nil RouteTable sends every notification to all of
+// them.
+func (table *RouteTable) Backends(note *registry.Notification) []string {
+	if table == nil {
+		return nil
+	}
+	table.mu.RLock()
+	routes := table.routes
+	table.mu.RUnlock()
+	now := time.Now()
+	for _, rule := range routes.Rules {
+		if rule.matches(note, now) {
+			return rule.Backends
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"testing"
+	"time"
+)
+
+func TestRouteRuleMatches(t *testing.T) {
+	priority := func(p int) *int { return &p }
+	note := &registry.Notification{
+		App:      &registry.Application{Name: "Build"},
+		Name:     "Failed",
+		Title:    "Build failed",
+		Text:     "3 tests failed on main",
+		Priority: 1,
+	}
+	// 1 January 2024 was a Monday.
+	monday := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.Local)
+	saturday := time.Date(2024, time.January, 6, 10, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		rule RouteRule
+		t    time.Time
+		want bool
+	}{
+		{RouteRule{}, monday, true},
+		{RouteRule{Application: "Build", Notification: "Failed"}, monday, true},
+		{RouteRule{Application: "Deploy"}, monday, false},
+		{RouteRule{Notification: "Passed"}, monday, false},
+		{RouteRule{Title: "(?i)^build"}, monday, true},
+		{RouteRule{Text: "on release"}, monday, false},
+		{RouteRule{MinPriority: priority(1)}, monday, true},
+		{RouteRule{MinPriority: priority(2)}, monday, false},
+		{RouteRule{MaxPriority: priority(1)}, monday, true},
+		{RouteRule{MaxPriority: priority(0)}, monday, false},
+		{RouteRule{MinPriority: priority(-2), MaxPriority: priority(2)}, monday, true},
+		{RouteRule{Hours: []string{"mon-fri 09:00-17:00"}}, monday, true},
+		{RouteRule{Hours: []string{"mon-fri 09:00-17:00"}}, saturday, false},
+		{RouteRule{Hours: []string{"mon-fri 09:00-17:00", "weekends 08:00-12:00"}}, saturday, true},
+		{RouteRule{Application: "Deploy", Hours: []string{"weekends 08:00-12:00"}}, saturday, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		rule.Backends = []string{DisplayBackend}
+		if err := rule.init([]string{DisplayBackend}); err != nil {
+			t.Errorf("rule %+v: %v", tt.rule, err)
+			continue
+		}
+		if got := rule.matches(note, tt.t); got != tt.want {
+			t.Errorf("rule %+v matches at %s = %v, want %v", tt.rule, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestRouteRuleInit(t *testing.T) {
+	priority := func(p int) *int { return &p }
+	names := []string{DisplayBackend, "slack"}
+	tests := []struct {
+		rule RouteRule
+		ok   bool
+	}{
+		{RouteRule{Backends: []string{"slack", DisplayBackend}}, true},
+		{RouteRule{}, false},
+		{RouteRule{Backends: []string{"email"}}, false},
+		{RouteRule{Backends: []string{"slack"}, MinPriority: priority(3)}, false},
+		{RouteRule{Backends: []string{"slack"}, MaxPriority: priority(-3)}, false},
+		{RouteRule{Backends: []string{"slack"}, Hours: []string{"someday 10:00-11:00"}}, false},
+		{RouteRule{Backends: []string{"slack"}, Title: "("}, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		if err := rule.init(names); (err == nil) != tt.ok {
+			t.Errorf("rule %+v: error %v, want ok %v", tt.rule, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// sendUsage describes the send command.
+const sendUsage = `usage: gntp_notify send [-to [password@]host[:port]] [-app <name>] [-name <name>] [-icon <url|file>] [-priority <n>] [-sticky] [-progress <percent>] [-coalescing-id <id>] <title> [text]`
+
+// runSendCommand runs the send command, given args: it sends a notification
+// to a GNTP server, registering its application first.
+func runSendCommand(args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	to := flags.String("to", "localhost", "Send to this GNTP server, given as [password@]host[:port]")
+	app := flags.String("app", "gntp_notify", "Send as this application")
+	name := flags.String("name", "Message", "Send this type of notification")
+	icon := flags.String("icon", "", "Show the notification with this icon, a URL or a file")
+	priority := flags.Int("priority", 0, "Send the notification with this priority, from -2 to 2")
+	sticky := flags.Bool("sticky", false, "Ask for the notification to stay on screen until dismissed")
+	progress := flags.Int("progress", -1, "Show a progress bar this many percent done, from 0 to 100")
+	coalescingId := flags.String("coalescing-id", "", "Replace the notification on screen sent with this coalescing id")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\n" + sendUsage)
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New(sendUsage)
+	}
+	if !validPriority(*priority) {
+		return errors.New("priorities are from -2 to 2")
+	}
+	if *progress > 100 {
+		return errors.New("progress is from 0 to 100")
+	}
+	var targets ForwardTargets
+	if err := targets.Set(*to); err != nil {
+		return err
+	}
+	target := targets[0]
+
+	binaries := make(map[string]*server.Binary)
+	iconValue, err := sendIcon(*icon, binaries)
+	if err != nil {
+		return err
+	}
+
+	appHeader := server.NewHeader()
+	appHeader.Set("Application-Name", *app)
+	appHeader.Set("Notifications-Count", "1")
+	typeHeader := server.NewHeader()
+	typeHeader.Set("Notification-Name", *name)
+	typeHeader.Set("Notification-Enabled", "True")
+	register := &server.Request{Type: "REGISTER", Headers: []server.Header{appHeader, typeHeader}, Binaries: binaries}
+
+	header := server.NewHeader()
+	header.Set("Application-Name", *app)
+	header.Set("Notification-Name", *name)
+	header.Set("Notification-Title", flags.Arg(0))
+	header.Set("Notification-Text", flags.Arg(1))
+	header.Set("Notification-Priority", strconv.Itoa(*priority))
+	if *sticky {
+		header.Set("Notification-Sticky", "True")
+	}
+	if iconValue != "" {
+		header.Set("Notification-Icon", iconValue)
+	}
+	if *progress >= 0 {
+		header.Set("X-Progress", strconv.Itoa(*progress))
+	}
+	if *coalescingId != "" {
+		header.Set("Notification-Coalescing-ID", *coalescingId)
+	}
+	notify := &server.Request{Type: "NOTIFY", Headers: []server.Header{header}, Binaries: binaries}
+
+	for _, req := range []*server.Request{register, notify} {
+		if target.Password != "" {
+			if req.KeyHash, err = server.NewKeyHash("SHA512", target.Password); err != nil {
+				return err
+			}
+		}
+		if err := sendRequest(target.Addr, req); err != nil {
+			return fmt.Errorf("%s: %w", req.Type, err)
+		}
+	}
+	return nil
+}
+
+// sendIcon gives the value of the Notification-Icon header for icon: a URL
+// as it is, or a file, given by its path or a file:// URI, as a binary
+// resource, which is added to binaries.
+func sendIcon(icon string, binaries map[string]*server.Binary) (string, error) {
+	path, local := registry.LocalIconPath(icon)
+	if !local {
+		if icon == "" || strings.Contains(icon, "://") {
+			return icon, nil
+		}
+		path = icon
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	ident := fmt.Sprintf("%x", md5.Sum(data))
+	binaries[ident] = &server.Binary{Ident: ident, Length: int64(len(data)), Data: data}
+	return "x-growl-resource://" + ident, nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+	"strings"
+)
+
+// AccessList decides which hosts may send requests to a Server, by the
+// networks their addresses are in.
+type AccessList struct {
+	// Allow, if not empty, lists the only networks allowed.
+	Allow []*net.IPNet
+	// Deny lists networks that are never allowed, even if in Allow.
+	Deny []*net.IPNet
+}
+
+// ParseNetwork parses s as a network in CIDR notation, such as
+// "192.168.0.0/16", or as a single IP address.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// Allowed reports whether requests from addr are allowed. Connections that
+// aren't over IP, such as those on unix sockets, are always allowed; access to
+// those is controlled by the file system.
+func (acl *AccessList) Allowed(addr net.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+
+	for _, network := range acl.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.Allow) == 0 {
+		return true
+	}
+	for _, network := range acl.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP gets the IP address of addr, or nil if it isn't an IP address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLog writes a line about each request a Server serves, in a format
+// that is easy to parse. It is safe for concurrent use.
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// AccessLogFormats are the formats an AccessLog can write: "common", like the
+// Common Log Format of web servers, or "json", with an object per line.
+var AccessLogFormats = []string{"common", "json"}
+
+// NewAccessLog allocates and initializes an AccessLog writing to w in the
+// given format, one of AccessLogFormats.
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	for _, f := range AccessLogFormats {
+		if f == format {
+			return &AccessLog{w: w, format: format}, nil
+		}
+	}
+	return nil, errors.New("gntp: unknown access log format " + format)
+}
+
+// accessLogEntry is what an AccessLog records about a request.
+type accessLogEntry struct {
+	Time         time.Time `json:"time"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Type         string    `json:"type"`
+	Application  string    `json:"application,omitempty"`
+	Notification string    `json:"notification,omitempty"`
+	Response     string    `json:"response"`
+	ErrorCode    int       `json:"error_code,omitempty"`
+	Duration     float64   `json:"duration_seconds"`
+}
+
+// log records that resp was written in reply to req, elapsed after the
+// connection was accepted at start. req is as far as it was parsed.
+func (al *AccessLog) log(start time.Time, remoteAddr string, req *Request, resp *Response, elapsed time.Duration) {
+	entry := accessLogEntry{
+		Time:       start,
+		RemoteAddr: remoteAddr,
+		Type:       req.Type,
+		Response:   resp.Type,
+		Duration:   elapsed.Seconds(),
+	}
+	if len(req.Headers) > 0 {
+		entry.Application, _ = req.Headers[0].Get("Application-Name")
+		entry.Notification, _ = req.Headers[0].Get("Notification-Name")
+	}
+	if len(resp.Headers) > 0 {
+		if code, ok := resp.Headers[0].Get("Error-Code"); ok {
+			entry.ErrorCode, _ = strconv.Atoi(code)
+		}
+	}
+
+	var line []byte
+	if al.format == "json" {
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		line = []byte(entry.common())
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.w.Write(line)
+}
+
+// common formats e as a line like the Common Log Format, with "-" for the
+// fields that are missing:
+//
+//	127.0.0.1:50432 [17/Oct/2026:10:04:05 +0200] "NOTIFY" "My App" "New Mail" OK - 0.002
+func (e accessLogEntry) common() string {
+	code := "-"
+	if e.ErrorCode != 0 {
+		code = strconv.Itoa(e.ErrorCode)
+	}
+	return fmt.Sprintf("%s [%s] %s %s %s %s %s %.3f\n",
+		dash(e.RemoteAddr), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(e.Type), quote(e.Application), quote(e.Notification),
+		e.Response, code, e.Duration)
+}
+
+// dash gets s, or "-" if it is empty.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote gets s quoted, or "-" if it is empty.
+func quote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strconv.Quote(s)
+}
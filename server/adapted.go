@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// Protocol adapters accept notifications over their own listeners, such as
+// HTTP, rather than the Server's. These let them hold those connections and
+// requests to the same limits as the Server holds its own.
+
+// Admit reports whether a request from addr, received by a protocol adapter,
+// may be served: its host must be allowed by the Server's Access list and
+// within its RateLimiter's limit. Otherwise it returns the NotAuthorizedError
+// to refuse the request with.
+func (srv *Server) Admit(addr net.Addr) error {
+	if !srv.Access.Allowed(addr) {
+		srv.logger().Warn("gntp: refused request from host not allowed", "remote_addr", addr.String())
+		return NotAuthorizedError("host not allowed")
+	}
+	if !srv.allowRate(addr) {
+		srv.logger().Warn("gntp: refused request over rate limit", "remote_addr", addr.String())
+		return NotAuthorizedError("too many requests")
+	}
+	return nil
+}
+
+// AcquireConn counts a connection accepted by a protocol adapter towards the
+// Server's MaxConns, along with its own, waiting up to its MaxConnsWait for
+// another to close if there are already as many. It reports whether the
+// connection may be served; if so, ReleaseConn must be called once it is
+// closed.
+func (srv *Server) AcquireConn() bool {
+	if !srv.acquireConn() {
+		srv.logger().Warn("gntp: refused connection over limit", "max_conns", srv.MaxConns)
+		return false
+	}
+	return true
+}
+
+// ReleaseConn stops counting a connection acquired with AcquireConn.
+func (srv *Server) ReleaseConn() {
+	srv.releaseConn()
+}
+
+// LogAdapted records req, received by a protocol adapter from remoteAddr at
+// start, in the Server's AccessLog and with its Observer, as answered with
+// the error err, or an -OK response if nil.
+func (srv *Server) LogAdapted(start time.Time, remoteAddr string, req *Request, err error) {
+	resp := NewResponse(1, 0)
+	if err != nil {
+		ge, ok := AsGntpError(err)
+		if !ok {
+			ge = InternalServerError()
+		}
+		resp = ge.Response()
+	}
+	elapsed := time.Since(start)
+	if obs := srv.Observer; obs != nil {
+		obs.Served(req.Type, resp, elapsed)
+	}
+	if al := srv.AccessLog; al != nil {
+		al.log(start, remoteAddr, req, resp, elapsed)
+	}
+}
+
+// AddrFromString gives the net.Addr of addr, a host:port with an IP address
+// for its host, such as the RemoteAddr of an HTTP request, or nil if it
+// isn't one. A nil address is allowed by any Access list.
+func AddrFromString(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	p, _ := net.LookupPort("tcp", port)
+	return &net.TCPAddr{IP: ip, Port: p}
+}
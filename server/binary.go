@@ -17,37 +17,74 @@ type Binary struct {
 
 // Objects implementing the Binaries interface allow for the saving and
 // retrieval of binary data.
+//
+// Add is given a reader of exactly length bytes, straight from the request,
+// so it can stream the data to where it is kept rather than hold it all in
+// memory. It should return io.ErrUnexpectedEOF if the data ends early.
 type Binaries interface {
 	Add(key string, length int64, r io.Reader) error
 	Get(key string) ([]byte, error)
 	Exists(key string) bool
 }
 
+// BinaryStats holds statistics about the binary data kept by a Binaries.
+type BinaryStats struct {
+	Hits      int64 // lookups that found the data
+	Misses    int64 // lookups that didn't
+	Evictions int64 // data removed to make room, or because it expired
+	Entries   int   // the number of binaries kept
+	Bytes     int64 // their total size
+}
+
+// StatBinaries is implemented by Binaries that can report statistics about
+// the data they keep.
+type StatBinaries interface {
+	Binaries
+	Stats() BinaryStats
+}
+
 // ReadBinaries finds all the binary resource references found in
 // headers, and saves them to binaries.
 func ReadBinaries(b *bufio.Reader, headers []Header, binaries Binaries) (map[string]*Binary, error) {
-	// Find how many header lines that have a value starting with the GNTP
-	// resource identifier.
-	count := 0
-	for _, header := range headers {
-		for _, values := range header {
-			for _, value := range values {
-				if strings.HasPrefix(value, "x-growl-resource://") {
-					count += 1
-				}
-			}
-		}
+	return readBinaries(b, headers, binaries, 0, nil)
+}
+
+// ReadBinaries finds all the binary resource references found in the
+// Request's headers, and saves them to binaries and the Request. Binaries
+// larger than the Server's MaxBinaryBytes are rejected, and each must be read
+// within its ReadPhaseTimeout.
+func (req *Request) ReadBinaries(b *bufio.Reader, binaries Binaries) error {
+	bs, err := readBinaries(b, req.Headers, binaries, req.maxBinaryBytes, req.phase)
+	if err != nil {
+		return err
 	}
+	req.Binaries = bs
+	return nil
+}
+
+// readBinaries implements ReadBinaries, rejecting binaries longer than
+// maxBytes, unless it is zero, and calling phase, if not nil, before reading
+// each.
+func readBinaries(b *bufio.Reader, headers []Header, binaries Binaries, maxBytes int64, phase func()) (map[string]*Binary, error) {
+	// Each binary is sent once, however many headers refer to it.
+	referenced := make(map[string]bool)
+	for _, ident := range resourceIdents(headers) {
+		referenced[ident] = true
+	}
+	count := len(referenced)
 
 	tp := textproto.NewReader(b)
 
 	bs := make(map[string]*Binary, count)
 	for i := 0; i < count; i++ {
+		if phase != nil {
+			phase()
+		}
 		binary := new(Binary)
 		// Read the Identifier and Length header block.
 		header, err := tp.ReadMIMEHeader()
 		if err != nil {
-			return nil, err
+			return nil, headerError(err)
 		}
 
 		if ident, ok := header["Identifier"]; ok {
@@ -55,44 +92,155 @@ func ReadBinaries(b *bufio.Reader, headers []Header, binaries Binaries) (map[str
 		} else {
 			return nil, MissingHeaderError("Binary Identifier")
 		}
+		// The identifier names the file the binary is kept in, so it
+		// must be one the headers gave, and safe as a file name.
+		if !validIdent(binary.Ident) {
+			return nil, InvalidRequestError("invalid binary Identifier " + strconv.Quote(binary.Ident))
+		}
+		if !referenced[binary.Ident] {
+			return nil, InvalidRequestError("binary " + binary.Ident + " not referred to by any header")
+		}
+		if bs[binary.Ident] != nil {
+			return nil, InvalidRequestError("binary " + binary.Ident + " sent more than once")
+		}
 
 		if length, ok := header["Length"]; ok {
-			if binary.Length, err = strconv.ParseInt(length[0], 10, 64); err != nil {
+			if binary.Length, err = strconv.ParseInt(length[0], 10, 64); err != nil || binary.Length < 0 {
 				return nil, InvalidRequestError(binary.Ident + " Length header invalid")
 			}
+			if maxBytes > 0 && binary.Length > maxBytes {
+				return nil, RequestTooLargeError("binary " + binary.Ident)
+			}
 		} else {
 			return nil, MissingHeaderError("Length for binary " + binary.Ident)
 		}
 
-		// Read the data from b and add it to binaries.
-		if err := binaries.Add(binary.Ident, binary.Length, b); err != nil && err == io.ErrUnexpectedEOF {
-			return nil, InvalidRequestError(binary.Ident + " data incomplete")
+		// Read the data from b and add it to binaries, then skip anything
+		// binaries didn't read so the next section can be.
+		data := io.LimitReader(b, binary.Length)
+		err = binaries.Add(binary.Ident, binary.Length, data)
+		if err == nil {
+			_, err = io.Copy(io.Discard, data)
+		}
+		if err != nil && err == io.ErrUnexpectedEOF {
+			return nil, InvalidRequestError(binary.Ident + " data incomplete").Wrap(err)
 		} else if err != nil {
 			return nil, err
 		}
 
 		bs[binary.Ident] = binary
 
-		// Read the two carriage-return/newlines at the end of the section.
-		for i := 0; i < 2; i++ {
-			var crlf byte
-			if crlf, err = b.ReadByte(); err != nil {
-				return nil, err
-			}
-			if crlf == '\r' {
-				if crlf, err = b.ReadByte(); err != nil {
-					return nil, err
+		if err := readBinaryTerminator(b, binary.Ident); err != nil {
+			return nil, err
+		}
+	}
+
+	return bs, nil
+}
+
+// maxIdentLength is the longest binary identifier accepted.
+const maxIdentLength = 128
+
+// validIdent reports whether ident is a binary identifier that is safe to
+// use as a file name: letters, digits, and -, _, ., { and }, not starting
+// with a dot.
+func validIdent(ident string) bool {
+	if ident == "" || len(ident) > maxIdentLength || ident[0] == '.' {
+		return false
+	}
+	for _, c := range ident {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == '{' || c == '}':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// resourceIdentifier starts the header values that refer to a binary, in any
+// case.
+const resourceIdentifier = "x-growl-resource://"
+
+// resourceIdent gets the identifier of the binary value refers to, if it is
+// an x-growl-resource:// URL.
+func resourceIdent(value string) (string, bool) {
+	if len(value) < len(resourceIdentifier) || !strings.EqualFold(value[:len(resourceIdentifier)], resourceIdentifier) {
+		return "", false
+	}
+	return value[len(resourceIdentifier):], true
+}
+
+// ResourceIdent gets the identifier of the binary value refers to, if it is
+// an x-growl-resource:// URL, in any case, with an identifier validIdent
+// accepts.
+func ResourceIdent(value string) (string, bool) {
+	ident, ok := resourceIdent(value)
+	if !ok || !validIdent(ident) {
+		return "", false
+	}
+	return ident, true
+}
+
+// checkResources rejects headers referring to a binary by an identifier
+// validIdent doesn't accept, which is then never looked up.
+func checkResources(headers []Header) error {
+	for _, ident := range resourceIdents(headers) {
+		if !validIdent(ident) {
+			return InvalidRequestError("invalid binary Identifier " + strconv.Quote(ident))
+		}
+	}
+	return nil
+}
+
+// Resources gets the identifiers of the binaries the Header refers to with
+// x-growl-resource:// URLs, each once.
+func (h Header) Resources() []string {
+	return resourceIdents([]Header{h})
+}
+
+// resourceIdents finds the identifiers of the binaries referred to by
+// headers, each once, in the order they are first referred to: by block, then
+// by header name.
+func resourceIdents(headers []Header) []string {
+	var idents []string
+	seen := make(map[string]bool)
+	for _, header := range headers {
+		for _, key := range header.keys() {
+			for _, value := range header[key] {
+				ident, ok := resourceIdent(value)
+				if !ok {
+					continue
+				}
+				if !seen[ident] {
+					seen[ident] = true
+					idents = append(idents, ident)
 				}
-			}
-			if crlf == '\n' {
-				continue
-			} else {
-				// We should call b.UnreadByte() here, but we might have read
-				// two bytes and we could only put one back in.
-				return nil, InvalidRequestError(binary.Ident + " data not properly terminated")
 			}
 		}
 	}
+	return idents
+}
 
-	return bs, nil
+// readBinaryTerminator reads the two carriage-return/newlines at the end of
+// the binary section for ident.
+func readBinaryTerminator(b *bufio.Reader, ident string) error {
+	for i := 0; i < 2; i++ {
+		crlf, err := b.ReadByte()
+		if err != nil {
+			return err
+		}
+		if crlf == '\r' {
+			if crlf, err = b.ReadByte(); err != nil {
+				return err
+			}
+		}
+		if crlf != '\n' {
+			// We should call b.UnreadByte() here, but we might have read
+			// two bytes and we could only put one back in.
+			return InvalidRequestError(ident + " data not properly terminated")
+		}
+	}
+	return nil
 }
@@ -1,17 +1,69 @@
 package server
 
 import (
+	"errors"
 	"strconv"
 )
 
+// The error codes defined by GNTP.
+const (
+	CodeTimedOut               = 200 // the server timed out waiting for the request to complete
+	CodeNetworkFailure         = 201 // the server was unavailable or the client could not reach it
+	CodeInvalidRequest         = 300 // the request contained an unsupported directive, invalid headers or values, or was otherwise malformed
+	CodeUnknownProtocol        = 301 // the request was not a GNTP request
+	CodeUnknownProtocolVersion = 302 // the request specified an unknown or unsupported GNTP version
+	CodeRequiredHeaderMissing  = 303 // the request was missing required information
+	CodeNotAuthorized          = 400 // the request supplied a missing or wrong password/key or was otherwise not authorized
+	CodeUnknownApplication     = 401 // the application has not been registered
+	CodeUnknownNotification    = 402 // the notification type was not registered by the application
+	CodeAlreadyProcessed       = 403 // the original request was already processed by this server
+	CodeNotificationDisabled   = 404 // the notification type was registered but disabled
+	CodeInternalServerError    = 500 // the server encountered an error while processing the request
+)
+
 // GntpError represents GNTP error.
+//
+// It can be matched with errors.Is against a GntpError with only a Code, to
+// find an error with that code however it is described:
+//
+//	if errors.Is(err, server.GntpError{Code: server.CodeUnknownApplication}) {
+//
+// and with errors.As to get at its Description.
 type GntpError struct {
 	Code        int
 	Description string
+	// Err is the underlying cause of the error, if any. It is not sent to
+	// the client.
+	Err error
 }
 
 func (g GntpError) Error() string {
-	return "GNTP " + strconv.Itoa(g.Code) + " error: " + g.Description
+	msg := "GNTP " + strconv.Itoa(g.Code) + " error: " + g.Description
+	if g.Err != nil {
+		msg += ": " + g.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap gets the underlying cause of the error.
+func (g GntpError) Unwrap() error {
+	return g.Err
+}
+
+// Is reports whether g matches target: a GntpError with the same Code and,
+// unless target's is empty, the same Description.
+func (g GntpError) Is(target error) bool {
+	t, ok := target.(GntpError)
+	if !ok {
+		return false
+	}
+	return t.Code == g.Code && (t.Description == "" || t.Description == g.Description)
+}
+
+// Wrap gets a copy of g caused by err.
+func (g GntpError) Wrap(err error) GntpError {
+	g.Err = err
+	return g
 }
 
 // Response builds a Response for the GntpError.
@@ -27,34 +79,69 @@ func (g GntpError) Response() *Response {
 	return resp
 }
 
+// AsGntpError finds the first GntpError in err's chain.
+func AsGntpError(err error) (GntpError, bool) {
+	var g GntpError
+	ok := errors.As(err, &g)
+	return g, ok
+}
+
+func TimedOutError() GntpError {
+	return GntpError{Code: CodeTimedOut, Description: "The server timed out waiting for the request to complete"}
+}
+
+func NetworkFailureError(err error) GntpError {
+	return GntpError{Code: CodeNetworkFailure, Description: "The server could not be reached", Err: err}
+}
+
+func TooManyConnectionsError() GntpError {
+	return GntpError{Code: CodeNetworkFailure, Description: "The server is busy: too many connections"}
+}
+
 func UnknownRequestTypeError(t string) GntpError {
-	return GntpError{300, "Unknown or unsupported directive type: " + t}
+	return GntpError{Code: CodeInvalidRequest, Description: "Unknown or unsupported directive type: " + t}
 }
 
 func InvalidRequestError(info string) GntpError {
-	return GntpError{300, "The request was malformed: " + info}
+	return GntpError{Code: CodeInvalidRequest, Description: "The request was malformed: " + info}
+}
+
+func RequestTooLargeError(what string) GntpError {
+	return GntpError{Code: CodeInvalidRequest, Description: "The request was too large: " + what + " exceeds the limit"}
 }
 
 func UnknownProtocolError(p string) GntpError {
-	return GntpError{301, "Unknown protocol: " + p}
+	return GntpError{Code: CodeUnknownProtocol, Description: "Unknown protocol: " + p}
 }
 
 func UnknownProtocolVersionError(v Version) GntpError {
-	return GntpError{302, "Unknown protocol version: " + strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor)}
+	return GntpError{Code: CodeUnknownProtocolVersion, Description: "Unknown protocol version: " + strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor)}
 }
 
 func MissingHeaderError(header string) GntpError {
-	return GntpError{303, "Required header " + header + " missing"}
+	return GntpError{Code: CodeRequiredHeaderMissing, Description: "Required header " + header + " missing"}
+}
+
+func NotAuthorizedError(info string) GntpError {
+	return GntpError{Code: CodeNotAuthorized, Description: "The request was not authorized: " + info}
 }
 
 func UnknownApplicationError(name string) GntpError {
-	return GntpError{400, "Application " + name + " not known"}
+	return GntpError{Code: CodeUnknownApplication, Description: "Application " + name + " not known"}
 }
 
 func UnknownNotificationError(app, name string) GntpError {
-	return GntpError{401, "Notification " + name + " not known for " + app}
+	return GntpError{Code: CodeUnknownNotification, Description: "Notification " + name + " not known for " + app}
+}
+
+func AlreadyProcessedError() GntpError {
+	return GntpError{Code: CodeAlreadyProcessed, Description: "The request was already processed"}
+}
+
+func NotificationDisabledError(app, name string) GntpError {
+	return GntpError{Code: CodeNotificationDisabled, Description: "Notification " + name + " is disabled for " + app}
 }
 
 func InternalServerError() GntpError {
-	return GntpError{500, "The server encountered an internal error"}
+	return GntpError{Code: CodeInternalServerError, Description: "The server encountered an internal error"}
 }
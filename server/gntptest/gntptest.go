@@ -0,0 +1,216 @@
+/*
+Package gntptest provides utilities for testing GNTP handlers, without
+opening real sockets.
+
+Requests are built with NewRequest, then either handled directly with
+Record:
+
+	req := gntptest.NewRequest("NOTIFY", gntptest.NewHeader(
+		"Application-Name", "My App",
+		"Notification-Name", "New Mail",
+		"Notification-Title", "Hello",
+	))
+	rec := gntptest.Record(handler, req)
+	if resp := rec.Result(); resp.Type != "OK" {
+		t.Errorf("got -%s response", resp.Type)
+	}
+
+or sent to a Server, which serves them just as a real server.Server would,
+over in-memory connections:
+
+	mux := server.NewServeMux()
+	mux.Register("NOTIFY", handler)
+	srv := gntptest.NewServer(mux)
+	defer srv.Close()
+	resp, err := srv.Do(req.Bytes())
+*/
+package gntptest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/jgrocho/gntp_notify/server"
+)
+
+// Request is a GNTP request to be sent to a handler.
+type Request struct {
+	Type     string            // the type of request (REGISTER, NOTIFY, etc.)
+	Headers  []server.Header   // the blocks of Header lines
+	Binaries map[string][]byte // a map from Identifier to binary data
+
+	// Password, if set, is used to add a key hash to the request.
+	Password string
+}
+
+// NewRequest allocates and initializes a Request of type reqType, with the
+// given blocks of headers.
+func NewRequest(reqType string, headers ...server.Header) *Request {
+	return &Request{
+		Type:     reqType,
+		Headers:  headers,
+		Binaries: make(map[string][]byte),
+	}
+}
+
+// NewHeader builds a Header from pairs of keys and values.
+func NewHeader(keyValues ...string) server.Header {
+	if len(keyValues)%2 != 0 {
+		panic("gntptest: NewHeader given an odd number of arguments")
+	}
+	header := server.NewHeader()
+	for i := 0; i < len(keyValues); i += 2 {
+		header.Add(keyValues[i], keyValues[i+1])
+	}
+	return header
+}
+
+// AddBinary adds data to the request as a binary resource, and returns the
+// x-growl-resource:// URL to refer to it by in a header. Binaries no header
+// refers to are not sent.
+func (req *Request) AddBinary(ident string, data []byte) string {
+	req.Binaries[ident] = data
+	return "x-growl-resource://" + ident
+}
+
+// Bytes formats the request as it is sent over the network. It panics if a
+// header refers to a binary that wasn't added.
+func (req *Request) Bytes() []byte {
+	out := &server.Request{
+		Type:     req.Type,
+		Headers:  req.Headers,
+		Binaries: make(map[string]*server.Binary, len(req.Binaries)),
+	}
+	if req.Password != "" {
+		kh, err := server.NewKeyHash("SHA512", req.Password)
+		if err != nil {
+			panic("gntptest: " + err.Error())
+		}
+		out.KeyHash = kh
+	}
+	for ident, data := range req.Binaries {
+		out.Binaries[ident] = &server.Binary{Ident: ident, Length: int64(len(data)), Data: data}
+	}
+
+	var buf bytes.Buffer
+	if err := out.Write(&buf); err != nil {
+		panic("gntptest: " + err.Error())
+	}
+	return buf.Bytes()
+}
+
+// ResponseRecorder is a server.ResponseWriter that records what a handler
+// did with a request.
+type ResponseRecorder struct {
+	Request   *server.Request    // the request, as far as it was parsed
+	Response  *server.Response   // the first message written, if any
+	Callbacks []*server.Response // the -CALLBACK messages written after it
+	Err       error              // the error from Parse or Respond, if any
+
+	header  server.Header
+	current *server.Response // the message written until its binaries are
+	pending map[string]bool  // the binaries of current not yet written
+}
+
+// NewRecorder allocates a ResponseRecorder.
+func NewRecorder() *ResponseRecorder {
+	return new(ResponseRecorder)
+}
+
+// Header gets the headers of the next message.
+func (rec *ResponseRecorder) Header() server.Header {
+	if rec.header == nil {
+		rec.header = server.NewHeader()
+	}
+	return rec.header
+}
+
+// WriteHeader records a message of type respType with the headers set,
+// refusing it if a server.Server would.
+func (rec *ResponseRecorder) WriteHeader(respType string) error {
+	if len(rec.pending) > 0 {
+		return server.ErrBinariesPending
+	}
+	if rec.Response != nil && respType != "CALLBACK" {
+		return server.ErrNotCallback
+	}
+	msg := server.NewResponse(1, 0)
+	msg.Type = respType
+	msg.Headers[0] = rec.Header()
+	rec.header = nil
+	if rec.Response == nil {
+		rec.Response = msg
+	} else {
+		rec.Callbacks = append(rec.Callbacks, msg)
+	}
+	rec.current = msg
+	rec.pending = make(map[string]bool)
+	for _, ident := range msg.Headers[0].Resources() {
+		rec.pending[ident] = true
+	}
+	return nil
+}
+
+// WriteBinary records the binary ident of the last message, reading all
+// its data from r, refusing it if a server.Server would.
+func (rec *ResponseRecorder) WriteBinary(ident string, length int64, r io.Reader) error {
+	if rec.current == nil {
+		return server.ErrHeaderNotWritten
+	}
+	if !rec.pending[ident] {
+		return errors.New("gntptest: binary " + ident + " not referred to by the headers, or already written")
+	}
+	data, err := io.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != length {
+		return io.ErrUnexpectedEOF
+	}
+	rec.current.Binaries[ident] = &server.Binary{Ident: ident, Length: length, Data: data}
+	delete(rec.pending, ident)
+	return nil
+}
+
+// Flush does nothing, as messages are recorded as they are written.
+func (rec *ResponseRecorder) Flush() error {
+	return nil
+}
+
+// Record has h parse and respond to req, as a server.Server would after
+// reading its directive line, and records the outcome. The request is not
+// authenticated, so its Password is ignored. Handlers that wait to write a
+// further message, such as a -CALLBACK response, hold up Record until they
+// do.
+func Record(h server.Handler, req *Request) *ResponseRecorder {
+	mux := server.NewServeMux()
+	mux.Register(req.Type, h)
+
+	rec := NewRecorder()
+	parsed, err := mux.Parse(bufio.NewReader(bytes.NewReader(req.Bytes())), nil)
+	rec.Request = parsed
+	if err != nil {
+		rec.Err = err
+		return rec
+	}
+	rec.Err = mux.Respond(rec, parsed)
+	if rec.Err == nil && rec.Response == nil {
+		// The server writes an -OK response for handlers that don't.
+		rec.WriteHeader("OK")
+	}
+	return rec
+}
+
+// Result gets the response a client would receive: the first message
+// recorded, or the -ERROR response for the recorded error if there was none.
+func (rec *ResponseRecorder) Result() *server.Response {
+	if rec.Response != nil {
+		return rec.Response
+	}
+	if ge, ok := server.AsGntpError(rec.Err); ok {
+		return ge.Response()
+	}
+	return server.InternalServerError().Response()
+}
@@ -0,0 +1,147 @@
+package gntptest
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jgrocho/gntp_notify/server"
+)
+
+func TestNewRequest(t *testing.T) {
+	req := NewRequest("NOTIFY", NewHeader(
+		"Application-Name", "Test",
+		"Notification-Name", "Test",
+		"Notification-Title", "Hello",
+	))
+	req.Headers[0].Set("Notification-Icon", req.AddBinary("abc", []byte("icon")))
+	req.Password = "secret"
+
+	parsed, err := server.ParseRequest(req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Type != "NOTIFY" || parsed.Notify == nil || parsed.Notify.Title != "Hello" {
+		t.Errorf("parsed %+v, want the NOTIFY request", parsed)
+	}
+	if b := parsed.Binaries["abc"]; b == nil || b.Length != 4 {
+		t.Errorf("binary abc not sent")
+	}
+	if parsed.KeyHash == nil || !parsed.KeyHash.Verify("secret") {
+		t.Errorf("key hash %v, want one for the password", parsed.KeyHash)
+	}
+}
+
+func TestNewHeaderOddArguments(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewHeader didn't panic given an odd number of arguments")
+		}
+	}()
+	NewHeader("Application-Name")
+}
+
+func TestResponseRecorder(t *testing.T) {
+	rec := NewRecorder()
+	if err := rec.WriteBinary("abc", 4, strings.NewReader("icon")); err != server.ErrHeaderNotWritten {
+		t.Errorf("binary before the headers: %v, want %v", err, server.ErrHeaderNotWritten)
+	}
+	rec.Header().Set("Notification-Icon", "x-growl-resource://abc")
+	if err := rec.WriteHeader("OK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.WriteHeader("CALLBACK"); err != server.ErrBinariesPending {
+		t.Errorf("message before the binaries of the last: %v, want %v", err, server.ErrBinariesPending)
+	}
+	if err := rec.WriteBinary("def", 4, strings.NewReader("icon")); err == nil {
+		t.Error("binary not referred to by the headers accepted")
+	}
+	if err := rec.WriteBinary("abc", 4, strings.NewReader("ic")); err == nil {
+		t.Error("binary shorter than its length accepted")
+	}
+	if err := rec.WriteBinary("abc", 4, strings.NewReader("icon")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.WriteHeader("OK"); err != server.ErrNotCallback {
+		t.Errorf("second -OK message: %v, want %v", err, server.ErrNotCallback)
+	}
+	if err := rec.WriteHeader("CALLBACK"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Response.Type != "OK" || !bytes.Equal(rec.Response.Binaries["abc"].Data, []byte("icon")) {
+		t.Errorf("response %+v, want -OK with binary abc", rec.Response)
+	}
+	if len(rec.Callbacks) != 1 || rec.Callbacks[0].Type != "CALLBACK" {
+		t.Errorf("callbacks %+v, want one -CALLBACK", rec.Callbacks)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	req := NewRequest("PING", NewHeader("X-Test", "1"))
+	tests := []struct {
+		name    string
+		handler server.Handler
+		typ     string
+		code    int
+	}{
+		{"no response", server.HandlerFunc(func(server.ResponseWriter, *server.Request) error { return nil }), "OK", 0},
+		{"response", server.HandlerFunc(func(w server.ResponseWriter, req *server.Request) error {
+			w.Header().Set("Response-Action", "PING")
+			return w.WriteHeader("OK")
+		}), "OK", 0},
+		{"error", server.HandlerFunc(func(server.ResponseWriter, *server.Request) error {
+			return server.UnknownApplicationError("Test")
+		}), "ERROR", server.CodeUnknownApplication},
+		{"parse error", server.HandlerFuncs{
+			ParseFunc: func(_ *bufio.Reader, req *server.Request) (*server.Request, error) {
+				return nil, server.MissingHeaderError("X-Other")
+			},
+		}, "ERROR", server.CodeRequiredHeaderMissing},
+	}
+	for _, tt := range tests {
+		resp := Record(tt.handler, req).Result()
+		if resp.Type != tt.typ {
+			t.Errorf("%s: -%s response, want -%s", tt.name, resp.Type, tt.typ)
+		}
+		if err, _ := server.AsGntpError(resp.Err()); err.Code != tt.code {
+			t.Errorf("%s: error code %d, want %d", tt.name, err.Code, tt.code)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	mux := server.NewServeMux()
+	var remoteAddr string
+	mux.Register("PING", server.HandlerFunc(func(w server.ResponseWriter, req *server.Request) error {
+		remoteAddr = req.RemoteAddr
+		return w.WriteHeader("OK")
+	}))
+	srv := NewServer(mux)
+	defer srv.Close()
+	srv.Password = "secret"
+
+	req := NewRequest("PING", NewHeader("X-Test", "1"))
+	tests := []struct {
+		password string
+		code     int
+	}{
+		{"secret", 0},
+		{"wrong", server.CodeNotAuthorized},
+		{"", server.CodeNotAuthorized},
+	}
+	for _, tt := range tests {
+		req.Password = tt.password
+		resp, err := srv.Do(req.Bytes())
+		if err != nil {
+			t.Errorf("password %q: %v", tt.password, err)
+			continue
+		}
+		if err, _ := server.AsGntpError(resp.Err()); err.Code != tt.code {
+			t.Errorf("password %q: error code %d, want %d", tt.password, err.Code, tt.code)
+		}
+	}
+	if !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("remote address %q, want one on the loopback address", remoteAddr)
+	}
+}
@@ -0,0 +1,133 @@
+package gntptest
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jgrocho/gntp_notify/server"
+)
+
+// Server is a server.Server serving connections made in memory with Dial.
+// They appear to come from the loopback address, as handlers such as
+// SUBSCRIBE's need the client's host.
+type Server struct {
+	// Server is the server.Server being tested. It may be configured, with
+	// a Password, timeouts and so on, before the first connection is made.
+	*server.Server
+
+	listener *pipeListener
+	done     chan struct{} // closed when Serve returns
+}
+
+// NewServer starts a Server, dispatching requests to h, which parses them
+// from their directive line like a server.ServeMux. If h is nil,
+// server.DefaultServeMux is used. The caller should call Close when finished,
+// to shut it down.
+func NewServer(h server.Handler) *Server {
+	srv := &Server{
+		Server:   server.New("", h),
+		listener: newPipeListener(),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(srv.done)
+		srv.Serve(srv.listener)
+	}()
+	return srv
+}
+
+// Dial makes a connection to the Server.
+func (srv *Server) Dial() (net.Conn, error) {
+	return srv.listener.dial()
+}
+
+// Do sends the raw request to the Server on a new connection, and reads the
+// response. If the response asks for a callback, the connection is closed
+// without waiting for it; use Dial and server.ReadResponse to test
+// callbacks.
+func (srv *Server) Do(request []byte) (*server.Response, error) {
+	conn, err := srv.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// net.Pipe is unbuffered, so write while reading the response, in case
+	// the Server responds before reading the whole request.
+	go conn.Write(request)
+
+	return server.ReadResponse(bufio.NewReader(conn))
+}
+
+// Close shuts the Server down, waiting for its connections to finish.
+func (srv *Server) Close() {
+	srv.Shutdown(context.Background())
+	<-srv.done
+}
+
+// pipeListener is a net.Listener accepting connections made with net.Pipe.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	dials     int32 // the number of connections made, numbering their ports
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// dial makes a connection to the listener, returning the client's end.
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, srv := net.Pipe()
+	port := 1024 + int(atomic.AddInt32(&l.dials, 1))%64512
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	select {
+	case l.conns <- pipeConn{srv, remote}:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		srv.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// pipeConn is the Server's end of a connection made with Dial.
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// pipeAddr is the address of a pipeListener.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The responses in testdata are laid out as Growl sends them: Growl for
+// Windows, with its Origin and X- headers, and Growl for Mac, with none.
+
+func TestReadGrowlResponses(t *testing.T) {
+	tests := []struct {
+		file, typ, action string
+		headers           map[string]string
+	}{
+		{"gfw-register-ok.gntp", "OK", "REGISTER", map[string]string{"Origin-Software-Name": "Growl/Win"}},
+		{"gfw-notify-ok.gntp", "OK", "NOTIFY", map[string]string{"Notification-ID": "", "X-Message-Daemon": "Growl/Win"}},
+		{"gfw-notify-error.gntp", "ERROR", "NOTIFY", map[string]string{"Error-Code": "401"}},
+		{"gfw-notify-callback.gntp", "CALLBACK", "NOTIFY", map[string]string{
+			"Notification-ID":                    "42",
+			"Notification-Callback-Result":       "CLICKED",
+			"Notification-Callback-Context":      "ticket-42",
+			"Notification-Callback-Context-Type": "string",
+		}},
+		{"growl-mac-register-ok.gntp", "OK", "REGISTER", nil},
+	}
+	for _, tt := range tests {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(bytes.NewReader(data))
+		resp, err := ReadResponse(r)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if resp.Type != tt.typ || resp.Version != (Version{1, 0}) {
+			t.Errorf("%s: %s -%s, want GNTP/1.0 -%s", tt.file, resp.Version, resp.Type, tt.typ)
+		}
+		if action, _ := resp.Headers[0].Get("Response-Action"); action != tt.action {
+			t.Errorf("%s: Response-Action = %q, want %q", tt.file, action, tt.action)
+		}
+		for key, want := range tt.headers {
+			if got, ok := resp.Headers[0].Get(key); !ok || got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.file, key, got, want)
+			}
+		}
+		if (resp.Err() != nil) != (tt.typ == "ERROR") {
+			t.Errorf("%s: Err() = %v", tt.file, resp.Err())
+		}
+		if rest, _ := r.Peek(1); len(rest) > 0 {
+			t.Errorf("%s: %q left unread", tt.file, rest)
+		}
+	}
+}
+
+func TestWriteResponseBinaries(t *testing.T) {
+	resp := NewResponse(1, 0)
+	resp.Headers[0].Set("Response-Action", "NOTIFY")
+	resp.Headers[0].Set("X-Icon", "x-growl-resource://4c2bd8c8d1b4cf4a")
+	resp.Headers[0].Set("X-Sound", "x-growl-resource://empty")
+	resp.Binaries = map[string]*Binary{
+		"4c2bd8c8d1b4cf4a": {Ident: "4c2bd8c8d1b4cf4a", Length: 6, Data: []byte("icon\r\n")},
+		"empty":            {Ident: "empty", Length: 0, Data: []byte{}},
+	}
+	var b bytes.Buffer
+	if err := resp.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "write-binaries.gntp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Write:\n%q\nwant:\n%q", b.Bytes(), want)
+	}
+}
@@ -1,10 +1,18 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // Header represents a block of Header: Value lines.
@@ -38,6 +46,103 @@ func (h Header) Get(key string) (string, bool) {
 	return v[0], ok
 }
 
+// Require gets the first value associated with key in the Header. If the key
+// is unset or empty it returns a MissingHeaderError.
+func (h Header) Require(key string) (string, error) {
+	v, ok := h.Get(key)
+	if !ok || v == "" {
+		return "", MissingHeaderError(textproto.CanonicalMIMEHeaderKey(key))
+	}
+	return v, nil
+}
+
+// GetInt gets the first value associated with key in the Header as an
+// integer. If the key is unset or empty it returns def. If the value is not
+// an integer it returns def and an InvalidRequestError.
+func (h Header) GetInt(key string, def int) (int, error) {
+	v, ok := h.Get(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return def, InvalidRequestError(textproto.CanonicalMIMEHeaderKey(key) + " must be an integer").Wrap(err)
+	}
+	return n, nil
+}
+
+// GetBool gets the first value associated with key in the Header as a GNTP
+// boolean: Yes or True, or No or False, in any case. If the key is unset or
+// empty it returns def. If the value is not a boolean it returns def and an
+// InvalidRequestError.
+func (h Header) GetBool(key string, def bool) (bool, error) {
+	v, ok := h.Get(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "yes", "true":
+		return true, nil
+	case "no", "false":
+		return false, nil
+	}
+	return def, InvalidRequestError(textproto.CanonicalMIMEHeaderKey(key) + " must be Yes, No, True or False")
+}
+
+// timeLayouts are the layouts GNTP dates are accepted in. The specification
+// asks for "yyyy-MM-dd HH:mm:ssZ", but clients send RFC 3339 too.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05Z",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+}
+
+// GetTime gets the first value associated with key in the Header as a time.
+// Times without a zone are taken as UTC. If the key is unset or empty it
+// returns def. If the value is not a time it returns def and an
+// InvalidRequestError.
+func (h Header) GetTime(key string, def time.Time) (time.Time, error) {
+	v, ok := h.Get(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	v = strings.TrimSpace(v)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return def, InvalidRequestError(textproto.CanonicalMIMEHeaderKey(key) + " must be a date and time")
+}
+
+// GetURL gets the first value associated with key in the Header as an
+// absolute URL. If the key is unset or empty it returns nil. If the value is
+// not an absolute URL it returns nil and an InvalidRequestError.
+func (h Header) GetURL(key string) (*url.URL, error) {
+	v, ok := h.Get(key)
+	if !ok || v == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(v))
+	if err != nil || !u.IsAbs() {
+		return nil, InvalidRequestError(textproto.CanonicalMIMEHeaderKey(key) + " must be an absolute URL")
+	}
+	return u, nil
+}
+
+// Custom gets the custom headers in the Header: those starting with X- or
+// Data-, which GNTP lets applications send for their own use.
+func (h Header) Custom() Header {
+	custom := NewHeader()
+	for k, vs := range h {
+		if strings.HasPrefix(k, "X-") || strings.HasPrefix(k, "Data-") {
+			custom[k] = append([]string(nil), vs...)
+		}
+	}
+	return custom
+}
+
 // Del deletes the values associated with the key.
 func (h Header) Del(key, value string) {
 	textproto.MIMEHeader(h).Del(key)
@@ -47,10 +152,20 @@ func (h Header) Del(key, value string) {
 // should not appear inside the value for a Header.
 var newlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
 
-// Write writes the Header to w.
+// keys gets the keys of the Header in order.
+func (h Header) keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write writes the Header to w, in order of key.
 func (h Header) Write(w io.Writer) error {
-	for k, vs := range h {
-		for _, v := range vs {
+	for _, k := range h.keys() {
+		for _, v := range h[k] {
 			v = newlineToSpace.Replace(v)
 			v = strings.TrimSpace(v)
 			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, v); err != nil {
@@ -60,3 +175,119 @@ func (h Header) Write(w io.Writer) error {
 	}
 	return nil
 }
+
+// ReadHeader reads a block of Header lines, up to and including the blank
+// line ending it. The Header blocks of a Request may not, together, be larger
+// than the Server's MaxHeaderBytes, nor more than its MaxHeaderBlocks, and
+// each may have no more than MaxHeaderLines lines of at most MaxLineBytes.
+func (req *Request) ReadHeader(b *bufio.Reader) (Header, error) {
+	req.phase()
+	req.headerBlocks++
+	if req.maxHeaderBlocks > 0 && req.headerBlocks > req.maxHeaderBlocks {
+		return nil, RequestTooLargeError("number of header blocks")
+	}
+
+	var block []byte
+	lines, lineBytes := 0, 0
+	start := true
+	for {
+		line, err := b.ReadSlice('\n')
+		req.headerBytes += int64(len(line))
+		if req.maxHeaderBytes > 0 && req.headerBytes > req.maxHeaderBytes {
+			return nil, RequestTooLargeError("headers")
+		}
+		lineBytes += len(line)
+		if req.maxLineBytes > 0 && lineBytes > req.maxLineBytes {
+			return nil, RequestTooLargeError("header line")
+		}
+		block = append(block, line...)
+		if err == bufio.ErrBufferFull {
+			start = false
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				// Let textproto decide whether the block is complete.
+				break
+			}
+			return nil, err
+		}
+		if start && (string(line) == "\r\n" || string(line) == "\n") {
+			break
+		}
+		start = true
+		lineBytes = 0
+		lines++
+		if req.maxHeaderLines > 0 && lines > req.maxHeaderLines {
+			return nil, RequestTooLargeError("number of header lines")
+		}
+	}
+
+	block = bytes.TrimPrefix(block, []byte(utf8BOM))
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(block)))
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, headerError(err)
+	}
+	header := Header(h)
+	repaired, err := header.sanitize()
+	if err != nil {
+		return nil, err
+	}
+	if repaired {
+		req.Logger().Debug("gntp: replaced invalid UTF-8 in headers")
+	}
+	return header, nil
+}
+
+// headerError turns an error textproto found in a block of headers into an
+// InvalidRequestError.
+func headerError(err error) error {
+	var protoErr textproto.ProtocolError
+	if errors.As(err, &protoErr) {
+		return InvalidRequestError(string(protoErr))
+	}
+	return err
+}
+
+// utf8BOM is the byte order mark some clients start text with, though UTF-8
+// has no need of one.
+const utf8BOM = "\ufeff"
+
+// maxInvalidUTF8 is the share of the bytes of a header value that may be
+// invalid UTF-8 for it to be repaired, rather than refused as not text at
+// all.
+const maxInvalidUTF8 = 0.25
+
+// sanitize makes the values of h valid UTF-8, as GNTP requires, though not
+// all clients keep to it: it strips any byte order mark they start with, and
+// replaces invalid sequences with U+FFFD. It reports whether any value was
+// repaired. Values that are mostly not UTF-8 can't be repaired, and it
+// fails with an InvalidRequestError.
+func (h Header) sanitize() (repaired bool, err error) {
+	for key, values := range h {
+		for i, v := range values {
+			if strings.HasPrefix(v, utf8BOM) {
+				v = strings.TrimPrefix(v, utf8BOM)
+				repaired = true
+			}
+			if !utf8.ValidString(v) {
+				invalid := 0
+				for j := 0; j < len(v); {
+					r, size := utf8.DecodeRuneInString(v[j:])
+					if r == utf8.RuneError && size == 1 {
+						invalid++
+					}
+					j += size
+				}
+				if float64(invalid) > maxInvalidUTF8*float64(len(v)) {
+					return repaired, InvalidRequestError(key + " is not UTF-8")
+				}
+				v = strings.ToValidUTF8(v, "\ufffd")
+				repaired = true
+			}
+			values[i] = v
+		}
+	}
+	return repaired, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+)
+
+// Middleware wraps a Handler to add to what it does, such as logging,
+// authentication or collecting statistics, without changing the Handler
+// itself. A Middleware for logging the type of every request might be:
+//
+//	func logTypes(next server.Handler) server.Handler {
+//		return server.HandlerFuncs{
+//			ParseFunc: next.Parse,
+//			RespondFunc: func(w server.ResponseWriter, req *server.Request) error {
+//				req.Logger().Info("responding")
+//				return next.Respond(w, req)
+//			},
+//		}
+//	}
+type Middleware func(Handler) Handler
+
+// Chain wraps h in each of middleware, so the first Middleware is the
+// outermost: it sees each request first, and each response last.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// HandlerFuncs adapts a pair of functions to a Handler, which is handy for
+// writing Middleware. Either may be nil: requests are then parsed as a
+// HandlerFunc parses them, and responded to with an -OK response.
+type HandlerFuncs struct {
+	ParseFunc   func(*bufio.Reader, *Request) (*Request, error)
+	RespondFunc func(ResponseWriter, *Request) error
+}
+
+// Parse calls ParseFunc, if not nil.
+func (h HandlerFuncs) Parse(b *bufio.Reader, req *Request) (*Request, error) {
+	if h.ParseFunc == nil {
+		return HandlerFunc(nil).Parse(b, req)
+	}
+	return h.ParseFunc(b, req)
+}
+
+// Respond calls RespondFunc, if not nil.
+func (h HandlerFuncs) Respond(w ResponseWriter, req *Request) error {
+	if h.RespondFunc == nil {
+		return nil
+	}
+	return h.RespondFunc(w, req)
+}
+
+// HandlerFunc adapts a function to a Handler, as http.HandlerFunc does, so
+// small handlers can be registered without defining a type:
+//
+//	server.Register("PING", server.HandlerFunc(func(w server.ResponseWriter, req *server.Request) error {
+//		w.Header().Set("Response-Action", "PING")
+//		return w.WriteHeader("OK")
+//	}))
+//
+// Requests are read with ReadBody, and their binaries kept in memory, in the
+// Data of the Request's Binaries.
+type HandlerFunc func(ResponseWriter, *Request) error
+
+// Parse reads the headers and binaries of req.
+func (f HandlerFunc) Parse(b *bufio.Reader, req *Request) (*Request, error) {
+	data := make(memoryBinaries)
+	if err := req.ReadBody(b, data); err != nil {
+		return nil, err
+	}
+	for ident, binary := range req.Binaries {
+		binary.Data = data[ident]
+	}
+	return req, nil
+}
+
+// Respond calls f.
+func (f HandlerFunc) Respond(w ResponseWriter, req *Request) error {
+	return f(w, req)
+}
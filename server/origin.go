@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Origin describes the machine and software a Server runs on. Growl servers
+// send it with every response, so clients can tell who answered.
+type Origin struct {
+	MachineName     string // Origin-Machine-Name
+	SoftwareName    string // Origin-Software-Name
+	SoftwareVersion string // Origin-Software-Version
+	PlatformName    string // Origin-Platform-Name
+	PlatformVersion string // Origin-Platform-Version
+
+	// Id identifies this Server in the Received headers it adds, so it can
+	// tell them from those of other servers on the same machine.
+	Id string
+}
+
+// NewOrigin builds an Origin for the software named name, at version,
+// running on this machine.
+func NewOrigin(name, version string) *Origin {
+	origin := &Origin{
+		SoftwareName:    name,
+		SoftwareVersion: version,
+		PlatformName:    runtime.GOOS,
+	}
+	origin.MachineName, _ = os.Hostname()
+	id := make([]byte, 8)
+	rand.Read(id)
+	origin.Id = hex.EncodeToString(id)
+	// The kernel release is only readily available on Linux.
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		origin.PlatformVersion = strings.TrimSpace(string(release))
+	}
+	return origin
+}
+
+// setHeaders sets the Origin headers, those that are known, and X-Timestamp
+// in header.
+func (origin *Origin) setHeaders(header Header) {
+	set := func(key, value string) {
+		if value != "" {
+			header.Set(key, value)
+		}
+	}
+	set("Origin-Machine-Name", origin.MachineName)
+	set("Origin-Software-Name", origin.SoftwareName)
+	set("Origin-Software-Version", origin.SoftwareVersion)
+	set("Origin-Platform-Name", origin.PlatformName)
+	set("Origin-Platform-Version", origin.PlatformVersion)
+	header.Set("X-Timestamp", time.Now().Format(time.RFC3339))
+}
+
+// AddReceived adds a Received header to header, as GNTP asks of servers
+// forwarding requests, recording that the request came from the host from
+// and was received by the Server origin describes.
+func (origin *Origin) AddReceived(header Header, from string) {
+	header.Add("Received", "From "+from+" by "+origin.MachineName+
+		" with "+origin.SoftwareName+"/"+origin.SoftwareVersion+
+		" id "+origin.Id+"; "+time.Now().UTC().Format("2006-01-02 15:04:05Z"))
+}
+
+// Received reports whether header holds a Received header added by the
+// Server origin describes, which means the request has been forwarded back
+// to it.
+func (origin *Origin) Received(header Header) bool {
+	if origin.Id == "" {
+		return false
+	}
+	for _, value := range header["Received"] {
+		// The date follows the last semicolon.
+		if i := strings.LastIndex(value, ";"); i >= 0 {
+			value = value[:i]
+		}
+		by, id := false, false
+		fields := strings.Fields(value)
+		for i := 0; i+1 < len(fields); i++ {
+			switch strings.ToLower(fields[i]) {
+			case "by":
+				by = strings.EqualFold(fields[i+1], origin.MachineName)
+			case "id":
+				id = fields[i+1] == origin.Id
+			}
+		}
+		if by && id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// crlf replaces the line breaks in s with CRLF, as GNTP sends them.
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// parseSeeds are requests to start fuzzing ParseRequest from: well-formed
+// ones, with CRLF or bare LF line endings, cut short, or declaring many
+// header blocks.
+var parseSeeds = []string{
+	crlf("GNTP/1.0 REGISTER NONE\nApplication-Name: Test\nNotifications-Count: 1\n\nNotification-Name: Message\nNotification-Enabled: True\n\n"),
+	"GNTP/1.0 REGISTER NONE\nApplication-Name: Test\nNotifications-Count: 1\n\nNotification-Name: Message\n\n",
+	crlf("GNTP/1.0 NOTIFY NONE\nApplication-Name: Test\nNotification-Name: Message\nNotification-Title: Hello\n\n"),
+	"GNTP/1.0 NOTIFY NONE\nApplication-Name: Test\nNotification-Name: Message\nNotification-Title: Hello\n\n",
+	crlf("GNTP/1.0 NOTIFY NONE\nApplication-Name: Test\nNotification-Name: Message\nNotification-Title: Hello\nNotification-Icon: x-growl-resource://abc\n\nIdentifier: abc\nLength: 4\n\ndata\n\n"),
+	"GNTP/1.0 NOTIFY NONE\nApplication-Name: Test\nNotification-Name: Message\nNotification-Icon: x-growl-resource://abc\n\nIdentifier: abc\nLength: 4\n\nda",
+	crlf("GNTP/1.0 REGISTER NONE\nApplication-Name: Test\nNotifications-Count: 1\n\nNotif"),
+	"GNTP/1.0 NOTIFY",
+	"GNTP/1.0 NOTIFY AES:0011",
+	crlf("GNTP/1.0 REGISTER NONE\nApplication-Name: Test\nNotifications-Count: 1000000\n\n" + strings.Repeat("Notification-Name: Message\n\n", 100)),
+	crlf("GNTP/1.0 SUBSCRIBE NONE\nSubscriber-ID: 1\nSubscriber-Name: Test\n\n"),
+	"",
+}
+
+func FuzzParseRequest(f *testing.F) {
+	for _, seed := range parseSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := ParseRequest(data)
+		if err != nil {
+			if req != nil {
+				t.Errorf("ParseRequest returned a request along with error %v", err)
+			}
+			return
+		}
+		if len(req.Headers) == 0 {
+			t.Errorf("ParseRequest returned a %s request without headers", req.Type)
+		}
+		for ident, b := range req.Binaries {
+			if b.Ident != ident {
+				t.Errorf("binary %q kept under %q", b.Ident, ident)
+			}
+		}
+	})
+}
+
+func TestParseRequestLineEndings(t *testing.T) {
+	for _, data := range []string{parseSeeds[0], parseSeeds[1], parseSeeds[2], parseSeeds[3], parseSeeds[4]} {
+		req, err := ParseRequest([]byte(data))
+		if err != nil {
+			t.Errorf("ParseRequest(%q): %v", data, err)
+			continue
+		}
+		if app, _ := req.Headers[0].Get("Application-Name"); app != "Test" {
+			t.Errorf("ParseRequest(%q): Application-Name = %q, want Test", data, app)
+		}
+	}
+}
+
+func TestParseRequestTruncated(t *testing.T) {
+	for _, data := range []string{parseSeeds[0], parseSeeds[4]} {
+		for i := 0; i < len(data)-1; i++ {
+			if _, err := ParseRequest([]byte(data[:i])); err == nil {
+				t.Errorf("ParseRequest(%q) cut short succeeded", data[:i])
+			}
+		}
+	}
+}
+
+func TestParseRequestManyBlocks(t *testing.T) {
+	if _, err := ParseRequest([]byte(parseSeeds[9])); err == nil {
+		t.Error("ParseRequest accepted a request declaring a million notification types")
+	}
+}
+
+func TestReadDirectiveLineLimit(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"GNTP/1.0 NOTIFY NONE\r\n", true},
+		{"GNTP/1.0 NOTIFY NONE", true},
+		{"GNTP/1.0 NOTIFY NONE " + strings.Repeat(" ", 64) + "\r\n", false},
+		{"GNTP/1.0 " + strings.Repeat("X", 8192), false},
+	}
+	for _, tt := range tests {
+		req := &Request{maxLineBytes: 64}
+		_, err := readDirective(bufio.NewReaderSize(strings.NewReader(tt.line), 16), req)
+		if tt.ok && err != nil {
+			t.Errorf("directive %.30q: %v", tt.line, err)
+		}
+		if !tt.ok {
+			if e, ok := err.(GntpError); !ok || e.Code != CodeInvalidRequest {
+				t.Errorf("directive %.30q: error %v, want a request too large error", tt.line, err)
+			}
+		}
+	}
+}
+
+func FuzzReadBinaries(f *testing.F) {
+	f.Add("abc", []byte(crlf("Identifier: abc\nLength: 4\n\ndata\n\n")))
+	f.Add("abc", []byte("Identifier: abc\nLength: 4\n\ndata\n\n"))
+	f.Add("abc", []byte(crlf("Identifier: abc\nLength: 4\n\nda")))
+	f.Add("abc", []byte(crlf("Identifier: abc\nLength: 99999999999\n\ndata\n\n")))
+	f.Add("abc", []byte(crlf("Identifier: abc\nLength: -1\n\n\n\n")))
+	f.Add("abc", []byte(crlf("Identifier: def\nLength: 0\n\n\n\n")))
+	f.Add("../x", []byte(crlf("Identifier: ../x\nLength: 0\n\n\n\n")))
+	f.Add("abc", []byte{})
+	f.Fuzz(func(t *testing.T, ident string, data []byte) {
+		header := NewHeader()
+		header.Set("Notification-Icon", "x-growl-resource://"+ident)
+		binaries := make(memoryBinaries)
+		bs, err := ReadBinaries(bufio.NewReader(bytes.NewReader(data)), []Header{header}, binaries)
+		if err != nil {
+			return
+		}
+		for key, b := range bs {
+			got, err := binaries.Get(key)
+			if err != nil {
+				t.Fatalf("binary %q read but not kept: %v", key, err)
+			}
+			if int64(len(got)) != b.Length {
+				t.Errorf("binary %q has %d bytes, but Length %d", key, len(got), b.Length)
+			}
+		}
+	})
+}
+
+func TestParseRequestResourceIdents(t *testing.T) {
+	notify := "GNTP/1.0 NOTIFY NONE\nApplication-Name: Test\nNotification-Name: Message\nNotification-Title: Hello\nNotification-Icon: %s\n\n"
+	for _, icon := range []string{
+		"x-growl-resource://../../etc/hostname",
+		"X-Growl-Resource://../../etc/hostname",
+		"x-growl-resource://a/b",
+		"x-growl-resource://",
+	} {
+		data := crlf(strings.Replace(notify, "%s", icon, 1))
+		if _, err := ParseRequest([]byte(data)); err == nil {
+			t.Errorf("ParseRequest accepted Notification-Icon: %s", icon)
+		}
+	}
+
+	// References are matched in any case, so need their binary sent.
+	data := crlf(strings.Replace(notify, "%s", "X-Growl-Resource://abc", 1))
+	if _, err := ParseRequest([]byte(data)); err == nil {
+		t.Error("ParseRequest accepted a reference to a binary not sent")
+	}
+	req, err := ParseRequest([]byte(data + crlf("Identifier: abc\nLength: 4\n\ndata\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Binaries["abc"] == nil {
+		t.Error("binary abc not read")
+	}
+}
+
+func TestParseRegisterResourceIdents(t *testing.T) {
+	data := crlf("GNTP/1.0 REGISTER NONE\nApplication-Name: Test\nNotifications-Count: 1\n\nNotification-Name: Message\nNotification-Icon: x-growl-resource://../x\n\n")
+	if _, err := ParseRequest([]byte(data)); err == nil {
+		t.Error("ParseRequest accepted a notification type icon outside the cache")
+	}
+}
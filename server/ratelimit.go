@@ -0,0 +1,87 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiterSweepInterval is how often a RateLimiter forgets the keys whose
+// buckets have filled up again.
+const rateLimiterSweepInterval = time.Minute
+
+// RateLimiter limits how often something may happen for each key, such as
+// each client's address, with a token bucket per key. It is safe for
+// concurrent use.
+type RateLimiter struct {
+	rate  float64 // tokens added to each bucket per second
+	burst float64 // the size of each bucket
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket holds the tokens left for a key, as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allocates and initializes a RateLimiter allowing rate events
+// per second for each key, in bursts of up to burst events.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether an event for key may happen now, taking a token from
+// its bucket if so.
+func (rl *RateLimiter) Allow(key string) bool {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimiterSweepInterval {
+		rl.sweep(now)
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{rl.burst, now}
+		rl.buckets[key] = b
+	}
+	b.tokens = rl.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill gives the tokens in b as of now.
+func (rl *RateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.rate
+	if tokens > rl.burst {
+		tokens = rl.burst
+	}
+	return tokens
+}
+
+// sweep forgets the keys whose buckets are full, as they behave the same as
+// new keys. rl.mu must be held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if rl.refill(b, now) >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
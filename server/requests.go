@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// RegisterRequest holds the headers of a REGISTER request: the application
+// being registered and the types of notification it sends.
+type RegisterRequest struct {
+	Application   string             // Application-Name
+	Icon          string             // Application-Icon, a URL or x-growl-resource:// identifier
+	Notifications []NotificationType // one for each Notifications-Count block
+	Custom        Header             // the X-* and Data-* headers of the application block
+}
+
+// NotificationType is a type of notification declared by a REGISTER request.
+type NotificationType struct {
+	Name    string // Notification-Name
+	Display string // Notification-Display-Name (or Notification-Display), or Name if not given
+	Enabled bool   // Notification-Enabled, false if not given
+	Icon    string // Notification-Icon, empty if not given
+}
+
+// NotifyRequest holds the headers of a NOTIFY request.
+type NotifyRequest struct {
+	Application  string // Application-Name
+	Name         string // Notification-Name
+	Id           string // Notification-ID
+	Title        string // Notification-Title
+	Text         string // Notification-Text
+	Icon         string // Notification-Icon, empty if not given
+	Sticky       bool   // Notification-Sticky
+	Priority     int    // Notification-Priority
+	CoalescingId string // Notification-Coalescing-ID
+
+	Callback CallbackInfo
+	Custom   Header // the X-* and Data-* headers
+}
+
+// CallbackInfo holds the callback headers of a NOTIFY request.
+type CallbackInfo struct {
+	Context     string // Notification-Callback-Context
+	ContextType string // Notification-Callback-Context-Type
+	Target      string // Notification-Callback-Target
+}
+
+// ParseRegister parses the header blocks of a REGISTER request: the
+// application block, followed by a block for each notification type.
+func ParseRegister(headers []Header) (*RegisterRequest, error) {
+	if len(headers) == 0 {
+		return nil, MissingHeaderError("Application-Name")
+	}
+	appHeader := headers[0]
+
+	reg := new(RegisterRequest)
+	var err error
+	if reg.Application, err = appHeader.Require("Application-Name"); err != nil {
+		return nil, err
+	}
+	count, err := registerCount(appHeader)
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) != count+1 {
+		return nil, InvalidRequestError("notification count does not match the notifications given")
+	}
+	if err := checkResources(headers); err != nil {
+		return nil, err
+	}
+	reg.Icon, _ = appHeader.Get("Application-Icon")
+	reg.Custom = appHeader.Custom()
+
+	reg.Notifications = make([]NotificationType, 0, count)
+	seen := make(map[string]bool, count)
+	for _, header := range headers[1:] {
+		var nt NotificationType
+		if nt.Name, err = header.Require("Notification-Name"); err != nil {
+			return nil, err
+		}
+		if seen[nt.Name] {
+			return nil, InvalidRequestError("Duplicate notification registered: " + nt.Name)
+		}
+		seen[nt.Name] = true
+
+		if nt.Display, _ = header.Get("Notification-Display-Name"); nt.Display == "" {
+			nt.Display, _ = header.Get("Notification-Display")
+		}
+		if nt.Display == "" {
+			nt.Display = nt.Name
+		}
+		// Notifications are not enabled by default, including when the value
+		// isn't a boolean.
+		nt.Enabled, _ = header.GetBool("Notification-Enabled", false)
+		nt.Icon, _ = header.Get("Notification-Icon")
+
+		reg.Notifications = append(reg.Notifications, nt)
+	}
+
+	return reg, nil
+}
+
+// registerCount gets the number of notification blocks a REGISTER request's
+// application block declares.
+func registerCount(appHeader Header) (int, error) {
+	if _, err := appHeader.Require("Notifications-Count"); err != nil {
+		return 0, err
+	}
+	count, err := appHeader.GetInt("Notifications-Count", 0)
+	if err != nil || count < 0 {
+		return 0, InvalidRequestError("notification count must be a non-negative integer")
+	}
+	return count, nil
+}
+
+// ParseNotify parses the header block of a NOTIFY request.
+func ParseNotify(header Header) (*NotifyRequest, error) {
+	n := new(NotifyRequest)
+	var err error
+	if n.Application, err = header.Require("Application-Name"); err != nil {
+		return nil, err
+	}
+	if n.Name, err = header.Require("Notification-Name"); err != nil {
+		return nil, err
+	}
+	var ok bool
+	if n.Title, ok = header.Get("Notification-Title"); !ok {
+		return nil, MissingHeaderError("Notification-Title")
+	}
+	if err := checkResources([]Header{header}); err != nil {
+		return nil, err
+	}
+
+	n.Id, _ = header.Get("Notification-ID")
+	n.Text, _ = header.Get("Notification-Text")
+	n.Icon, _ = header.Get("Notification-Icon")
+
+	// Notifications are not sticky by default, including when the value isn't
+	// a boolean.
+	n.Sticky, _ = header.GetBool("Notification-Sticky", false)
+	// Default priority is zero, including when the value isn't an integer.
+	n.Priority, _ = header.GetInt("Notification-Priority", 0)
+
+	n.CoalescingId, _ = header.Get("Notification-Coalescing-ID")
+	n.Custom = header.Custom()
+
+	n.Callback.Context, _ = header.Get("Notification-Callback-Context")
+	n.Callback.ContextType, _ = header.Get("Notification-Callback-Context-Type")
+	n.Callback.Target, _ = header.Get("Notification-Callback-Target")
+	if n.Callback.Context != "" && n.Callback.ContextType == "" {
+		return nil, MissingHeaderError("Notification-Callback-Context-Type")
+	}
+
+	return n, nil
+}
+
+// ReadRegister reads the header blocks of a REGISTER request, as many as its
+// application block declares, and parses them into the Request's Register.
+func (req *Request) ReadRegister(b *bufio.Reader) error {
+	header, err := req.ReadHeader(b)
+	if err != nil {
+		return err
+	}
+	count, err := registerCount(header)
+	if err != nil {
+		return err
+	}
+	// Refuse a count over the limit before reading any of its blocks.
+	if req.maxHeaderBlocks > 0 && count >= req.maxHeaderBlocks {
+		return RequestTooLargeError("number of header blocks")
+	}
+
+	// The blocks are only kept as they are read, so a count far larger
+	// than the request holds costs nothing.
+	req.Headers = []Header{header}
+	for i := 0; i < count; i++ {
+		block, err := req.ReadHeader(b)
+		if err != nil {
+			return err
+		}
+		req.Headers = append(req.Headers, block)
+	}
+
+	req.Register, err = ParseRegister(req.Headers)
+	return err
+}
+
+// ReadNotify reads the header block of a NOTIFY request, and parses it into
+// the Request's Notify.
+func (req *Request) ReadNotify(b *bufio.Reader) error {
+	header, err := req.ReadHeader(b)
+	if err != nil {
+		return err
+	}
+	req.Headers = []Header{header}
+
+	req.Notify, err = ParseNotify(header)
+	return err
+}
+
+// ParseRequest parses a whole request, as it is sent over the network, from
+// data: its directive line, its header blocks, read as its type asks, and
+// its binaries, which are kept in the Request. It doesn't involve any
+// Handler or Server, so none of a Server's limits apply, nor a password, so
+// encrypted requests are refused. Requests of types other than REGISTER and
+// NOTIFY are read as a single header block.
+// It is meant for tests and fuzzing: it never panics, however malformed or
+// cut short data is.
+func ParseRequest(data []byte) (*Request, error) {
+	req := new(Request)
+	b, err := readDirective(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.ReadBody(b, make(memoryBinaries)); err != nil {
+		return nil, incomplete(err)
+	}
+	return req, nil
+}
+
+// ReadBody reads the rest of a request once its directive line is read: its
+// header blocks, read as its type asks, and its binaries, which are saved to
+// binaries. REGISTER and NOTIFY requests are read with ReadRegister and
+// ReadNotify, and requests of other types as a single header block.
+func (req *Request) ReadBody(b *bufio.Reader, binaries Binaries) error {
+	var err error
+	switch req.Type {
+	case "REGISTER":
+		err = req.ReadRegister(b)
+	case "NOTIFY":
+		err = req.ReadNotify(b)
+	default:
+		var header Header
+		if header, err = req.ReadHeader(b); err == nil {
+			req.Headers = []Header{header}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return req.ReadBinaries(b, binaries)
+}
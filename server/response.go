@@ -0,0 +1,240 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ResponseWriter is used by a Handler to write the response to a request.
+//
+// A response is made of messages, each a directive line and a block of
+// headers, sent by WriteHeader, followed by the binaries the headers refer
+// to, each sent by WriteBinary. The first message is the -OK response, or
+// the -ERROR response a Handler sends itself; further messages may only be
+// -CALLBACK responses, such as the result of a notification's callback,
+// which the Handler waits for before returning. Each message is sent to the
+// client as soon as it is complete.
+//
+// The Server enforces this order, refusing writes that would break it. If
+// Respond returns without writing anything, the Server writes an -OK
+// response with the headers set, or an -ERROR response for its error.
+type ResponseWriter interface {
+	// Header gets the headers of the next message, which WriteHeader sends.
+	Header() Header
+	// WriteHeader sends the directive line of a message of type respType,
+	// such as "OK" or "CALLBACK", and its headers. The binaries they refer
+	// to must all be written before another message is.
+	WriteHeader(respType string) error
+	// WriteBinary sends the binary ident, which the headers of the message
+	// refer to, with the length bytes of data read from r.
+	WriteBinary(ident string, length int64, r io.Reader) error
+	// Flush sends anything written so far to the client.
+	Flush() error
+}
+
+// Errors for writes to a ResponseWriter out of order.
+var (
+	ErrHeaderNotWritten = errors.New("gntp: binary written before the headers")
+	ErrBinariesPending  = errors.New("gntp: message written before the binaries of the last")
+	ErrNotCallback      = errors.New("gntp: only -CALLBACK messages may follow the first")
+)
+
+// response implements ResponseWriter for a conn.
+type response struct {
+	conn  *conn
+	req   *Request  // the request, as far as it was parsed
+	start time.Time // when the conn started on the request
+
+	header  Header
+	first   *Response       // the first message written, without binary data
+	current *Response       // the message written until its binaries are
+	pending map[string]bool // the binaries of current not yet written
+	err     error           // the error that broke the conn, if any
+}
+
+// Header gets the headers of the next message.
+func (w *response) Header() Header {
+	if w.header == nil {
+		w.header = NewHeader()
+	}
+	return w.header
+}
+
+// WriteHeader sends the directive line and headers of a message of type
+// respType.
+func (w *response) WriteHeader(respType string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.current != nil {
+		return ErrBinariesPending
+	}
+	if w.first != nil && respType != "CALLBACK" {
+		return ErrNotCallback
+	}
+
+	msg := &Response{
+		Version:  Version{1, 0},
+		Type:     respType,
+		Headers:  []Header{w.Header()},
+		Binaries: make(map[string]*Binary),
+	}
+	w.header = nil
+	w.conn.server.setOrigin(msg)
+
+	w.conn.responded = true
+	w.conn.setWriteDeadline()
+	bw := w.conn.writer
+	fmt.Fprintf(bw, "%s -%s NONE\r\n", msg.Version, msg.Type)
+	if err := msg.Headers[0].Write(bw); err != nil {
+		return w.fail(err)
+	}
+	bw.WriteString("\r\n")
+
+	w.current = msg
+	w.pending = make(map[string]bool)
+	for _, ident := range resourceIdents(msg.Headers) {
+		w.pending[ident] = true
+	}
+	return w.complete()
+}
+
+// WriteBinary sends the binary ident of the current message.
+func (w *response) WriteBinary(ident string, length int64, r io.Reader) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.current == nil {
+		return ErrHeaderNotWritten
+	}
+	if !w.pending[ident] {
+		return fmt.Errorf("gntp: binary %s not referred to by the headers, or already written", ident)
+	}
+
+	w.conn.setWriteDeadline()
+	bw := w.conn.writer
+	fmt.Fprintf(bw, "Identifier: %s\r\nLength: %d\r\n\r\n", ident, length)
+	if _, err := io.CopyN(bw, r, length); err != nil {
+		return w.fail(fmt.Errorf("gntp: writing binary %s: %w", ident, err))
+	}
+	bw.WriteString("\r\n\r\n")
+
+	delete(w.pending, ident)
+	w.current.Binaries[ident] = &Binary{Ident: ident, Length: length}
+	return w.complete()
+}
+
+// Flush sends anything written so far to the client.
+func (w *response) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.conn.setWriteDeadline()
+	if err := w.conn.writer.Flush(); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// complete sends the current message, once all its binaries are written.
+func (w *response) complete() error {
+	if len(w.pending) > 0 {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	msg := w.current
+	w.current, w.pending = nil, nil
+	w.written(msg)
+	return nil
+}
+
+// fail records err, which left a message partly written, so the conn can't
+// be used for anything more.
+func (w *response) fail(err error) error {
+	w.err = err
+	w.conn.server.onError(w.req, err)
+	return err
+}
+
+// written tells the Server's hooks that msg was sent in full.
+func (w *response) written(msg *Response) {
+	srv := w.conn.server
+	if hook := srv.OnResponseWritten; hook != nil {
+		hook(w.req, msg)
+	}
+	if w.first != nil {
+		return
+	}
+	w.first = msg
+	elapsed := time.Since(w.start)
+	if obs := srv.Observer; obs != nil {
+		obs.Served(w.req.Type, msg, elapsed)
+	}
+	if al := srv.AccessLog; al != nil {
+		al.log(w.start, w.conn.remoteAddr, w.req, msg, elapsed)
+	}
+}
+
+// writeResponse sends resp, a whole message built beforehand, such as the
+// -ERROR response for a request that could not be parsed.
+func (w *response) writeResponse(resp *Response) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.conn.responded = true
+	w.conn.setWriteDeadline()
+	w.conn.server.setOrigin(resp)
+	err := resp.Write(w.conn.writer)
+	if err == nil {
+		err = w.conn.writer.Flush()
+	}
+	if err != nil {
+		w.req.Logger().Warn("gntp: could not write response", "err", err)
+		return w.fail(err)
+	}
+	w.written(resp)
+	return nil
+}
+
+// finish completes the response once the Handler's Respond has returned err,
+// writing an -ERROR response for err, or an -OK one if Respond wrote
+// nothing. It reports whether the conn is left ready for another request.
+func (w *response) finish(err error) bool {
+	log := w.req.Logger()
+	if w.first == nil && w.current == nil && w.err == nil {
+		if err == nil {
+			return w.WriteHeader("OK") == nil
+		}
+		w.conn.server.onError(w.req, err)
+		var resp *Response
+		if ge, ok := AsGntpError(err); ok {
+			if ge.Err != nil {
+				log.Warn("gntp: request failed", "err", err)
+			}
+			resp = ge.Response()
+		} else {
+			log.Error("gntp: could not create response", "err", err)
+			resp = InternalServerError().Response()
+		}
+		return w.writeResponse(resp) == nil
+	}
+
+	switch {
+	case err != nil:
+		// The client has had some of the response, so it is too late to
+		// tell it of the error.
+		if err != w.err {
+			w.conn.server.onError(w.req, err)
+		}
+		log.Warn("gntp: response failed after it was started", "err", err)
+		return false
+	case w.current != nil:
+		log.Error("gntp: handler did not write all the binaries of its response", "missing", len(w.pending))
+		return false
+	}
+	return w.err == nil
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// KeyHash represents the key hash portion of a GNTP information line.
+type KeyHash struct {
+	Algorithm string // the hash algorithm (MD5, SHA1, SHA256 or SHA512)
+	Hash      []byte // the hash of the key
+	Salt      []byte // the salt used to derive the key from the password
+}
+
+// Encryption represents the encryption portion of a GNTP information line.
+type Encryption struct {
+	Algorithm string // the encryption algorithm (NONE, AES, DES or 3DES)
+	IV        []byte // the initialization vector, if Algorithm is not NONE
+}
+
+// newHash returns a hash.Hash for the named GNTP key hash algorithm.
+func newHash(algorithm string) (hash.Hash, bool) {
+	switch algorithm {
+	case "MD5":
+		return md5.New(), true
+	case "SHA1":
+		return sha1.New(), true
+	case "SHA256":
+		return sha256.New(), true
+	case "SHA512":
+		return sha512.New(), true
+	}
+	return nil, false
+}
+
+// parseKeyHash parses a key hash of the form "ALGORITHM:HASH.SALT".
+func parseKeyHash(s string) (*KeyHash, error) {
+	f := strings.SplitN(s, ":", 2)
+	if len(f) != 2 {
+		return nil, InvalidRequestError("key hash malformed")
+	}
+	kh := &KeyHash{Algorithm: strings.ToUpper(f[0])}
+	if _, ok := newHash(kh.Algorithm); !ok {
+		return nil, InvalidRequestError("unsupported key hash algorithm " + f[0])
+	}
+
+	f = strings.SplitN(f[1], ".", 2)
+	if len(f) != 2 {
+		return nil, InvalidRequestError("key hash missing salt")
+	}
+	var err error
+	if kh.Hash, err = hex.DecodeString(f[0]); err != nil {
+		return nil, InvalidRequestError("key hash malformed").Wrap(err)
+	}
+	if kh.Salt, err = hex.DecodeString(f[1]); err != nil {
+		return nil, InvalidRequestError("key hash salt malformed").Wrap(err)
+	}
+	return kh, nil
+}
+
+// NewKeyHash builds a KeyHash for password using the named hash algorithm and
+// a random salt, for authenticating requests sent to other GNTP servers.
+func NewKeyHash(algorithm, password string) (*KeyHash, error) {
+	kh := &KeyHash{Algorithm: strings.ToUpper(algorithm), Salt: make([]byte, 16)}
+	h, ok := newHash(kh.Algorithm)
+	if !ok {
+		return nil, errors.New("gntp: unsupported key hash algorithm " + algorithm)
+	}
+	if _, err := rand.Read(kh.Salt); err != nil {
+		return nil, err
+	}
+	h.Write(kh.Key(password))
+	kh.Hash = h.Sum(nil)
+	return kh, nil
+}
+
+// String returns the key hash as it appears in a GNTP information line.
+func (kh *KeyHash) String() string {
+	return kh.Algorithm + ":" + strings.ToUpper(hex.EncodeToString(kh.Hash)) + "." + strings.ToUpper(hex.EncodeToString(kh.Salt))
+}
+
+// Key derives the key from password and the KeyHash's salt.
+func (kh *KeyHash) Key(password string) []byte {
+	h, _ := newHash(kh.Algorithm)
+	h.Write([]byte(password))
+	h.Write(kh.Salt)
+	return h.Sum(nil)
+}
+
+// Verify reports whether the KeyHash was derived from password.
+func (kh *KeyHash) Verify(password string) bool {
+	h, _ := newHash(kh.Algorithm)
+	h.Write(kh.Key(password))
+	return subtle.ConstantTimeCompare(h.Sum(nil), kh.Hash) == 1
+}
+
+// authenticate checks req's key hash against the Server's password. If no
+// password is set, every request is allowed.
+func authenticate(req *Request) error {
+	if req.password == "" {
+		return nil
+	}
+	if req.KeyHash == nil {
+		return NotAuthorizedError("password required")
+	}
+	if !req.KeyHash.Verify(req.password) {
+		return NotAuthorizedError("invalid key hash")
+	}
+	return nil
+}
+
+// parseEncryption parses an encryption specifier of the form "NONE" or
+// "ALGORITHM:IV".
+func parseEncryption(s string) (Encryption, error) {
+	f := strings.SplitN(s, ":", 2)
+	enc := Encryption{Algorithm: strings.ToUpper(f[0])}
+	if enc.Algorithm == "NONE" {
+		return enc, nil
+	}
+
+	if _, _, ok := cipherSizes(enc.Algorithm); !ok {
+		return enc, InvalidRequestError("unsupported encryption algorithm " + f[0])
+	}
+	if len(f) != 2 {
+		return enc, InvalidRequestError("encryption missing initialization vector")
+	}
+	var err error
+	if enc.IV, err = hex.DecodeString(f[1]); err != nil {
+		return enc, InvalidRequestError("initialization vector malformed").Wrap(err)
+	}
+	return enc, nil
+}
+
+// cipherSizes returns the key and block sizes, in bytes, for the named GNTP
+// encryption algorithm.
+func cipherSizes(algorithm string) (keySize, blockSize int, ok bool) {
+	switch algorithm {
+	case "AES":
+		return 24, aes.BlockSize, true
+	case "DES":
+		return 8, des.BlockSize, true
+	case "3DES":
+		return 24, des.BlockSize, true
+	}
+	return 0, 0, false
+}
+
+// newDecrypter builds a CBC decrypter for enc using the given key.
+func newDecrypter(enc Encryption, key []byte) (cipher.BlockMode, error) {
+	keySize, blockSize, _ := cipherSizes(enc.Algorithm)
+	if len(key) < keySize {
+		return nil, InvalidRequestError("key hash algorithm too weak for " + enc.Algorithm)
+	}
+	if len(enc.IV) != blockSize {
+		return nil, InvalidRequestError("initialization vector must be " + strconv.Itoa(blockSize) + " bytes")
+	}
+	key = key[:keySize]
+
+	var block cipher.Block
+	var err error
+	switch enc.Algorithm {
+	case "AES":
+		block, err = aes.NewCipher(key)
+	case "DES":
+		block, err = des.NewCipher(key)
+	case "3DES":
+		block, err = des.NewTripleDESCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCBCDecrypter(block, enc.IV), nil
+}
+
+// decrypt decrypts and unpads (PKCS#7) data in place.
+func decrypt(mode cipher.BlockMode, data []byte) ([]byte, error) {
+	size := mode.BlockSize()
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, InvalidRequestError("encrypted data has invalid length")
+	}
+	mode.CryptBlocks(data, data)
+
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > size {
+		return nil, InvalidRequestError("could not decrypt request")
+	}
+	for _, p := range data[len(data)-pad:] {
+		if int(p) != pad {
+			return nil, InvalidRequestError("could not decrypt request")
+		}
+	}
+	return data[:len(data)-pad], nil
+}
+
+// maxDecryptBytes is the most data of an encrypted request that is decrypted:
+// its header blocks and binaries together. Encrypted requests are decrypted
+// in memory before they can be read, whatever the Server's limits.
+const maxDecryptBytes = 32 << 20
+
+// readEncryptedBlock reads from b up to and including the next blank line,
+// returning what came before it. The block counts towards req's header size,
+// and must fit within maxDecryptBytes.
+func readEncryptedBlock(b *bufio.Reader, req *Request) ([]byte, error) {
+	req.phase()
+	var data []byte
+	for !bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		line, err := b.ReadSlice('\n')
+		req.headerBytes += int64(len(line))
+		if req.maxHeaderBytes > 0 && req.headerBytes > req.maxHeaderBytes {
+			return nil, RequestTooLargeError("headers")
+		}
+		if len(data)+len(line) > maxDecryptBytes {
+			return nil, RequestTooLargeError("encrypted headers")
+		}
+		data = append(data, line...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil, InvalidRequestError("encrypted data not properly terminated")
+			}
+			return nil, err
+		}
+	}
+	return data[:len(data)-4], nil
+}
+
+// decryptRequest reads the encrypted header blocks and binary sections of req
+// from b. It returns a new bufio.Reader from which the decrypted request can
+// be read as though it was never encrypted. The request is held in memory
+// until then, so no more than maxDecryptBytes of it are read. Without a
+// password there is no key to decrypt it with, so it is refused.
+func decryptRequest(b *bufio.Reader, req *Request) (*bufio.Reader, error) {
+	if req.password == "" {
+		return nil, NotAuthorizedError("encrypted request without a password set")
+	}
+	if req.KeyHash == nil {
+		return nil, InvalidRequestError("encrypted request without key hash")
+	}
+
+	// The decrypted sections are read in turn, rather than copied together.
+	var out []io.Reader
+	key := req.KeyHash.Key(req.password)
+
+	// All the header blocks are encrypted together.
+	data, err := readEncryptedBlock(b, req)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := newDecrypter(req.Encryption, key)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decrypt(mode, data); err != nil {
+		return nil, err
+	}
+	budget := int64(maxDecryptBytes - len(data))
+	out = append(out, bytes.NewReader(bytes.TrimRight(data, "\r\n")), strings.NewReader("\r\n\r\n"))
+
+	// Find how many binary sections follow, from the decrypted headers.
+	var headers []Header
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		h, err := tp.ReadMIMEHeader()
+		if len(h) > 0 {
+			headers = append(headers, Header(h))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Each binary section is encrypted separately; only its data is
+	// encrypted, not its Identifier and Length headers.
+	tp = textproto.NewReader(b)
+	for i := len(resourceIdents(headers)); i > 0; i-- {
+		req.phase()
+		h, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return nil, err
+		}
+		header := Header(h)
+		ident, ok := header.Get("Identifier")
+		if !ok {
+			return nil, MissingHeaderError("Binary Identifier")
+		}
+		length, ok := header.Get("Length")
+		if !ok {
+			return nil, MissingHeaderError("Length for binary " + ident)
+		}
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err != nil || n < 0 {
+			return nil, InvalidRequestError(ident + " Length header invalid")
+		}
+		if req.maxBinaryBytes > 0 && n > req.maxBinaryBytes {
+			return nil, RequestTooLargeError("binary " + ident)
+		}
+		if n > budget {
+			return nil, RequestTooLargeError("encrypted binary " + ident)
+		}
+		budget -= n
+
+		// Let the buffer grow as the data arrives, rather than trust
+		// Length for how much to allocate.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, b, n); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, InvalidRequestError(ident + " data incomplete")
+		} else if err != nil {
+			return nil, err
+		}
+		data := buf.Bytes()
+		if err := readBinaryTerminator(b, ident); err != nil {
+			return nil, err
+		}
+
+		mode, _ := newDecrypter(req.Encryption, key)
+		if data, err = decrypt(mode, data); err != nil {
+			return nil, err
+		}
+		out = append(out,
+			strings.NewReader("Identifier: "+ident+"\r\nLength: "+strconv.Itoa(len(data))+"\r\n\r\n"),
+			bytes.NewReader(data),
+			strings.NewReader("\r\n\r\n"))
+	}
+
+	return bufio.NewReader(io.MultiReader(out...)), nil
+}
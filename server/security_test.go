@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// encrypt pads (PKCS#7) and encrypts data with AES, as a client would.
+func encrypt(t *testing.T, key, iv, data []byte) []byte {
+	block, err := aes.NewCipher(key[:24])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+// encryptedRequest builds a NOTIFY request encrypted with password, with an
+// icon sent as a binary.
+func encryptedRequest(t *testing.T, password string, icon []byte) []byte {
+	kh, err := NewKeyHash("SHA256", password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := kh.Key(password)
+	iv := bytes.Repeat([]byte{1}, aes.BlockSize)
+
+	var b bytes.Buffer
+	b.WriteString("GNTP/1.0 NOTIFY AES:" + hex.EncodeToString(iv) + " " + kh.String() + "\r\n")
+	b.Write(encrypt(t, key, iv, []byte(crlf("Application-Name: Test\nNotification-Name: Message\nNotification-Title: Hello\nNotification-Icon: x-growl-resource://abc\n"))))
+	b.WriteString("\r\n\r\n")
+	data := encrypt(t, key, iv, icon)
+	b.WriteString("Identifier: abc\r\nLength: " + strconv.Itoa(len(data)) + "\r\n\r\n")
+	b.Write(data)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// readEncrypted reads data as the Server would, with password set.
+func readEncrypted(data []byte, password string) (*Request, memoryBinaries, error) {
+	req := &Request{password: password}
+	b, err := readDirective(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	binaries := make(memoryBinaries)
+	if err := req.ReadBody(b, binaries); err != nil {
+		return nil, nil, err
+	}
+	return req, binaries, nil
+}
+
+func TestDecryptRequest(t *testing.T) {
+	icon := []byte("icon data, longer than a single block")
+	req, binaries, err := readEncrypted(encryptedRequest(t, "secret", icon), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title, _ := req.Headers[0].Get("Notification-Title"); title != "Hello" {
+		t.Errorf("Notification-Title = %q, want Hello", title)
+	}
+	if got, err := binaries.Get("abc"); err != nil || !bytes.Equal(got, icon) {
+		t.Errorf("binary abc = %q, %v, want %q", got, err, icon)
+	}
+}
+
+func TestDecryptRequestWithoutPassword(t *testing.T) {
+	_, _, err := readEncrypted(encryptedRequest(t, "", []byte("icon")), "")
+	if ge, ok := AsGntpError(err); !ok || ge.Code != CodeNotAuthorized {
+		t.Errorf("encrypted request without a password set: %v, want not authorized", err)
+	}
+}
+
+func TestDecryptRequestTooLarge(t *testing.T) {
+	data := encryptedRequest(t, "secret", []byte("icon"))
+	// Claim a binary far larger than is sent, or could be decrypted.
+	i := bytes.Index(data, []byte("Length: "))
+	j := i + bytes.Index(data[i:], []byte("\r\n"))
+	data = append(append(append([]byte(nil), data[:i]...), "Length: 99999999999"...), data[j:]...)
+	_, _, err := readEncrypted(data, "secret")
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("encrypted binary over the limit: %v, want too large", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	kh, err := NewKeyHash("SHA256", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := NewKeyHash("SHA256", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.ToUpper(hex.EncodeToString(kh.Hash))
+	tests := []struct {
+		password string
+		keyHash  string
+		code     int
+	}{
+		{"secret", kh.String(), 0},
+		{"secret", strings.ToLower(kh.String()), 0},
+		{"", "", 0},
+		{"", kh.String(), 0},
+		{"secret", wrong.String(), CodeNotAuthorized},
+		{"secret", "", CodeNotAuthorized},
+		{"secret", "CRC32:" + hash + ".00", CodeInvalidRequest},
+		{"secret", "SHA256:" + hash, CodeInvalidRequest},
+		{"secret", "SHA256:" + hash + ".ZZ", CodeInvalidRequest},
+		{"secret", "SHA256:XYZ." + hash, CodeInvalidRequest},
+		{"secret", "SHA256", CodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		line := strings.TrimSpace("GNTP/1.0 NOTIFY NONE " + tt.keyHash)
+		req := &Request{password: tt.password}
+		_, err := readDirective(bufio.NewReader(strings.NewReader(line+"\r\n")), req)
+		if gerr, _ := AsGntpError(err); gerr.Code != tt.code || (tt.code != 0) != (err != nil) {
+			t.Errorf("password %q, key hash %q: error %v, want code %d", tt.password, tt.keyHash, err, tt.code)
+		}
+	}
+}
@@ -11,20 +11,38 @@ types, then start the server.
 	server.Register("REGISTER", registerHandler)
 	server.Start()
 
-The server should be gracefully shutdown with a call to Exit:
+Handlers write their responses with a ResponseWriter, much as HTTP handlers
+do, sending the headers and then any binaries, which are streamed to the
+client as they are written. A handler may keep writing after its first
+response, such as a -CALLBACK response once a notification is clicked.
 
-	server.Exit()
+The server should be gracefully shutdown with a call to Shutdown, which
+waits for connections to complete until the given context expires:
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+
+Features that apply to every request, such as logging or collecting
+statistics, can be added by setting the Server's Middleware, rather than
+changing each handler.
+
+The server logs through a log/slog Logger, slog.Default unless the Server's
+Logger is set. Handlers should log through Request.Logger, which adds the
+remote address and type of the request to every message.
 */
 package server
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"net/textproto"
+	"os"
 	"runtime/debug"
 	"strings"
 	"sync"
@@ -44,10 +62,92 @@ func (v Version) String() string {
 
 // Request represents a GNTP request.
 type Request struct {
-	Version  Version            // the GNTP version
-	Type     string             // the type of request (REGISTER, NOTIFY, etc.)
-	Headers  []Header           // a slice of Header lines
-	Binaries map[string]*Binary // a map from Identifier to Binary data
+	Version    Version              // the GNTP version
+	Type       string               // the type of request (REGISTER, NOTIFY, etc.)
+	Encryption Encryption           // the encryption used by the request
+	KeyHash    *KeyHash             // the key hash, or nil if none was sent
+	Headers    []Header             // a slice of Header lines
+	Binaries   map[string]*Binary   // a map from Identifier to Binary data
+	RemoteAddr string               // the network address the request came from
+	LocalAddr  string               // the network address it was received on, if known
+	TLS        *tls.ConnectionState // the TLS connection it came over, or nil
+	Received   time.Time            // when reading the request started
+
+	// Register and Notify hold the parsed headers of REGISTER and NOTIFY
+	// requests, if they were read with ReadRegister or ReadNotify.
+	Register *RegisterRequest
+	Notify   *NotifyRequest
+
+	password        string // the Server's password, used to decrypt the request
+	maxHeaderBytes  int64  // the Server's MaxHeaderBytes
+	maxBinaryBytes  int64  // the Server's MaxBinaryBytes
+	maxHeaderBlocks int    // the Server's MaxHeaderBlocks
+	maxHeaderLines  int    // the Server's MaxHeaderLines
+	maxLineBytes    int    // the Server's MaxLineBytes
+	headerBytes     int64  // the size of the Header blocks read so far
+	headerBlocks    int    // the number of Header blocks read so far
+	startPhase      func() // starts the deadline for reading the next part, if not nil
+
+	logger *slog.Logger    // logs with the request's remote address and type
+	ctx    context.Context // the request's Context, if not Background
+}
+
+// Context gets the Context of the request, which is canceled when the
+// Server shuts down, or once it has responded. Handlers waiting to write a
+// further message, such as a -CALLBACK response, should give up when it is.
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// WithContext gets a shallow copy of the request with its Context changed
+// to ctx. A Handler's Parse may return one whose Context carries what it
+// built from the request, such as the model its headers describe, for
+// Respond to get with Context().Value rather than building it again.
+func (req *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("gntp: nil context")
+	}
+	r := new(Request)
+	*r = *req
+	r.ctx = ctx
+	return r
+}
+
+// LogValue describes the request in log messages: its version, type,
+// encryption and headers, and the identifiers and lengths of its binaries,
+// rather than their data.
+func (req *Request) LogValue() slog.Value {
+	binaries := make(map[string]int64, len(req.Binaries))
+	for ident, b := range req.Binaries {
+		binaries[ident] = b.Length
+	}
+	return slog.GroupValue(
+		slog.String("version", req.Version.String()),
+		slog.String("type", req.Type),
+		slog.String("encryption", req.Encryption.Algorithm),
+		slog.Any("headers", req.Headers),
+		slog.Any("binaries", binaries),
+	)
+}
+
+// phase starts the deadline for reading the next part of the request: its
+// directive line, a header block or a binary.
+func (req *Request) phase() {
+	if req.startPhase != nil {
+		req.startPhase()
+	}
+}
+
+// Logger gets the Logger for messages about the request. Each message
+// carries the remote address and, once parsed, the type of the request.
+func (req *Request) Logger() *slog.Logger {
+	if req.logger == nil {
+		return slog.Default()
+	}
+	return req.logger
 }
 
 // Response represents a GNTP response
@@ -71,45 +171,12 @@ func NewResponse(major, minor int) *Response {
 	return resp
 }
 
-// write formats and writes resp to the given io.Writer.
-func (resp *Response) write(w io.Writer) error {
-	tp := textproto.NewWriter(bufio.NewWriter(w))
-
-	// Write the GNTP directive line.
-	if err := tp.PrintfLine("GNTP/%d.%d -%s NONE",
-		resp.Version.Major, resp.Version.Minor,
-		resp.Type); err != nil {
-		return err
-	}
-
-	// Write each block of header lines.
-	for _, header := range resp.Headers {
-		if err := header.Write(w); err != nil {
-			return err
-		}
-		// ...ending with a blank line.
-		if err := tp.PrintfLine(""); err != nil {
-			return err
-		}
-	}
-
-	// Write each binary
-	for id, binary := range resp.Binaries {
-		if err := tp.PrintfLine("Identifier: %s", id); err != nil {
-			return err
-		}
-		if err := tp.PrintfLine("Length: %d", binary.Length); err != nil {
-			return err
-		}
-		if _, err := w.Write(binary.Data); err != nil {
-			return err
-		}
-		if err := tp.PrintfLine(""); err != nil {
-			return err
-		}
-	}
-
-	return nil
+// NewCallbackResponse creates a -CALLBACK Response with the specified major
+// and minor version.
+func NewCallbackResponse(major, minor int) *Response {
+	resp := NewResponse(major, minor)
+	resp.Type = "CALLBACK"
+	return resp
 }
 
 // Object implementing the Handler interface register to parse and then
@@ -117,11 +184,13 @@ func (resp *Response) write(w io.Writer) error {
 //
 // Parse should read as much from the bufio.Reader as it needs and
 // return a new or modified Request. Anything read by a previous Parse
-// will be in the passed-in Request.
-// Respond takes a Request and generates a Response.
+// will be in the passed-in Request. Whatever Parse builds from the request
+// can be passed on to Respond in its Context, with WithContext.
+// Respond takes a Request and writes its response with the ResponseWriter,
+// or returns an error for the Server to write as an -ERROR response.
 type Handler interface {
 	Parse(*bufio.Reader, *Request) (*Request, error)
-	Respond(*Request) (*Response, error)
+	Respond(ResponseWriter, *Request) error
 }
 
 // ServeMux is a GNTP request multiplexer. It matches the type of an
@@ -180,9 +249,10 @@ func (t UnhandledHandler) Parse(b *bufio.Reader, req *Request) (*Request, error)
 	return req, UnknownRequestTypeError(string(t))
 }
 
-// Respond returns nothing since Parse always returns an error.
-func (t UnhandledHandler) Respond(req *Request) (*Response, error) {
-	return nil, nil
+// Respond returns a 300 invalid request error too, though it is never
+// called since Parse always returns an error.
+func (t UnhandledHandler) Respond(w ResponseWriter, req *Request) error {
+	return UnknownRequestTypeError(string(t))
 }
 
 // atoi parses strings for ints. It's a simpler version of strconv.Atoi
@@ -222,57 +292,121 @@ func parseGntpVersion(version string) (major, minor int, ok bool) {
 	return
 }
 
-// Parse reads the directive and first block of Header lines, then
-// dispatches to the registered Handler's Parse function for the
-// request's Type.
+// Parse reads the directive line, then dispatches to the registered Handler's
+// Parse function for the request's Type. A request that ends early is
+// refused as incomplete.
 func (mux *ServeMux) Parse(b *bufio.Reader, req *Request) (*Request, error) {
 	if req == nil {
 		req = new(Request)
 	}
+	var err error
+	if b, err = readDirective(b, req); err != nil {
+		return req, err
+	}
+
+	// Dispatch to the registered Handler's Parse function.
+	parsed, err := mux.handler(req.Type).Parse(b, req)
+	return parsed, incomplete(err)
+}
+
+// incomplete turns the end of a request's data, once its directive line has
+// been read, into an InvalidRequestError, as the request was cut short.
+func incomplete(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return InvalidRequestError("request incomplete").Wrap(err)
+	}
+	return err
+}
 
-	tp := textproto.NewReader(b)
+// readDirective reads and parses the directive line of req from b,
+// authenticates req and, if it is encrypted, decrypts the rest of it. It
+// returns the reader the rest of req is read from.
+func readDirective(b *bufio.Reader, req *Request) (*bufio.Reader, error) {
+	req.phase()
 
-	// Read the directive line.
-	var s string
+	// Read the directive line, of at most MaxLineBytes. A line cut short by
+	// the connection closing is parsed as it is, but one cut short by a
+	// timeout is not.
+	var line []byte
 	var err error
-	if s, err = tp.ReadLine(); err != nil {
-		return req, err
+	for {
+		var part []byte
+		part, err = b.ReadSlice('\n')
+		line = append(line, part...)
+		if req.maxLineBytes > 0 && len(line) > req.maxLineBytes {
+			return b, RequestTooLargeError("directive line")
+		}
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return b, err
 	}
+	s := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+	s = strings.TrimPrefix(s, utf8BOM)
 
 	// Split and parse the directive line.
 	var f []string
 	if f = strings.SplitN(s, " ", 3); len(f) < 3 {
-		return req, UnknownProtocolError(s)
+		return b, UnknownProtocolError(s)
 	}
 	var ok bool
 	if req.Version.Major, req.Version.Minor, ok = parseGntpVersion(f[0]); !ok {
-		return req, UnknownProtocolError(s)
+		return b, UnknownProtocolError(s)
 	}
 
 	req.Type = f[1]
+	req.logger = req.Logger().With("type", req.Type)
 
-	// TODO: Handle security settings, if any.
-	// For now we require NONE.
-	if f[2] != "NONE" {
-		return req, InvalidRequestError("unsupported encryption")
+	// Parse the security settings: the encryption algorithm, followed by an
+	// optional key hash.
+	security := strings.Fields(f[2])
+	if len(security) == 0 || len(security) > 2 {
+		return b, UnknownProtocolError(s)
+	}
+	if req.Encryption, err = parseEncryption(security[0]); err != nil {
+		return b, err
+	}
+	if len(security) == 2 {
+		if req.KeyHash, err = parseKeyHash(security[1]); err != nil {
+			return b, err
+		}
 	}
 
-	// Dispatch to the registered Handler's Parse function.
-	return mux.handler(req.Type).Parse(b, req)
+	// Check the request came from someone who knows our password.
+	if err = authenticate(req); err != nil {
+		return b, err
+	}
+
+	// Decrypt the rest of the request, so the Handler need not know it was
+	// ever encrypted.
+	if req.Encryption.Algorithm != "NONE" {
+		if b, err = decryptRequest(b, req); err != nil {
+			return b, incomplete(err)
+		}
+	}
+	return b, nil
 }
 
 // Respond dispatches to the registered Handler's Respond function.
-func (mux *ServeMux) Respond(req *Request) (*Response, error) {
-	return mux.handler(req.Type).Respond(req)
+func (mux *ServeMux) Respond(w ResponseWriter, req *Request) error {
+	return mux.handler(req.Type).Respond(w, req)
 }
 
 // conn represents the connection between server and client.
 type conn struct {
 	remoteAddr string
+	localAddr  string
 	server     *Server
 	rwc        net.Conn
+	lr         *io.LimitedReader
 	reader     *bufio.Reader
 	writer     *bufio.Writer
+	responded  bool  // whether writing a response has started
+	limit      int64 // the most each request may read from lr
+
+	readDeadline time.Time // when the request must be read by, if not zero
 }
 
 // close flushes and closes a conn's writer and connection.
@@ -287,13 +421,43 @@ func (c *conn) close() {
 	}
 }
 
+// setWriteDeadline sets the deadline for writing a response to the conn,
+// according to its Server's WriteTimeout.
+func (c *conn) setWriteDeadline() {
+	if d := c.server.WriteTimeout; d != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+// startPhase sets the deadline for reading the next part of a request,
+// according to the conn's Server's ReadPhaseTimeout, though never past the
+// deadline for reading the whole request.
+func (c *conn) startPhase() {
+	d := c.server.ReadPhaseTimeout
+	if d == 0 {
+		return
+	}
+	deadline := time.Now().Add(d)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.rwc.SetReadDeadline(deadline)
+}
+
 // serve dispatches to the conn's Server's Handler's Parse and Respond
 // functions. DefaultServeMux is used if the Handler is nil.
 //
 // Any panic's occuring in the Handler's functions are considered fatal
-// to the conn, and result in the connection being closed without any
-// further processing occuring.
+// to the conn. If no response has been written yet, the client is sent an
+// InternalServerError, then the connection is closed without any further
+// processing occuring.
 func (c *conn) serve() {
+	// Remove ourself from the Server's WaitGroup when done.
+	defer c.server.wg.Done()
+
+	// Close the conn when we're done.
+	defer c.close()
+
 	// Error (panic) recovery.
 	defer func() {
 		err := recover()
@@ -301,61 +465,287 @@ func (c *conn) serve() {
 			return
 		}
 
-		var buf bytes.Buffer
-		fmt.Fprintf(&buf, "gntp: panic serving %v: %v\n", c.remoteAddr, err)
-		buf.Write(debug.Stack())
-		log.Print(buf.String())
+		c.server.logger().Error("gntp: panic serving connection",
+			"remote_addr", c.remoteAddr, "panic", err, "stack", string(debug.Stack()))
 
-		if c.rwc != nil {
-			c.rwc.Close()
+		if !c.responded && c.rwc != nil {
+			c.setWriteDeadline()
+			resp := InternalServerError().Response()
+			c.server.setOrigin(resp)
+			if err := resp.Write(c.writer); err == nil {
+				c.writer.Flush()
+			}
 		}
 	}()
 
-	// Close the conn when we're done.
-	defer c.close()
+	if obs := c.server.Observer; obs != nil {
+		obs.ConnOpened()
+		defer obs.ConnClosed()
+	}
 
-	// Add (and later remove) ourself from the Server's WaitGroup.
-	c.server.wg.Add(1)
-	defer c.server.wg.Done()
+	if hook := c.server.OnConnect; hook != nil {
+		if err := hook(c.rwc); err != nil {
+			c.server.logger().Debug("gntp: connection refused by hook", "remote_addr", c.remoteAddr, "err", err)
+			return
+		}
+	}
 
 	// Get the right Handler to use.
 	handler := c.server.handler
 	if handler == nil {
 		handler = DefaultServeMux
 	}
+	handler = Chain(handler, c.server.Middleware...)
+
+	// Serve requests until the client stops sending them.
+	for first := true; c.serveRequest(handler, first); first = false {
+		if !c.awaitRequest() {
+			return
+		}
+	}
+}
+
+// serveRequest reads a request from the conn, dispatching to handler's Parse
+// and Respond functions, and writes its response, refusing it if it is the
+// first from a host that isn't allowed. It reports whether the conn may be
+// kept open for another request.
+func (c *conn) serveRequest(handler Handler, first bool) (keep bool) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(c.server.ctx)
+	defer cancel()
+	c.responded = false
+	c.lr.N = c.limit
+	c.readDeadline = time.Time{}
+	if d := c.server.ReadTimeout; d != 0 {
+		c.readDeadline = time.Now().Add(d)
+	}
+	c.rwc.SetReadDeadline(c.readDeadline)
+
+	req := &Request{
+		RemoteAddr:      c.remoteAddr,
+		LocalAddr:       c.localAddr,
+		Received:        start,
+		password:        c.server.Password,
+		maxHeaderBytes:  c.server.MaxHeaderBytes,
+		maxBinaryBytes:  c.server.MaxBinaryBytes,
+		maxHeaderBlocks: c.server.MaxHeaderBlocks,
+		maxHeaderLines:  c.server.MaxHeaderLines,
+		maxLineBytes:    c.server.MaxLineBytes,
+		startPhase:      c.startPhase,
+		logger:          c.server.logger().With("remote_addr", c.remoteAddr),
+		ctx:             ctx,
+	}
+	log := req.logger
+
+	// The response is written as far as the request was parsed: Handlers
+	// may return a nil Request on error, so hold on to this one for its
+	// type.
+	w := &response{conn: c, req: req, start: start}
+	if first && !c.server.Access.Allowed(c.rwc.RemoteAddr()) {
+		// Refuse hosts that aren't allowed without reading their request.
+		log.Warn("gntp: refused request from host not allowed")
+		w.writeResponse(NotAuthorizedError("host not allowed").Response())
+		return false
+	}
+	if first && !c.server.allowRate(c.rwc.RemoteAddr()) {
+		log.Warn("gntp: refused request over rate limit")
+		w.writeResponse(NotAuthorizedError("too many requests").Response())
+		return false
+	}
 
-	var req *Request
-	var resp *Response
-	var err error
 	// Dispatch to the Handler's Parse function.
-	if req, err = handler.Parse(c.reader, req); err != nil {
-		if ge, ok := err.(GntpError); ok {
+	parsed, err := handler.Parse(c.reader, req)
+	if err != nil {
+		if err == io.EOF {
+			// The client closed the connection without sending anything.
+			log.Debug("gntp: connection closed before request")
+			return false
+		}
+		if obs := c.server.Observer; obs != nil {
+			obs.ParseFailed(err)
+		}
+		c.server.onError(req, err)
+		var resp *Response
+		if ge, ok := AsGntpError(err); ok {
 			resp = ge.Response()
+		} else if c.lr.N == 0 {
+			log.Warn("gntp: request too large")
+			resp = RequestTooLargeError("request").Response()
+		} else if nerr := net.Error(nil); errors.As(err, &nerr) && nerr.Timeout() {
+			log.Warn("gntp: timed out reading request")
+			resp = TimedOutError().Response()
 		} else {
-			log.Println("gntp: could not parse request: " + err.Error())
+			log.Warn("gntp: could not parse request", "err", err)
 			resp = InternalServerError().Response()
 		}
-	} else { // Successful parse
-		if resp, err = handler.Respond(req); err != nil {
-			if ge, ok := err.(*GntpError); ok {
-				resp = ge.Response()
-			} else {
-				log.Println("gntp: could not create response: " + err.Error())
-				resp = InternalServerError().Response()
-			}
-		}
+		// The rest of the request can't be told from the next one.
+		w.writeResponse(resp)
+		return false
 	}
 
-	// Write out our Response to the connection.
-	resp.write(c.writer)
+	if parsed == nil {
+		parsed = req
+	} else if parsed.ctx == nil {
+		parsed.ctx = req.ctx
+	}
+	// The TLS handshake is only done once the request starts being read.
+	if tc, ok := c.rwc.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		parsed.TLS = &state
+	}
+	w.req = parsed
+	if hook := c.server.OnRequestParsed; hook != nil {
+		hook(parsed)
+	}
+	// Dispatch to the Handler's Respond function, which may keep the
+	// connection until it writes a -CALLBACK response.
+	return w.finish(handler.Respond(w, parsed))
 }
 
+// awaitRequest waits for the client to start another request on the conn, for
+// up to its Server's IdleTimeout, or until the Server shuts down. It reports
+// whether the client did.
+func (c *conn) awaitRequest() bool {
+	d := c.server.IdleTimeout
+	if d == 0 {
+		return false
+	}
+	rwc := c.rwc
+	rwc.SetReadDeadline(time.Now().Add(d))
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.server.quit:
+			rwc.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	_, err := c.reader.Peek(1)
+	return err == nil
+}
+
+// Observer is told what a Server does, so statistics can be collected. Its
+// methods are called from each connection's goroutine, so must be safe for
+// concurrent use.
+type Observer interface {
+	// ConnOpened is called when a connection is accepted, and ConnClosed
+	// when it is closed.
+	ConnOpened()
+	ConnClosed()
+	// ParseFailed is called when a request can't be parsed.
+	ParseFailed(err error)
+	// Served is called when the response to a request has been written,
+	// elapsed after the connection was accepted. reqType is the empty string
+	// if the request could not be parsed far enough to know it.
+	Served(reqType string, resp *Response, elapsed time.Duration)
+}
+
+// Server represents a GNTP server.
 type Server struct {
-	addr     string
-	handler  Handler
-	listener net.Listener
-	shutdown bool
-	wg       *sync.WaitGroup
+	// Password is used to authenticate and decrypt requests. If set, every
+	// request must carry a key hash derived from it; if not, encrypted
+	// requests are refused.
+	Password string
+
+	// ReadTimeout is the maximum duration for reading an entire request.
+	// Zero means no timeout.
+	ReadTimeout time.Duration
+	// IdleTimeout is how long a connection is kept open after a response,
+	// for the client to send another request on it. Zero closes it after
+	// the first response.
+	IdleTimeout time.Duration
+	// ReadPhaseTimeout is the maximum duration for reading each part of a
+	// request: its directive line, each header block and each binary, so a
+	// client can't keep a connection by trickling its request. Zero means
+	// no timeout.
+	ReadPhaseTimeout time.Duration
+	// WriteTimeout is the maximum duration for writing each response.
+	// Zero means no timeout.
+	WriteTimeout time.Duration
+
+	// MaxConns is the maximum number of connections served at once,
+	// including those kept open for a callback. Zero means no limit.
+	MaxConns int
+	// MaxConnsWait is how long a connection over MaxConns waits for another
+	// to close. If none does, it is refused with a TooManyConnectionsError
+	// without its request being read. Zero refuses it at once.
+	MaxConnsWait time.Duration
+
+	// MaxRequestBytes is the maximum size of a request, including its
+	// binary data. Zero means no limit.
+	MaxRequestBytes int64
+	// MaxHeaderBytes is the maximum size of the header blocks of a request,
+	// if the handler reads them with Request.ReadHeader. Zero means no limit.
+	MaxHeaderBytes int64
+	// MaxHeaderBlocks is the maximum number of header blocks in a request,
+	// including the blocks a REGISTER request declares but hasn't sent yet.
+	// Zero means no limit.
+	MaxHeaderBlocks int
+	// MaxHeaderLines is the maximum number of lines in each header block.
+	// Zero means no limit.
+	MaxHeaderLines int
+	// MaxLineBytes is the maximum size of the directive line and of each
+	// header line. Zero means no limit.
+	MaxLineBytes int
+	// MaxBinaryBytes is the maximum size of each binary in a request, if the
+	// handler reads them with Request.ReadBinaries. Zero means no limit.
+	MaxBinaryBytes int64
+
+	// Logger receives the Server's log messages. If nil, slog.Default is
+	// used.
+	Logger *slog.Logger
+
+	// Observer, if not nil, is told about each connection and request.
+	Observer Observer
+
+	// Access, if not nil, decides which hosts may send requests. Requests
+	// from other hosts are refused with a NotAuthorizedError.
+	Access *AccessList
+
+	// RateLimiter, if not nil, limits how often each host, by IP address,
+	// may connect. Requests over the limit are refused with a
+	// NotAuthorizedError.
+	RateLimiter *RateLimiter
+
+	// AccessLog, if not nil, records each request served.
+	AccessLog *AccessLog
+
+	// Middleware wraps the Server's Handler, see Chain. It must be set
+	// before the Server starts.
+	Middleware []Middleware
+
+	// OnConnect, if not nil, is called with each connection when it is
+	// accepted. If it returns an error, the connection is closed without
+	// reading a request.
+	OnConnect func(conn net.Conn) error
+	// OnRequestParsed, if not nil, is called with each request once it has
+	// been parsed, before the Handler responds to it.
+	OnRequestParsed func(req *Request)
+	// OnResponseWritten, if not nil, is called with each response once it
+	// has been written, including -CALLBACK responses. req is as far as it
+	// was parsed.
+	OnResponseWritten func(req *Request, resp *Response)
+	// OnError, if not nil, is called with the errors from parsing, responding
+	// to, or writing the response to each request. req is as far as it was
+	// parsed.
+	OnError func(req *Request, err error)
+
+	// Origin, if not nil, is added to every response, -OK, -ERROR and
+	// -CALLBACK, as Origin-* headers along with an X-Timestamp.
+	Origin *Origin
+
+	addr    string
+	handler Handler
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     chan struct{}   // holds a value for each connection, if MaxConns is set
+	connsOnce sync.Once       // makes conns
+	quit      chan struct{}   // closed when the Server is shut down
+	ctx       context.Context // canceled when the Server is shut down
+	cancel    context.CancelFunc
+	wg        *sync.WaitGroup
 }
 
 // noLimit is effectively an infinite upper bound for io.LimitedReader.
@@ -365,24 +755,34 @@ const noLimit int64 = (1 << 63) - 1
 func (srv *Server) newConn(rwc net.Conn) (c *conn) {
 	c = new(conn)
 	c.remoteAddr = rwc.RemoteAddr().String()
+	c.localAddr = rwc.LocalAddr().String()
 	c.server = srv
 	c.rwc = rwc
-	lr := io.LimitReader(rwc, noLimit).(*io.LimitedReader)
-	c.reader = bufio.NewReader(lr)
+	c.limit = srv.MaxRequestBytes
+	if c.limit == 0 {
+		c.limit = noLimit
+	}
+	c.lr = io.LimitReader(rwc, c.limit).(*io.LimitedReader)
+	c.reader = bufio.NewReader(c.lr)
 	c.writer = bufio.NewWriter(rwc)
 	return c
 }
 
 // New allocates and initializes a Server.
 func New(addr string, handler Handler) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		addr:    addr,
-		handler: handler,
-		wg:      new(sync.WaitGroup),
+		addr:      addr,
+		handler:   handler,
+		listeners: make(map[net.Listener]struct{}),
+		quit:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		wg:        new(sync.WaitGroup),
 	}
 }
 
-// DefaultServer is the default Server used by Start() and Exit().
+// DefaultServer is the default Server used by Start() and Shutdown().
 var DefaultServer = New("", nil)
 
 // Start starts the DefaultServer.
@@ -390,10 +790,82 @@ func Start() error {
 	return DefaultServer.Start()
 }
 
-// Start begins listening on the Server's address and handles each new
-// connection in a seperate goroutine.
+// ErrServerClosed is returned by Start after a call to Shutdown.
+var ErrServerClosed = errors.New("gntp: server closed")
+
+// Start begins listening on the Server's address and serves each new
+// connection, see Serve.
+//
+// It returns ErrServerClosed once Shutdown is called, without waiting for
+// connections to finish; Shutdown waits for them.
 func (srv *Server) Start() error {
-	addr := srv.addr
+	return srv.StartAll(srv.addr)
+}
+
+// StartAll starts the DefaultServer on each of addrs.
+func StartAll(addrs ...string) error {
+	return DefaultServer.StartAll(addrs...)
+}
+
+// StartAll begins listening on each of addrs at once, see Listen, and serves
+// connections from all of them, see Serve. Every address shares the Server's
+// Handler and is shut down together by Shutdown.
+//
+// If any address can't be listened on, none are served. Otherwise, StartAll
+// returns as ServeAll does.
+func (srv *Server) StartAll(addrs ...string) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := Listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	return srv.ServeAll(listeners...)
+}
+
+// ServeAll starts the DefaultServer on each of listeners.
+func ServeAll(listeners ...net.Listener) error {
+	return DefaultServer.ServeAll(listeners...)
+}
+
+// ServeAll serves connections from each of listeners at once, see Serve. It
+// returns once every listener has stopped, with the first error other than
+// ErrServerClosed, if any.
+func (srv *Server) ServeAll(listeners ...net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+
+	err := ErrServerClosed
+	for range listeners {
+		if e := <-errs; e != ErrServerClosed && err == ErrServerClosed {
+			err = e
+		}
+	}
+	return err
+}
+
+// Listen listens on addr. Addresses of the form "unix:/path/to/socket" are
+// unix sockets, any stale socket at the path is replaced. Otherwise addr is a
+// TCP address, where the port "gntp", or an empty addr, means the standard
+// GNTP port 23053.
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := addr[5:]
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+
 	if addr == "" {
 		addr = ":gntp"
 	}
@@ -402,17 +874,44 @@ func (srv *Server) Start() error {
 	if strings.HasSuffix(addr, ":gntp") {
 		addr = addr[0:len(addr)-5] + ":23053"
 	}
+	return net.Listen("tcp", addr)
+}
 
-	var err error
-	srv.listener, err = net.Listen("tcp", addr)
-	if err != nil {
-		return err
+// Serve starts the DefaultServer on l.
+func Serve(l net.Listener) error {
+	return DefaultServer.Serve(l)
+}
+
+// Serve accepts connections on l, handling each in a seperate goroutine. It
+// may be called several times, with different listeners, to serve on all of
+// them at once.
+//
+// Like Start, it returns ErrServerClosed once Shutdown is called. l is always
+// closed when Serve returns.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	srv.mu.Lock()
+	if srv.shuttingDown() {
+		srv.mu.Unlock()
+		return ErrServerClosed
 	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+	}()
 
 	var tempDelay time.Duration
 	for {
-		rw, err := srv.listener.Accept()
+		rw, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 				// Account for temporary errors in accepting a connection, with
 				// expontential backoff from 5ms upto 1s.
@@ -424,42 +923,188 @@ func (srv *Server) Start() error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				log.Printf("http: Accept error: %v, retrying in %v", err, tempDelay)
+				srv.logger().Warn("gntp: accept error", "err", err, "retry_in", tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
-			if srv.shutdown {
-				// Break out of the infinite loop if we've been asked to
-				// shutdown.
-				break
-			}
 			return err
 		}
 		tempDelay = 0
 
-		// Handle each connection in a new goroutine.
+		// Waiting for a connection to close holds up accepting more, which
+		// queue until then.
+		if !srv.acquireConn() {
+			srv.refuseConn(rw)
+			continue
+		}
+
+		// Handle each connection in a new goroutine, adding it to the
+		// Server's WaitGroup before Shutdown could start waiting.
 		c := srv.newConn(rw)
-		go c.serve()
+		srv.wg.Add(1)
+		go func() {
+			defer srv.releaseConn()
+			c.serve()
+		}()
+	}
+}
+
+// acquireConn counts a new connection towards the Server's MaxConns, waiting
+// up to its MaxConnsWait for another to close if there are already as many.
+// It reports whether the connection may be served.
+func (srv *Server) acquireConn() bool {
+	conns := srv.connSlots()
+	if conns == nil {
+		return true
+	}
+	select {
+	case conns <- struct{}{}:
+		return true
+	default:
+	}
+	if srv.MaxConnsWait <= 0 {
+		return false
 	}
+	t := time.NewTimer(srv.MaxConnsWait)
+	defer t.Stop()
+	select {
+	case conns <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-srv.quit:
+		return false
+	}
+}
 
-	// Wait for all goroutine'd connections to finish.
-	srv.wg.Wait()
-	return nil
+// releaseConn stops counting a closed connection towards the Server's
+// MaxConns.
+func (srv *Server) releaseConn() {
+	if conns := srv.connSlots(); conns != nil {
+		<-conns
+	}
 }
 
-// Exit exits the DefaultServer.
-func Exit() {
-	DefaultServer.Exit()
+// connSlots gives the channel holding a value for each connection counted
+// towards the Server's MaxConns, or nil if it has none.
+func (srv *Server) connSlots() chan struct{} {
+	srv.connsOnce.Do(func() {
+		if srv.MaxConns > 0 {
+			srv.conns = make(chan struct{}, srv.MaxConns)
+		}
+	})
+	return srv.conns
+}
+
+// refuseTimeout bounds how long writing the refusal to a connection over the
+// Server's MaxConns may take.
+const refuseTimeout = time.Second
+
+// refuseConn answers rw, a connection over the Server's MaxConns, with a
+// TooManyConnectionsError, and closes it.
+func (srv *Server) refuseConn(rw net.Conn) {
+	defer rw.Close()
+	srv.logger().Warn("gntp: refused connection over limit", "remote_addr", rw.RemoteAddr().String(), "max_conns", srv.MaxConns)
+	rw.SetWriteDeadline(time.Now().Add(refuseTimeout))
+	resp := TooManyConnectionsError().Response()
+	srv.setOrigin(resp)
+	w := bufio.NewWriter(rw)
+	if err := resp.Write(w); err == nil {
+		w.Flush()
+	}
+	if obs := srv.Observer; obs != nil {
+		obs.Served("", resp, 0)
+	}
 }
 
-// Exit tells the Server to shutdown and closes it's listener.
+// allowRate reports whether a connection from addr is within the Server's
+// RateLimiter's limit. Connections that aren't over IP are not limited.
+func (srv *Server) allowRate(addr net.Addr) bool {
+	if srv.RateLimiter == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	return srv.RateLimiter.Allow(ip.String())
+}
+
+// onError calls the Server's OnError hook, if it has one.
+func (srv *Server) onError(req *Request, err error) {
+	if srv.OnError != nil {
+		srv.OnError(req, err)
+	}
+}
+
+// setOrigin adds the Server's Origin to the headers of resp.
+func (srv *Server) setOrigin(resp *Response) {
+	if srv.Origin == nil || len(resp.Headers) == 0 {
+		return
+	}
+	srv.Origin.setHeaders(resp.Headers[0])
+}
+
+// logger gets the Logger for the Server's messages.
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger == nil {
+		return slog.Default()
+	}
+	return srv.Logger
+}
+
+// Accepting reports whether the Server is accepting connections on at least
+// one listener.
+func (srv *Server) Accepting() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return !srv.shuttingDown() && len(srv.listeners) > 0
+}
+
+// shuttingDown reports whether Shutdown has been called.
+func (srv *Server) shuttingDown() bool {
+	select {
+	case <-srv.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown shuts down the DefaultServer.
+func Shutdown(ctx context.Context) error {
+	return DefaultServer.Shutdown(ctx)
+}
+
+// Shutdown gracefully shuts down the Server. It closes the listeners, so no
+// new connections are accepted, then waits for existing connections to
+// complete. Connections waiting to send a callback are closed without
+// sending it.
 //
-// It doesn't allow any new connections to the server, but any existing
-// connections will complete, if Start() was called first.
-func (srv *Server) Exit() {
-	log.Printf("debug: srv.Exit() called\n")
-	srv.shutdown = true
-	if srv.listener != nil {
-		srv.listener.Close()
+// If ctx expires before every connection completes, Shutdown returns the
+// context's error. Once Shutdown has been called the Server cannot be
+// started again.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	if !srv.shuttingDown() {
+		close(srv.quit)
+		srv.cancel()
+	}
+	for l := range srv.listeners {
+		l.Close()
+	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Write formats and writes req to the given io.Writer, as it is sent over the
+// network: unencrypted, with its KeyHash if it has one, and with the Data of
+// each of its Binaries, see writeMessage. A zero Version is written as
+// GNTP/1.0.
+func (req *Request) Write(w io.Writer) error {
+	version := req.Version
+	if version == (Version{}) {
+		version = Version{1, 0}
+	}
+
+	security := "NONE"
+	if req.KeyHash != nil {
+		security += " " + req.KeyHash.String()
+	}
+	return writeMessage(w, fmt.Sprintf("%s %s %s", version, req.Type, security), req.Headers, req.Binaries)
+}
+
+// Write formats and writes resp to the given io.Writer, as it is sent over
+// the network, see writeMessage.
+func (resp *Response) Write(w io.Writer) error {
+	return writeMessage(w, fmt.Sprintf("%s -%s NONE", resp.Version, resp.Type), resp.Headers, resp.Binaries)
+}
+
+// writeMessage writes a request or response to w: the directive line, each
+// block of headers ending with a blank line, then a section for each binary
+// the headers refer to, in the order they are first referred to. Each
+// section is an Identifier and Length block, ending with a blank line, then
+// the data, ending with two line breaks.
+//
+// It is an error for the headers to refer to a binary missing from binaries,
+// and nothing is written. Binaries not referred to are not written, as the
+// other end would not expect them.
+func writeMessage(w io.Writer, directive string, headers []Header, binaries map[string]*Binary) error {
+	idents := resourceIdents(headers)
+	for _, ident := range idents {
+		binary, ok := binaries[ident]
+		if !ok || (binary.Data == nil && binary.Length > 0) {
+			return errors.New("gntp: no data for binary " + ident)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(directive + "\r\n")
+
+	for _, header := range headers {
+		if err := header.Write(bw); err != nil {
+			return err
+		}
+		bw.WriteString("\r\n")
+	}
+
+	for _, ident := range idents {
+		data := binaries[ident].Data
+		fmt.Fprintf(bw, "Identifier: %s\r\nLength: %d\r\n\r\n", ident, len(data))
+		bw.Write(data)
+		bw.WriteString("\r\n\r\n")
+	}
+
+	return bw.Flush()
+}
+
+// maxResponseBinaryBytes is the maximum size of each binary in a response
+// read by ReadResponse, which keeps them in memory.
+const maxResponseBinaryBytes = 16 << 20
+
+// ReadResponse reads a GNTP response from b: its directive line, its block of
+// headers, and the data of any binaries the headers refer to, each of at most
+// maxResponseBinaryBytes. Encrypted responses are not supported.
+func ReadResponse(b *bufio.Reader) (*Response, error) {
+	tp := textproto.NewReader(b)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	f := strings.Fields(line)
+	if len(f) < 2 || len(f) > 3 || !strings.HasPrefix(f[1], "-") {
+		return nil, UnknownProtocolError(line)
+	}
+	major, minor, ok := parseGntpVersion(f[0])
+	if !ok {
+		return nil, UnknownProtocolError(line)
+	}
+	if len(f) == 3 && f[2] != "NONE" {
+		return nil, errors.New("gntp: encrypted responses are not supported")
+	}
+
+	resp := NewResponse(major, minor)
+	resp.Type = f[1][1:]
+	h, err := tp.ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(h) > 0) {
+		return nil, err
+	}
+	resp.Headers[0] = Header(h)
+
+	data := make(memoryBinaries)
+	if resp.Binaries, err = readBinaries(b, resp.Headers, data, maxResponseBinaryBytes, nil); err != nil {
+		return nil, err
+	}
+	for ident, binary := range resp.Binaries {
+		binary.Data = data[ident]
+	}
+
+	return resp, nil
+}
+
+// Err gets the GntpError an -ERROR Response stands for, or nil for any other
+// Response.
+func (resp *Response) Err() error {
+	if resp.Type != "ERROR" || len(resp.Headers) == 0 {
+		return nil
+	}
+	var gerr GntpError
+	code, _ := resp.Headers[0].Get("Error-Code")
+	gerr.Code, _ = strconv.Atoi(code)
+	gerr.Description, _ = resp.Headers[0].Get("Error-Description")
+	return gerr
+}
+
+// memoryBinaries implements Binaries by keeping the data in memory.
+type memoryBinaries map[string][]byte
+
+func (mb memoryBinaries) Add(key string, length int64, r io.Reader) error {
+	// Read the data as it comes, rather than trust length enough to
+	// allocate it all up front.
+	data, err := io.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != length {
+		return io.ErrUnexpectedEOF
+	}
+	mb[key] = data
+	return nil
+}
+
+func (mb memoryBinaries) Get(key string) ([]byte, error) {
+	data, ok := mb[key]
+	if !ok {
+		return nil, errors.New("gntp: no binary " + key)
+	}
+	return data, nil
+}
+
+func (mb memoryBinaries) Exists(key string) bool {
+	_, ok := mb[key]
+	return ok
+}
+
+func (mb memoryBinaries) Stats() BinaryStats {
+	stats := BinaryStats{Entries: len(mb)}
+	for _, data := range mb {
+		stats.Bytes += int64(len(data))
+	}
+	return stats
+}
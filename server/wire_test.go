@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// responseWithBinaries builds an -OK response referring to three binaries,
+// one of them twice: one whose data holds line breaks, one empty, and one
+// plain.
+func responseWithBinaries() *Response {
+	resp := NewResponse(1, 0)
+	resp.Headers[0].Set("Response-Action", "NOTIFY")
+	resp.Headers[0].Set("X-A", "x-growl-resource://one")
+	resp.Headers[0].Set("X-B", "x-growl-resource://two")
+	resp.Headers[0].Set("X-C", "x-growl-resource://three")
+	resp.Headers[0].Set("X-D", "x-growl-resource://one")
+	resp.Binaries = map[string]*Binary{
+		"one":   {Ident: "one", Length: 8, Data: []byte("a\r\n\r\nb\r\n")},
+		"two":   {Ident: "two", Length: 0, Data: []byte{}},
+		"three": {Ident: "three", Length: 5, Data: []byte("three")},
+	}
+	return resp
+}
+
+func TestResponseWrite(t *testing.T) {
+	var b bytes.Buffer
+	if err := responseWithBinaries().Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	// Each block ends with a blank line, and each binary's data with two
+	// line breaks, in the order the headers first refer to them.
+	want := "GNTP/1.0 -OK NONE\r\n" +
+		"Response-Action: NOTIFY\r\nX-A: x-growl-resource://one\r\nX-B: x-growl-resource://two\r\nX-C: x-growl-resource://three\r\nX-D: x-growl-resource://one\r\n\r\n" +
+		"Identifier: one\r\nLength: 8\r\n\r\na\r\n\r\nb\r\n\r\n\r\n" +
+		"Identifier: two\r\nLength: 0\r\n\r\n\r\n\r\n" +
+		"Identifier: three\r\nLength: 5\r\n\r\nthree\r\n\r\n"
+	if got := b.String(); got != want {
+		t.Errorf("Write:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	// Write two responses back to back, so reading the first must leave
+	// the second intact after its last binary.
+	var b bytes.Buffer
+	sent := responseWithBinaries()
+	for i := 0; i < 2; i++ {
+		if err := sent.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bufio.NewReader(&b)
+	for i := 0; i < 2; i++ {
+		resp, err := ReadResponse(r)
+		if err != nil {
+			t.Fatalf("ReadResponse %d: %v", i, err)
+		}
+		if resp.Type != "OK" || resp.Version != sent.Version {
+			t.Errorf("ReadResponse %d: %s -%s, want %s -%s", i, resp.Version, resp.Type, sent.Version, sent.Type)
+		}
+		if action, _ := resp.Headers[0].Get("Response-Action"); action != "NOTIFY" {
+			t.Errorf("ReadResponse %d: Response-Action = %q, want NOTIFY", i, action)
+		}
+		if len(resp.Binaries) != len(sent.Binaries) {
+			t.Errorf("ReadResponse %d: %d binaries, want %d", i, len(resp.Binaries), len(sent.Binaries))
+		}
+		for ident, want := range sent.Binaries {
+			got, ok := resp.Binaries[ident]
+			if !ok {
+				t.Errorf("ReadResponse %d: binary %s missing", i, ident)
+				continue
+			}
+			if got.Length != want.Length || !bytes.Equal(got.Data, want.Data) {
+				t.Errorf("ReadResponse %d: binary %s = %d %q, want %d %q", i, ident, got.Length, got.Data, want.Length, want.Data)
+			}
+		}
+	}
+	if rest, _ := r.Peek(1); len(rest) > 0 {
+		t.Errorf("ReadResponse left %q unread", rest)
+	}
+}
+
+func TestReadResponseBinaryTooLarge(t *testing.T) {
+	// Claim a binary far larger than is sent, or is kept in memory.
+	data := crlf("GNTP/1.0 -OK NONE\nResponse-Action: NOTIFY\nX-Icon: x-growl-resource://abc\n\nIdentifier: abc\nLength: 99999999999\n\ndata\n\n")
+	_, err := ReadResponse(bufio.NewReader(strings.NewReader(data)))
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("ReadResponse of a binary over the limit: %v, want too large", err)
+	}
+}
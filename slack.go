@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/jgrocho/gntp_notify/registry"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// slackColors maps GNTP priorities to the colors of the bar beside Slack
+// attachments.
+var slackColors = map[int]string{
+	-2: "#9e9e9e",
+	-1: "#9e9e9e",
+	0:  "#439fe0",
+	1:  "#f2a600",
+	2:  "#d40e0d",
+}
+
+// slackAttachment is an attachment of a Slack or Mattermost message.
+type slackAttachment struct {
+	Fallback   string `json:"fallback"`
+	Color      string `json:"color"`
+	AuthorName string `json:"author_name"`
+	Title      string `json:"title"`
+	Text       string `json:"text,omitempty"`
+	ThumbURL   string `json:"thumb_url,omitempty"`
+	Footer     string `json:"footer"`
+	Ts         int64  `json:"ts"`
+}
+
+// slackMessage is the payload of a Slack or Mattermost incoming webhook.
+type slackMessage struct {
+	Username    string            `json:"username,omitempty"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// newSlackMessage builds the slackMessage for note, sent as username, if not
+// empty: an attachment colored by its priority.
+func newSlackMessage(note *registry.Notification, username string) *slackMessage {
+	attachment := slackAttachment{
+		Fallback:   note.App.Name + ": " + note.Title,
+		Color:      slackColors[note.Priority],
+		AuthorName: note.App.Name,
+		Title:      note.Title,
+		Text:       note.Text,
+		Footer:     note.Display,
+		Ts:         time.Now().Unix(),
+	}
+	if attachment.Footer == "" {
+		attachment.Footer = note.Name
+	}
+	if registry.RemoteIcon(note.Icon) {
+		attachment.ThumbURL = note.Icon
+	}
+	return &slackMessage{Username: username, Attachments: []slackAttachment{attachment}}
+}
+
+// slackPost is a message waiting to be posted to an incoming webhook.
+type slackPost struct {
+	note *registry.Notification
+	url  string
+}
+
+// slackBackend is a Backend that posts notifications to Slack or Mattermost
+// incoming webhooks, in the background.
+type slackBackend struct {
+	client   *http.Client
+	hooks    *AppTargets
+	username string
+	queue    chan slackPost
+}
+
+// NewSlackBackend builds a Backend that posts notifications to the incoming
+// webhooks for their application in hooks, as username, if not empty.
+func NewSlackBackend(hooks *AppTargets, username string) Backend {
+	backend := &slackBackend{
+		client:   &http.Client{Timeout: webhookTimeout},
+		hooks:    hooks,
+		username: username,
+		queue:    make(chan slackPost, webhookQueueSize),
+	}
+	go backend.run()
+	return backend
+}
+
+// Show queues note to be posted to the webhook for its application, if any.
+func (backend *slackBackend) Show(note *registry.Notification) {
+	u := backend.hooks.target(note.App.Name)
+	if u == "" {
+		return
+	}
+	select {
+	case backend.queue <- slackPost{note, u}:
+	default:
+		slog.Warn("gntp: slack queue full, dropping notification", "app", note.App.Name, "name", note.Name)
+		notificationsFailed.Inc("slack")
+	}
+}
+
+// run posts each message from the queue.
+func (backend *slackBackend) run() {
+	for post := range backend.queue {
+		if err := backend.send(post); err != nil {
+			slog.Warn("gntp: could not post notification to slack", "app", post.note.App.Name, "name", post.note.Name, "err", err)
+			notificationsFailed.Inc("slack")
+			continue
+		}
+		slog.Debug("gntp: posted notification to slack", "app", post.note.App.Name, "name", post.note.Name)
+		notificationsShown.Inc("slack")
+	}
+}
+
+// send posts post to its webhook.
+func (backend *slackBackend) send(post slackPost) error {
+	body, err := json.Marshal(newSlackMessage(post.note, backend.username))
+	if err != nil {
+		return err
+	}
+	resp, err := backend.client.Post(post.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook responded " + resp.Status)
+	}
+	return nil
+}
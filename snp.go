@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snpMaxLine is the longest SNP request line read.
+const snpMaxLine = 64 << 10
+
+// The status codes of SNP responses.
+const (
+	snpOK              = 0
+	snpFailed          = 101
+	snpUnknownCommand  = 102
+	snpBadPacket       = 107
+	snpNotRegistered   = 201
+	snpNotAuthorized   = 202
+	snpDefaultTypeName = "Message"
+)
+
+// snpError is an error answered to an SNP request, with its status code.
+type snpError struct {
+	code int
+	msg  string
+}
+
+func (e snpError) Error() string {
+	return e.msg
+}
+
+// SNPServer accepts notifications from Snarl clients, over version 1 of the
+// Snarl Network Protocol: lines such as
+//
+//	type=SNP#?version=1.0&action=notification&app=Backup&class=Done&title=Backup finished&text=12 GB&timeout=10
+//
+// each answered by a line such as SNP/1.0/0/OK. Requests are handled as the
+// REGISTER and NOTIFY requests they stand for, so notifications go through
+// the same rules as any other.
+type SNPServer struct {
+	// server holds the limits connections are held to, as GNTP
+	// connections are, and the access log requests are recorded in.
+	server   *server.Server
+	apps     *registry.Applications
+	register server.Handler
+	notify   server.Handler
+	// password, if not empty, must be given by each request.
+	password string
+	// timeout bounds how long a connection may sit idle.
+	timeout time.Duration
+
+	// classes are the classes of notification each application added, in
+	// order, which it is registered with.
+	mu      sync.Mutex
+	classes map[string][]adaptedType
+}
+
+// NewSNPServer builds an SNPServer handing requests to register and notify,
+// and requiring password, if not empty. Connections idle for longer than
+// timeout are closed.
+func NewSNPServer(srv *server.Server, apps *registry.Applications, register, notify server.Handler, password string, timeout time.Duration) *SNPServer {
+	return &SNPServer{
+		server:   srv,
+		apps:     apps,
+		register: register,
+		notify:   notify,
+		password: password,
+		timeout:  timeout,
+		classes:  make(map[string][]adaptedType),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves each connection,
+// up to the connection limit of the GNTP server.
+func (srv *SNPServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l := limitedListener{ln, srv.server}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serve(conn)
+	}
+}
+
+// serve answers each request read from conn, until it is closed.
+func (srv *SNPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	// Refuse hosts that aren't allowed, or are over the rate limit, without
+	// reading their requests.
+	if err := srv.server.Admit(conn.RemoteAddr()); err != nil {
+		if srv.timeout > 0 {
+			conn.SetDeadline(time.Now().Add(srv.timeout))
+		}
+		fmt.Fprintf(conn, "SNP/1.0/%d/Not authorized\r\n", snpNotAuthorized)
+		return
+	}
+	r := bufio.NewReaderSize(conn, 4096)
+	for {
+		if srv.timeout > 0 {
+			conn.SetDeadline(time.Now().Add(srv.timeout))
+		}
+		line, err := readSNPLine(r)
+		if err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+		version := "1.0"
+		params, err := parseSNP(line)
+		if err == nil {
+			if v := params["version"]; v != "" {
+				version = v
+			}
+			err = srv.handle(params, conn.RemoteAddr().String())
+		}
+		code, msg := snpOK, "OK"
+		if err != nil {
+			code, msg = snpFailed, err.Error()
+			var snpErr snpError
+			if errors.As(err, &snpErr) {
+				code = snpErr.code
+			}
+			slog.Debug("gntp: refused SNP request", "remote_addr", conn.RemoteAddr().String(), "code", code, "err", err)
+		}
+		if _, err := fmt.Fprintf(conn, "SNP/%s/%d/%s\r\n", version, code, msg); err != nil {
+			return
+		}
+	}
+}
+
+// readSNPLine reads a request line from r, without its line ending.
+func readSNPLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		part, more, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > snpMaxLine {
+			return "", errors.New("SNP request too long")
+		}
+		if !more {
+			return string(line), nil
+		}
+	}
+}
+
+// parseSNP parses the parameters of an SNP request line, keyed by their
+// lowercased names. In values, \n stands for a line break. Invalid UTF-8 is
+// replaced, as in GNTP headers.
+func parseSNP(line string) (map[string]string, error) {
+	line = strings.ToValidUTF8(line, "\ufffd")
+	const prefix = "type=snp#?"
+	if len(line) < len(prefix) || !strings.EqualFold(line[:len(prefix)], prefix) {
+		return nil, snpError{snpBadPacket, "Bad packet"}
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(line[len(prefix):], "&") {
+		key, value, _ := strings.Cut(param, "=")
+		params[strings.ToLower(key)] = strings.ReplaceAll(value, "\\n", "\n")
+	}
+	return params, nil
+}
+
+// handle carries out the action of the request with params, sent from
+// remoteAddr.
+func (srv *SNPServer) handle(params map[string]string, remoteAddr string) error {
+	if srv.password != "" && subtle.ConstantTimeCompare([]byte(params["password"]), []byte(srv.password)) != 1 {
+		return snpError{snpNotAuthorized, "Not authorized"}
+	}
+	app := params["app"]
+	switch action := strings.ToLower(params["action"]); action {
+	case "register":
+		if app == "" {
+			return snpError{snpBadPacket, "Missing app"}
+		}
+		return srv.addClass(app, "", "", remoteAddr)
+	case "add_class":
+		if app == "" || params["class"] == "" {
+			return snpError{snpBadPacket, "Missing app or class"}
+		}
+		if srv.apps.Get(app) == nil {
+			return snpError{snpNotRegistered, "Not registered"}
+		}
+		return srv.addClass(app, params["class"], params["title"], remoteAddr)
+	case "unregister":
+		// Only applications registered over SNP may be unregistered
+		// over it, not those registered over GNTP.
+		srv.mu.Lock()
+		_, ok := srv.classes[app]
+		delete(srv.classes, app)
+		srv.mu.Unlock()
+		if !ok || !srv.apps.Remove(app) {
+			return snpError{snpNotRegistered, "Not registered"}
+		}
+		return nil
+	case "notification":
+		return srv.notification(params, remoteAddr)
+	default:
+		return snpError{snpUnknownCommand, "Unknown command " + action}
+	}
+}
+
+// addClass registers app, sent from remoteAddr, with the class of
+// notification named class, shown as title, if not empty, along with those
+// added before. Apps are always registered with a default class, for
+// notifications without one.
+func (srv *SNPServer) addClass(app, class, title, remoteAddr string) error {
+	srv.mu.Lock()
+	classes, ok := srv.classes[app]
+	if !ok {
+		classes = []adaptedType{{Name: snpDefaultTypeName}}
+	}
+	if class != "" {
+		replaced := false
+		for i := range classes {
+			if classes[i].Name == class {
+				classes[i].Display = title
+				replaced = true
+			}
+		}
+		if !replaced {
+			classes = append(classes, adaptedType{Name: class, Display: title})
+		}
+	}
+	srv.classes[app] = classes
+	types := append([]adaptedType(nil), classes...)
+	srv.mu.Unlock()
+
+	return handleAdapted(srv.server, srv.register, adaptedRegister(app, "", types), remoteAddr)
+}
+
+// notification shows the notification with params, sent from remoteAddr,
+// first registering its application or class if they aren't yet.
+func (srv *SNPServer) notification(params map[string]string, remoteAddr string) error {
+	app, class := params["app"], params["class"]
+	if app == "" {
+		return snpError{snpBadPacket, "Missing app"}
+	}
+	if class == "" {
+		class = snpDefaultTypeName
+	}
+	if binaryReference(params["icon"]) {
+		return snpError{snpBadPacket, "Icon must be a URL or a file"}
+	}
+	if _, _, err := srv.apps.NotificationType(app, class); err != nil {
+		if err := srv.addClass(app, class, "", remoteAddr); err != nil {
+			return err
+		}
+	}
+
+	header := server.NewHeader()
+	header.Set("Application-Name", app)
+	header.Set("Notification-Name", class)
+	header.Set("Notification-Title", params["title"])
+	if text := params["text"]; text != "" {
+		header.Set("Notification-Text", text)
+	}
+	if icon := params["icon"]; icon != "" {
+		header.Set("Notification-Icon", icon)
+	}
+	if priority, err := strconv.Atoi(params["priority"]); err == nil && validPriority(priority) {
+		header.Set("Notification-Priority", strconv.Itoa(priority))
+	}
+	// A timeout of 0 keeps the notification on screen until dismissed.
+	if params["timeout"] == "0" {
+		header.Set("Notification-Sticky", "True")
+	}
+	return handleAdapted(srv.server, srv.notify, &server.Request{Type: "NOTIFY", Headers: []server.Header{header}}, remoteAddr)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"github.com/jgrocho/gntp_notify/server"
+	"testing"
+	"time"
+)
+
+func TestSNPIcons(t *testing.T) {
+	tests := []struct {
+		icon string
+		ok   bool
+	}{
+		{"", true},
+		{"https://example.com/icon.png", true},
+		{"x-growl-resource://../../etc/hostname", false},
+		{"X-Growl-Resource://../../etc/hostname", false},
+		{"x-growl-resource://abc", false},
+	}
+	for _, tt := range tests {
+		var notified *server.Request
+		srv := NewSNPServer(&server.Server{}, registry.NewApplications(),
+			server.HandlerFunc(func(server.ResponseWriter, *server.Request) error { return nil }),
+			server.HandlerFunc(func(_ server.ResponseWriter, req *server.Request) error {
+				notified = req
+				return nil
+			}),
+			"", time.Minute)
+		params := map[string]string{"action": "notification", "app": "Test", "title": "Hello", "icon": tt.icon}
+		err := srv.handle(params, "127.0.0.1:1234")
+		if tt.ok && err != nil {
+			t.Errorf("icon %q: %v", tt.icon, err)
+		}
+		if !tt.ok {
+			if e, ok := err.(snpError); !ok || e.code != snpBadPacket {
+				t.Errorf("icon %q: error %v, want code %d", tt.icon, err, snpBadPacket)
+			}
+			if notified != nil {
+				t.Errorf("icon %q: notification handled", tt.icon)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// ApplicationNames implements flag.Value for a set of application names,
+// given by repeating the flag.
+type ApplicationNames map[string]bool
+
+// String returns the names, separated by commas.
+func (names *ApplicationNames) String() string {
+	list := make([]string, 0, len(*names))
+	for name := range *names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// Set adds a name.
+func (names *ApplicationNames) Set(value string) error {
+	if *names == nil {
+		*names = make(ApplicationNames)
+	}
+	(*names)[value] = true
+	return nil
+}
+
+// SoundPolicy decides which notifications may play sounds.
+type SoundPolicy struct {
+	// Disabled silences every notification.
+	Disabled bool
+	// Muted silences the notifications from these applications.
+	Muted ApplicationNames
+}
+
+// allowed reports whether note may play a sound. A nil SoundPolicy allows
+// every sound.
+func (policy *SoundPolicy) allowed(note *registry.Notification) bool {
+	if policy == nil {
+		return true
+	}
+	return !policy.Disabled && !policy.Muted[note.App.Name]
+}
+
+// notificationSound gives the sound to play with note: either the name of a
+// sound from the freedesktop sound theme, or, if isFile, the name of a sound
+// file, from opts.Cache, or a local file in one of opts.IconDirs, as icons
+// must be. It returns the empty string if note has no sound, or it is a local
+// file in none of them.
+func notificationSound(note *registry.Notification, opts *BackendOptions) (sound string, isFile bool) {
+	sound = note.Sound
+	if sound == "" {
+		return "", false
+	}
+	if strings.HasPrefix(strings.ToLower(sound), "x-growl-resource://") {
+		return opts.Cache.GetFileName(sound[19:]), true
+	}
+	if path, ok := registry.LocalIconPath(sound); ok {
+		if !opts.IconDirs.allows(path) {
+			slog.Warn("gntp: sound not in an allowed directory", "sound", path, "app", note.App.Name, "name", note.Name)
+			return "", false
+		}
+		return path, true
+	}
+	return sound, false
+}
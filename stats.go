@@ -0,0 +1,68 @@
+package main
+
+import (
+	"expvar"
+	"github.com/jgrocho/gntp_notify/server"
+	"sync/atomic"
+	"time"
+)
+
+// The statistics published through expvar on the -debug-addr listener.
+var (
+	startTime = time.Now()
+
+	// statConnections holds the number of connections open ("active") and
+	// accepted ("total").
+	statConnections = expvar.NewMap("connections")
+	// statRequests holds the number of requests served of each type.
+	statRequests = expvar.NewMap("requests")
+
+	// digestPending is the number of notifications held for the next
+	// digest.
+	digestPending int64
+	// quietPending is the number of notifications held until quiet hours
+	// end.
+	quietPending int64
+	// notificationsPending is the number of notifications waiting to be
+	// shown.
+	notificationsPending int64
+)
+
+func init() {
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} {
+		return int64(time.Since(startTime).Seconds())
+	}))
+}
+
+// publishQueueDepth publishes the number of notifications and requests waiting
+// to be processed: those waiting to be shown, those held for a digest, for
+// quiet hours or by dnd, and those queued to be forwarded by forwarder, which may be nil.
+func publishQueueDepth(forwarder *Forwarder, dnd *DoNotDisturb) {
+	expvar.Publish("queue_depth", expvar.Func(func() interface{} {
+		depth := map[string]int64{
+			"notifications": atomic.LoadInt64(&notificationsPending),
+			"digest":        atomic.LoadInt64(&digestPending),
+			"quiet":         atomic.LoadInt64(&quietPending),
+			"dnd":           int64(dnd.Held()),
+		}
+		if forwarder != nil {
+			depth["forward"] = int64(forwarder.QueueDepth())
+		}
+		return depth
+	}))
+}
+
+// publishCacheStats publishes the Stats of cache: lookups that found a file
+// or didn't, evictions, and the number and total size of its files.
+func publishCacheStats(cache server.StatBinaries) {
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		stats := cache.Stats()
+		return map[string]int64{
+			"hits":      stats.Hits,
+			"misses":    stats.Misses,
+			"evictions": stats.Evictions,
+			"files":     int64(stats.Entries),
+			"bytes":     stats.Bytes,
+		}
+	}))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/jgrocho/gntp_notify/registry"
+	"html"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramAPI is the URL of the Telegram Bot API.
+const telegramAPI = "https://api.telegram.org"
+
+// telegramCaptionLength is the longest caption Telegram accepts for a photo;
+// longer messages are sent as text.
+const telegramCaptionLength = 1024
+
+// telegramMessage is a message waiting to be sent to a Telegram chat.
+type telegramMessage struct {
+	note *registry.Notification
+	chat string
+}
+
+// telegramBackend is a Backend that sends notifications to Telegram chats
+// through a bot, in the background.
+type telegramBackend struct {
+	opts   *BackendOptions
+	client *http.Client
+	// api is the URL of the bot's methods, ending in a slash.
+	api   string
+	chats *AppTargets
+	// photos is whether notifications with an icon are sent as a photo of
+	// it, captioned with their title and text.
+	photos bool
+	queue  chan telegramMessage
+}
+
+// NewTelegramBackend builds a Backend that sends notifications to chats,
+// through the bot with token, using the Bot API at api. With photos, the
+// icons of notifications are uploaded as photos, found as set by opts.
+func NewTelegramBackend(opts *BackendOptions, api, token string, chats *AppTargets, photos bool) Backend {
+	backend := &telegramBackend{
+		opts:   opts,
+		client: &http.Client{Timeout: webhookTimeout},
+		api:    strings.TrimSuffix(api, "/") + "/bot" + token + "/",
+		chats:  chats,
+		photos: photos,
+		queue:  make(chan telegramMessage, webhookQueueSize),
+	}
+	go backend.run()
+	return backend
+}
+
+// Show queues note to be sent to the chat for its application, if any.
+func (backend *telegramBackend) Show(note *registry.Notification) {
+	chat := backend.chats.target(note.App.Name)
+	if chat == "" {
+		return
+	}
+	select {
+	case backend.queue <- telegramMessage{note, chat}:
+	default:
+		slog.Warn("gntp: telegram queue full, dropping notification", "app", note.App.Name, "name", note.Name)
+		notificationsFailed.Inc("telegram")
+	}
+}
+
+// run sends each message from the queue.
+func (backend *telegramBackend) run() {
+	for msg := range backend.queue {
+		if err := backend.send(msg); err != nil {
+			slog.Warn("gntp: could not send notification to telegram", "chat", msg.chat, "app", msg.note.App.Name, "name", msg.note.Name, "err", err)
+			notificationsFailed.Inc("telegram")
+			continue
+		}
+		slog.Debug("gntp: sent notification to telegram", "chat", msg.chat, "app", msg.note.App.Name, "name", msg.note.Name)
+		notificationsShown.Inc("telegram")
+	}
+}
+
+// telegramText formats note as the HTML text of a message.
+func telegramText(note *registry.Notification) string {
+	text := "<b>" + html.EscapeString(note.Title) + "</b>"
+	if note.Text != "" {
+		text += "\n" + html.EscapeString(note.Text)
+	}
+	return text
+}
+
+// telegramResponse is the response to a Bot API method.
+type telegramResponse struct {
+	Ok          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// send sends msg, as a photo of its icon if it has one and photos are sent,
+// otherwise as text. If the bot is sending too much, it waits as long as
+// Telegram asks and tries once more.
+func (backend *telegramBackend) send(msg telegramMessage) error {
+	retryAfter, err := backend.sendOnce(msg)
+	if retryAfter > 0 {
+		time.Sleep(time.Duration(retryAfter) * time.Second)
+		_, err = backend.sendOnce(msg)
+	}
+	return err
+}
+
+// sendOnce sends msg. If Telegram asks to wait before sending more, it
+// returns the number of seconds to wait.
+func (backend *telegramBackend) sendOnce(msg telegramMessage) (int, error) {
+	text := telegramText(msg.note)
+	var resp *http.Response
+	var err error
+	icon := ""
+	if backend.photos && len(text) <= telegramCaptionLength {
+		icon = iconFileName(msg.note, backend.opts.Cache, backend.opts.IconDirs)
+	}
+	if icon != "" {
+		resp, err = backend.sendPhoto(msg.chat, icon, text)
+	} else {
+		resp, err = backend.client.PostForm(backend.api+"sendMessage", url.Values{
+			"chat_id":    {msg.chat},
+			"text":       {text},
+			"parse_mode": {"HTML"},
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, errors.New("telegram responded " + resp.Status)
+	}
+	if !result.Ok {
+		return result.Parameters.RetryAfter, errors.New("telegram responded " + strconv.Itoa(resp.StatusCode) + ": " + result.Description)
+	}
+	return 0, nil
+}
+
+// sendPhoto uploads the image file at path to chat, captioned with caption.
+func (backend *telegramBackend) sendPhoto(chat, path, caption string) (*http.Response, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("chat_id", chat)
+	form.WriteField("caption", caption)
+	form.WriteField("parse_mode", "HTML")
+	part, err := form.CreateFormFile("photo", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+	return backend.client.Post(backend.api+"sendPhoto", form.FormDataContentType(), &body)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/registry"
+	"log/slog"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs are the functions notification templates may call, besides
+// those built in to text/template.
+var templateFuncs = template.FuncMap{
+	"truncate": truncate,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trim":     strings.TrimSpace,
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+}
+
+// parseTemplate parses the notification template text, which is named name
+// in errors.
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// TemplateData is what notification templates are executed on: the fields
+// of the notification, as received, and its custom headers.
+type TemplateData struct {
+	Application string
+	Name        string
+	Id          string
+	Title       string
+	Text        string
+	Priority    int
+	Sticky      bool
+
+	custom map[string][]string
+}
+
+// newTemplateData gives the TemplateData for note.
+func newTemplateData(note *registry.Notification) *TemplateData {
+	return &TemplateData{
+		Application: note.App.Name,
+		Name:        note.Name,
+		Id:          note.Id,
+		Title:       note.Title,
+		Text:        note.Text,
+		Priority:    note.Priority,
+		Sticky:      note.Sticky,
+		custom:      note.Custom,
+	}
+}
+
+// Header gives the value of the custom header name, such as X-Ticket, or the
+// empty string if the notification was sent without it.
+func (data *TemplateData) Header(name string) string {
+	for key, values := range data.custom {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// executeTemplate executes tmpl, if not nil, on data. It reports false if
+// there is no template, or it failed, in which case the failure is logged.
+func executeTemplate(tmpl *template.Template, data *TemplateData) (string, bool) {
+	if tmpl == nil {
+		return "", false
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		slog.Warn("gntp: could not execute template", "template", tmpl.Name(), "app", data.Application, "name", data.Name, "err", err)
+		return "", false
+	}
+	return buf.String(), true
+}
+
+// truncate shortens s to n characters, ending it with an ellipsis if it is
+// cut.
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if n < 1 || len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
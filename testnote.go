@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/jgrocho/gntp_notify/server"
+	"time"
+)
+
+// testApplication is the application test notifications are sent as, and
+// testType their type.
+const (
+	testApplication = "gntp_notify"
+	testType        = "Test"
+)
+
+// sendTestNotification sends a sample notification to register and notify,
+// the REGISTER and NOTIFY handlers, registering testApplication first, as
+// though it were received over GNTP from this machine, so the whole pipeline
+// can be checked without a client.
+func sendTestNotification(register, notify server.Handler) error {
+	reg := adaptedRegister(testApplication, "", []adaptedType{{Name: testType, Display: "Test notifications"}})
+	if err := handleAdapted(nil, register, reg, "127.0.0.1:0"); err != nil {
+		return err
+	}
+	header := server.NewHeader()
+	header.Set("Application-Name", testApplication)
+	header.Set("Notification-Name", testType)
+	header.Set("Notification-Title", "Test notification")
+	header.Set("Notification-Text", "Sent by gntp_notify at "+time.Now().Format("15:04:05")+": notifications are working.")
+	return handleAdapted(nil, notify, &server.Request{Type: "NOTIFY", Headers: []server.Header{header}}, "127.0.0.1:0")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the version of gntp_notify, and commit and buildDate the
+// revision it was built from and when. Release builds set them with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...";
+// otherwise they are filled in from what the go command records in the
+// binary, where it can, with the time of the commit for buildDate.
+var (
+	version   = "devel"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "devel" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	vcsCommit, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			vcsCommit = setting.Value
+			if len(vcsCommit) > 12 {
+				vcsCommit = vcsCommit[:12]
+			}
+		case "vcs.time":
+			if buildDate == "" {
+				buildDate = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if commit == "" && vcsCommit != "" {
+		commit = vcsCommit
+		if modified {
+			commit += "-dirty"
+		}
+	}
+}
+
+// fullVersion gives the version of gntp_notify with the commit and build
+// date, where known, as sent with every response: such as
+// "1.2.0 (3f2c1a9b7d4e, 2024-05-01T12:00:00Z)".
+func fullVersion() string {
+	switch {
+	case commit != "" && buildDate != "":
+		return version + " (" + commit + ", " + buildDate + ")"
+	case commit != "":
+		return version + " (" + commit + ")"
+	case buildDate != "":
+		return version + " (" + buildDate + ")"
+	}
+	return version
+}
+
+// printVersion writes the version of gntp_notify, the commit and date it was
+// built from, where known, and the version of Go it was built with to w.
+func printVersion(w io.Writer) {
+	fmt.Fprintln(w, "gntp_notify", version)
+	if commit != "" {
+		fmt.Fprintln(w, "commit:", commit)
+	}
+	if buildDate != "" {
+		fmt.Fprintln(w, "built:", buildDate)
+	}
+	fmt.Fprintln(w, "go:", runtime.Version())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/jgrocho/gntp_notify/registry"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookTimeout bounds each request to a webhook.
+const webhookTimeout = 10 * time.Second
+
+// webhookQueueSize is how many notifications may wait to be sent to each
+// webhook before more are dropped.
+const webhookQueueSize = 64
+
+// webhookSignatureHeader is the header holding the HMAC signature of the body
+// of each webhook request, when a secret is set.
+const webhookSignatureHeader = "X-Gntp-Signature"
+
+// WebhookURLs implements flag.Value for a list of webhook URLs.
+type WebhookURLs []string
+
+// String returns the URLs, separated by commas.
+func (urls *WebhookURLs) String() string {
+	return strings.Join(*urls, ",")
+}
+
+// Set checks and adds an http or https URL.
+func (urls *WebhookURLs) Set(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook URL must be an http or https URL")
+	}
+	*urls = append(*urls, value)
+	return nil
+}
+
+// WebhookPayload is the notification a webhook is sent: as JSON, or as the
+// data of its template.
+type WebhookPayload struct {
+	Time        time.Time `json:"time"`
+	Application string    `json:"application"`
+	Name        string    `json:"name"`
+	Id          string    `json:"id,omitempty"`
+	Title       string    `json:"title"`
+	Text        string    `json:"text,omitempty"`
+	Priority    int       `json:"priority"`
+	Sticky      bool      `json:"sticky"`
+	// Icon is the URL of the icon, if it was given by URL.
+	Icon string `json:"icon,omitempty"`
+	// Custom holds the first value of each X-* and Data-* header.
+	Custom map[string]string `json:"custom,omitempty"`
+}
+
+// newWebhookPayload builds the WebhookPayload for note.
+func newWebhookPayload(note *registry.Notification) *WebhookPayload {
+	payload := &WebhookPayload{
+		Time:        time.Now(),
+		Application: note.App.Name,
+		Name:        note.Name,
+		Id:          note.Id,
+		Title:       note.Title,
+		Text:        note.Text,
+		Priority:    note.Priority,
+		Sticky:      note.Sticky,
+	}
+	if registry.RemoteIcon(note.Icon) {
+		payload.Icon = note.Icon
+	}
+	if len(note.Custom) > 0 {
+		payload.Custom = make(map[string]string, len(note.Custom))
+		for key, values := range note.Custom {
+			payload.Custom[key] = values[0]
+		}
+	}
+	return payload
+}
+
+// webhookFuncs are the functions available to webhook templates.
+var webhookFuncs = template.FuncMap{
+	// json gives a value as JSON, such as a quoted and escaped string.
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// ParseWebhookTemplate parses the template for the body of webhook requests
+// in the file at path. It is executed with a WebhookPayload.
+func ParseWebhookTemplate(path string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("webhook").Funcs(webhookFuncs).Parse(string(data))
+}
+
+// webhookBackend is a Backend that POSTs each notification to webhooks. Each
+// webhook has its own queue, so a slow one does not hold up the others, nor
+// the notifications being displayed.
+type webhookBackend struct {
+	client *http.Client
+	// template, if not nil, builds the body of the requests; otherwise
+	// they are the WebhookPayload as JSON.
+	template *template.Template
+	// contentType is the type of the body of the requests.
+	contentType string
+	// secret, if not empty, is the key the body of each request is signed
+	// with, as an HMAC-SHA256 in the webhookSignatureHeader.
+	secret []byte
+	queues []chan *registry.Notification
+}
+
+// NewWebhookBackend builds a Backend that POSTs each notification to urls,
+// with the body built by tmpl, if not nil, of contentType, and signed with
+// secret, if not empty.
+func NewWebhookBackend(urls []string, tmpl *template.Template, contentType, secret string) Backend {
+	backend := &webhookBackend{
+		client:      &http.Client{Timeout: webhookTimeout},
+		template:    tmpl,
+		contentType: contentType,
+		secret:      []byte(secret),
+	}
+	for _, u := range urls {
+		queue := make(chan *registry.Notification, webhookQueueSize)
+		backend.queues = append(backend.queues, queue)
+		go backend.run(u, queue)
+	}
+	return backend
+}
+
+// Show queues note to be sent to each webhook.
+func (backend *webhookBackend) Show(note *registry.Notification) {
+	for _, queue := range backend.queues {
+		select {
+		case queue <- note:
+		default:
+			slog.Warn("gntp: webhook queue full, dropping notification", "app", note.App.Name, "name", note.Name)
+			notificationsFailed.Inc("webhook")
+		}
+	}
+}
+
+// run sends each notification from queue to the webhook at u.
+func (backend *webhookBackend) run(u string, queue <-chan *registry.Notification) {
+	for note := range queue {
+		if err := backend.send(u, note); err != nil {
+			slog.Warn("gntp: could not send notification to webhook", "url", u, "app", note.App.Name, "name", note.Name, "err", err)
+			notificationsFailed.Inc("webhook")
+			continue
+		}
+		slog.Debug("gntp: sent notification to webhook", "url", u, "app", note.App.Name, "name", note.Name)
+		notificationsShown.Inc("webhook")
+	}
+}
+
+// body builds the body of the request for note.
+func (backend *webhookBackend) body(note *registry.Notification) ([]byte, error) {
+	payload := newWebhookPayload(note)
+	if backend.template == nil {
+		return json.Marshal(payload)
+	}
+	var buf bytes.Buffer
+	if err := backend.template.Execute(&buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// send POSTs note to the webhook at u.
+func (backend *webhookBackend) send(u string, note *registry.Notification) error {
+	body, err := backend.body(note)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", backend.contentType)
+	req.Header.Set("User-Agent", "gntp_notify/"+version)
+	if len(backend.secret) > 0 {
+		mac := hmac.New(sha256.New, backend.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := backend.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook responded " + resp.Status)
+	}
+	return nil
+}